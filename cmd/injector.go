@@ -1,25 +1,62 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
-	"strings"
-
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/debug"
 	"github.com/inloco/kafka-elasticsearch-injector/src/injector"
 	"github.com/inloco/kafka-elasticsearch-injector/src/kafka"
 	"github.com/inloco/kafka-elasticsearch-injector/src/logger_builder"
 	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 	"github.com/inloco/kafka-elasticsearch-injector/src/probes"
-	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/inloco/kafka-elasticsearch-injector/src/reload"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
 )
 
+const serviceName = "kafka-elasticsearch-injector"
+
 func main() {
-	logger := logger_builder.NewLogger("kafka-elasticsearch-injector")
+	validateOnly := flag.Bool("validate-config", false, "validate the config, print the effective config and exit")
+	flag.Parse()
+	// loaded before anything reads the env vars, the logger included
+	var configErr error
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		configErr = config_file.Load(path)
+	}
+	logger := logger_builder.NewLogger(serviceName)
+	if configErr != nil {
+		level.Error(logger).Log("message", "invalid config file", "err", configErr)
+		os.Exit(1)
+	}
+	probes.LivenessRoute, probes.ReadinessRoute = os.Getenv("K8S_LIVENESS_ROUTE"), os.Getenv("K8S_READINESS_ROUTE")
+
+	pipelines := injector.Pipelines()
+	errs := injector.ValidateConfig(pipelines)
+	if *validateOnly {
+		config_file.WriteEffective(os.Stdout)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "invalid config: %s\n", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(errs) > 0 {
+		// every invalid setting is reported at once, before connecting anywhere
+		for _, err := range errs {
+			level.Error(logger).Log("message", "invalid config", "err", err)
+		}
+		os.Exit(1)
+	}
 
 	probesPort := os.Getenv("PROBES_PORT")
 	p := probes.New(probesPort)
@@ -29,49 +66,93 @@ func main() {
 	level.Info(logger).Log(
 		"message", fmt.Sprintf("Initializing kubernetes probes at %s", probesPort),
 	)
+	p.Handle("/metrics", metrics.Handler())
 	go p.Serve()
 	metrics.Register()
-	schemaRegistry, err := schema_registry.NewSchemaRegistry(os.Getenv("SCHEMA_REGISTRY_URL"))
+	tracingConfig, err := tracing.NewConfig(logger)
 	if err != nil {
-		level.Error(logger).Log("err", err, "message", "failed to create schema registry client")
+		level.Error(logger).Log("err", err, "message", "invalid tracing config")
+		panic(err)
 	}
-
-	kafkaConfig := &kafka.Config{
-		Type:                  kafka.ConsumerType,
-		Topics:                strings.Split(os.Getenv("KAFKA_TOPICS"), ","),
-		ConsumerGroup:         os.Getenv("KAFKA_CONSUMER_GROUP"),
-		Concurrency:           os.Getenv("KAFKA_CONSUMER_CONCURRENCY"),
-		BatchSize:             os.Getenv("KAFKA_CONSUMER_BATCH_SIZE"),
-		BufferSize:            os.Getenv("KAFKA_CONSUMER_BUFFER_SIZE"),
-		MetricsUpdateInterval: os.Getenv("KAFKA_CONSUMER_METRICS_UPDATE_INTERVAL"),
-		RecordType:            os.Getenv("KAFKA_CONSUMER_RECORD_TYPE"),
+	tracer := tracing.NewTracer(tracingConfig)
+	var d *debug.Server
+	if debugPort := os.Getenv("DEBUG_PORT"); debugPort != "" {
+		level.Info(logger).Log("message", fmt.Sprintf("Initializing debug endpoints at %s", debugPort))
+		d = debug.New(debugPort)
+		go d.Serve()
 	}
 	metricsPublisher := metrics.NewMetricsPublisher()
-	service := injector.NewService(logger, metricsPublisher)
-	p.SetReadinessCheck(service.ReadinessCheck)
+	// the transforms, filter, rate limits and log levels are reloaded on SIGHUP and when the config file changes
+	reloader := reload.New(os.Getenv("CONFIG_FILE"), logger, metricsPublisher)
+	injector.HandleLevelReloads(reloader)
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	// validated with the rest of the config
+	watchInterval, _ := time.ParseDuration(os.Getenv("CONFIG_FILE_WATCH_INTERVAL"))
+	go reloader.Watch(reloads, watchInterval)
 
-	endpoints := injector.MakeEndpoints(service)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	notifications := make(chan kafka.Notification, 10)
+	if pipelines[0].Name != "" {
+		backoff := injector.DefaultRestartBackoff
+		if value := os.Getenv("PIPELINES_RESTART_BACKOFF"); value != "" {
+			backoff, _ = time.ParseDuration(value)
+		}
+		running := make([]*runningPipeline, len(pipelines))
+		for idx, config := range pipelines {
+			running[idx] = newRunningPipeline(config, logger, backoff)
+			running[idx].addChecks(p, d)
+		}
+		p.Ready()
+		go logNotifications(logger, p, notifications)
+		// each pipeline flushes the documents buffered by its bulk processor before it stops
+		runPipelines(running, reloader, tracer, notifications, signals)
+		tracer.Close()
+		return
+	}
 
-	consumer, err := injector.MakeKafkaConsumer(endpoints, logger, schemaRegistry, kafkaConfig)
+	pipeline, err := newPipeline(pipelines[0], metricsPublisher, tracer)
 	if err != nil {
-		level.Error(logger).Log("err", err, "message", "error creating kafka consumer")
+		level.Error(logger).Log("err", err, "message", "error creating the pipeline")
 		panic(err)
 	}
+	service, consumer := pipeline.service, pipeline.consumer
+	p.Ready()
+	p.AddReadinessCheck(logger_builder.ComponentElasticsearch, service.ReadinessCheck)
+	// the rate limits can be changed while running, on the metrics port
+	metrics.Handle("/rate-limit", consumer.RateLimiter)
 	k := kafka.NewKafka(os.Getenv("KAFKA_ADDRESS"), consumer, metricsPublisher)
+	if d != nil {
+		d.AddStatus(logger_builder.ComponentKafka, func() interface{} { return k.Status() })
+		d.AddStatus(logger_builder.ComponentElasticsearch, func() interface{} { return service.Status() })
+	}
+	injector.HandleReloads(reloader, pipelines[0], service, &k, consumer.RateLimiter)
+	if consumer.Replay == nil {
+		p.AddLivenessCheck(logger_builder.ComponentKafka, k.Health().Alive)
+		p.AddReadinessCheck(logger_builder.ComponentKafka, k.Health().Ready)
+	}
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	notifications := make(chan kafka.Notification, 10)
-	go func() {
-		for {
-			ntf := <-notifications
-			switch ntf {
-			case kafka.Ready:
-				level.Info(logger).Log("message", "kafka consumer ready")
-			case kafka.Inserted:
-				level.Info(logger).Log("message", fmt.Sprintf("inserted records"))
-			}
+	if consumer.Replay != nil {
+		summary, err := k.Replay(signals)
+		service.Close()
+		tracer.Close()
+		level.Info(logger).Log(
+			"message", "replay finished",
+			"read", summary.Read,
+			"indexed", summary.Indexed,
+			"failed", summary.Failed,
+			"skipped", summary.Skipped,
+		)
+		if err != nil {
+			level.Error(logger).Log("err", err, "message", "replay failed")
+			os.Exit(1)
 		}
-	}()
+		return
+	}
+	go logNotifications(logger, p, notifications)
 	k.Start(signals, notifications)
+	// documents buffered by the bulk processor are flushed before exiting
+	service.Close()
+	tracer.Close()
 }
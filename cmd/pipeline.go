@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/debug"
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/injector"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka"
+	"github.com/inloco/kafka-elasticsearch-injector/src/logger_builder"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/probes"
+	"github.com/inloco/kafka-elasticsearch-injector/src/reload"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
+)
+
+// kafkaConsumer is the consumer created by kafka.NewKafka.
+type kafkaConsumer interface {
+	Start(signals chan os.Signal, notifications chan<- kafka.Notification)
+	Health() *kafka.Health
+	Status() kafka.Status
+	SetFilter(filter *models.Filter)
+}
+
+// pipeline is the elasticsearch service and the kafka consumer of a pipeline, before the consumer is started.
+type pipeline struct {
+	config   config_file.Pipeline
+	service  injector.Service
+	consumer kafka.Consumer
+}
+
+// componentLogger is the logger of a component of a pipeline, with the name of the pipeline when it has one.
+func componentLogger(config config_file.Pipeline, component string) log.Logger {
+	logger := logger_builder.NewComponentLogger(serviceName, component)
+	if config.Name != "" {
+		logger = log.With(logger, "pipeline", config.Name)
+	}
+	return logger
+}
+
+// newPipeline creates the schema registry client, the elasticsearch service and the consumer of a pipeline,
+// connecting to elasticsearch.
+func newPipeline(config config_file.Pipeline, metricsPublisher metrics.MetricsPublisher, tracer *tracing.Tracer) (*pipeline, error) {
+	schemaRegistry, err := injector.NewSchemaRegistry(config, componentLogger(config, logger_builder.ComponentSchemaRegistry))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema registry client: %s", err)
+	}
+	esConfig, err := elasticsearch.NewConfigFrom(config.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	service, err := injector.NewServiceWithConfig(componentLogger(config, logger_builder.ComponentElasticsearch), metricsPublisher, esConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error creating injector service: %s", err)
+	}
+	endpoints := injector.MakeEndpoints(service)
+	consumer, err := injector.MakeKafkaConsumer(endpoints, componentLogger(config, logger_builder.ComponentKafka), schemaRegistry, injector.NewKafkaConfig(config))
+	if err != nil {
+		service.Close()
+		return nil, fmt.Errorf("error creating kafka consumer: %s", err)
+	}
+	consumer.Tracer = tracer
+	return &pipeline{config: config, service: service, consumer: consumer}, nil
+}
+
+// logNotifications logs the notifications of the consumers, taking the process out of service once they shut down.
+func logNotifications(logger log.Logger, p *probes.Probes, notifications <-chan kafka.Notification) {
+	for ntf := range notifications {
+		switch ntf {
+		case kafka.Ready:
+			level.Info(logger).Log("message", "kafka consumer ready")
+		case kafka.Inserted:
+			level.Info(logger).Log("message", fmt.Sprintf("inserted records"))
+		case kafka.ShuttingDown:
+			// kubernetes stops counting on the pod while it drains
+			p.Unready()
+		}
+	}
+}
+
+// runningPipeline runs a pipeline of the config file apart from the others: a pipeline that fails to connect to
+// elasticsearch or whose consumer fails is started again after a backoff, while the other pipelines keep running.
+// Its checks fail in the meantime, without failing the liveness of the process.
+type runningPipeline struct {
+	config           config_file.Pipeline
+	logger           log.Logger
+	metricsPublisher metrics.MetricsPublisher
+	backoff          time.Duration
+	// signals are the shutdown signals of the process, forwarded to each pipeline
+	signals chan os.Signal
+
+	lock     sync.Mutex
+	pipeline *pipeline
+	// current is the consumer started last, nil while the pipeline is not consuming
+	current kafkaConsumer
+}
+
+func newRunningPipeline(config config_file.Pipeline, logger log.Logger, backoff time.Duration) *runningPipeline {
+	return &runningPipeline{
+		config:           config,
+		logger:           log.With(logger, "pipeline", config.Name),
+		metricsPublisher: metrics.NewPipelineMetricsPublisher(),
+		backoff:          backoff,
+		signals:          make(chan os.Signal, 1),
+	}
+}
+
+// addChecks adds the checks and the statuses of the pipeline under its name, like orders/kafka.
+func (r *runningPipeline) addChecks(p *probes.Probes, d *debug.Server) {
+	kafkaCheck := probes.PipelineCheck(r.config.Name, logger_builder.ComponentKafka)
+	elasticsearchCheck := probes.PipelineCheck(r.config.Name, logger_builder.ComponentElasticsearch)
+	p.AddLivenessCheck(kafkaCheck, func() bool {
+		// a pipeline that failed is started again, the process is kept alive for the other pipelines
+		current := r.currentConsumer()
+		return current == nil || current.Health().Alive()
+	})
+	p.AddReadinessCheck(kafkaCheck, func() bool {
+		current := r.currentConsumer()
+		return current != nil && current.Health().Ready()
+	})
+	p.AddReadinessCheck(elasticsearchCheck, func() bool {
+		service := r.service()
+		return service != nil && service.ReadinessCheck()
+	})
+	if d == nil {
+		return
+	}
+	d.AddStatus(kafkaCheck, func() interface{} {
+		if current := r.currentConsumer(); current != nil {
+			return current.Status()
+		}
+		return nil
+	})
+	d.AddStatus(elasticsearchCheck, func() interface{} {
+		if service := r.service(); service != nil {
+			return service.Status()
+		}
+		return nil
+	})
+}
+
+func (r *runningPipeline) currentConsumer() kafkaConsumer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.current
+}
+
+func (r *runningPipeline) service() injector.Service {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pipeline == nil {
+		return nil
+	}
+	return r.pipeline.service
+}
+
+// SetFilter replaces the filter of the consumer running, and of the ones started after it fails.
+func (r *runningPipeline) SetFilter(filter *models.Filter) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pipeline != nil {
+		r.pipeline.consumer.Filter = filter
+	}
+	if r.current != nil {
+		r.current.SetFilter(filter)
+	}
+}
+
+// run runs the pipeline until the process shuts down, starting it again whenever it fails.
+func (r *runningPipeline) run(reloader *reload.Reloader, tracer *tracing.Tracer, notifications chan<- kafka.Notification) {
+	pipeline, err := newPipeline(r.config, r.metricsPublisher, tracer)
+	for err != nil {
+		level.Error(r.logger).Log("message", "could not start the pipeline, retrying", "err", err, "backoff", r.backoff)
+		if !r.wait() {
+			return
+		}
+		pipeline, err = newPipeline(r.config, r.metricsPublisher, tracer)
+	}
+	defer pipeline.service.Close()
+	r.lock.Lock()
+	r.pipeline = pipeline
+	r.lock.Unlock()
+	injector.HandleReloads(reloader, r.config, pipeline.service, r, pipeline.consumer.RateLimiter)
+	metrics.Handle("/rate-limit/"+r.config.Name, pipeline.consumer.RateLimiter)
+
+	for {
+		r.lock.Lock()
+		k := kafka.NewKafka(r.config.Getenv("KAFKA_ADDRESS"), pipeline.consumer, r.metricsPublisher)
+		r.current = &k
+		r.lock.Unlock()
+		stopped := r.start(&k, notifications)
+		r.lock.Lock()
+		r.current = nil
+		r.lock.Unlock()
+		if stopped {
+			return
+		}
+		level.Error(r.logger).Log("message", "the pipeline failed, starting it again", "backoff", r.backoff)
+		if !r.wait() {
+			return
+		}
+	}
+}
+
+// start consumes until the process shuts down, false when the consumer failed instead.
+func (r *runningPipeline) start(k kafkaConsumer, notifications chan<- kafka.Notification) (stopped bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			level.Error(r.logger).Log("message", "the consumer of the pipeline failed", "err", err)
+		}
+	}()
+	k.Start(r.signals, notifications)
+	return true
+}
+
+// wait waits for the backoff, false when the process shuts down first.
+func (r *runningPipeline) wait() bool {
+	select {
+	case <-r.signals:
+		return false
+	case <-time.After(r.backoff):
+		return true
+	}
+}
+
+// runPipelines runs the pipelines of the config file until the process shuts down, forwarding the signals to each
+// of them.
+func runPipelines(pipelines []*runningPipeline, reloader *reload.Reloader, tracer *tracing.Tracer, notifications chan<- kafka.Notification, signals <-chan os.Signal) {
+	var running sync.WaitGroup
+	for _, r := range pipelines {
+		running.Add(1)
+		go func(r *runningPipeline) {
+			defer running.Done()
+			r.run(reloader, tracer, notifications)
+		}(r)
+	}
+	go func() {
+		for signal := range signals {
+			for _, r := range pipelines {
+				select {
+				case r.signals <- signal:
+				default:
+				}
+			}
+		}
+	}()
+	running.Wait()
+}
@@ -0,0 +1,371 @@
+// Package config_file loads the settings of a yaml file, keyed by their env vars, for the configs too complex to
+// be kept in flat env vars, like the per topic overrides. Env vars already set take precedence over the file, so
+// that deployments configured by env vars keep working.
+package config_file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/validation"
+)
+
+type setting struct {
+	// pipeline is the name of the pipeline of the setting, empty for the settings of the whole process
+	pipeline string
+	name     string
+	value    string
+}
+
+// pipelinesKey is the key of the pipelines of the file, which is not an env var.
+const pipelinesKey = "PIPELINES"
+
+var pipelineName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Pipeline is a pipeline of the config file, consuming its own topics into its own elasticsearch. Its settings
+// override the env vars and the settings of the file, for the pipeline alone.
+type Pipeline struct {
+	Name     string
+	Settings map[string]string
+}
+
+// LookupEnv looks a setting of the pipeline up, falling back to the env vars.
+func (p Pipeline) LookupEnv(name string) (string, bool) {
+	if value, set := p.Settings[name]; set {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// Getenv is the value of a setting of the pipeline, empty when it is not set.
+func (p Pipeline) Getenv(name string) string {
+	value, _ := p.LookupEnv(name)
+	return value
+}
+
+// pipelineSetting tells whether a setting configures a pipeline rather than the whole process, like the ports,
+// the logs or the tracing do.
+func pipelineSetting(name string) bool {
+	for _, prefix := range []string{"KAFKA_", "SCHEMA_REGISTRY_", "ELASTICSEARCH_", "ES_", "DRY_RUN"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// fromFile are the env vars set by the last load of the file.
+	fromFile = make(map[string]bool)
+	// pipelines are the pipelines of the last load of the file.
+	pipelines []Pipeline
+)
+
+// Load sets the env vars of the settings of the file that are not set yet. The file is loaded as a whole: when
+// any of its settings is invalid, none is set. Loading it again replaces the env vars the file set before, and
+// unsets the ones of the settings removed from it.
+func Load(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file %s: %s", path, err)
+	}
+	parsed, err := parse(path, string(content))
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]bool, len(parsed))
+	var loadedPipelines []Pipeline
+	for _, s := range parsed {
+		if s.pipeline != "" {
+			if len(loadedPipelines) == 0 || loadedPipelines[len(loadedPipelines)-1].Name != s.pipeline {
+				loadedPipelines = append(loadedPipelines, Pipeline{Name: s.pipeline, Settings: make(map[string]string)})
+			}
+			loadedPipelines[len(loadedPipelines)-1].Settings[s.name] = s.value
+			continue
+		}
+		if _, set := os.LookupEnv(s.name); !set || fromFile[s.name] {
+			os.Setenv(s.name, s.value)
+			loaded[s.name] = true
+		}
+	}
+	for name := range fromFile {
+		if !loaded[name] {
+			os.Unsetenv(name)
+		}
+	}
+	fromFile = loaded
+	pipelines = loadedPipelines
+	return nil
+}
+
+// Pipelines are the pipelines of the config file, in the order they are written, none when the process runs the
+// single pipeline of the env vars.
+func Pipelines() []Pipeline {
+	return pipelines
+}
+
+// Effective are the values of the settings set, from the env vars and the config file.
+func Effective() map[string]string {
+	values := make(map[string]string)
+	for name := range settings {
+		if value, set := os.LookupEnv(name); set {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// parse reads the settings of a file, failing with the line and key of every invalid setting.
+func parse(path, content string) ([]setting, error) {
+	root, err := parseYAML(content)
+	if err != nil {
+		if yamlErr, ok := err.(*yamlError); ok {
+			return nil, fmt.Errorf("%s:%d: %s", path, yamlErr.line, yamlErr.message)
+		}
+		return nil, err
+	}
+	if root == nil || root.isNull() {
+		return nil, nil
+	}
+	if root.kind != mappingNode {
+		return nil, fmt.Errorf("%s:%d: the config file should be a mapping of settings, not a %s", path, root.line, root.kind)
+	}
+	var errs validation.Errors
+	var parsed []setting
+	for _, e := range root.entries {
+		if e.key == pipelinesKey {
+			parsed = append(parsed, parsePipelines(path, e, &errs)...)
+			continue
+		}
+		parsed = append(parsed, parseSetting(path, "", e, &errs)...)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// parseSetting reads a setting of the file or of one of its pipelines, none when it is null.
+func parseSetting(path, pipeline string, e entry, errs *validation.Errors) []setting {
+	kind, known := settings[e.key]
+	if !known {
+		errs.Addf("%s:%d: unknown setting %s", path, e.line, e.key)
+		return nil
+	}
+	if pipeline != "" && !pipelineSetting(e.key) {
+		errs.Addf("%s:%d: %s can't be set for a pipeline, only for the whole process", path, e.line, e.key)
+		return nil
+	}
+	if e.value.isNull() {
+		return nil
+	}
+	value, err := encode(kind, e.value)
+	if err != nil {
+		yamlErr := err.(*yamlError)
+		errs.Addf("%s:%d: %s %s", path, yamlErr.line, e.key, yamlErr.message)
+		return nil
+	}
+	return []setting{{pipeline: pipeline, name: e.key, value: value}}
+}
+
+// parsePipelines reads the settings of the pipelines, a mapping of their names to the mapping of their settings.
+func parsePipelines(path string, e entry, errs *validation.Errors) []setting {
+	if e.value.isNull() {
+		return nil
+	}
+	if e.value.kind != mappingNode {
+		errs.Addf("%s:%d: %s should be a mapping of pipelines, not a %s", path, e.value.line, pipelinesKey, e.value.kind)
+		return nil
+	}
+	var parsed []setting
+	seen := make(map[string]bool)
+	for _, p := range e.value.entries {
+		if !pipelineName.MatchString(p.key) {
+			errs.Addf("%s:%d: invalid pipeline name %q, it should hold lowercase letters, digits, - and _", path, p.line, p.key)
+			continue
+		}
+		if seen[p.key] {
+			errs.Addf("%s:%d: pipeline %s is defined twice", path, p.line, p.key)
+			continue
+		}
+		seen[p.key] = true
+		if p.value.kind != mappingNode || len(p.value.entries) == 0 {
+			errs.Addf("%s:%d: pipeline %s should be a mapping of its settings", path, p.line, p.key)
+			continue
+		}
+		for _, pe := range p.value.entries {
+			parsed = append(parsed, parseSetting(path, p.key, pe, errs)...)
+		}
+	}
+	return parsed
+}
+
+// encode writes a yaml value in the format of the env var of its setting. A scalar is always kept as is, so that
+// values written in the format of the env var keep working.
+func encode(kind settingKind, value *node) (string, error) {
+	if value.kind == scalarNode {
+		return value.value, nil
+	}
+	switch kind {
+	case list, conditions:
+		if value.kind != sequenceNode {
+			return "", errorAt(value.line, "should be a sequence or a scalar, not a %s", value.kind)
+		}
+		items := make([]string, len(value.items))
+		for idx, item := range value.items {
+			if item.kind != scalarNode {
+				return "", errorAt(item.line, "should be a sequence of scalars, not of %ss", item.kind)
+			}
+			if kind == list && strings.Contains(item.value, ",") {
+				return "", errorAt(item.line, "items can't hold commas: %q", item.value)
+			}
+			items[idx] = item.value
+		}
+		if kind == conditions {
+			return strings.Join(items, " && "), nil
+		}
+		return strings.Join(items, ","), nil
+	case pairs, keyValues:
+		if value.kind != mappingNode {
+			return "", errorAt(value.line, "should be a mapping or a scalar, not a %s", value.kind)
+		}
+		separator := ":"
+		if kind == keyValues {
+			separator = "="
+		}
+		items := make([]string, len(value.entries))
+		for idx, e := range value.entries {
+			if e.value.kind != scalarNode {
+				return "", errorAt(e.line, "should be a mapping of scalars, %s is a %s", e.key, e.value.kind)
+			}
+			if strings.ContainsAny(e.key, ","+separator) {
+				return "", errorAt(e.line, "keys can't hold commas or %s: %q", separator, e.key)
+			}
+			mapped := e.value.value
+			if kind == keyValues {
+				mapped = url.QueryEscape(mapped)
+			} else if strings.Contains(mapped, ",") {
+				return "", errorAt(e.line, "values can't hold commas: %q", mapped)
+			}
+			items[idx] = e.key + separator + mapped
+		}
+		return strings.Join(items, ","), nil
+	case object:
+		encoded, err := json.Marshal(toJSON(value))
+		if err != nil {
+			return "", errorAt(value.line, "can't be written as json: %s", err)
+		}
+		return string(encoded), nil
+	default:
+		return "", errorAt(value.line, "should be a scalar, not a %s", value.kind)
+	}
+}
+
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// toJSON is the json value of a yaml value, plain scalars being numbers, flags and nulls where they are written
+// as such.
+func toJSON(value *node) interface{} {
+	switch value.kind {
+	case mappingNode:
+		object := make(map[string]interface{}, len(value.entries))
+		for _, e := range value.entries {
+			object[e.key] = toJSON(e.value)
+		}
+		return object
+	case sequenceNode:
+		array := make([]interface{}, len(value.items))
+		for idx, item := range value.items {
+			array[idx] = toJSON(item)
+		}
+		return array
+	}
+	if value.quoted {
+		return value.value
+	}
+	if value.isNull() {
+		return nil
+	}
+	switch value.value {
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if jsonNumber.MatchString(value.value) {
+		return json.Number(value.value)
+	}
+	return value.value
+}
+
+// redacted stands for the values of the secret settings in the effective config.
+const redacted = "[redacted]"
+
+var secretSetting = regexp.MustCompile(`PASSWORD|SECRET|API_KEY|AUTHORIZATION|TOKEN|HEADERS|SALT`)
+
+// WriteEffective writes the settings in effect, from the env vars and the config file, as a config file with
+// the secrets redacted.
+func WriteEffective(w io.Writer) error {
+	values := Effective()
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", name, strconv.Quote(redact(name, values[name]))); err != nil {
+			return err
+		}
+	}
+	if len(pipelines) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "%s:\n", pipelinesKey); err != nil {
+		return err
+	}
+	for _, p := range pipelines {
+		if _, err := fmt.Fprintf(w, "  %s:\n", p.Name); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(p.Settings))
+		for name := range p.Settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "    %s: %s\n", name, strconv.Quote(redact(name, p.Settings[name]))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretSetting.MatchString(name) {
+		return redacted
+	}
+	items := strings.Split(value, ",")
+	for idx, item := range items {
+		u, err := url.Parse(strings.TrimSpace(item))
+		if err != nil || u.User == nil || u.Host == "" {
+			continue
+		}
+		if _, hasPassword := u.User.Password(); hasPassword {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+			items[idx] = u.String()
+		}
+	}
+	return strings.Join(items, ",")
+}
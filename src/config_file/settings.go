@@ -0,0 +1,209 @@
+package config_file
+
+type settingKind int
+
+// The yaml values of the settings are written to their env vars in the format of each setting.
+const (
+	// scalar is a string, a number or a flag
+	scalar settingKind = iota
+	// list is a sequence of scalars, joined by commas
+	list
+	// pairs is a mapping of scalars, written as comma separated key:value pairs
+	pairs
+	// keyValues is a mapping of scalars, written as comma separated key=value pairs with url encoded values
+	keyValues
+	// object is any value, written as json
+	object
+	// conditions is a sequence of filter conditions, joined by &&
+	conditions
+)
+
+// settings are the settings a config file may hold, the env vars of the README.
+var settings = map[string]settingKind{
+	"CONFIG_FILE_WATCH_INTERVAL":                    scalar,
+	"DEBUG_PORT":                                    scalar,
+	"DRY_RUN":                                       scalar,
+	"DRY_RUN_COMMIT":                                scalar,
+	"DRY_RUN_OUTPUT":                                scalar,
+	"ELASTICSEARCH_API_KEY":                         scalar,
+	"ELASTICSEARCH_AWS_REGION":                      scalar,
+	"ELASTICSEARCH_AWS_SERVICE":                     scalar,
+	"ELASTICSEARCH_AWS_SIGV4":                       scalar,
+	"ELASTICSEARCH_CA_CERT_PATH":                    scalar,
+	"ELASTICSEARCH_CLIENT_BACKOFF":                  scalar,
+	"ELASTICSEARCH_CLIENT_CERT_PATH":                scalar,
+	"ELASTICSEARCH_CLIENT_KEY_PATH":                 scalar,
+	"ELASTICSEARCH_CLIENT_MAX_BACKOFF":              scalar,
+	"ELASTICSEARCH_CLIENT_RETRIES":                  scalar,
+	"ELASTICSEARCH_GZIP":                            scalar,
+	"ELASTICSEARCH_HEALTHCHECK_INTERVAL":            scalar,
+	"ELASTICSEARCH_HOST":                            list,
+	"ELASTICSEARCH_KEEP_ALIVE":                      scalar,
+	"ELASTICSEARCH_MAX_IDLE_CONNS_PER_HOST":         scalar,
+	"ELASTICSEARCH_PASSWORD":                        scalar,
+	"ELASTICSEARCH_SNIFF":                           scalar,
+	"ELASTICSEARCH_TLS_INSECURE_SKIP_VERIFY":        scalar,
+	"ELASTICSEARCH_USERNAME":                        scalar,
+	"ES_BLACKLISTED_COLUMNS":                        list,
+	"ES_BULK_ACTION":                                scalar,
+	"ES_BULK_BACKOFF":                               scalar,
+	"ES_BULK_CONCURRENCY":                           scalar,
+	"ES_BULK_FLUSH_ACTIONS":                         scalar,
+	"ES_BULK_FLUSH_BYTES":                           scalar,
+	"ES_BULK_FLUSH_INTERVAL":                        scalar,
+	"ES_BULK_MAX_BACKOFF":                           scalar,
+	"ES_BULK_MAX_BYTES":                             scalar,
+	"ES_BULK_MAX_RETRIES":                           scalar,
+	"ES_BULK_PROCESSOR":                             scalar,
+	"ES_BULK_REFRESH":                               scalar,
+	"ES_BULK_TIMEOUT":                               scalar,
+	"ES_BULK_WAIT_FOR_ACTIVE_SHARDS":                scalar,
+	"ES_CIRCUIT_BREAKER_PROBE_INTERVAL":             scalar,
+	"ES_CIRCUIT_BREAKER_THRESHOLD":                  scalar,
+	"ES_CONNECT_BACKOFF":                            scalar,
+	"ES_CONNECT_RETRIES":                            scalar,
+	"ES_CONNECT_TIMEOUT":                            scalar,
+	"ES_DATA_STREAM":                                scalar,
+	"ES_DEAD_LETTER_FILE":                           scalar,
+	"ES_DEAD_LETTER_INDEX":                          scalar,
+	"ES_DEAD_LETTER_MODE":                           scalar,
+	"ES_DEDUPE_IN_BATCH":                            scalar,
+	"ES_DOC_ID_COLUMN":                              scalar,
+	"ES_DOC_ID_COLUMN_MISSING":                      scalar,
+	"ES_DOC_ID_HASH":                                scalar,
+	"ES_DOC_ID_SEPARATOR":                           scalar,
+	"ES_DOC_TYPE":                                   scalar,
+	"ES_EXTERNAL_VERSION":                           scalar,
+	"ES_EXTRA_INDICES":                              list,
+	"ES_FIELD_COERCIONS":                            pairs,
+	"ES_FIELD_COERCION_ERRORS":                      scalar,
+	"ES_FIELD_RENAMES":                              pairs,
+	"ES_FLATTEN_ARRAYS":                             scalar,
+	"ES_FLATTEN_MAX_DEPTH":                          scalar,
+	"ES_FLATTEN_NESTED":                             scalar,
+	"ES_GEO_POINT_FIELDS":                           pairs,
+	"ES_GEO_POINT_REMOVE_SOURCES":                   scalar,
+	"ES_HEADER_FIELDS":                              list,
+	"ES_INCLUDE_KAFKA_METADATA":                     scalar,
+	"ES_INDEX":                                      scalar,
+	"ES_INDEX_COLUMN":                               scalar,
+	"ES_INDEX_COLUMN_IS_TIMESTAMP":                  scalar,
+	"ES_INDEX_COLUMN_MISSING":                       scalar,
+	"ES_INDEX_COLUMN_TIMESTAMP_FORMAT":              scalar,
+	"ES_INDEX_SANITIZE":                             scalar,
+	"ES_INDEX_STATIC":                               scalar,
+	"ES_INDEX_TIME_FIELD":                           scalar,
+	"ES_INDEX_TIME_LAYOUT":                          scalar,
+	"ES_INDEX_TIME_SOURCE":                          scalar,
+	"ES_INDEX_TIME_ZONE":                            scalar,
+	"ES_INGESTED_AT_FIELD":                          scalar,
+	"ES_JOIN_CHILD_NAME":                            scalar,
+	"ES_JOIN_FIELD":                                 scalar,
+	"ES_JOIN_PARENT_COLUMN":                         scalar,
+	"ES_JOIN_PARENT_NAME":                           scalar,
+	"ES_KAFKA_METADATA_PREFIX":                      scalar,
+	"ES_MASKED_COLUMNS":                             pairs,
+	"ES_MASK_SALT":                                  scalar,
+	"ES_MAX_DOC_BYTES":                              scalar,
+	"ES_PIPELINE":                                   scalar,
+	"ES_READINESS_CHECK_INDEX":                      scalar,
+	"ES_READINESS_MIN_STATUS":                       scalar,
+	"ES_READINESS_MODE":                             scalar,
+	"ES_READINESS_TIMEOUT":                          scalar,
+	"ES_RETRY_ON_CONFLICT":                          scalar,
+	"ES_ROUTING_COLUMN":                             scalar,
+	"ES_ROUTING_MISSING":                            scalar,
+	"ES_SCRIPT":                                     scalar,
+	"ES_SCRIPT_UPSERT":                              object,
+	"ES_TEMPLATE":                                   object,
+	"ES_TEMPLATE_NAME":                              scalar,
+	"ES_TEMPLATE_OVERWRITE":                         scalar,
+	"ES_TEMPLATE_PATH":                              scalar,
+	"ES_TIME_SUFFIX":                                scalar,
+	"ES_TOPIC_CONFIG":                               object,
+	"ES_TOPIC_CONFIG_PATH":                          scalar,
+	"ES_TOPIC_PIPELINES":                            pairs,
+	"ES_TRUNCATE_FIELDS":                            pairs,
+	"ES_VERSION_COLUMN":                             scalar,
+	"ES_WHITELISTED_COLUMNS":                        list,
+	"K8S_LIVENESS_ROUTE":                            scalar,
+	"K8S_READINESS_ROUTE":                           scalar,
+	"KAFKA_ADDRESS":                                 scalar,
+	"KAFKA_CONSUMER_AVRO_BINARY_FIELDS":             pairs,
+	"KAFKA_CONSUMER_AVRO_BINARY_FORMAT":             scalar,
+	"KAFKA_CONSUMER_AVRO_DECIMAL_FORMAT":            scalar,
+	"KAFKA_CONSUMER_AVRO_OMIT_NULLS":                scalar,
+	"KAFKA_CONSUMER_AVRO_TIMESTAMP_FORMAT":          scalar,
+	"KAFKA_CONSUMER_BATCH_LINGER":                   scalar,
+	"KAFKA_CONSUMER_BATCH_SIZE":                     scalar,
+	"KAFKA_CONSUMER_BUFFER_SIZE":                    scalar,
+	"KAFKA_CONSUMER_CONCURRENCY":                    scalar,
+	"KAFKA_CONSUMER_DECODE_ERROR_POLICY":            scalar,
+	"KAFKA_CONSUMER_DELETE_TOMBSTONES":              scalar,
+	"KAFKA_CONSUMER_DISPATCH":                       scalar,
+	"KAFKA_CONSUMER_FILTER":                         conditions,
+	"KAFKA_CONSUMER_GROUP":                          scalar,
+	"KAFKA_CONSUMER_JSON_SCHEMA_VALIDATE":           scalar,
+	"KAFKA_CONSUMER_MAX_BYTES_PER_SECOND":           scalar,
+	"KAFKA_CONSUMER_MAX_IN_FLIGHT":                  scalar,
+	"KAFKA_CONSUMER_MAX_RECORDS_PER_SECOND":         scalar,
+	"KAFKA_CONSUMER_METRICS_UPDATE_INTERVAL":        scalar,
+	"KAFKA_CONSUMER_READER_SCHEMAS":                 object,
+	"KAFKA_CONSUMER_READER_SCHEMAS_PATH":            scalar,
+	"KAFKA_CONSUMER_READER_SCHEMA_REFRESH_INTERVAL": scalar,
+	"KAFKA_CONSUMER_RECORD_TYPE":                    scalar,
+	"KAFKA_CONSUMER_RESUME_IN_FLIGHT":               scalar,
+	"KAFKA_CONSUMER_SHUTDOWN_TIMEOUT":               scalar,
+	"KAFKA_CONSUMER_STALL_TIMEOUT":                  scalar,
+	"KAFKA_DEAD_LETTER_BROKERS":                     list,
+	"KAFKA_DEAD_LETTER_TOPIC":                       scalar,
+	"KAFKA_FORCE_SEEK":                              scalar,
+	"KAFKA_HEALTH_CHECK_INTERVAL":                   scalar,
+	"KAFKA_LIVENESS_TIMEOUT":                        scalar,
+	"KAFKA_METADATA_REFRESH_INTERVAL":               scalar,
+	"KAFKA_REPLAY_END":                              scalar,
+	"KAFKA_REPLAY_RATE":                             scalar,
+	"KAFKA_REPLAY_START":                            scalar,
+	"KAFKA_SASL_MECHANISM":                          scalar,
+	"KAFKA_SASL_PASSWORD":                           scalar,
+	"KAFKA_SASL_USERNAME":                           scalar,
+	"KAFKA_START_OFFSET":                            scalar,
+	"KAFKA_TLS":                                     scalar,
+	"KAFKA_TLS_CA_CERT_PATH":                        scalar,
+	"KAFKA_TLS_CLIENT_CERT_PATH":                    scalar,
+	"KAFKA_TLS_CLIENT_KEY_PATH":                     scalar,
+	"KAFKA_TLS_INSECURE_SKIP_VERIFY":                scalar,
+	"KAFKA_TOPICS":                                  list,
+	"KAFKA_TOPICS_PATTERN":                          scalar,
+	"KAFKA_VERSION":                                 scalar,
+	"LOG_FORMAT":                                    scalar,
+	"LOG_LEVEL":                                     scalar,
+	"LOG_LEVEL_ELASTICSEARCH":                       scalar,
+	"LOG_LEVEL_KAFKA":                               scalar,
+	"LOG_LEVEL_SCHEMA_REGISTRY":                     scalar,
+	"METRICS_END_TO_END_LATENCY_BUCKETS":            list,
+	"METRICS_PORT":                                  scalar,
+	"OTEL_BSP_SCHEDULE_DELAY":                       scalar,
+	"OTEL_EXPORTER_OTLP_ENDPOINT":                   scalar,
+	"OTEL_EXPORTER_OTLP_HEADERS":                    keyValues,
+	"OTEL_EXPORTER_OTLP_PROTOCOL":                   scalar,
+	"OTEL_EXPORTER_OTLP_TIMEOUT":                    scalar,
+	"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT":            scalar,
+	"OTEL_EXPORTER_OTLP_TRACES_HEADERS":             keyValues,
+	"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL":            scalar,
+	"OTEL_EXPORTER_OTLP_TRACES_TIMEOUT":             scalar,
+	"OTEL_RESOURCE_ATTRIBUTES":                      keyValues,
+	"OTEL_SDK_DISABLED":                             scalar,
+	"OTEL_SERVICE_NAME":                             scalar,
+	"OTEL_TRACES_EXPORTER":                          scalar,
+	"PIPELINES_RESTART_BACKOFF":                     scalar,
+	"PROBES_PORT":                                   scalar,
+	"SCHEMA_REGISTRY_AUTHORIZATION":                 scalar,
+	"SCHEMA_REGISTRY_CA_CERT_PATH":                  scalar,
+	"SCHEMA_REGISTRY_LOCAL_SCHEMA_DIR":              scalar,
+	"SCHEMA_REGISTRY_PASSWORD":                      scalar,
+	"SCHEMA_REGISTRY_PERSIST_SCHEMAS":               scalar,
+	"SCHEMA_REGISTRY_PROBE_INTERVAL":                scalar,
+	"SCHEMA_REGISTRY_URL":                           list,
+	"SCHEMA_REGISTRY_USERNAME":                      scalar,
+}
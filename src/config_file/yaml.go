@@ -0,0 +1,508 @@
+package config_file
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The subset of yaml a config file is written in: block mappings and sequences, flow mappings and sequences on a
+// single line, plain and quoted scalars, literal and folded block scalars, and comments. Anchors, aliases, tags
+// and multiple documents are not supported.
+
+type nodeKind int
+
+const (
+	scalarNode nodeKind = iota
+	mappingNode
+	sequenceNode
+)
+
+func (k nodeKind) String() string {
+	switch k {
+	case mappingNode:
+		return "mapping"
+	case sequenceNode:
+		return "sequence"
+	default:
+		return "scalar"
+	}
+}
+
+type node struct {
+	kind nodeKind
+	line int
+	// value is the text of a scalar, quoted when it was written between quotes, so that it is never a number,
+	// a bool or null
+	value  string
+	quoted bool
+	// entries are the keys and values of a mapping, in the order they were written
+	entries []entry
+	items   []*node
+}
+
+type entry struct {
+	key   string
+	line  int
+	value *node
+}
+
+// isNull tells whether a scalar is the yaml null, like a key without any value.
+func (n *node) isNull() bool {
+	return n.kind == scalarNode && !n.quoted && (n.value == "" || n.value == "~" || n.value == "null" || n.value == "Null" || n.value == "NULL")
+}
+
+type sourceLine struct {
+	number int
+	indent int
+	// text is the line without its indentation and comment, raw is the whole line
+	text string
+	raw  string
+}
+
+type yamlParser struct {
+	lines []sourceLine
+	pos   int
+}
+
+type yamlError struct {
+	line    int
+	message string
+}
+
+func (e *yamlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.message)
+}
+
+func errorAt(line int, format string, args ...interface{}) error {
+	return &yamlError{line: line, message: fmt.Sprintf(format, args...)}
+}
+
+// parseYAML parses a document, nil when it has no content.
+func parseYAML(content string) (*node, error) {
+	p := &yamlParser{}
+	content = strings.TrimSuffix(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	for idx, raw := range strings.Split(content, "\n") {
+		line := sourceLine{number: idx + 1, raw: raw}
+		trimmed := strings.TrimLeft(raw, " ")
+		line.indent = len(raw) - len(trimmed)
+		line.text = strings.TrimRight(stripComment(trimmed), " \t")
+		if strings.HasPrefix(line.text, "\t") {
+			return nil, errorAt(line.number, "tabs can't be used for indentation")
+		}
+		p.lines = append(p.lines, line)
+	}
+	first := p.peek()
+	if first != nil && first.text == "---" {
+		p.pos++
+	}
+	for _, line := range p.lines[p.pos:] {
+		if line.indent == 0 && (line.text == "---" || line.text == "...") {
+			return nil, errorAt(line.number, "multiple documents are not supported")
+		}
+		if line.indent == 0 && strings.HasPrefix(line.text, "%") {
+			return nil, errorAt(line.number, "directives are not supported")
+		}
+	}
+	first = p.peek()
+	if first == nil {
+		return nil, nil
+	}
+	root, err := p.parseNode(first.indent, first.number)
+	if err != nil {
+		return nil, err
+	}
+	if extra := p.peek(); extra != nil {
+		return nil, errorAt(extra.number, "unexpected indentation")
+	}
+	return root, nil
+}
+
+// stripComment drops a comment starting with # at the beginning or after a space, outside of quotes.
+func stripComment(text string) string {
+	var quote byte
+	for idx := 0; idx < len(text); idx++ {
+		c := text[idx]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				idx++
+			}
+		case c == '"' || c == '\'':
+			if idx == 0 || strings.ContainsRune(" \t[{,:-", rune(text[idx-1])) {
+				quote = c
+			}
+		case c == '#' && (idx == 0 || text[idx-1] == ' ' || text[idx-1] == '\t'):
+			return text[:idx]
+		}
+	}
+	return text
+}
+
+// peek is the next line with content, nil at the end of the document.
+func (p *yamlParser) peek() *sourceLine {
+	for p.pos < len(p.lines) {
+		if p.lines[p.pos].text != "" {
+			return &p.lines[p.pos]
+		}
+		p.pos++
+	}
+	return nil
+}
+
+// parseNode parses the block starting at the next line, which is indented by indent.
+func (p *yamlParser) parseNode(indent, line int) (*node, error) {
+	next := p.peek()
+	if next == nil || next.indent < indent {
+		return &node{kind: scalarNode, line: line}, nil
+	}
+	if isSequenceItem(next.text) {
+		return p.parseSequence(next.indent)
+	}
+	if _, _, ok := splitKey(next.text); ok {
+		return p.parseMapping(next.indent)
+	}
+	p.pos++
+	value, err := parseInline(next.text, next.number)
+	if err != nil {
+		return nil, err
+	}
+	if following := p.peek(); following != nil && following.indent >= indent {
+		return nil, errorAt(following.number, "multi line plain scalars are not supported, use a block scalar with | or >")
+	}
+	return value, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) parseMapping(indent int) (*node, error) {
+	mapping := &node{kind: mappingNode, line: p.peek().number}
+	seen := make(map[string]bool)
+	for {
+		line := p.peek()
+		if line == nil || line.indent < indent {
+			return mapping, nil
+		}
+		if line.indent > indent {
+			return nil, errorAt(line.number, "unexpected indentation")
+		}
+		key, rest, ok := splitKey(line.text)
+		if !ok {
+			return nil, errorAt(line.number, "expected a key: value pair")
+		}
+		if seen[key] {
+			return nil, errorAt(line.number, "duplicate key %s", key)
+		}
+		seen[key] = true
+		p.pos++
+		value, err := p.parseValue(rest, line, indent)
+		if err != nil {
+			return nil, err
+		}
+		mapping.entries = append(mapping.entries, entry{key: key, line: line.number, value: value})
+	}
+}
+
+func (p *yamlParser) parseSequence(indent int) (*node, error) {
+	sequence := &node{kind: sequenceNode, line: p.peek().number}
+	for {
+		line := p.peek()
+		if line == nil || line.indent < indent {
+			return sequence, nil
+		}
+		if line.indent > indent {
+			return nil, errorAt(line.number, "unexpected indentation")
+		}
+		if !isSequenceItem(line.text) {
+			// the mapping the sequence is the value of goes on
+			return sequence, nil
+		}
+		rest := strings.TrimPrefix(line.text, "-")
+		trimmed := strings.TrimLeft(rest, " ")
+		if _, _, ok := splitKey(trimmed); ok && trimmed != "" && trimmed[0] != '[' && trimmed[0] != '{' {
+			// a mapping starting on the line of the item, it is indented by the dash and the spaces after it
+			line.indent += 1 + len(rest) - len(trimmed)
+			line.text = trimmed
+			item, err := p.parseMapping(line.indent)
+			if err != nil {
+				return nil, err
+			}
+			sequence.items = append(sequence.items, item)
+			continue
+		}
+		p.pos++
+		item, err := p.parseValue(trimmed, line, indent)
+		if err != nil {
+			return nil, err
+		}
+		sequence.items = append(sequence.items, item)
+	}
+}
+
+// parseValue parses the value after a key or a dash, which is either on the same line or in the block that
+// follows, indented further.
+func (p *yamlParser) parseValue(rest string, line *sourceLine, indent int) (*node, error) {
+	if strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">") {
+		return p.parseBlockScalar(rest, line.number, indent)
+	}
+	if rest != "" {
+		return parseInline(rest, line.number)
+	}
+	next := p.peek()
+	if next == nil {
+		return &node{kind: scalarNode, line: line.number}, nil
+	}
+	if next.indent > indent {
+		return p.parseNode(next.indent, line.number)
+	}
+	if next.indent == indent && isSequenceItem(next.text) && !isSequenceItem(line.text) {
+		// the items of a sequence may be as indented as their key
+		return p.parseSequence(indent)
+	}
+	return &node{kind: scalarNode, line: line.number}, nil
+}
+
+func (p *yamlParser) parseBlockScalar(header string, line, indent int) (*node, error) {
+	folded := header[0] == '>'
+	chomping := strings.TrimSpace(header[1:])
+	if chomping != "" && chomping != "-" && chomping != "+" {
+		return nil, errorAt(line, "unsupported block scalar header %s", header)
+	}
+	var lines []string
+	contentIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		raw := p.lines[p.pos].raw
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.TrimSpace(raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		lineIndent := len(raw) - len(trimmed)
+		if contentIndent < 0 {
+			if lineIndent <= indent {
+				break
+			}
+			contentIndent = lineIndent
+		}
+		if lineIndent < contentIndent {
+			break
+		}
+		lines = append(lines, raw[contentIndent:])
+	}
+	// trailing blank lines belong to the block only to be chomped
+	content := len(lines)
+	for content > 0 && lines[content-1] == "" {
+		content--
+	}
+	trailing := len(lines) - content
+	lines = lines[:content]
+	var value string
+	if folded {
+		var builder strings.Builder
+		for idx, text := range lines {
+			if idx > 0 {
+				// a line break is folded into a space, a blank line into a line break
+				if text == "" {
+					builder.WriteString("\n")
+				} else if lines[idx-1] != "" {
+					builder.WriteString(" ")
+				}
+			}
+			builder.WriteString(text)
+		}
+		value = builder.String()
+	} else {
+		value = strings.Join(lines, "\n")
+	}
+	switch {
+	case chomping == "-" || value == "":
+	case chomping == "+":
+		value += strings.Repeat("\n", 1+trailing)
+	default:
+		value += "\n"
+	}
+	return &node{kind: scalarNode, line: line, value: value, quoted: true}, nil
+}
+
+// splitKey splits a mapping entry into its key and the rest of the line after the colon.
+func splitKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := closingQuote(text)
+		if end < 0 || end+1 >= len(text) || text[end+1] != ':' {
+			return "", "", false
+		}
+		if end+2 < len(text) && text[end+2] != ' ' {
+			return "", "", false
+		}
+		key, err := unquote(text[:end+1])
+		if err != nil {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(text[end+2:]), true
+	}
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] == ':' && (idx+1 == len(text) || text[idx+1] == ' ') {
+			return strings.TrimSpace(text[:idx]), strings.TrimSpace(text[idx+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// closingQuote is the index of the quote closing the scalar that starts text, -1 if it is never closed.
+func closingQuote(text string) int {
+	quote := text[0]
+	for idx := 1; idx < len(text); idx++ {
+		switch {
+		case quote == '"' && text[idx] == '\\':
+			idx++
+		case text[idx] == quote && quote == '\'' && idx+1 < len(text) && text[idx+1] == '\'':
+			// '' is an escaped single quote
+			idx++
+		case text[idx] == quote:
+			return idx
+		}
+	}
+	return -1
+}
+
+func unquote(text string) (string, error) {
+	if text[0] == '\'' {
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	}
+	return strconv.Unquote(text)
+}
+
+// parseInline parses a value written on a single line, a scalar or a flow collection.
+func parseInline(text string, line int) (*node, error) {
+	switch text[0] {
+	case '&', '*', '!':
+		return nil, errorAt(line, "anchors, aliases and tags are not supported")
+	case '[', '{':
+		flow := &flowParser{text: text, line: line}
+		value, err := flow.parse()
+		if err != nil {
+			return nil, err
+		}
+		if rest := strings.TrimSpace(flow.text[flow.pos:]); rest != "" {
+			return nil, errorAt(line, "unexpected %q after %s", rest, value.kind)
+		}
+		return value, nil
+	case '"', '\'':
+		end := closingQuote(text)
+		if end < 0 {
+			return nil, errorAt(line, "unterminated quoted scalar")
+		}
+		if rest := strings.TrimSpace(text[end+1:]); rest != "" {
+			return nil, errorAt(line, "unexpected %q after quoted scalar", rest)
+		}
+		value, err := unquote(text[:end+1])
+		if err != nil {
+			return nil, errorAt(line, "invalid quoted scalar %s", text)
+		}
+		return &node{kind: scalarNode, line: line, value: value, quoted: true}, nil
+	}
+	return &node{kind: scalarNode, line: line, value: text}, nil
+}
+
+type flowParser struct {
+	text string
+	pos  int
+	line int
+}
+
+func (f *flowParser) skipSpaces() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *flowParser) parse() (*node, error) {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return nil, errorAt(f.line, "unterminated flow collection")
+	}
+	switch f.text[f.pos] {
+	case '[':
+		return f.parseCollection(']')
+	case '{':
+		return f.parseCollection('}')
+	case '"', '\'':
+		end := closingQuote(f.text[f.pos:])
+		if end < 0 {
+			return nil, errorAt(f.line, "unterminated quoted scalar")
+		}
+		value, err := unquote(f.text[f.pos : f.pos+end+1])
+		if err != nil {
+			return nil, errorAt(f.line, "invalid quoted scalar %s", f.text[f.pos:f.pos+end+1])
+		}
+		f.pos += end + 1
+		return &node{kind: scalarNode, line: f.line, value: value, quoted: true}, nil
+	}
+	start := f.pos
+	for f.pos < len(f.text) && !strings.ContainsRune(",]}", rune(f.text[f.pos])) {
+		if f.text[f.pos] == ':' && (f.pos+1 == len(f.text) || strings.ContainsRune(" ,]}", rune(f.text[f.pos+1]))) {
+			break
+		}
+		f.pos++
+	}
+	return &node{kind: scalarNode, line: f.line, value: strings.TrimSpace(f.text[start:f.pos])}, nil
+}
+
+func (f *flowParser) parseCollection(closing byte) (*node, error) {
+	collection := &node{kind: sequenceNode, line: f.line}
+	if closing == '}' {
+		collection.kind = mappingNode
+	}
+	seen := make(map[string]bool)
+	f.pos++
+	for {
+		f.skipSpaces()
+		if f.pos >= len(f.text) {
+			return nil, errorAt(f.line, "unterminated flow %s", collection.kind)
+		}
+		if f.text[f.pos] == closing {
+			f.pos++
+			return collection, nil
+		}
+		value, err := f.parse()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpaces()
+		if closing == '}' {
+			if value.kind != scalarNode || f.pos >= len(f.text) || f.text[f.pos] != ':' {
+				return nil, errorAt(f.line, "expected a key: value pair in flow mapping")
+			}
+			if seen[value.value] {
+				return nil, errorAt(f.line, "duplicate key %s", value.value)
+			}
+			seen[value.value] = true
+			f.pos++
+			f.skipSpaces()
+			mapped := &node{kind: scalarNode, line: f.line}
+			if f.pos < len(f.text) && f.text[f.pos] != ',' && f.text[f.pos] != '}' {
+				if mapped, err = f.parse(); err != nil {
+					return nil, err
+				}
+			}
+			collection.entries = append(collection.entries, entry{key: value.value, line: f.line, value: mapped})
+		} else {
+			collection.items = append(collection.items, value)
+		}
+		f.skipSpaces()
+		if f.pos < len(f.text) && f.text[f.pos] == ',' {
+			f.pos++
+			continue
+		}
+		if f.pos >= len(f.text) || f.text[f.pos] != closing {
+			return nil, errorAt(f.line, "expected , or %c in flow %s", closing, collection.kind)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package debug
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+// StatusRoute serves the status of each component as json.
+const StatusRoute = "/debug/status"
+
+// StatusFunc snapshots the state of a component, encoded as json.
+type StatusFunc func() interface{}
+
+// Server serves the profiles of net/http/pprof, the variables of expvar and the status of the components on a
+// port of its own, away from the probes and the metrics, so that it is only reachable where it was configured.
+type Server struct {
+	port string
+
+	// statuses are added while serving, as the components are created
+	lock     sync.Mutex
+	statuses map[string]StatusFunc
+}
+
+func New(port string) *Server {
+	return &Server{port: port, statuses: make(map[string]StatusFunc)}
+}
+
+// AddStatus adds a named component to the status, like the kafka consumer.
+func (s *Server) AddStatus(name string, fn StatusFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.statuses[name] = fn
+}
+
+func (s *Server) status(w http.ResponseWriter, _ *http.Request) {
+	s.lock.Lock()
+	statuses := make(map[string]StatusFunc, len(s.statuses))
+	for name, fn := range s.statuses {
+		statuses[name] = fn
+	}
+	s.lock.Unlock()
+	report := make(map[string]interface{}, len(statuses))
+	for name, fn := range statuses {
+		report[name] = fn()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc(StatusRoute, s.status)
+	return mux
+}
+
+func (s *Server) Serve() error {
+	return http.ListenAndServe(":"+s.port, s.mux())
+}
@@ -0,0 +1,38 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Routes(t *testing.T) {
+	s := New("0")
+	s.AddStatus("kafka", func() interface{} {
+		return map[string]int{"in_flight_records": 3}
+	})
+	server := httptest.NewServer(s.mux())
+	defer server.Close()
+
+	res, err := http.Get(server.URL + StatusRoute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	var status map[string]map[string]int
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.Equal(t, map[string]map[string]int{"kafka": {"in_flight_records": 3}}, status)
+
+	for _, route := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/vars"} {
+		res, err := http.Get(server.URL + route)
+		if !assert.NoError(t, err, route) {
+			continue
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, route)
+	}
+}
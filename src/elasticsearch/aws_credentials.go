@@ -0,0 +1,213 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentials are renewed this long before they expire, so that no request is signed with expired ones
+const awsCredentialsExpiryWindow = 5 * time.Minute
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	// expires is zero for credentials that don't expire
+	expires time.Time
+}
+
+type awsCredentialsProvider interface {
+	retrieve() (awsCredentials, error)
+}
+
+// awsCredentialsChain looks for credentials like the AWS SDKs do: in the environment, then with the web identity
+// token of IAM roles for service accounts, then in the shared credentials file. The credentials found are kept
+// until they are about to expire.
+type awsCredentialsChain struct {
+	providers []awsCredentialsProvider
+	now       func() time.Time
+
+	mutex  sync.Mutex
+	cached *awsCredentials
+}
+
+func newAWSCredentialsChain(region string) *awsCredentialsChain {
+	return &awsCredentialsChain{
+		providers: []awsCredentialsProvider{
+			envCredentials{},
+			webIdentityCredentials{
+				endpoint: fmt.Sprintf("https://sts.%s.amazonaws.com/", region),
+				client:   &http.Client{Timeout: 10 * time.Second},
+			},
+			sharedFileCredentials{},
+		},
+		now: time.Now,
+	}
+}
+
+func (c *awsCredentialsChain) retrieve() (awsCredentials, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cached != nil && (c.cached.expires.IsZero() || c.now().Add(awsCredentialsExpiryWindow).Before(c.cached.expires)) {
+		return *c.cached, nil
+	}
+	var failures []string
+	for _, provider := range c.providers {
+		credentials, err := provider.retrieve()
+		if err == errNoAWSCredentials {
+			continue
+		}
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		c.cached = &credentials
+		return credentials, nil
+	}
+	if len(failures) > 0 {
+		return awsCredentials{}, errors.New(strings.Join(failures, ", "))
+	}
+	return awsCredentials{}, errors.New("no aws credentials in the environment, web identity token or shared credentials file")
+}
+
+// errNoAWSCredentials is returned by the providers without any credentials set up, the chain moves on to the next.
+var errNoAWSCredentials = errors.New("no aws credentials")
+
+type envCredentials struct{}
+
+func (envCredentials) retrieve() (awsCredentials, error) {
+	accessKeyID, secretAccessKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKeyID == "" || secretAccessKey == "" {
+		return awsCredentials{}, errNoAWSCredentials
+	}
+	return awsCredentials{
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+// webIdentityCredentials assumes the role of AWS_ROLE_ARN with the token of AWS_WEB_IDENTITY_TOKEN_FILE, both set
+// up by EKS for the pods of service accounts annotated with an IAM role.
+type webIdentityCredentials struct {
+	endpoint string
+	client   *http.Client
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+func (p webIdentityCredentials) retrieve() (awsCredentials, error) {
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return awsCredentials{}, errNoAWSCredentials
+	}
+	// the token is rotated in place, so it is read again on every renewal
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not read web identity token: %s", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "kafka-elasticsearch-injector"
+	}
+	res, err := p.client.PostForm(p.endpoint, url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	})
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not assume role %s with web identity: %s", roleARN, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not assume role %s with web identity: %s", roleARN, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("could not assume role %s with web identity: %s %s", roleARN, res.Status, body)
+	}
+	var parsed assumeRoleWithWebIdentityResponse
+	if err := xml.Unmarshal(body, &parsed); err != nil {
+		return awsCredentials{}, fmt.Errorf("could not parse the credentials of role %s: %s", roleARN, err)
+	}
+	return awsCredentials{
+		accessKeyID:     parsed.Credentials.AccessKeyID,
+		secretAccessKey: parsed.Credentials.SecretAccessKey,
+		sessionToken:    parsed.Credentials.SessionToken,
+		expires:         parsed.Credentials.Expiration,
+	}, nil
+}
+
+// sharedFileCredentials reads the AWS_PROFILE profile, default unless set, of the shared credentials file at
+// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+type sharedFileCredentials struct{}
+
+func (sharedFileCredentials) retrieve() (awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return awsCredentials{}, errNoAWSCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return awsCredentials{}, errNoAWSCredentials
+	}
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("could not read shared credentials file: %s", err)
+	}
+	defer file.Close()
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		if section == profile && len(pair) == 2 {
+			values[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, fmt.Errorf("could not read shared credentials file: %s", err)
+	}
+	if values["aws_access_key_id"] == "" || values["aws_secret_access_key"] == "" {
+		return awsCredentials{}, errNoAWSCredentials
+	}
+	return awsCredentials{
+		accessKeyID:     values["aws_access_key_id"],
+		secretAccessKey: values["aws_secret_access_key"],
+		sessionToken:    values["aws_session_token"],
+	}, nil
+}
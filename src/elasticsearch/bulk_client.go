@@ -0,0 +1,131 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// BulkClient is what a recordDatabase needs of an elasticsearch client: bulk requests along with the result of
+// each of their items, pings and the cluster health. olivereClient implements it with olivere/elastic, whose
+// client is still the one of GetClient for the index templates and the bulk processor.
+type BulkClient interface {
+	// Bulk sends the requests in a single bulk request, the items are their results in the same order.
+	Bulk(ctx context.Context, request BulkRequest) ([]BulkItem, error)
+	// Ping returns the version number of the elasticsearch answering on the host.
+	Ping(ctx context.Context, host string) (string, error)
+	// ClusterHealth waits up to timeout for the cluster to reach the status, without timeout when it is 0.
+	ClusterHealth(ctx context.Context, status string, timeout time.Duration) (ClusterHealth, error)
+	// IndexExists tells whether the index, alias or data stream exists.
+	IndexExists(ctx context.Context, index string) (bool, error)
+}
+
+// BulkRequest is a bulk request with the refresh and active shards parameters, empty to leave them out.
+type BulkRequest struct {
+	Refresh      string
+	ActiveShards string
+	// Requests hold the lines of each request of the bulk, its action and its source unless deleting
+	Requests [][]string
+}
+
+// BulkItem is the result of one request of a bulk.
+type BulkItem struct {
+	// Action is create, index, update or delete
+	Action string
+	Index  string
+	ID     string
+	Status int
+	// ErrorType and ErrorReason tell why the request failed, empty when elasticsearch gave no error
+	ErrorType   string
+	ErrorReason string
+}
+
+// succeeded tells whether the request of the item was applied.
+func (item BulkItem) succeeded() bool {
+	return item.Status >= http.StatusOK && item.Status <= 299
+}
+
+// ClusterHealth is the health of the cluster.
+type ClusterHealth struct {
+	Status string
+	// TimedOut is set when the cluster didn't reach the status in time
+	TimedOut bool
+}
+
+// olivereClient is a BulkClient backed by olivere/elastic.
+type olivereClient struct {
+	client *elastic.Client
+}
+
+func (c olivereClient) Bulk(ctx context.Context, request BulkRequest) ([]BulkItem, error) {
+	bulk := c.client.Bulk()
+	if request.Refresh != "" {
+		bulk = bulk.Refresh(request.Refresh)
+	}
+	if request.ActiveShards != "" {
+		bulk = bulk.WaitForActiveShards(request.ActiveShards)
+	}
+	for _, lines := range request.Requests {
+		bulk.Add(bulkLines(lines))
+	}
+	res, err := bulk.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bulkItems(res.Items), nil
+}
+
+func (c olivereClient) Ping(ctx context.Context, host string) (string, error) {
+	info, _, err := c.client.Ping(host).Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	return info.Version.Number, nil
+}
+
+func (c olivereClient) ClusterHealth(ctx context.Context, status string, timeout time.Duration) (ClusterHealth, error) {
+	request := c.client.ClusterHealth().WaitForStatus(status)
+	if timeout > 0 {
+		request.Timeout(fmt.Sprintf("%dms", timeout/time.Millisecond))
+	}
+	health, err := request.Do(ctx)
+	if err != nil {
+		return ClusterHealth{}, err
+	}
+	return ClusterHealth{Status: health.Status, TimedOut: health.TimedOut}, nil
+}
+
+func (c olivereClient) IndexExists(ctx context.Context, index string) (bool, error) {
+	return c.client.IndexExists(index).Do(ctx)
+}
+
+// bulkItems are the results of the items of an olivere bulk response, each item holding a single action.
+func bulkItems(items []map[string]*elastic.BulkResponseItem) []BulkItem {
+	results := make([]BulkItem, 0, len(items))
+	for _, item := range items {
+		for action, result := range item {
+			bulkItem := BulkItem{Action: action, Index: result.Index, ID: result.Id, Status: result.Status}
+			if result.Error != nil {
+				bulkItem.ErrorType = result.Error.Type
+				bulkItem.ErrorReason = result.Error.Reason
+			}
+			results = append(results, bulkItem)
+		}
+	}
+	return results
+}
+
+// bulkLines is a request of a bulk already serialized to its lines.
+type bulkLines []string
+
+func (l bulkLines) String() string {
+	return strings.Join(l, "\n")
+}
+
+func (l bulkLines) Source() ([]string, error) {
+	return l, nil
+}
@@ -0,0 +1,69 @@
+package elasticsearch
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/olivere/elastic"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBulkClient answers every bulk with its items, keeping the requests sent.
+type fakeBulkClient struct {
+	BulkClient
+	items    []BulkItem
+	requests []BulkRequest
+}
+
+func (c *fakeBulkClient) Bulk(ctx context.Context, request BulkRequest) ([]BulkItem, error) {
+	c.requests = append(c.requests, request)
+	return c.items, nil
+}
+
+func TestBulkItems(t *testing.T) {
+	items := bulkItems([]map[string]*elastic.BulkResponseItem{
+		{"create": {Index: "i", Id: "1", Status: 201}},
+		{"update": {Index: "i", Id: "2", Status: 400, Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception", Reason: "failed to parse"}}},
+		{"delete": {Index: "i", Id: "3", Status: 404}},
+	})
+	assert.Equal(t, []BulkItem{
+		{Action: "create", Index: "i", ID: "1", Status: 201},
+		{Action: "update", Index: "i", ID: "2", Status: 400, ErrorType: "mapper_parsing_exception", ErrorReason: "failed to parse"},
+		{Action: "delete", Index: "i", ID: "3", Status: 404},
+	}, items)
+}
+
+func TestRecordDatabase_DoBulk_BulkClient(t *testing.T) {
+	client := &fakeBulkClient{items: []BulkItem{
+		{Action: "create", Index: "i", ID: "1", Status: 201},
+		{Action: "create", Index: "i", ID: "2", Status: 400, ErrorType: "mapper_parsing_exception", ErrorReason: "failed to parse"},
+		{Action: "create", Index: "i", ID: "3", Status: 429, ErrorType: "es_rejected_execution_exception"},
+		{Action: "create", Index: "i", ID: "4", Status: 409, ErrorType: "version_conflict_engine_exception"},
+		{Action: "delete", Index: "i", ID: "5", Status: 404},
+	}}
+	d := newRecordDatabase(logger, Config{DocType: "t", BulkTimeout: time.Second, Refresh: "wait_for"})
+	var records []*models.ElasticRecord
+	for _, id := range []string{"1", "2", "3", "4"} {
+		records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: id, Json: map[string]interface{}{}})
+	}
+	records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: "5", Deleted: true})
+	chunks, _, err := d.buildBulkRequests(records)
+	if !assert.NoError(t, err) || !assert.Len(t, chunks, 1) {
+		return
+	}
+
+	res, err := d.doBulk(context.Background(), client, chunks[0].request, chunks[0].records)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"4"}, res.AlreadyExists)
+		assert.Equal(t, []*models.ElasticRecord{records[2]}, res.Retry)
+		assert.Equal(t, []Failure{{Index: "i", DocID: "2", Status: 400, Type: "mapper_parsing_exception", Reason: "failed to parse"}}, res.Rejected)
+		assert.True(t, res.Overloaded)
+	}
+	if assert.Len(t, client.requests, 1) && assert.Len(t, client.requests[0].Requests, 5) {
+		assert.Equal(t, "wait_for", client.requests[0].Refresh)
+		assert.Equal(t, []string{`{"create":{"_index":"i","_id":"1","_type":"t"}}`, `{}`}, client.requests[0].Requests[0])
+		assert.Equal(t, []string{`{"delete":{"_index":"i","_type":"t","_id":"5"}}`}, client.requests[0].Requests[4])
+	}
+}
@@ -1,64 +1,225 @@
 package elasticsearch
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/inloco/kafka-elasticsearch-injector/src/models"
 )
 
+// dataStreamTimestampField is required on every document written to a data stream
+const (
+	dataStreamTimestampField  = "@timestamp"
+	dataStreamTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// errSkipRecord is returned for the records left out of the batch for a missing column, as configured.
+var errSkipRecord = errors.New("record skipped")
+
+// FailureCoercionError is the failure type of the dead letters of records holding fields that can't be coerced
+const FailureCoercionError = "coercion_error"
+
+// UncoercibleError reports the records holding fields that can't be coerced, with the dead-letter policy of
+// ES_FIELD_COERCION_ERRORS. EncodeElasticRecords returns it along with the documents of the other records, the
+// uncoercible records having no document there.
+type UncoercibleError struct {
+	Records []UncoercibleRecord
+}
+
+// UncoercibleRecord is a record holding fields that can't be coerced, with its document left uncoerced.
+type UncoercibleRecord struct {
+	// Position is the position of the record in the encoded records
+	Position int
+	Document *models.ElasticRecord
+	Failure  Failure
+}
+
+func (e *UncoercibleError) Error() string {
+	return fmt.Sprintf("%d records hold fields that can't be coerced, first failure: %s", len(e.Records), e.Records[0].Failure)
+}
+
 type Codec interface {
+	// EncodeElasticRecords returns the documents aligned with the records, nil for the records to skip. It
+	// returns an *UncoercibleError along with the documents of the other records when some can't be coerced.
 	EncodeElasticRecords(records []*models.Record) ([]*models.ElasticRecord, error)
+	EncodeExtraIndices(documents []*models.ElasticRecord, records []*models.Record) ([][]*models.ElasticRecord, error)
 }
 
 type basicCodec struct {
 	config Config
 	logger log.Logger
+	// now is the clock of the ingestion timestamps, time.Now when nil
+	now func() time.Time
+	// ingestedAtWarnings holds the topics already warned about records with their own ingestion field
+	ingestedAtWarnings *sync.Map
+	// indexTimeWarnings holds the topics already warned about records without their index time
+	indexTimeWarnings *sync.Map
 }
 
 func NewCodec(logger log.Logger, config Config) Codec {
-	return basicCodec{logger: logger, config: config}
+	if config.StaticIndex && config.IndexColumn != "" {
+		level.Warn(logger).Log("message", "ES_INDEX_COLUMN is ignored when ES_INDEX_STATIC is set", "index_column", config.IndexColumn)
+	}
+	return basicCodec{logger: logger, config: config, now: time.Now, ingestedAtWarnings: &sync.Map{}, indexTimeWarnings: &sync.Map{}}
 }
 
 func (c basicCodec) EncodeElasticRecords(records []*models.Record) ([]*models.ElasticRecord, error) {
 	elasticRecords := make([]*models.ElasticRecord, len(records))
+	var uncoercible *UncoercibleError
 	for idx, record := range records {
 		index, err := c.getDatabaseIndex(record)
+		if err == errSkipRecord {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		if c.config.SanitizeIndex {
+			if index, err = sanitizeIndexName(index); err != nil {
+				return nil, err
+			}
+		}
 
 		docID, err := c.getDatabaseDocID(record)
+		if err == errSkipRecord {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		routing, err := c.getDatabaseRouting(record)
 		if err != nil {
 			return nil, err
 		}
 
+		version, err := c.getDatabaseVersion(record)
+		if err != nil {
+			return nil, err
+		}
+
+		parentID, isChild := c.getJoinParent(record)
+		if isChild {
+			// children live in the shard of their parent
+			routing = parentID
+		}
+
+		if record.Deleted {
+			elasticRecords[idx] = &models.ElasticRecord{
+				Index:   index,
+				Type:    record.Topic,
+				ID:      docID,
+				Routing: routing,
+				Version: version,
+				Deleted: true,
+			}
+			continue
+		}
+
+		document, err := c.getDatabaseDocument(record)
+		coercionErr, isCoercionErr := err.(*models.CoercionError)
+		switch {
+		case isCoercionErr && c.config.CoercionErrors == CoercionErrorsSkip:
+			c.skipUncoercible(record, coercionErr)
+			continue
+		case isCoercionErr && c.config.CoercionErrors == CoercionErrorsDeadLetter:
+			// the document is built uncoerced for the dead letter queue
+		case err != nil:
+			return nil, err
+		}
+		if c.config.JoinField != "" {
+			document[c.config.JoinField] = c.joinRelation(parentID, isChild)
+		}
 		elasticRecords[idx] = &models.ElasticRecord{
-			Index: index,
-			Type:  record.Topic,
-			ID:    docID,
-			Json:  record.FilteredFieldsJSON(c.config.BlacklistedColumns),
+			Index:    index,
+			Type:     record.Topic,
+			ID:       docID,
+			Routing:  routing,
+			Pipeline: c.getDatabasePipeline(record),
+			Version:  version,
+			Json:     document,
+		}
+		if c.config.BulkAction == BulkActionScript {
+			script := c.config.scriptFor(record.Topic)
+			if script == "" {
+				return nil, fmt.Errorf("no script to update the documents of topic %s", record.Topic)
+			}
+			elasticRecords[idx].Script = script
+			elasticRecords[idx].Upsert = c.config.scriptUpsertFor(record.Topic)
+		}
+		if isCoercionErr {
+			if uncoercible == nil {
+				uncoercible = &UncoercibleError{}
+			}
+			uncoercible.Records = append(uncoercible.Records, UncoercibleRecord{
+				Position: idx,
+				Document: elasticRecords[idx],
+				Failure: Failure{
+					Index:    index,
+					DocID:    docID,
+					Pipeline: elasticRecords[idx].Pipeline,
+					Type:     FailureCoercionError,
+					Reason:   coercionErr.Error(),
+				},
+			})
+			elasticRecords[idx] = nil
 		}
 	}
 
+	if uncoercible != nil {
+		return elasticRecords, uncoercible
+	}
 	return elasticRecords, nil
 }
 
 func (c basicCodec) getDatabaseIndex(record *models.Record) (string, error) {
-	indexPrefix := c.config.Index
+	indexPrefix := c.config.indexFor(record.Topic)
 	if indexPrefix == "" {
 		indexPrefix = record.Topic
 	}
 
+	if c.config.StaticIndex {
+		// usually a write alias, rolled over by ILM
+		return indexPrefix, nil
+	}
+
+	record = c.withIndexTime(record)
 	indexColumn := c.config.IndexColumn
-	indexSuffix := record.FormatTimestampDay()
-	if c.config.TimeSuffix == TimeSuffixHour {
-		indexSuffix = record.FormatTimestampHour()
+	indexSuffix := c.getTimeSuffix(record)
+	if indexColumn == "" && (c.config.DataStream || indexSuffix == "") {
+		// nothing to append, data streams roll over their backing indices themselves
+		return indexPrefix, nil
+	}
+	indexColumnValue, _ := record.GetField(indexColumn)
+	if _, isTime := indexColumnValue.(time.Time); indexColumn != "" && (c.config.IndexColumnIsTime || isTime) {
+		// avro timestamps are formatted like the record timestamp, even without ES_INDEX_COLUMN_IS_TIMESTAMP
+		if columnSuffix := c.getColumnTimeSuffix(record); columnSuffix != "" {
+			return fmt.Sprintf("%s-%s", indexPrefix, columnSuffix), nil
+		}
+		return indexPrefix, nil
 	}
 	if indexColumn != "" {
 		newIndexSuffix, err := record.GetValueForField(indexColumn)
 		if err != nil {
+			switch c.config.MissingIndex {
+			case MissingColumnSkip:
+				return "", c.skipRecord(record, indexColumn, err)
+			case MissingColumnFallback:
+				// the index the record would have without an index column
+				if c.config.DataStream || indexSuffix == "" {
+					return indexPrefix, nil
+				}
+				return fmt.Sprintf("%s-%s", indexPrefix, indexSuffix), nil
+			}
 			level.Error(c.logger).Log("err", err, "message", "Could not get column value from record.")
 			return "", err
 		}
@@ -68,17 +229,419 @@ func (c basicCodec) getDatabaseIndex(record *models.Record) (string, error) {
 	return fmt.Sprintf("%s-%s", indexPrefix, indexSuffix), nil
 }
 
+// withIndexTime is the record with the timestamp of its index suffix, taken from the index time source. Records
+// without a usable time for it fall back to their kafka timestamp, and to the processing time when the broker
+// set none.
+func (c basicCodec) withIndexTime(record *models.Record) *models.Record {
+	indexed := *record
+	switch c.config.IndexTimeSource {
+	case IndexTimeProcessingTime:
+		indexed.Timestamp = c.clock()
+		return &indexed
+	case IndexTimeRecordField:
+		field, _ := record.GetField(c.config.IndexTimeField)
+		ts, err := parseColumnTime(field, c.config.IndexColumnFormat)
+		if err == nil {
+			indexed.Timestamp = ts
+			return &indexed
+		}
+		c.warnIndexTime(record, "Could not parse the index time field, using the kafka timestamp.", "err", err, "index_time_field", c.config.IndexTimeField)
+	}
+	// brokers send -1 for the messages produced without timestamp, and they are zero before kafka 0.10
+	if record.Timestamp.Unix() <= 0 {
+		c.warnIndexTime(record, "Record has no kafka timestamp, using the processing time.")
+		indexed.Timestamp = c.clock()
+	}
+	return &indexed
+}
+
+type indexTimeWarning struct {
+	topic   string
+	message string
+}
+
+// warnIndexTime warns once per topic about records without their index time, they are usually all alike.
+func (c basicCodec) warnIndexTime(record *models.Record, message string, keyvals ...interface{}) {
+	warned := false
+	if c.indexTimeWarnings != nil {
+		_, warned = c.indexTimeWarnings.LoadOrStore(indexTimeWarning{record.Topic, message}, true)
+	}
+	if !warned {
+		level.Warn(c.logger).Log(append([]interface{}{"message", message, "topic", record.Topic, "offset", record.Offset}, keyvals...)...)
+	}
+}
+
+func (c basicCodec) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+// getColumnTimeSuffix formats the time held by the index column like the record timestamp would be,
+// falling back to the record timestamp when the column can't be parsed.
+func (c basicCodec) getColumnTimeSuffix(record *models.Record) string {
+	column, _ := record.GetField(c.config.IndexColumn)
+	ts, err := parseColumnTime(column, c.config.IndexColumnFormat)
+	if err != nil {
+		level.Warn(c.logger).Log(
+			"err", err,
+			"message", "Could not parse index column as a timestamp, using the record timestamp.",
+			"index_column", c.config.IndexColumn,
+		)
+		return c.getTimeSuffix(record)
+	}
+	columnRecord := *record
+	columnRecord.Timestamp = ts
+	return c.getTimeSuffix(&columnRecord)
+}
+
+func parseColumnTime(value interface{}, format ColumnTimeFormat) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		if format == ColumnTimeRFC3339 {
+			return time.Parse(time.RFC3339Nano, v)
+		}
+	}
+	epoch, err := parseColumnInt(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch format {
+	case ColumnTimeEpochSeconds:
+		return time.Unix(epoch, 0), nil
+	case ColumnTimeEpochMillis:
+		return time.Unix(0, epoch*int64(time.Millisecond)), nil
+	default:
+		return time.Time{}, fmt.Errorf("expected a rfc3339 string, got %v", value)
+	}
+}
+
+func parseColumnInt(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, errors.New("column is missing")
+	case int64:
+		return v, nil
+	case int32:
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	case json.Number:
+		if epoch, err := v.Int64(); err == nil {
+			return epoch, nil
+		}
+		epoch, err := v.Float64()
+		return int64(epoch), err
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("unsupported column type %T", value)
+	}
+}
+
+func (c basicCodec) getTimeSuffix(record *models.Record) string {
+	if c.config.TimeLayout != "" {
+		return record.FormatTimestamp(c.config.TimeLayout, c.config.TimeZone)
+	}
+	return c.formatTimeSuffix(record, c.config.TimeSuffix)
+}
+
+func (c basicCodec) formatTimeSuffix(record *models.Record, suffix TimeIndexSuffix) string {
+	loc := c.config.TimeZone
+	switch suffix {
+	case TimeSuffixHour:
+		return record.FormatTimestamp(models.LayoutHour, loc)
+	case TimeSuffixWeek:
+		return record.FormatTimestampWeek(loc)
+	case TimeSuffixMonth:
+		return record.FormatTimestamp(models.LayoutMonth, loc)
+	case TimeSuffixNone:
+		return ""
+	default:
+		return record.FormatTimestamp(models.LayoutDay, loc)
+	}
+}
+
+// EncodeExtraIndices copies the documents of the records to each of the extra indices, with the same id. It
+// returns one slice of documents per extra index, aligned with the records. Their time suffixes come from the
+// index time source, like the one of the primary index.
+func (c basicCodec) EncodeExtraIndices(documents []*models.ElasticRecord, records []*models.Record) ([][]*models.ElasticRecord, error) {
+	if len(c.config.ExtraIndices) == 0 {
+		return nil, nil
+	}
+	indexed := make([]*models.Record, len(documents))
+	for idx := range documents {
+		indexed[idx] = c.withIndexTime(records[idx])
+	}
+	targets := make([][]*models.ElasticRecord, len(c.config.ExtraIndices))
+	for targetIdx, target := range c.config.ExtraIndices {
+		copies := make([]*models.ElasticRecord, len(documents))
+		for idx, document := range documents {
+			index := target.Prefix
+			if suffix := c.formatTimeSuffix(indexed[idx], target.Suffix); suffix != "" {
+				index = fmt.Sprintf("%s-%s", target.Prefix, suffix)
+			}
+			if c.config.SanitizeIndex {
+				var err error
+				if index, err = sanitizeIndexName(index); err != nil {
+					return nil, err
+				}
+			}
+			documentCopy := *document
+			documentCopy.Index = index
+			copies[idx] = &documentCopy
+		}
+		targets[targetIdx] = copies
+	}
+	return targets, nil
+}
+
 func (c basicCodec) getDatabaseDocID(record *models.Record) (string, error) {
+	docID, err := c.getRawDocID(record)
+	if err != nil {
+		return "", err
+	}
+	switch c.config.DocIDHash {
+	case DocIDHashSHA256:
+		sum := sha256.Sum256([]byte(docID))
+		return hex.EncodeToString(sum[:]), nil
+	case DocIDHashMurmur3:
+		return hex.EncodeToString(murmur3Digest([]byte(docID))), nil
+	default:
+		return docID, nil
+	}
+}
+
+func (c basicCodec) getRawDocID(record *models.Record) (string, error) {
 	docID := record.GetId()
 
-	docIDColumn := c.config.DocIDColumn
+	docIDColumn := c.config.docIDColumnFor(record.Topic)
+	if record.Deleted && len(record.Key) == 0 && (docIDColumn == "" || docIDColumn == models.KeyColumn) {
+		// the partition and offset of a tombstone don't identify any document, only its key does
+		return "", fmt.Errorf("tombstone without key at %s", record.GetId())
+	}
+	if docIDColumn == "" && record.Deleted {
+		// the key as the key column reads it, avro keys without their wire format header
+		return record.GetKeyValue(), nil
+	}
 	if docIDColumn != "" {
-		newDocID, err := record.GetValueForField(docIDColumn)
-		if err != nil {
-			level.Error(c.logger).Log("err", err, "message", "Could not get doc id value from record.")
-			return "", err
+		// composite ids join their columns in the configured order
+		columns := splitList(docIDColumn)
+		values := make([]string, len(columns))
+		for idx, column := range columns {
+			value, err := record.GetValueForField(column)
+			if err != nil {
+				switch c.config.MissingDocID {
+				case MissingColumnSkip:
+					return "", c.skipRecord(record, column, err)
+				case MissingColumnFallback:
+					if record.Deleted {
+						// the partition and offset of a tombstone don't identify the document to delete
+						return "", c.skipRecord(record, column, err)
+					}
+					return docID, nil
+				}
+				level.Error(c.logger).Log("err", err, "message", "Could not get doc id value from record.")
+				return "", err
+			}
+			values[idx] = value
 		}
-		docID = newDocID
+		docID = strings.Join(values, c.config.DocIDSeparator)
 	}
 	return docID, nil
 }
+
+func (c basicCodec) skipRecord(record *models.Record, column string, err error) error {
+	level.Warn(c.logger).Log(
+		"message", "skipping record missing a column",
+		"column", column,
+		"topic", record.Topic,
+		"partition", record.Partition,
+		"offset", record.Offset,
+		"err", err,
+	)
+	return errSkipRecord
+}
+
+func (c basicCodec) skipUncoercible(record *models.Record, err *models.CoercionError) {
+	level.Warn(c.logger).Log(
+		"message", "skipping record with a field that can't be coerced",
+		"field", err.Field,
+		"topic", record.Topic,
+		"partition", record.Partition,
+		"offset", record.Offset,
+		"err", err,
+	)
+}
+
+func (c basicCodec) getDatabaseRouting(record *models.Record) (string, error) {
+	routingColumn := c.config.RoutingColumn
+	if routingColumn == "" {
+		return "", nil
+	}
+	routing, err := record.GetValueForField(routingColumn)
+	if err != nil {
+		if c.config.MissingRouting == MissingRoutingDefault {
+			return "", nil
+		}
+		level.Error(c.logger).Log("err", err, "message", "Could not get routing value from record.")
+		return "", err
+	}
+	return routing, nil
+}
+
+func (c basicCodec) getDatabasePipeline(record *models.Record) string {
+	if pipeline, ok := c.config.TopicPipelines[record.Topic]; ok {
+		return pipeline
+	}
+	return c.config.Pipeline
+}
+
+// getDatabaseDocument is the filtered record with its fields masked, renamed, coerced and flattened, and its geo
+// points assembled. Columns like the index and doc id ones refer to the fields of the record, so they keep their
+// original names, while the coercions refer to the renamed fields, nested ones by their path before flattening.
+// With the dead-letter policy of CoercionErrors, the document of a record whose fields can't be
+// coerced is returned uncoerced along with the *models.CoercionError.
+func (c basicCodec) getDatabaseDocument(record *models.Record) (map[string]interface{}, error) {
+	var document map[string]interface{}
+	if len(c.config.WhitelistedColumns) > 0 {
+		document = record.WhitelistedFieldsJSON(c.config.WhitelistedColumns)
+	} else {
+		document = record.FilteredFieldsJSON(c.config.blacklistedColumnsFor(record.Topic))
+	}
+	if len(c.config.MaskedColumns) > 0 {
+		models.MaskFields(document, c.config.MaskedColumns, c.config.MaskSalt)
+	}
+	if err := models.RenameFields(document, c.config.FieldRenames); err != nil {
+		level.Error(c.logger).Log("err", err, "message", "Could not rename record fields.")
+		return nil, err
+	}
+	var coercionErr error
+	if len(c.config.FieldCoercions) > 0 {
+		if coercionErr = models.CoerceFields(document, c.config.FieldCoercions); coercionErr != nil {
+			if c.config.CoercionErrors == CoercionErrorsFail {
+				level.Error(c.logger).Log("err", coercionErr, "message", "Could not coerce record fields.")
+			}
+			if c.config.CoercionErrors != CoercionErrorsDeadLetter {
+				return nil, coercionErr
+			}
+		}
+	}
+	if c.config.FlattenNested {
+		for _, path := range models.FlattenFields(document, c.config.FlattenMaxDepth, c.config.FlattenArrays) {
+			level.Warn(c.logger).Log("message", "flattened fields collide, keeping the first one", "field", path, "topic", record.Topic, "offset", record.Offset)
+		}
+	}
+	if len(c.config.GeoPointFields) > 0 {
+		models.AddGeoPoints(document, c.config.GeoPointFields, c.config.RemoveGeoSources)
+	}
+	if len(c.config.HeaderFields) > 0 {
+		c.addHeaderFields(record, document)
+	}
+	if c.config.KafkaMetadata {
+		c.addKafkaMetadata(record, document)
+	}
+	if c.config.IngestedAtField != "" {
+		c.addIngestedAt(record, document)
+	}
+	if c.config.DataStream {
+		if _, ok := document[dataStreamTimestampField]; !ok {
+			document[dataStreamTimestampField] = record.FormatTimestamp(dataStreamTimestampLayout, nil)
+		}
+	}
+	return document, coercionErr
+}
+
+// getJoinParent is the parent id of a child record of a join field, records without it are parents.
+func (c basicCodec) getJoinParent(record *models.Record) (string, bool) {
+	if c.config.JoinField == "" {
+		return "", false
+	}
+	parentID, err := record.GetValueForField(c.config.JoinParentColumn)
+	if err != nil || parentID == "" {
+		return "", false
+	}
+	return parentID, true
+}
+
+func (c basicCodec) joinRelation(parentID string, isChild bool) interface{} {
+	if !isChild {
+		return c.config.JoinParentName
+	}
+	return map[string]interface{}{"name": c.config.JoinChildName, "parent": parentID}
+}
+
+// addKafkaMetadata adds the topic, partition, offset and timestamp of the record to its document. Fields
+// of the record with the same names are kept.
+func (c basicCodec) addKafkaMetadata(record *models.Record, document map[string]interface{}) {
+	prefix := c.config.MetadataPrefix
+	metadata := map[string]interface{}{
+		prefix + "topic":     record.Topic,
+		prefix + "partition": record.Partition,
+		prefix + "offset":    record.Offset,
+		prefix + "timestamp": record.FormatTimestamp(dataStreamTimestampLayout, nil),
+	}
+	for field, value := range metadata {
+		if _, exists := document[field]; exists {
+			level.Warn(c.logger).Log("message", "record field has the name of a kafka metadata field, keeping the record field", "field", field)
+			continue
+		}
+		document[field] = value
+	}
+}
+
+// addHeaderFields copies the configured kafka headers of the record to its document. Headers the record doesn't
+// have are left out, and fields of the record with the same names are kept.
+func (c basicCodec) addHeaderFields(record *models.Record, document map[string]interface{}) {
+	for header, field := range c.config.HeaderFields {
+		value, ok := record.Headers[header]
+		if !ok {
+			continue
+		}
+		if _, exists := document[field]; exists {
+			level.Warn(c.logger).Log("message", "record field has the name of a header field, keeping the record field", "field", field, "header", header)
+			continue
+		}
+		document[field] = value
+	}
+}
+
+// addIngestedAt stamps the document with the time it is written at, unless the record has a field with the same name.
+func (c basicCodec) addIngestedAt(record *models.Record, document map[string]interface{}) {
+	field := c.config.IngestedAtField
+	if _, exists := document[field]; exists {
+		warned := false
+		if c.ingestedAtWarnings != nil {
+			_, warned = c.ingestedAtWarnings.LoadOrStore(record.Topic, true)
+		}
+		if !warned {
+			level.Warn(c.logger).Log("message", "records already have the ingestion timestamp field, keeping the record field", "field", field, "topic", record.Topic)
+		}
+		return
+	}
+	document[field] = c.clock().UTC().Format(dataStreamTimestampLayout)
+}
+
+// getDatabaseVersion is the external version of the document, the record offset unless a version column
+// is set. Offsets only grow within a partition, so they only version documents whose ids don't span partitions.
+func (c basicCodec) getDatabaseVersion(record *models.Record) (int64, error) {
+	if !c.config.ExternalVersion {
+		return 0, nil
+	}
+	versionColumn := c.config.VersionColumn
+	if versionColumn == "" {
+		return record.Offset, nil
+	}
+	column, _ := record.GetField(versionColumn)
+	version, err := parseColumnInt(column)
+	if err != nil {
+		level.Error(c.logger).Log("err", err, "message", "Could not get version value from record.", "version_column", versionColumn)
+		return 0, err
+	}
+	return version, nil
+}
@@ -1,8 +1,10 @@
 package elasticsearch
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -53,6 +55,112 @@ func TestCodec_EncodeElasticRecordsHourSuffix(t *testing.T) {
 	}
 }
 
+func TestCodec_EncodeElasticRecords_Tombstone(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{},
+		logger: codecLogger,
+	}
+	record := &models.Record{
+		Topic:     "my-topic",
+		Partition: 1,
+		Offset:    10,
+		Timestamp: time.Now(),
+		Key:       []byte("user-42"),
+		Deleted:   true,
+		Json:      map[string]interface{}{},
+	}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		elasticRecord := elasticRecords[0]
+		assert.Equal(t, fmt.Sprintf("%s-%s", record.Topic, record.FormatTimestampDay()), elasticRecord.Index)
+		assert.Equal(t, "user-42", elasticRecord.ID)
+		assert.True(t, elasticRecord.Deleted)
+		assert.Nil(t, elasticRecord.Json)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_TombstoneAvroKey(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{},
+		logger: codecLogger,
+	}
+	// the magic byte and schema id 7 of the schema registry, then the avro string "user-42"
+	key := append([]byte{0, 0, 0, 0, 7, 14}, "user-42"...)
+	record := &models.Record{
+		Topic:     "my-topic",
+		Timestamp: time.Now(),
+		Key:       key,
+		KeyString: "user-42",
+		Deleted:   true,
+		Json:      map[string]interface{}{},
+	}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "user-42", elasticRecords[0].ID)
+		assert.True(t, elasticRecords[0].Deleted)
+	}
+
+	// keys whose schema can't be found are encoded like the key column does
+	record.KeyString = ""
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, base64.StdEncoding.EncodeToString(key), elasticRecords[0].ID)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_TombstoneDocIDColumn(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{DocIDColumn: "id"},
+		logger: codecLogger,
+	}
+	record := &models.Record{
+		Topic:     "my-topic",
+		Timestamp: time.Now(),
+		Key:       []byte(`{"id":"42"}`),
+		Deleted:   true,
+		Json:      map[string]interface{}{"id": "42"},
+	}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "42", elasticRecords[0].ID)
+		assert.True(t, elasticRecords[0].Deleted)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_TombstoneWithoutKey(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{},
+		logger: codecLogger,
+	}
+	record := &models.Record{Topic: "my-topic", Timestamp: time.Now(), Deleted: true}
+
+	_, err := codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+}
+
+func TestCodec_EncodeElasticRecords_KeyColumn(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{DocIDColumn: models.KeyColumn, RoutingColumn: models.KeyColumn},
+		logger: codecLogger,
+	}
+	keyed, _, _ := fixtures.NewRecord(time.Now())
+	keyed.Key = []byte("user-42")
+	unkeyed, _, _ := fixtures.NewRecord(time.Now())
+	tombstone := &models.Record{Topic: "my-topic", Timestamp: time.Now(), Deleted: true}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{keyed, unkeyed})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "user-42", elasticRecords[0].ID)
+		assert.Equal(t, "user-42", elasticRecords[0].Routing)
+		assert.Equal(t, unkeyed.GetId(), elasticRecords[1].ID)
+	}
+	_, err = codec.EncodeElasticRecords([]*models.Record{tombstone})
+	assert.Error(t, err)
+}
+
 func TestCodec_EncodeElasticRecords_ColumnsBlacklist(t *testing.T) {
 	codec := &basicCodec{
 		config: Config{BlacklistedColumns: []string{"value"}},
@@ -119,3 +227,809 @@ func TestCodec_EncodeElasticRecords_InexistentDocIDColumn(t *testing.T) {
 	_, err := codec.EncodeElasticRecords([]*models.Record{record})
 	assert.Error(t, err)
 }
+
+func TestCodec_EncodeElasticRecords_CompositeDocIDColumn(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{DocIDColumn: "value, id", DocIDSeparator: ":"},
+		logger: codecLogger,
+	}
+	record, id, value := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, fmt.Sprintf("%d:%d", value, id), elasticRecords[0].ID)
+	}
+
+	codec.config.DocIDColumn = "id,account_id"
+	_, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "account_id")
+	}
+}
+
+func TestCodec_EncodeElasticRecords_DocIDHash(t *testing.T) {
+	record := &models.Record{
+		Topic:     "my-topic",
+		Partition: 1,
+		Offset:    42,
+		Timestamp: time.Now(),
+		Json:      map[string]interface{}{"user": "user-42", "url": "https://example.com/a/very/long/url"},
+	}
+	// changing any of these changes the id of every indexed document
+	for _, tc := range []struct {
+		config   Config
+		expected string
+	}{
+		{Config{DocIDHash: DocIDHashSHA256}, "1d446b526abebc35f726a6a21c25ffadbdf6be216b6e6a29877c95b25c1a1f51"},
+		{Config{DocIDHash: DocIDHashSHA256, DocIDColumn: "user,url", DocIDSeparator: ":"}, "6ce54d3566494405bd52ce02b06560c8d7ab672b7642e0490108f14f63c67706"},
+		{Config{DocIDHash: DocIDHashMurmur3}, "5f572047d6e1d21b243f674dbefbfc6f"},
+	} {
+		codec := &basicCodec{config: tc.config, logger: codecLogger}
+		elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+		if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+			assert.Equal(t, tc.expected, elasticRecords[0].ID)
+		}
+	}
+}
+
+func TestCodec_EncodeElasticRecords_RoutingColumn(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{RoutingColumn: "id"},
+		logger: codecLogger,
+	}
+	record, id, _ := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, strconv.Itoa(int(id)), elasticRecords[0].Routing)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_MissingRoutingColumn(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	codec := &basicCodec{
+		config: Config{RoutingColumn: "tenant"},
+		logger: codecLogger,
+	}
+	_, err := codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+
+	codec.config.MissingRouting = MissingRoutingDefault
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Empty(t, elasticRecords[0].Routing)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_MissingDocIDColumn(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	codec := &basicCodec{
+		config: Config{DocIDColumn: "user_id"},
+		logger: codecLogger,
+	}
+	_, err := codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+
+	codec.config.MissingDocID = MissingColumnSkip
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Nil(t, elasticRecords[0])
+	}
+
+	codec.config.MissingDocID = MissingColumnFallback
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, record.GetId(), elasticRecords[0].ID)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_MissingIndexColumn(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	codec := &basicCodec{
+		config: Config{IndexColumn: "campaign_id"},
+		logger: codecLogger,
+	}
+	_, err := codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+
+	codec.config.MissingIndex = MissingColumnSkip
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Nil(t, elasticRecords[0])
+	}
+
+	codec.config.MissingIndex = MissingColumnFallback
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, fmt.Sprintf("%s-%s", record.Topic, record.FormatTimestampDay()), elasticRecords[0].Index)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_JoinField(t *testing.T) {
+	config := Config{
+		DocIDColumn:      "id",
+		TimeSuffix:       TimeSuffixNone,
+		BulkAction:       BulkActionUpsert,
+		JoinField:        "relation",
+		JoinParentName:   "order",
+		JoinChildName:    "line",
+		JoinParentColumn: "order_id",
+	}
+	codec := &basicCodec{config: config, logger: codecLogger}
+	order := &models.Record{Topic: "orders", Json: map[string]interface{}{"id": "o1"}}
+	line := &models.Record{Topic: "orders", Json: map[string]interface{}{"id": "l1", "order_id": "o1"}}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{order, line})
+	if !assert.NoError(t, err) || !assert.Len(t, elasticRecords, 2) {
+		return
+	}
+	assert.Equal(t, "order", elasticRecords[0].Json["relation"])
+	assert.Empty(t, elasticRecords[0].Routing)
+	assert.Equal(t, map[string]interface{}{"name": "line", "parent": "o1"}, elasticRecords[1].Json["relation"])
+	assert.Equal(t, "o1", elasticRecords[1].Routing)
+
+	d := newRecordDatabase(codecLogger, config)
+	for idx, expected := range [][]string{
+		{
+			`{"update":{"_index":"orders","_type":"orders","_id":"o1","retry_on_conflict":0}}`,
+			`{"doc":{"id":"o1","relation":"order"},"doc_as_upsert":true}`,
+		},
+		{
+			`{"update":{"_index":"orders","_type":"orders","_id":"l1","retry_on_conflict":0,"routing":"o1"}}`,
+			`{"doc":{"id":"l1","order_id":"o1","relation":{"name":"line","parent":"o1"}},"doc_as_upsert":true}`,
+		},
+	} {
+		request, err := d.bulkableRequest(elasticRecords[idx])
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, source)
+			}
+		}
+	}
+}
+
+func TestCodec_EncodeElasticRecords_Script(t *testing.T) {
+	views := "ctx._source.views += 1"
+	codec := &basicCodec{
+		config: Config{
+			BulkAction:   BulkActionScript,
+			Script:       "ctx._source.count += params.count",
+			ScriptUpsert: map[string]interface{}{"count": 0},
+			TopicConfigs: map[string]TopicConfig{
+				"views": {Script: &views, ScriptUpsert: map[string]interface{}{"views": 0}},
+			},
+		},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	view, _, _ := fixtures.NewRecord(time.Now())
+	view.Topic = "views"
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record, view})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "ctx._source.count += params.count", elasticRecords[0].Script)
+		assert.Equal(t, map[string]interface{}{"count": 0}, elasticRecords[0].Upsert)
+		assert.Equal(t, views, elasticRecords[1].Script)
+		assert.Equal(t, map[string]interface{}{"views": 0}, elasticRecords[1].Upsert)
+	}
+
+	codec.config.Script = ""
+	_, err = codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+}
+
+func TestCodec_EncodeElasticRecords_Pipeline(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{Pipeline: "geoip", TopicPipelines: map[string]string{"raw": ""}},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	rawRecord, _, _ := fixtures.NewRecord(time.Now())
+	rawRecord.Topic = "raw"
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record, rawRecord})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "geoip", elasticRecords[0].Pipeline)
+		assert.Empty(t, elasticRecords[1].Pipeline)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_DataStream(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{Index: "logs-app-default", DataStream: true},
+		logger: codecLogger,
+	}
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	record, _, _ := fixtures.NewRecord(ts)
+	withTimestamp, _, _ := fixtures.NewRecord(ts)
+	withTimestamp.Json["@timestamp"] = "2018-01-01T00:00:00.000Z"
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record, withTimestamp})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "logs-app-default", elasticRecords[0].Index)
+		assert.Equal(t, "2018-01-02T03:04:05.006Z", elasticRecords[0].Json["@timestamp"])
+		assert.Equal(t, "2018-01-01T00:00:00.000Z", elasticRecords[1].Json["@timestamp"])
+	}
+}
+
+func TestCodec_EncodeElasticRecords_StaticIndex(t *testing.T) {
+	codec := NewCodec(codecLogger, Config{Index: "events-write", IndexColumn: "id", StaticIndex: true})
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "events-write", elasticRecords[0].Index)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_TimeSuffix(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC))
+	for timeSuffix, expected := range map[TimeIndexSuffix]string{
+		TimeSuffixHour:  "prefix-2018-03-05-14",
+		TimeSuffixDay:   "prefix-2018-03-05",
+		TimeSuffixWeek:  "prefix-2018-w10",
+		TimeSuffixMonth: "prefix-2018-03",
+		TimeSuffixNone:  "prefix",
+	} {
+		codec := &basicCodec{
+			config: Config{Index: "prefix", TimeSuffix: timeSuffix},
+			logger: codecLogger,
+		}
+		elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+		if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+			assert.Equal(t, expected, elasticRecords[0].Index)
+		}
+	}
+}
+
+func TestCodec_EncodeElasticRecords_TimeLayoutAndZone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if !assert.NoError(t, err) {
+		return
+	}
+	codec := &basicCodec{
+		config: Config{Index: "prefix", TimeLayout: "2006.01.02", TimeZone: newYork},
+		logger: codecLogger,
+	}
+	// around the daylight saving changes a fixed offset would put these records in the wrong day
+	for ts, expected := range map[time.Time]string{
+		time.Date(2018, 3, 11, 4, 30, 0, 0, time.UTC): "prefix-2018.03.10", // 23:30 EST
+		time.Date(2018, 3, 11, 5, 30, 0, 0, time.UTC): "prefix-2018.03.11", // 00:30 EST
+		time.Date(2018, 11, 4, 3, 30, 0, 0, time.UTC): "prefix-2018.11.03", // 23:30 EDT
+		time.Date(2018, 11, 4, 4, 30, 0, 0, time.UTC): "prefix-2018.11.04", // 00:30 EDT
+	} {
+		record, _, _ := fixtures.NewRecord(ts)
+		elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+		if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+			assert.Equal(t, expected, elasticRecords[0].Index)
+		}
+	}
+}
+
+func TestCodec_EncodeElasticRecords_TimeZoneUTC(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{Index: "prefix", TimeZone: time.UTC},
+		logger: codecLogger,
+	}
+	saoPaulo := time.FixedZone("BRT", -3*60*60)
+	record, _, _ := fixtures.NewRecord(time.Date(2018, 3, 5, 22, 0, 0, 0, saoPaulo))
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "prefix-2018-03-06", elasticRecords[0].Index)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IndexColumnTimestamp(t *testing.T) {
+	ts := time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC)
+	for format, value := range map[ColumnTimeFormat]interface{}{
+		ColumnTimeEpochMillis:  ts.UnixNano() / int64(time.Millisecond),
+		ColumnTimeEpochSeconds: float64(ts.Unix()),
+		ColumnTimeRFC3339:      "2018-03-05T14:30:00Z",
+	} {
+		codec := &basicCodec{
+			config: Config{Index: "events", IndexColumn: "created_at", IndexColumnIsTime: true, IndexColumnFormat: format, TimeZone: time.UTC},
+			logger: codecLogger,
+		}
+		record, _, _ := fixtures.NewRecord(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		record.Json["created_at"] = value
+
+		elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+		if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+			assert.Equal(t, "events-2018-03-05", elasticRecords[0].Index)
+		}
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IndexColumnAvroTimestamp(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{Index: "events", IndexColumn: "created_at", TimeSuffix: TimeSuffixMonth, TimeZone: time.UTC},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	// decoded from a timestamp-millis field
+	record.Json["created_at"] = time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC)
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "events-2018-03", elasticRecords[0].Index)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IndexColumnTimestampFallback(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{Index: "events", IndexColumn: "created_at", IndexColumnIsTime: true},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	record.Json["created_at"] = "yesterday"
+	missing, _, _ := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record, missing})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "events-"+record.FormatTimestampDay(), elasticRecords[0].Index)
+		assert.Equal(t, "events-"+missing.FormatTimestampDay(), elasticRecords[1].Index)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IndexTimeSource(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	replayed, _, _ := fixtures.NewRecord(time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC))
+	replayed.Json["occurred_at"] = "2018-03-01T10:00:00Z"
+
+	for source, expected := range map[IndexTimeSource]string{
+		IndexTimeKafkaTimestamp: "events-2018-03-05",
+		IndexTimeRecordField:    "events-2018-03-01",
+		IndexTimeProcessingTime: "events-2021-06-01",
+	} {
+		codec := &basicCodec{
+			config: Config{Index: "events", IndexTimeSource: source, IndexTimeField: "occurred_at", IndexColumnFormat: ColumnTimeRFC3339},
+			logger: codecLogger,
+			now:    clock,
+		}
+		elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{replayed})
+		if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+			assert.Equal(t, expected, elasticRecords[0].Index)
+		}
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IndexTimeFieldPath(t *testing.T) {
+	config, err := NewConfigFrom(func(name string) (string, bool) {
+		value, ok := map[string]string{
+			"ES_INDEX":                         "events",
+			"ES_INDEX_TIME_SOURCE":             "record_field",
+			"ES_INDEX_TIME_FIELD":              "event.occurred_at",
+			"ES_INDEX_COLUMN_TIMESTAMP_FORMAT": "rfc3339",
+		}[name]
+		return value, ok
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	codec := &basicCodec{config: config, logger: codecLogger, indexTimeWarnings: &sync.Map{}}
+	// 23:59 in the time zone of the producer, 02:59 UTC of the next day
+	record, _, _ := fixtures.NewRecord(time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC))
+	record.Json["event"] = map[string]interface{}{"occurred_at": "2021-03-14T23:59:00-03:00"}
+	// records without the field fall back to their kafka timestamp
+	missing, _, _ := fixtures.NewRecord(time.Date(2021, 3, 1, 23, 59, 0, 0, time.FixedZone("BRT", -3*60*60)))
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record, missing})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "events-2021-03-15", elasticRecords[0].Index)
+		assert.Equal(t, "events-2021-03-02", elasticRecords[1].Index)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_FieldCoercionsRenamedAndFlattened(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	record.Json["usr_id_v2"] = "42"
+	record.Json["legacy_amount"] = "10"
+	record.Json["user"] = map[string]interface{}{"age": "30"}
+	codec := &basicCodec{config: Config{
+		Index:         "events",
+		FieldRenames:  map[string]string{"usr_id_v2": "user_id", "legacy_amount": "amount"},
+		FlattenNested: true,
+		FieldCoercions: map[string]models.Coercion{
+			"user_id":       models.CoerceLong,
+			"legacy_amount": models.CoerceLong,
+			"user.age":      models.CoerceLong,
+		},
+	}, logger: codecLogger}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, int64(42), elasticRecords[0].Json["user_id"], "renamed fields are coerced by their new name")
+		assert.Equal(t, "10", elasticRecords[0].Json["amount"], "the original names of renamed fields are ignored")
+		assert.Equal(t, int64(30), elasticRecords[0].Json["user.age"], "nested fields are coerced by their path before flattening")
+	}
+}
+
+func TestCodec_EncodeElasticRecords_GeoPointFields(t *testing.T) {
+	located, _, _ := fixtures.NewRecord(time.Now())
+	located.Json["latitude"] = "-8.05"
+	located.Json["lon"] = -34.9
+	unlocated, _, _ := fixtures.NewRecord(time.Now())
+	unlocated.Json["latitude"] = nil
+	unlocated.Json["lon"] = -34.9
+	codec := &basicCodec{config: Config{
+		Index:            "events",
+		FieldRenames:     map[string]string{"latitude": "lat"},
+		FieldCoercions:   map[string]models.Coercion{"lat": models.CoerceDouble},
+		GeoPointFields:   map[string]models.GeoPoint{"location": {Lat: "lat", Lon: "lon"}},
+		RemoveGeoSources: true,
+	}, logger: codecLogger}
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{located, unlocated})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		// assembled after the renames and coercions
+		assert.Equal(t, map[string]interface{}{"lat": -8.05, "lon": -34.9}, elasticRecords[0].Json["location"])
+		assert.NotContains(t, elasticRecords[0].Json, "lat")
+		assert.NotContains(t, elasticRecords[0].Json, "lon")
+		assert.NotContains(t, elasticRecords[1].Json, "location")
+		assert.NotContains(t, elasticRecords[1].Json, "lon")
+	}
+}
+
+func TestCodec_EncodeElasticRecords_FieldCoercions(t *testing.T) {
+	coerced, _, _ := fixtures.NewRecord(time.Now())
+	coerced.Json["user_id"] = "42"
+	uncoercible, _, _ := fixtures.NewRecord(time.Now())
+	uncoercible.Json["user_id"] = "n/a"
+	config := Config{
+		Index:          "events",
+		FieldRenames:   map[string]string{"user_id": "uid"},
+		FieldCoercions: map[string]models.Coercion{"uid": models.CoerceLong},
+	}
+
+	codec := &basicCodec{config: config, logger: codecLogger}
+	_, err := codec.EncodeElasticRecords([]*models.Record{coerced, uncoercible})
+	assert.EqualError(t, err, `field uid can't be coerced to long: "n/a"`)
+
+	config.CoercionErrors = CoercionErrorsSkip
+	codec = &basicCodec{config: config, logger: codecLogger}
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{coerced, uncoercible})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		// coerced after the renames
+		assert.Equal(t, int64(42), elasticRecords[0].Json["uid"])
+		assert.Nil(t, elasticRecords[1])
+	}
+
+	config.CoercionErrors = CoercionErrorsDeadLetter
+	codec = &basicCodec{config: config, logger: codecLogger}
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{coerced, uncoercible})
+	uncoercibleErr, ok := err.(*UncoercibleError)
+	if assert.True(t, ok, "expected an UncoercibleError, got %v", err) && assert.Len(t, uncoercibleErr.Records, 1) {
+		assert.Equal(t, 1, uncoercibleErr.Records[0].Position)
+		assert.Equal(t, "n/a", uncoercibleErr.Records[0].Document.Json["uid"])
+		assert.Equal(t, Failure{
+			Index:  elasticRecords[0].Index,
+			DocID:  uncoercible.GetId(),
+			Type:   FailureCoercionError,
+			Reason: `field uid can't be coerced to long: "n/a"`,
+		}, uncoercibleErr.Records[0].Failure)
+	}
+	if assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, int64(42), elasticRecords[0].Json["uid"])
+		assert.Nil(t, elasticRecords[1])
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IndexTimeFallback(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	codec := &basicCodec{
+		config:            Config{Index: "events", IndexTimeSource: IndexTimeRecordField, IndexTimeField: "occurred_at"},
+		logger:            codecLogger,
+		now:               func() time.Time { return now },
+		indexTimeWarnings: &sync.Map{},
+	}
+	// the field can't be parsed, the kafka timestamp is used
+	unparsable, _, _ := fixtures.NewRecord(time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC))
+	unparsable.Json["occurred_at"] = "yesterday"
+	// no field nor timestamp, sent by the broker as -1
+	untimed, _, _ := fixtures.NewRecord(time.Unix(0, -int64(time.Millisecond)))
+	zero, _, _ := fixtures.NewRecord(time.Time{})
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{unparsable, untimed, zero})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 3) {
+		assert.Equal(t, "events-2018-03-05", elasticRecords[0].Index)
+		assert.Equal(t, "events-2021-06-01", elasticRecords[1].Index)
+		assert.Equal(t, "events-2021-06-01", elasticRecords[2].Index)
+	}
+	// the record keeps its timestamp
+	assert.True(t, zero.Timestamp.IsZero())
+}
+
+func TestCodec_EncodeElasticRecords_ExternalVersion(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	record.Json["updated_at"] = int64(1520260200000)
+
+	codec := &basicCodec{config: Config{ExternalVersion: true}, logger: codecLogger}
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, record.Offset, elasticRecords[0].Version)
+	}
+
+	codec.config.VersionColumn = "updated_at"
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, int64(1520260200000), elasticRecords[0].Version)
+	}
+
+	codec.config.VersionColumn = "missing"
+	_, err = codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+}
+
+func TestCodec_EncodeElasticRecords_TopicConfig(t *testing.T) {
+	noDocID := ""
+	codec := &basicCodec{
+		config: Config{
+			Index:              "events",
+			DocIDColumn:        "id",
+			BlacklistedColumns: []string{"value"},
+			TopicConfigs: map[string]TopicConfig{
+				"clicks": {Index: "clicks", DocIDColumn: &noDocID, BlacklistedColumns: []string{}},
+				"views":  {BlacklistedColumns: []string{"id"}},
+			},
+		},
+		logger: codecLogger,
+	}
+	click, _, _ := fixtures.NewRecord(time.Now())
+	click.Topic = "clicks"
+	view, viewID, _ := fixtures.NewRecord(time.Now())
+	view.Topic = "views"
+	other, otherID, _ := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{click, view, other})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 3) {
+		assert.Equal(t, fmt.Sprintf("clicks-%s", click.FormatTimestampDay()), elasticRecords[0].Index)
+		assert.Equal(t, click.GetId(), elasticRecords[0].ID)
+		assert.Contains(t, elasticRecords[0].Json, "value")
+
+		assert.Equal(t, fmt.Sprintf("events-%s", view.FormatTimestampDay()), elasticRecords[1].Index)
+		assert.Equal(t, strconv.Itoa(int(viewID)), elasticRecords[1].ID)
+		assert.NotContains(t, elasticRecords[1].Json, "id")
+		assert.Contains(t, elasticRecords[1].Json, "value")
+
+		assert.Equal(t, fmt.Sprintf("events-%s", other.FormatTimestampDay()), elasticRecords[2].Index)
+		assert.Equal(t, strconv.Itoa(int(otherID)), elasticRecords[2].ID)
+		assert.NotContains(t, elasticRecords[2].Json, "value")
+	}
+}
+
+func TestCodec_EncodeElasticRecords_ColumnsWhitelist(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{WhitelistedColumns: []string{"id"}},
+		logger: codecLogger,
+	}
+	record, id, _ := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, map[string]interface{}{"id": id}, elasticRecords[0].Json)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_MaskedColumns(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{
+			DocIDColumn:        "id",
+			BlacklistedColumns: []string{"value"},
+			MaskedColumns:      map[string]models.MaskStrategy{"id": models.MaskRedact, "value": models.MaskRedact},
+			FieldRenames:       map[string]string{"id": "user_id"},
+		},
+		logger: codecLogger,
+	}
+	record, id, _ := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		// the doc id comes from the unmasked column, blacklisted columns stay out
+		assert.Equal(t, strconv.Itoa(int(id)), elasticRecords[0].ID)
+		assert.Equal(t, map[string]interface{}{"user_id": models.RedactedValue}, elasticRecords[0].Json)
+		assert.Equal(t, id, record.Json["id"])
+	}
+}
+
+func TestCodec_EncodeElasticRecords_FlattenNested(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{DocIDColumn: "payment.id", IndexColumn: "payment.method.type", FlattenNested: true},
+		logger: codecLogger,
+	}
+	record, _, value := fixtures.NewRecord(time.Now())
+	payment := map[string]interface{}{"id": "p-1", "method": map[string]interface{}{"type": "card"}}
+	items := []interface{}{map[string]interface{}{"sku": "a-1"}}
+	record.Json["payment"] = payment
+	record.Json["items"] = items
+	delete(record.Json, "id")
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "p-1", elasticRecords[0].ID)
+		assert.Equal(t, record.Topic+"-card", elasticRecords[0].Index)
+		assert.Equal(t, map[string]interface{}{
+			"value":               value,
+			"payment.id":          "p-1",
+			"payment.method.type": "card",
+			"items":               items,
+		}, elasticRecords[0].Json)
+		// the record keeps its nested objects
+		assert.Equal(t, payment, record.Json["payment"])
+	}
+}
+
+func TestCodec_EncodeElasticRecords_FieldRenames(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{
+			DocIDColumn:  "id",
+			FieldRenames: map[string]string{"id": "user_id", "missing": "other"},
+		},
+		logger: codecLogger,
+	}
+	record, id, value := fixtures.NewRecord(time.Now())
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		// columns are resolved with the original names
+		assert.Equal(t, strconv.Itoa(int(id)), elasticRecords[0].ID)
+		assert.Equal(t, map[string]interface{}{"user_id": id, "value": value}, elasticRecords[0].Json)
+		assert.Contains(t, record.Json, "id")
+	}
+
+	codec.config.FieldRenames = map[string]string{"id": "value"}
+	_, err = codec.EncodeElasticRecords([]*models.Record{record})
+	assert.Error(t, err)
+
+	codec.config.FieldRenames = map[string]string{"id": "value", "value": "id"}
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"id": value, "value": id}, elasticRecords[0].Json)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_KafkaMetadata(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{KafkaMetadata: true, MetadataPrefix: "kafka."},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Date(2018, 1, 1, 12, 30, 0, 0, time.UTC))
+	record.Json["kafka.topic"] = "own-topic"
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		document := elasticRecords[0].Json
+		assert.Equal(t, "own-topic", document["kafka.topic"])
+		assert.Equal(t, record.Partition, document["kafka.partition"])
+		assert.Equal(t, record.Offset, document["kafka.offset"])
+		assert.Equal(t, "2018-01-01T12:30:00.000Z", document["kafka.timestamp"])
+	}
+}
+
+func TestCodec_EncodeElasticRecords_HeaderFields(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{
+			HeaderFields: map[string]string{"traceparent": "traceparent", "x-tenant-id": "tenant", "x-missing": "missing"},
+			DocIDColumn:  "header.x-request-id",
+			IndexColumn:  "header.x-tenant-id",
+		},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	record.Headers = map[string]string{"traceparent": "00-abc-01", "x-tenant-id": "acme", "x-request-id": "42"}
+	record.Json["tenant"] = "own"
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "42", elasticRecords[0].ID)
+		assert.Equal(t, record.Topic+"-acme", elasticRecords[0].Index)
+		document := elasticRecords[0].Json
+		assert.Equal(t, "00-abc-01", document["traceparent"])
+		assert.Equal(t, "own", document["tenant"])
+		assert.NotContains(t, document, "missing")
+	}
+}
+
+func TestCodec_EncodeElasticRecords_IngestedAtField(t *testing.T) {
+	now := time.Date(2018, 1, 1, 9, 30, 0, 123000000, time.FixedZone("BRT", -3*3600))
+	codec := &basicCodec{
+		config:             Config{IngestedAtField: "ingested_at"},
+		logger:             codecLogger,
+		now:                func() time.Time { return now },
+		ingestedAtWarnings: &sync.Map{},
+	}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	own, _, _ := fixtures.NewRecord(time.Now())
+	own.Json["ingested_at"] = "own"
+
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record, own})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 2) {
+		assert.Equal(t, "2018-01-01T12:30:00.123Z", elasticRecords[0].Json["ingested_at"])
+		assert.Equal(t, "own", elasticRecords[1].Json["ingested_at"])
+	}
+	_, warned := codec.ingestedAtWarnings.Load(own.Topic)
+	assert.True(t, warned)
+}
+
+func TestCodec_EncodeExtraIndices(t *testing.T) {
+	codec := &basicCodec{
+		config: Config{ExtraIndices: []IndexTarget{{Prefix: "rollup", Suffix: TimeSuffixMonth}, {Prefix: "archive", Suffix: TimeSuffixNone}}},
+		logger: codecLogger,
+	}
+	record, _, _ := fixtures.NewRecord(time.Date(2020, 3, 15, 10, 0, 0, 0, time.UTC))
+	records := []*models.Record{record}
+	documents, _ := codec.EncodeElasticRecords(records)
+
+	targets, err := codec.EncodeExtraIndices(documents, records)
+	if assert.NoError(t, err) && assert.Len(t, targets, 2) {
+		assert.Equal(t, "rollup-2020-03", targets[0][0].Index)
+		assert.Equal(t, "archive", targets[1][0].Index)
+		for _, target := range targets {
+			assert.Equal(t, documents[0].ID, target[0].ID)
+			assert.Equal(t, documents[0].Json, target[0].Json)
+		}
+	}
+	// the primary document is left untouched
+	assert.Equal(t, fmt.Sprintf("%s-2020-03-15", record.Topic), documents[0].Index)
+}
+
+func TestCodec_EncodeExtraIndices_IndexTimeSource(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	replayed, _, _ := fixtures.NewRecord(time.Date(2018, 3, 5, 14, 30, 0, 0, time.UTC))
+	replayed.Json["occurred_at"] = "2018-01-31T10:00:00Z"
+
+	for source, expected := range map[IndexTimeSource][]string{
+		IndexTimeKafkaTimestamp: {"events-2018-03-05", "rollup-2018-03"},
+		IndexTimeRecordField:    {"events-2018-01-31", "rollup-2018-01"},
+		IndexTimeProcessingTime: {"events-2021-06-01", "rollup-2021-06"},
+	} {
+		codec := &basicCodec{
+			config: Config{
+				Index:             "events",
+				IndexTimeSource:   source,
+				IndexTimeField:    "occurred_at",
+				IndexColumnFormat: ColumnTimeRFC3339,
+				ExtraIndices:      []IndexTarget{{Prefix: "rollup", Suffix: TimeSuffixMonth}},
+			},
+			logger: codecLogger,
+			now:    clock,
+		}
+		records := []*models.Record{replayed}
+		documents, err := codec.EncodeElasticRecords(records)
+		if !assert.NoError(t, err) || !assert.Len(t, documents, 1) {
+			continue
+		}
+		targets, err := codec.EncodeExtraIndices(documents, records)
+		if assert.NoError(t, err) && assert.Len(t, targets, 1) {
+			assert.Equal(t, expected, []string{documents[0].Index, targets[0][0].Index}, "%v", source)
+		}
+	}
+}
+
+func TestCodec_EncodeExtraIndices_WithoutKafkaTimestamp(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	codec := &basicCodec{
+		config:            Config{Index: "events", ExtraIndices: []IndexTarget{{Prefix: "rollup", Suffix: TimeSuffixMonth}}},
+		logger:            codecLogger,
+		now:               func() time.Time { return now },
+		indexTimeWarnings: &sync.Map{},
+	}
+	// brokers send -1 for the messages produced without timestamp
+	record, _, _ := fixtures.NewRecord(time.Unix(0, -1e6))
+	records := []*models.Record{record}
+	documents, err := codec.EncodeElasticRecords(records)
+	if !assert.NoError(t, err) || !assert.Len(t, documents, 1) {
+		return
+	}
+	targets, err := codec.EncodeExtraIndices(documents, records)
+	if assert.NoError(t, err) && assert.Len(t, targets, 1) {
+		assert.Equal(t, "events-2021-06-01", documents[0].Index)
+		assert.Equal(t, "rollup-2021-06", targets[0][0].Index)
+	}
+}
@@ -1,61 +1,964 @@
 package elasticsearch
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/validation"
 )
 
 type TimeIndexSuffix int
 
 const (
-	TimeSuffixDay  TimeIndexSuffix = 0
-	TimeSuffixHour TimeIndexSuffix = 1
+	TimeSuffixDay   TimeIndexSuffix = 0
+	TimeSuffixHour  TimeIndexSuffix = 1
+	TimeSuffixWeek  TimeIndexSuffix = 2
+	TimeSuffixMonth TimeIndexSuffix = 3
+	TimeSuffixNone  TimeIndexSuffix = 4
+)
+
+type ColumnTimeFormat int
+
+const (
+	ColumnTimeEpochMillis  ColumnTimeFormat = 0
+	ColumnTimeEpochSeconds ColumnTimeFormat = 1
+	ColumnTimeRFC3339      ColumnTimeFormat = 2
+)
+
+// IndexTimeSource is the time the index suffix of a record is formatted from.
+type IndexTimeSource int
+
+const (
+	IndexTimeKafkaTimestamp IndexTimeSource = 0
+	IndexTimeRecordField    IndexTimeSource = 1
+	IndexTimeProcessingTime IndexTimeSource = 2
+)
+
+type DocIDHash int
+
+const (
+	DocIDHashNone    DocIDHash = 0
+	DocIDHashSHA256  DocIDHash = 1
+	DocIDHashMurmur3 DocIDHash = 2
+)
+
+type BulkAction int
+
+const (
+	BulkActionCreate BulkAction = 0
+	BulkActionIndex  BulkAction = 1
+	BulkActionUpsert BulkAction = 2
+	BulkActionScript BulkAction = 3
+)
+
+type DeadLetterMode int
+
+const (
+	DeadLetterDisabled DeadLetterMode = 0
+	DeadLetterIndex    DeadLetterMode = 1
+	DeadLetterFile     DeadLetterMode = 2
+)
+
+type MissingRouting int
+
+const (
+	MissingRoutingFail    MissingRouting = 0
+	MissingRoutingDefault MissingRouting = 1
+)
+
+// MissingColumn is what to do with the records missing the doc id or index column.
+type MissingColumn int
+
+const (
+	MissingColumnFail     MissingColumn = 0
+	MissingColumnSkip     MissingColumn = 1
+	MissingColumnFallback MissingColumn = 2
+)
+
+// CoercionErrors is what to do with the records holding a field that can't be coerced to its type.
+type CoercionErrors int
+
+const (
+	CoercionErrorsFail       CoercionErrors = 0
+	CoercionErrorsSkip       CoercionErrors = 1
+	CoercionErrorsDeadLetter CoercionErrors = 2
+)
+
+type ReadinessMode int
+
+const (
+	ReadinessHealth ReadinessMode = 0
+	ReadinessPing   ReadinessMode = 1
+)
+
+const (
+	// DocTypeTopic keeps the legacy behavior of using the record's topic as the document type
+	DocTypeTopic = "_topic"
+	// DocTypeNone omits the document type, as required by elasticsearch 7 and later
+	DocTypeNone = "_doc"
 )
 
 type Config struct {
-	Host               string
+	Hosts              []string
+	Username           string
+	Password           string
+	APIKey             string
+	CACertPath         string
+	ClientCertPath     string
+	ClientKeyPath      string
+	InsecureSkipVerify bool
+	Gzip               bool
+	DisableSniff       bool
+	DisableHealth      bool
+	HealthInterval     time.Duration
+	AWSSigV4           bool
+	AWSRegion          string
+	AWSService         string
+	ClientRetries      int
+	ClientBackoff      time.Duration
+	ClientMaxBackoff   time.Duration
+	IdleConnsPerHost   int
+	KeepAlive          time.Duration
+	ConnectRetries     int
+	ConnectBackoff     time.Duration
+	ConnectTimeout     time.Duration
+	ReadinessMode      ReadinessMode
+	ReadinessStatus    string
+	ReadinessTimeout   time.Duration
+	ReadinessIndex     bool
 	Index              string
+	StaticIndex        bool
+	SanitizeIndex      bool
+	DataStream         bool
+	DocType            string
 	IndexColumn        string
+	IndexColumnIsTime  bool
+	IndexColumnFormat  ColumnTimeFormat
+	IndexTimeSource    IndexTimeSource
+	IndexTimeField     string
 	DocIDColumn        string
+	DocIDSeparator     string
+	DocIDHash          DocIDHash
+	RoutingColumn      string
+	MissingRouting     MissingRouting
+	MissingDocID       MissingColumn
+	MissingIndex       MissingColumn
+	JoinField          string
+	JoinParentName     string
+	JoinChildName      string
+	JoinParentColumn   string
+	Pipeline           string
+	TopicPipelines     map[string]string
 	BlacklistedColumns []string
+	WhitelistedColumns []string
+	FieldRenames       map[string]string
+	FieldCoercions     map[string]models.Coercion
+	CoercionErrors     CoercionErrors
+	FlattenNested      bool
+	FlattenMaxDepth    int
+	FlattenArrays      bool
+	GeoPointFields     map[string]models.GeoPoint
+	RemoveGeoSources   bool
+	MaskedColumns      map[string]models.MaskStrategy
+	MaskSalt           string
+	KafkaMetadata      bool
+	HeaderFields       map[string]string
+	MetadataPrefix     string
+	IngestedAtField    string
+	TopicConfigs       map[string]TopicConfig
+	Script             string
+	ScriptUpsert       map[string]interface{}
 	BulkTimeout        time.Duration
+	BulkMaxBytes       int64
+	MaxDocBytes        int64
+	TruncateFields     map[string]int
+	BulkConcurrency    int
+	Refresh            string
+	ActiveShards       string
+	BulkProcessor      bool
+	DedupeInBatch      bool
+	BulkFlushInterval  time.Duration
+	BulkFlushActions   int
+	BulkFlushBytes     int
 	Backoff            time.Duration
+	MaxBackoff         time.Duration
+	MaxRetries         int
+	BreakerThreshold   int
+	BreakerInterval    time.Duration
 	TimeSuffix         TimeIndexSuffix
+	ExtraIndices       []IndexTarget
+	TimeLayout         string
+	TimeZone           *time.Location
+	BulkAction         BulkAction
+	RetryOnConflict    int
+	ExternalVersion    bool
+	VersionColumn      string
+	DeadLetterMode     DeadLetterMode
+	DeadLetterIndex    string
+	DeadLetterFile     string
+	Template           TemplateConfig
+	DryRun             bool
+	DryRunOutput       string
+}
+
+// NewConfig reads the config of the environment variables, failing with every invalid setting found.
+func NewConfig() (Config, error) {
+	return NewConfigFrom(os.LookupEnv)
 }
 
-func NewConfig() Config {
-	timeoutStr, exists := os.LookupEnv("ES_BULK_TIMEOUT")
-	timeout := 1 * time.Second
-	if exists {
-		d, err := time.ParseDuration(timeoutStr)
-		if err == nil {
-			timeout = d
+// NewConfigFrom reads the config of the settings looked up, like the environment variables overridden by the
+// settings of a pipeline.
+func NewConfigFrom(lookupEnv func(name string) (string, bool)) (Config, error) {
+	getenv := func(name string) string {
+		value, _ := lookupEnv(name)
+		return value
+	}
+	var errs validation.Errors
+	timeout := errs.Duration("ES_BULK_TIMEOUT", getenv("ES_BULK_TIMEOUT"), 1*time.Second, false)
+	backoff := errs.Duration("ES_BULK_BACKOFF", getenv("ES_BULK_BACKOFF"), 1*time.Second, false)
+	maxBackoff := errs.Duration("ES_BULK_MAX_BACKOFF", getenv("ES_BULK_MAX_BACKOFF"), 30*time.Second, false)
+	bulkMaxBytes := int64(errs.Int("ES_BULK_MAX_BYTES", getenv("ES_BULK_MAX_BYTES"), 0, true))
+	maxDocBytes := int64(errs.Int("ES_MAX_DOC_BYTES", getenv("ES_MAX_DOC_BYTES"), 0, true))
+	truncateFields, err := parseTruncateFields(getenv("ES_TRUNCATE_FIELDS"))
+	if err != nil {
+		errs.Addf("invalid ES_TRUNCATE_FIELDS: %s", err)
+	}
+	bulkConcurrency := errs.Int("ES_BULK_CONCURRENCY", getenv("ES_BULK_CONCURRENCY"), 1, false)
+	bulkProcessor := errs.Bool("ES_BULK_PROCESSOR", getenv("ES_BULK_PROCESSOR"), false)
+	dedupeInBatch := errs.Bool("ES_DEDUPE_IN_BATCH", getenv("ES_DEDUPE_IN_BATCH"), false)
+	bulkFlushInterval := 1 * time.Second
+	if intervalStr, exists := lookupEnv("ES_BULK_FLUSH_INTERVAL"); exists {
+		d, err := time.ParseDuration(intervalStr)
+		if err != nil || d <= 0 {
+			errs.Addf("invalid ES_BULK_FLUSH_INTERVAL %q, should be a positive duration", intervalStr)
+		} else {
+			bulkFlushInterval = d
 		}
 	}
-	backoffStr, exists := os.LookupEnv("ES_BULK_BACKOFF")
-	backoff := 1 * time.Second
-	if exists {
-		d, err := time.ParseDuration(backoffStr)
-		if err == nil {
-			backoff = d
+	bulkFlushActions := errs.Int("ES_BULK_FLUSH_ACTIONS", getenv("ES_BULK_FLUSH_ACTIONS"), 1000, true)
+	bulkFlushBytes := errs.Int("ES_BULK_FLUSH_BYTES", getenv("ES_BULK_FLUSH_BYTES"), 5<<20, true)
+	refresh := getenv("ES_BULK_REFRESH")
+	switch refresh {
+	case "", "false", "true", "wait_for":
+	default:
+		errs.Addf("invalid ES_BULK_REFRESH %q, should be false, true or wait_for", refresh)
+	}
+	activeShards := getenv("ES_BULK_WAIT_FOR_ACTIVE_SHARDS")
+	if activeShards != "" && activeShards != "all" {
+		if shards, err := strconv.Atoi(activeShards); err != nil || shards <= 0 {
+			errs.Addf("invalid ES_BULK_WAIT_FOR_ACTIVE_SHARDS %q, should be all or a positive number", activeShards)
+		}
+	}
+	maxRetries := errs.Int("ES_BULK_MAX_RETRIES", getenv("ES_BULK_MAX_RETRIES"), 5, true)
+	breakerThreshold := errs.Int("ES_CIRCUIT_BREAKER_THRESHOLD", getenv("ES_CIRCUIT_BREAKER_THRESHOLD"), 0, true)
+	breakerInterval := 10 * time.Second
+	if intervalStr, exists := lookupEnv("ES_CIRCUIT_BREAKER_PROBE_INTERVAL"); exists {
+		d, err := time.ParseDuration(intervalStr)
+		if err != nil || d <= 0 {
+			errs.Addf("invalid ES_CIRCUIT_BREAKER_PROBE_INTERVAL %q, should be a positive duration", intervalStr)
+		} else {
+			breakerInterval = d
+		}
+	}
+	timeSuffix, err := parseTimeSuffix(getenv("ES_TIME_SUFFIX"))
+	if err != nil {
+		errs.Addf("invalid ES_TIME_SUFFIX: %s", err)
+	}
+	extraIndices, err := parseIndexTargets(getenv("ES_EXTRA_INDICES"))
+	if err != nil {
+		errs.Addf("invalid ES_EXTRA_INDICES: %s", err)
+	}
+	timeLayout := getenv("ES_INDEX_TIME_LAYOUT")
+	if err := validateTimeLayout(timeLayout); err != nil {
+		errs.Addf("invalid ES_INDEX_TIME_LAYOUT: %s", err)
+	}
+	timeZone := time.UTC
+	if zone := getenv("ES_INDEX_TIME_ZONE"); zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			errs.Addf("invalid ES_INDEX_TIME_ZONE: %s", err)
+		}
+		timeZone = loc
+	}
+	indexColumnIsTime := errs.Bool("ES_INDEX_COLUMN_IS_TIMESTAMP", getenv("ES_INDEX_COLUMN_IS_TIMESTAMP"), false)
+	indexColumnFormat := ColumnTimeEpochMillis
+	switch format := getenv("ES_INDEX_COLUMN_TIMESTAMP_FORMAT"); format {
+	case "", "epoch_millis":
+	case "epoch_seconds":
+		indexColumnFormat = ColumnTimeEpochSeconds
+	case "rfc3339":
+		indexColumnFormat = ColumnTimeRFC3339
+	default:
+		errs.Addf("invalid ES_INDEX_COLUMN_TIMESTAMP_FORMAT %q, should be epoch_millis, epoch_seconds or rfc3339", format)
+	}
+	indexTimeSource := IndexTimeKafkaTimestamp
+	indexTimeField := getenv("ES_INDEX_TIME_FIELD")
+	switch source := getenv("ES_INDEX_TIME_SOURCE"); source {
+	case "", "kafka_timestamp":
+	case "record_field":
+		if indexTimeField == "" {
+			errs.Add(errors.New("ES_INDEX_TIME_FIELD is required when ES_INDEX_TIME_SOURCE is record_field"))
+		}
+		indexTimeSource = IndexTimeRecordField
+	case "processing_time":
+		indexTimeSource = IndexTimeProcessingTime
+	default:
+		errs.Addf("invalid ES_INDEX_TIME_SOURCE %q, should be kafka_timestamp, record_field or processing_time", source)
+	}
+	bulkAction := BulkActionCreate
+	switch action := getenv("ES_BULK_ACTION"); action {
+	case "", "create":
+	case "index":
+		bulkAction = BulkActionIndex
+	case "upsert":
+		bulkAction = BulkActionUpsert
+		if getenv("ES_DOC_ID_COLUMN") == "" {
+			errs.Add(errors.New("ES_DOC_ID_COLUMN is required when ES_BULK_ACTION is upsert"))
+		}
+	case "script":
+		bulkAction = BulkActionScript
+		if getenv("ES_DOC_ID_COLUMN") == "" {
+			errs.Add(errors.New("ES_DOC_ID_COLUMN is required when ES_BULK_ACTION is script"))
+		}
+	default:
+		errs.Addf("invalid ES_BULK_ACTION %q, should be create, index, upsert or script", action)
+	}
+	missingRouting := MissingRoutingFail
+	switch missing := getenv("ES_ROUTING_MISSING"); missing {
+	case "", "fail":
+	case "default":
+		missingRouting = MissingRoutingDefault
+	default:
+		errs.Addf("invalid ES_ROUTING_MISSING %q, should be fail or default", missing)
+	}
+	missingDocID, err := parseMissingColumn(getenv("ES_DOC_ID_COLUMN_MISSING"))
+	if err != nil {
+		errs.Addf("invalid ES_DOC_ID_COLUMN_MISSING: %s", err)
+	}
+	missingIndex, err := parseMissingColumn(getenv("ES_INDEX_COLUMN_MISSING"))
+	if err != nil {
+		errs.Addf("invalid ES_INDEX_COLUMN_MISSING: %s", err)
+	}
+	joinField := getenv("ES_JOIN_FIELD")
+	if joinField != "" {
+		for _, required := range []string{"ES_JOIN_PARENT_NAME", "ES_JOIN_CHILD_NAME", "ES_JOIN_PARENT_COLUMN"} {
+			if getenv(required) == "" {
+				errs.Addf("%s is required when ES_JOIN_FIELD is set", required)
+			}
+		}
+	}
+	pipeline := getenv("ES_PIPELINE")
+	topicPipelines, err := splitMap(getenv("ES_TOPIC_PIPELINES"))
+	if err != nil {
+		errs.Addf("invalid ES_TOPIC_PIPELINES: %s", err)
+	}
+	if (bulkAction == BulkActionUpsert || bulkAction == BulkActionScript) && (pipeline != "" || len(topicPipelines) > 0) {
+		errs.Add(errors.New("ingest pipelines are not supported when ES_BULK_ACTION is upsert or script"))
+	}
+	docIDSeparator, exists := lookupEnv("ES_DOC_ID_SEPARATOR")
+	if !exists {
+		docIDSeparator = ":"
+	}
+	docIDHash := DocIDHashNone
+	switch hash := getenv("ES_DOC_ID_HASH"); hash {
+	case "", "none":
+	case "sha256":
+		docIDHash = DocIDHashSHA256
+	case "murmur3":
+		docIDHash = DocIDHashMurmur3
+	default:
+		errs.Addf("invalid ES_DOC_ID_HASH %q, should be none, sha256 or murmur3", hash)
+	}
+	staticIndex := errs.Bool("ES_INDEX_STATIC", getenv("ES_INDEX_STATIC"), false)
+	// invalid KAFKA_CONSUMER_DELETE_TOMBSTONES values are reported by the kafka config
+	if deleteTombstones, _ := strconv.ParseBool(getenv("KAFKA_CONSUMER_DELETE_TOMBSTONES")); deleteTombstones {
+		if err := validateTombstoneIndices(staticIndex, timeSuffix, timeLayout, getenv("ES_INDEX_COLUMN"), indexColumnIsTime, extraIndices); err != nil {
+			errs.Add(err)
+		}
+	}
+	sanitizeIndex := errs.Bool("ES_INDEX_SANITIZE", getenv("ES_INDEX_SANITIZE"), true)
+	dataStream := errs.Bool("ES_DATA_STREAM", getenv("ES_DATA_STREAM"), false)
+	if dataStream && bulkAction != BulkActionCreate {
+		errs.Add(errors.New("data streams only accept the create bulk action, ES_BULK_ACTION should be create"))
+	}
+	externalVersion := errs.Bool("ES_EXTERNAL_VERSION", getenv("ES_EXTERNAL_VERSION"), false)
+	if externalVersion && bulkAction != BulkActionIndex {
+		errs.Add(errors.New("ES_EXTERNAL_VERSION requires ES_BULK_ACTION to be index"))
+	}
+	retryOnConflict := errs.Int("ES_RETRY_ON_CONFLICT", getenv("ES_RETRY_ON_CONFLICT"), 0, true)
+	deadLetterMode := DeadLetterDisabled
+	switch mode := getenv("ES_DEAD_LETTER_MODE"); mode {
+	case "":
+	case "index":
+		deadLetterMode = DeadLetterIndex
+	case "file":
+		deadLetterMode = DeadLetterFile
+	default:
+		errs.Addf("invalid ES_DEAD_LETTER_MODE %q, should be index or file", mode)
+	}
+	deadLetterIndex := getenv("ES_DEAD_LETTER_INDEX")
+	if deadLetterIndex == "" {
+		deadLetterIndex = "dead-letter"
+	}
+	deadLetterFile := getenv("ES_DEAD_LETTER_FILE")
+	if deadLetterMode == DeadLetterFile && deadLetterFile == "" {
+		errs.Add(errors.New("ES_DEAD_LETTER_FILE is required when ES_DEAD_LETTER_MODE is file"))
+	}
+	if len(extraIndices) > 0 && deadLetterMode == DeadLetterDisabled {
+		// the failures of the extra indices don't hold back consumption, without a dead letter queue they'd be lost
+		errs.Add(errors.New("ES_DEAD_LETTER_MODE is required when ES_EXTRA_INDICES is set"))
+	}
+	templateOverwrite := errs.Bool("ES_TEMPLATE_OVERWRITE", getenv("ES_TEMPLATE_OVERWRITE"), false)
+	template, err := newTemplateConfig(
+		getenv("ES_TEMPLATE_NAME"),
+		getenv("ES_TEMPLATE"),
+		getenv("ES_TEMPLATE_PATH"),
+		templateOverwrite,
+	)
+	errs.Add(err)
+	topicConfigs, err := newTopicConfigs(getenv("ES_TOPIC_CONFIG"), getenv("ES_TOPIC_CONFIG_PATH"))
+	errs.Add(err)
+	script := getenv("ES_SCRIPT")
+	scriptUpsert, err := parseScriptUpsert(getenv("ES_SCRIPT_UPSERT"))
+	if err != nil {
+		errs.Addf("invalid ES_SCRIPT_UPSERT: %s", err)
+	}
+	if bulkAction == BulkActionScript {
+		if script == "" && !topicConfigsHaveScript(topicConfigs) {
+			errs.Add(errors.New("ES_SCRIPT, or a script in ES_TOPIC_CONFIG, is required when ES_BULK_ACTION is script"))
+		}
+		if dedupeInBatch {
+			// every record is an update of its own, like an increment
+			errs.Add(errors.New("ES_DEDUPE_IN_BATCH can't be set when ES_BULK_ACTION is script"))
+		}
+	}
+	whitelistedColumns := splitList(getenv("ES_WHITELISTED_COLUMNS"))
+	if len(whitelistedColumns) > 0 {
+		if len(splitList(getenv("ES_BLACKLISTED_COLUMNS"))) > 0 {
+			errs.Add(errors.New("only one of ES_WHITELISTED_COLUMNS and ES_BLACKLISTED_COLUMNS should be set"))
+		}
+		for topic, topicConfig := range topicConfigs {
+			if topicConfig.BlacklistedColumns != nil {
+				errs.Addf("blacklisted_columns of topic %s can't be set with ES_WHITELISTED_COLUMNS", topic)
+			}
+		}
+	}
+	fieldRenames, err := splitMap(getenv("ES_FIELD_RENAMES"))
+	if err != nil {
+		errs.Addf("invalid ES_FIELD_RENAMES: %s", err)
+	} else if err := validateFieldRenames(fieldRenames); err != nil {
+		errs.Addf("invalid ES_FIELD_RENAMES: %s", err)
+	}
+	fieldCoercions, err := parseFieldCoercions(getenv("ES_FIELD_COERCIONS"))
+	if err != nil {
+		errs.Addf("invalid ES_FIELD_COERCIONS: %s", err)
+	}
+	coercionErrors := CoercionErrorsFail
+	switch policy := getenv("ES_FIELD_COERCION_ERRORS"); policy {
+	case "", "fail":
+	case "skip":
+		coercionErrors = CoercionErrorsSkip
+	case "dead-letter":
+		coercionErrors = CoercionErrorsDeadLetter
+	default:
+		errs.Addf("invalid ES_FIELD_COERCION_ERRORS %q, should be fail, skip or dead-letter", policy)
+	}
+	if coercionErrors == CoercionErrorsDeadLetter && deadLetterMode == DeadLetterDisabled {
+		errs.Add(errors.New("ES_DEAD_LETTER_MODE is required when ES_FIELD_COERCION_ERRORS is dead-letter"))
+	}
+	flattenNested := errs.Bool("ES_FLATTEN_NESTED", getenv("ES_FLATTEN_NESTED"), false)
+	flattenArrays := errs.Bool("ES_FLATTEN_ARRAYS", getenv("ES_FLATTEN_ARRAYS"), false)
+	geoPointFields, err := parseGeoPointFields(getenv("ES_GEO_POINT_FIELDS"))
+	if err != nil {
+		errs.Addf("invalid ES_GEO_POINT_FIELDS: %s", err)
+	}
+	removeGeoSources := errs.Bool("ES_GEO_POINT_REMOVE_SOURCES", getenv("ES_GEO_POINT_REMOVE_SOURCES"), false)
+	flattenMaxDepth := 0
+	if depth := getenv("ES_FLATTEN_MAX_DEPTH"); depth != "" {
+		if flattenMaxDepth, err = strconv.Atoi(depth); err != nil || flattenMaxDepth < 0 {
+			errs.Addf("invalid ES_FLATTEN_MAX_DEPTH %q, should be a non negative number of levels", depth)
 		}
 	}
-	timeSuffix := TimeSuffixDay
-	if suffix := os.Getenv("ES_TIME_SUFFIX"); suffix != "" {
-		switch suffix {
-		case "hour":
-			timeSuffix = TimeSuffixHour
+	maskedColumns, err := parseMaskedColumns(getenv("ES_MASKED_COLUMNS"))
+	if err != nil {
+		errs.Addf("invalid ES_MASKED_COLUMNS: %s", err)
+	}
+	headerFields, err := parseHeaderFields(getenv("ES_HEADER_FIELDS"))
+	if err != nil {
+		errs.Addf("invalid ES_HEADER_FIELDS: %s", err)
+	}
+	kafkaMetadata := errs.Bool("ES_INCLUDE_KAFKA_METADATA", getenv("ES_INCLUDE_KAFKA_METADATA"), false)
+	kafkaMetadataPrefix, exists := lookupEnv("ES_KAFKA_METADATA_PREFIX")
+	if !exists {
+		kafkaMetadataPrefix = "_kafka_"
+	}
+	hosts := getenv("ELASTICSEARCH_HOST")
+	errs.URLs("ELASTICSEARCH_HOST", hosts)
+	insecureSkipVerify := errs.Bool("ELASTICSEARCH_TLS_INSECURE_SKIP_VERIFY", getenv("ELASTICSEARCH_TLS_INSECURE_SKIP_VERIFY"), false)
+	gzipEnabled := errs.Bool("ELASTICSEARCH_GZIP", getenv("ELASTICSEARCH_GZIP"), false)
+	apiKey := encodeAPIKey(getenv("ELASTICSEARCH_API_KEY"))
+	if apiKey != "" && getenv("ELASTICSEARCH_USERNAME") != "" {
+		errs.Add(errors.New("only one of ELASTICSEARCH_API_KEY and ELASTICSEARCH_USERNAME should be set"))
+	}
+	awsSigV4 := errs.Bool("ELASTICSEARCH_AWS_SIGV4", getenv("ELASTICSEARCH_AWS_SIGV4"), false)
+	awsRegion := firstNonEmpty(getenv("ELASTICSEARCH_AWS_REGION"), getenv("AWS_REGION"), getenv("AWS_DEFAULT_REGION"))
+	awsService := firstNonEmpty(getenv("ELASTICSEARCH_AWS_SERVICE"), "es")
+	if awsSigV4 {
+		if awsRegion == "" {
+			errs.Add(errors.New("ELASTICSEARCH_AWS_REGION or AWS_REGION is required when ELASTICSEARCH_AWS_SIGV4 is set"))
+		}
+		if getenv("ELASTICSEARCH_USERNAME") != "" || apiKey != "" {
+			errs.Add(errors.New("ELASTICSEARCH_USERNAME and ELASTICSEARCH_API_KEY can't be set when ELASTICSEARCH_AWS_SIGV4 is set"))
 		}
 	}
-	return Config{
-		Host:               os.Getenv("ELASTICSEARCH_HOST"),
-		Index:              os.Getenv("ES_INDEX"),
-		IndexColumn:        os.Getenv("ES_INDEX_COLUMN"),
-		DocIDColumn:        os.Getenv("ES_DOC_ID_COLUMN"),
-		BlacklistedColumns: strings.Split(os.Getenv("ES_BLACKLISTED_COLUMNS"), ","),
+	// the managed service doesn't expose the addresses of its nodes
+	sniff := errs.Bool("ELASTICSEARCH_SNIFF", getenv("ELASTICSEARCH_SNIFF"), !awsSigV4)
+	healthInterval := 60 * time.Second
+	disableHealth := awsSigV4
+	if intervalStr := getenv("ELASTICSEARCH_HEALTHCHECK_INTERVAL"); intervalStr != "" {
+		healthInterval = errs.Duration("ELASTICSEARCH_HEALTHCHECK_INTERVAL", intervalStr, healthInterval, false)
+		disableHealth = false
+	}
+	clientRetries := errs.Int("ELASTICSEARCH_CLIENT_RETRIES", getenv("ELASTICSEARCH_CLIENT_RETRIES"), 0, true)
+	clientBackoff := errs.Duration("ELASTICSEARCH_CLIENT_BACKOFF", getenv("ELASTICSEARCH_CLIENT_BACKOFF"), 100*time.Millisecond, false)
+	clientMaxBackoff := errs.Duration("ELASTICSEARCH_CLIENT_MAX_BACKOFF", getenv("ELASTICSEARCH_CLIENT_MAX_BACKOFF"), 2*time.Second, false)
+	idleConnsPerHost := errs.Int("ELASTICSEARCH_MAX_IDLE_CONNS_PER_HOST", getenv("ELASTICSEARCH_MAX_IDLE_CONNS_PER_HOST"), 0, true)
+	keepAlive := errs.Duration("ELASTICSEARCH_KEEP_ALIVE", getenv("ELASTICSEARCH_KEEP_ALIVE"), 30*time.Second, true)
+	connectRetries := errs.Int("ES_CONNECT_RETRIES", getenv("ES_CONNECT_RETRIES"), 6, true)
+	readinessMode := ReadinessHealth
+	switch mode := getenv("ES_READINESS_MODE"); mode {
+	case "", "health":
+	case "ping":
+		readinessMode = ReadinessPing
+	default:
+		errs.Addf("invalid ES_READINESS_MODE %q, should be health or ping", mode)
+	}
+	readinessStatus := "yellow"
+	switch status := getenv("ES_READINESS_MIN_STATUS"); status {
+	case "":
+	case "green", "yellow", "red":
+		readinessStatus = status
+	default:
+		errs.Addf("invalid ES_READINESS_MIN_STATUS %q, should be green, yellow or red", status)
+	}
+	readinessTimeout := errs.Duration("ES_READINESS_TIMEOUT", getenv("ES_READINESS_TIMEOUT"), 1*time.Second, false)
+	readinessIndex := errs.Bool("ES_READINESS_CHECK_INDEX", getenv("ES_READINESS_CHECK_INDEX"), false)
+	connectTimeout := errs.Duration("ES_CONNECT_TIMEOUT", getenv("ES_CONNECT_TIMEOUT"), 5*time.Second, false)
+	connectBackoff := errs.Duration("ES_CONNECT_BACKOFF", getenv("ES_CONNECT_BACKOFF"), 5*time.Second, true)
+	dryRun := errs.Bool("DRY_RUN", getenv("DRY_RUN"), false)
+	config := Config{
+		Hosts:              splitList(hosts),
+		Username:           getenv("ELASTICSEARCH_USERNAME"),
+		Password:           getenv("ELASTICSEARCH_PASSWORD"),
+		APIKey:             apiKey,
+		CACertPath:         getenv("ELASTICSEARCH_CA_CERT_PATH"),
+		ClientCertPath:     getenv("ELASTICSEARCH_CLIENT_CERT_PATH"),
+		ClientKeyPath:      getenv("ELASTICSEARCH_CLIENT_KEY_PATH"),
+		InsecureSkipVerify: insecureSkipVerify,
+		Gzip:               gzipEnabled,
+		DisableSniff:       !sniff,
+		DisableHealth:      disableHealth,
+		HealthInterval:     healthInterval,
+		AWSSigV4:           awsSigV4,
+		AWSRegion:          awsRegion,
+		AWSService:         awsService,
+		ClientRetries:      clientRetries,
+		ClientBackoff:      clientBackoff,
+		ClientMaxBackoff:   clientMaxBackoff,
+		IdleConnsPerHost:   idleConnsPerHost,
+		KeepAlive:          keepAlive,
+		ConnectRetries:     connectRetries,
+		ConnectBackoff:     connectBackoff,
+		ConnectTimeout:     connectTimeout,
+		ReadinessMode:      readinessMode,
+		ReadinessStatus:    readinessStatus,
+		ReadinessTimeout:   readinessTimeout,
+		ReadinessIndex:     readinessIndex,
+		Index:              getenv("ES_INDEX"),
+		StaticIndex:        staticIndex,
+		SanitizeIndex:      sanitizeIndex,
+		DataStream:         dataStream,
+		DocType:            getenv("ES_DOC_TYPE"),
+		IndexColumn:        getenv("ES_INDEX_COLUMN"),
+		IndexColumnIsTime:  indexColumnIsTime,
+		IndexTimeSource:    indexTimeSource,
+		IndexTimeField:     indexTimeField,
+		IndexColumnFormat:  indexColumnFormat,
+		DocIDColumn:        getenv("ES_DOC_ID_COLUMN"),
+		DocIDSeparator:     docIDSeparator,
+		DocIDHash:          docIDHash,
+		RoutingColumn:      getenv("ES_ROUTING_COLUMN"),
+		MissingRouting:     missingRouting,
+		MissingDocID:       missingDocID,
+		MissingIndex:       missingIndex,
+		JoinField:          joinField,
+		JoinParentName:     getenv("ES_JOIN_PARENT_NAME"),
+		JoinChildName:      getenv("ES_JOIN_CHILD_NAME"),
+		JoinParentColumn:   getenv("ES_JOIN_PARENT_COLUMN"),
+		Pipeline:           pipeline,
+		TopicPipelines:     topicPipelines,
+		BlacklistedColumns: strings.Split(getenv("ES_BLACKLISTED_COLUMNS"), ","),
+		WhitelistedColumns: whitelistedColumns,
+		FieldRenames:       fieldRenames,
+		FieldCoercions:     fieldCoercions,
+		CoercionErrors:     coercionErrors,
+		FlattenNested:      flattenNested,
+		FlattenMaxDepth:    flattenMaxDepth,
+		FlattenArrays:      flattenArrays,
+		GeoPointFields:     geoPointFields,
+		RemoveGeoSources:   removeGeoSources,
+		MaskedColumns:      maskedColumns,
+		MaskSalt:           getenv("ES_MASK_SALT"),
+		KafkaMetadata:      kafkaMetadata,
+		HeaderFields:       headerFields,
+		MetadataPrefix:     kafkaMetadataPrefix,
+		IngestedAtField:    getenv("ES_INGESTED_AT_FIELD"),
+		TopicConfigs:       topicConfigs,
+		Script:             script,
+		ScriptUpsert:       scriptUpsert,
 		BulkTimeout:        timeout,
+		BulkMaxBytes:       bulkMaxBytes,
+		MaxDocBytes:        maxDocBytes,
+		TruncateFields:     truncateFields,
+		BulkConcurrency:    bulkConcurrency,
+		Refresh:            refresh,
+		ActiveShards:       activeShards,
+		BulkProcessor:      bulkProcessor,
+		DedupeInBatch:      dedupeInBatch,
+		BulkFlushInterval:  bulkFlushInterval,
+		BulkFlushActions:   bulkFlushActions,
+		BulkFlushBytes:     bulkFlushBytes,
 		Backoff:            backoff,
+		MaxBackoff:         maxBackoff,
+		MaxRetries:         maxRetries,
+		BreakerThreshold:   breakerThreshold,
+		BreakerInterval:    breakerInterval,
 		TimeSuffix:         timeSuffix,
+		ExtraIndices:       extraIndices,
+		TimeLayout:         timeLayout,
+		TimeZone:           timeZone,
+		BulkAction:         bulkAction,
+		RetryOnConflict:    retryOnConflict,
+		ExternalVersion:    externalVersion,
+		VersionColumn:      getenv("ES_VERSION_COLUMN"),
+		DeadLetterMode:     deadLetterMode,
+		DeadLetterIndex:    deadLetterIndex,
+		DeadLetterFile:     deadLetterFile,
+		Template:           template,
+		DryRun:             dryRun,
+		DryRunOutput:       getenv("DRY_RUN_OUTPUT"),
+	}
+	// the topics are also read by the kafka config, which reports their errors
+	if err := config.validateSharedIndices(splitList(getenv("KAFKA_TOPICS")), getenv("KAFKA_TOPICS_PATTERN")); err != nil {
+		errs.Add(err)
+	}
+	if config.tlsEnabled() {
+		// fail at startup instead of on the first insert
+		if _, err := config.tlsConfig(); err != nil {
+			errs.Add(err)
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// TransformSettings are the env vars of the transforms of the documents, the part of the config that can be
+// changed while running.
+var TransformSettings = []string{
+	"ES_BLACKLISTED_COLUMNS",
+	"ES_WHITELISTED_COLUMNS",
+	"ES_FIELD_RENAMES",
+	"ES_FIELD_COERCIONS",
+	"ES_FIELD_COERCION_ERRORS",
+	"ES_FLATTEN_NESTED",
+	"ES_FLATTEN_ARRAYS",
+	"ES_FLATTEN_MAX_DEPTH",
+	"ES_GEO_POINT_FIELDS",
+	"ES_GEO_POINT_REMOVE_SOURCES",
+	"ES_MASKED_COLUMNS",
+	"ES_MASK_SALT",
+	"ES_INCLUDE_KAFKA_METADATA",
+	"ES_KAFKA_METADATA_PREFIX",
+	"ES_HEADER_FIELDS",
+	"ES_INGESTED_AT_FIELD",
+}
+
+// WithTransforms is the config with the transforms of the documents of another one, see TransformSettings.
+func (c Config) WithTransforms(other Config) Config {
+	c.BlacklistedColumns = other.BlacklistedColumns
+	c.WhitelistedColumns = other.WhitelistedColumns
+	c.FieldRenames = other.FieldRenames
+	c.FieldCoercions = other.FieldCoercions
+	c.CoercionErrors = other.CoercionErrors
+	c.FlattenNested = other.FlattenNested
+	c.FlattenArrays = other.FlattenArrays
+	c.FlattenMaxDepth = other.FlattenMaxDepth
+	c.GeoPointFields = other.GeoPointFields
+	c.RemoveGeoSources = other.RemoveGeoSources
+	c.MaskedColumns = other.MaskedColumns
+	c.MaskSalt = other.MaskSalt
+	c.KafkaMetadata = other.KafkaMetadata
+	c.MetadataPrefix = other.MetadataPrefix
+	c.HeaderFields = other.HeaderFields
+	c.IngestedAtField = other.IngestedAtField
+	return c
+}
+
+// IndexTarget is an additional index every record is copied to, named after its prefix and the record's
+// timestamp formatted with its own suffix.
+type IndexTarget struct {
+	Prefix string
+	Suffix TimeIndexSuffix
+}
+
+func parseTimeSuffix(suffix string) (TimeIndexSuffix, error) {
+	switch suffix {
+	case "", "day", "daily":
+		return TimeSuffixDay, nil
+	case "hour", "hourly":
+		return TimeSuffixHour, nil
+	case "week", "weekly":
+		return TimeSuffixWeek, nil
+	case "month", "monthly":
+		return TimeSuffixMonth, nil
+	case "none":
+		return TimeSuffixNone, nil
+	default:
+		return 0, fmt.Errorf("%q should be hour, day, week, month or none", suffix)
+	}
+}
+
+func parseMissingColumn(missing string) (MissingColumn, error) {
+	switch missing {
+	case "", "fail":
+		return MissingColumnFail, nil
+	case "skip":
+		return MissingColumnSkip, nil
+	case "fallback":
+		return MissingColumnFallback, nil
+	default:
+		return 0, fmt.Errorf("%q should be fail, skip or fallback", missing)
+	}
+}
+
+// validateTombstoneIndices makes sure a tombstone is deleted from the index its document was written to. Time
+// suffixes come from the timestamp of each record, the tombstone's being later than the document's, so the delete
+// would miss the document, which elasticsearch reports as not found and the injector as done.
+func validateTombstoneIndices(staticIndex bool, timeSuffix TimeIndexSuffix, timeLayout string, indexColumn string, indexColumnIsTime bool, extraIndices []IndexTarget) error {
+	timeSuffixed := timeSuffix != TimeSuffixNone || timeLayout != ""
+	if !staticIndex && timeSuffixed && (indexColumn == "" || indexColumnIsTime) {
+		return errors.New("KAFKA_CONSUMER_DELETE_TOMBSTONES requires ES_INDEX_STATIC, ES_TIME_SUFFIX to be none or an ES_INDEX_COLUMN of the key, time suffixed indices would miss the documents to delete")
+	}
+	for _, target := range extraIndices {
+		if target.Suffix != TimeSuffixNone {
+			return fmt.Errorf("KAFKA_CONSUMER_DELETE_TOMBSTONES requires the extra indices to have no time suffix, %s should be %s:none", target.Prefix, target.Prefix)
+		}
+	}
+	return nil
+}
+
+// parseIndexTargets parses a comma separated list of index prefixes, each optionally followed by a colon and
+// its time suffix, daily by default. Ex: "rollup:month,archive:none"
+func parseIndexTargets(value string) ([]IndexTarget, error) {
+	var targets []IndexTarget
+	for _, entry := range splitList(value) {
+		prefix, suffix := entry, ""
+		if idx := strings.Index(entry, ":"); idx >= 0 {
+			prefix, suffix = strings.TrimSpace(entry[:idx]), strings.TrimSpace(entry[idx+1:])
+		}
+		if prefix == "" {
+			return nil, fmt.Errorf("%q has no index prefix", entry)
+		}
+		timeSuffix, err := parseTimeSuffix(suffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, IndexTarget{Prefix: prefix, Suffix: timeSuffix})
+	}
+	return targets, nil
+}
+
+// splitList parses a comma separated env var, ignoring blank entries and surrounding whitespace.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseMaskedColumns parses a comma separated list of field:strategy pairs.
+func parseMaskedColumns(value string) (map[string]models.MaskStrategy, error) {
+	pairs, err := splitMap(value)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	masks := make(map[string]models.MaskStrategy, len(pairs))
+	for field, strategy := range pairs {
+		switch strategy {
+		case "sha256":
+			masks[field] = models.MaskSHA256
+		case "redact":
+			masks[field] = models.MaskRedact
+		case "last4":
+			masks[field] = models.MaskLast4
+		default:
+			return nil, fmt.Errorf("mask %q of field %s should be sha256, redact or last4", strategy, field)
+		}
+	}
+	return masks, nil
+}
+
+// parseFieldCoercions parses a comma separated list of field:type pairs.
+func parseFieldCoercions(value string) (map[string]models.Coercion, error) {
+	pairs, err := splitMap(value)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	coercions := make(map[string]models.Coercion, len(pairs))
+	for field, coercion := range pairs {
+		switch coercion {
+		case "long":
+			coercions[field] = models.CoerceLong
+		case "double":
+			coercions[field] = models.CoerceDouble
+		case "boolean":
+			coercions[field] = models.CoerceBoolean
+		case "string":
+			coercions[field] = models.CoerceString
+		default:
+			return nil, fmt.Errorf("type %q of field %s should be long, double, boolean or string", coercion, field)
+		}
+	}
+	return coercions, nil
+}
+
+// parseGeoPointFields parses a comma separated list of field:lat/lon pairs.
+func parseGeoPointFields(value string) (map[string]models.GeoPoint, error) {
+	pairs, err := splitMap(value)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	points := make(map[string]models.GeoPoint, len(pairs))
+	for field, columns := range pairs {
+		latLon := strings.Split(columns, "/")
+		if len(latLon) != 2 || strings.TrimSpace(latLon[0]) == "" || strings.TrimSpace(latLon[1]) == "" {
+			return nil, fmt.Errorf("columns %q of field %s should be in the format lat/lon", columns, field)
+		}
+		points[field] = models.GeoPoint{Lat: strings.TrimSpace(latLon[0]), Lon: strings.TrimSpace(latLon[1])}
+	}
+	return points, nil
+}
+
+// parseHeaderFields parses a comma separated list of headers, each optionally renamed as header:field.
+func parseHeaderFields(value string) (map[string]string, error) {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string]string, len(items))
+	for _, item := range items {
+		header, field := item, item
+		if pair := strings.SplitN(item, ":", 2); len(pair) == 2 {
+			header, field = strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		}
+		if header == "" || field == "" {
+			return nil, fmt.Errorf("%q should be in the format header or header:field", item)
+		}
+		fields[header] = field
+	}
+	if err := validateFieldRenames(fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// validateFieldRenames rejects renames that would make fields overwrite each other.
+func validateFieldRenames(renames map[string]string) error {
+	renamedFrom := make(map[string]string)
+	for from, to := range renames {
+		if to == "" {
+			return fmt.Errorf("field %s is renamed to an empty name", from)
+		}
+		if other, ok := renamedFrom[to]; ok {
+			return fmt.Errorf("fields %s and %s are both renamed to %s", other, from, to)
+		}
+		renamedFrom[to] = from
+	}
+	return nil
+}
+
+// encodeAPIKey accepts an api key either encoded, as elasticsearch returns it, or as its id and key joined by a
+// colon, which base64 never contains.
+func encodeAPIKey(apiKey string) string {
+	if !strings.Contains(apiKey, ":") {
+		return apiKey
+	}
+	return base64.StdEncoding.EncodeToString([]byte(apiKey))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// splitMap parses a comma separated list of key:value pairs.
+func splitMap(value string) (map[string]string, error) {
+	items := make(map[string]string)
+	for _, item := range splitList(value) {
+		pair := strings.SplitN(item, ":", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+			return nil, fmt.Errorf("%q should be in the format key:value", item)
+		}
+		items[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+	return items, nil
+}
+
+// parseTruncateFields parses a comma separated list of field:bytes pairs.
+func parseTruncateFields(value string) (map[string]int, error) {
+	pairs, err := splitMap(value)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	fields := make(map[string]int, len(pairs))
+	for field, limit := range pairs {
+		bytes, err := strconv.Atoi(limit)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("maximum size %q of field %s should be a positive number of bytes", limit, field)
+		}
+		fields[field] = bytes
+	}
+	return fields, nil
+}
+
+// validateTimeLayout makes sure a custom time layout formats into a valid index name. Any string is a
+// valid go layout, so the ones without any time element are refused as well.
+func validateTimeLayout(layout string) error {
+	if layout == "" {
+		return nil
+	}
+	reference := time.Date(2018, 11, 23, 13, 14, 15, 0, time.UTC)
+	formatted := reference.Format(layout)
+	if formatted == layout {
+		return fmt.Errorf("%q has no time element", layout)
+	}
+	if formatted != strings.ToLower(formatted) || strings.ContainsAny(formatted, "\\/*?\"<>| ,#:") {
+		return fmt.Errorf("%q formats to %q, which is not a valid index name", layout, formatted)
 	}
+	return nil
 }
@@ -0,0 +1,671 @@
+package elasticsearch
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConfig_Hosts(t *testing.T) {
+	os.Setenv("ELASTICSEARCH_HOST", " http://es-1:9200, http://es-2:9200 ,,http://es-3:9200,")
+	defer os.Unsetenv("ELASTICSEARCH_HOST")
+
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"http://es-1:9200", "http://es-2:9200", "http://es-3:9200"}, config.Hosts)
+	}
+}
+
+func TestNewConfig_UpsertRequiresDocIDColumn(t *testing.T) {
+	os.Setenv("ES_BULK_ACTION", "upsert")
+	defer os.Unsetenv("ES_BULK_ACTION")
+
+	_, err := NewConfig()
+	assert.Error(t, err)
+
+	os.Setenv("ES_DOC_ID_COLUMN", "id")
+	defer os.Unsetenv("ES_DOC_ID_COLUMN")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, BulkActionUpsert, config.BulkAction)
+	}
+}
+
+func TestNewConfig_Script(t *testing.T) {
+	os.Setenv("ES_BULK_ACTION", "script")
+	os.Setenv("ES_DOC_ID_COLUMN", "page_id")
+	defer os.Unsetenv("ES_BULK_ACTION")
+	defer os.Unsetenv("ES_DOC_ID_COLUMN")
+	_, err := NewConfig()
+	assert.Error(t, err, "a script is required")
+
+	os.Setenv("ES_SCRIPT", "ctx._source.views += params.views")
+	os.Setenv("ES_SCRIPT_UPSERT", `{"views": 0}`)
+	defer os.Unsetenv("ES_SCRIPT")
+	defer os.Unsetenv("ES_SCRIPT_UPSERT")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, BulkActionScript, config.BulkAction)
+		assert.Equal(t, "ctx._source.views += params.views", config.Script)
+		assert.Equal(t, map[string]interface{}{"views": float64(0)}, config.ScriptUpsert)
+	}
+
+	os.Setenv("ES_DEDUPE_IN_BATCH", "true")
+	_, err = NewConfig()
+	assert.Error(t, err)
+	os.Unsetenv("ES_DEDUPE_IN_BATCH")
+
+	os.Setenv("ES_SCRIPT_UPSERT", "[]")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_APIKey(t *testing.T) {
+	os.Setenv("ELASTICSEARCH_API_KEY", "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==")
+	defer os.Unsetenv("ELASTICSEARCH_API_KEY")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==", config.APIKey)
+	}
+
+	os.Setenv("ELASTICSEARCH_API_KEY", "VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw")
+	config, err = NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==", config.APIKey)
+	}
+
+	os.Setenv("ELASTICSEARCH_USERNAME", "elastic")
+	defer os.Unsetenv("ELASTICSEARCH_USERNAME")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_AWSSigV4(t *testing.T) {
+	os.Setenv("ELASTICSEARCH_AWS_SIGV4", "true")
+	defer os.Unsetenv("ELASTICSEARCH_AWS_SIGV4")
+	_, err := NewConfig()
+	assert.Error(t, err, "a region is required")
+
+	os.Setenv("AWS_REGION", "us-east-1")
+	defer os.Unsetenv("AWS_REGION")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.AWSSigV4)
+		assert.Equal(t, "us-east-1", config.AWSRegion)
+		assert.Equal(t, "es", config.AWSService)
+		assert.True(t, config.DisableSniff)
+		assert.True(t, config.DisableHealth)
+	}
+
+	os.Setenv("ELASTICSEARCH_AWS_REGION", "eu-west-1")
+	os.Setenv("ELASTICSEARCH_AWS_SERVICE", "aoss")
+	os.Setenv("ELASTICSEARCH_SNIFF", "true")
+	os.Setenv("ELASTICSEARCH_HEALTHCHECK_INTERVAL", "30s")
+	defer os.Unsetenv("ELASTICSEARCH_AWS_REGION")
+	defer os.Unsetenv("ELASTICSEARCH_AWS_SERVICE")
+	defer os.Unsetenv("ELASTICSEARCH_SNIFF")
+	defer os.Unsetenv("ELASTICSEARCH_HEALTHCHECK_INTERVAL")
+	config, err = NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "eu-west-1", config.AWSRegion)
+		assert.Equal(t, "aoss", config.AWSService)
+		assert.False(t, config.DisableSniff)
+		assert.False(t, config.DisableHealth)
+	}
+
+	os.Setenv("ELASTICSEARCH_USERNAME", "elastic")
+	defer os.Unsetenv("ELASTICSEARCH_USERNAME")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_MissingRouting(t *testing.T) {
+	os.Setenv("ES_ROUTING_MISSING", "default")
+	defer os.Unsetenv("ES_ROUTING_MISSING")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, MissingRoutingDefault, config.MissingRouting)
+	}
+
+	os.Setenv("ES_ROUTING_MISSING", "ignore")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_MissingColumns(t *testing.T) {
+	os.Setenv("ES_DOC_ID_COLUMN_MISSING", "fallback")
+	os.Setenv("ES_INDEX_COLUMN_MISSING", "skip")
+	defer os.Unsetenv("ES_DOC_ID_COLUMN_MISSING")
+	defer os.Unsetenv("ES_INDEX_COLUMN_MISSING")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, MissingColumnFallback, config.MissingDocID)
+		assert.Equal(t, MissingColumnSkip, config.MissingIndex)
+	}
+
+	os.Setenv("ES_INDEX_COLUMN_MISSING", "default")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_JoinField(t *testing.T) {
+	os.Setenv("ES_JOIN_FIELD", "relation")
+	os.Setenv("ES_JOIN_PARENT_NAME", "order")
+	os.Setenv("ES_JOIN_CHILD_NAME", "line")
+	defer os.Unsetenv("ES_JOIN_FIELD")
+	defer os.Unsetenv("ES_JOIN_PARENT_NAME")
+	defer os.Unsetenv("ES_JOIN_CHILD_NAME")
+	_, err := NewConfig()
+	assert.Error(t, err)
+
+	os.Setenv("ES_JOIN_PARENT_COLUMN", "order_id")
+	defer os.Unsetenv("ES_JOIN_PARENT_COLUMN")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "relation", config.JoinField)
+		assert.Equal(t, "order", config.JoinParentName)
+		assert.Equal(t, "line", config.JoinChildName)
+		assert.Equal(t, "order_id", config.JoinParentColumn)
+	}
+}
+
+func TestNewConfig_TopicPipelines(t *testing.T) {
+	os.Setenv("ES_PIPELINE", "geoip")
+	defer os.Unsetenv("ES_PIPELINE")
+	os.Setenv("ES_TOPIC_PIPELINES", "clicks:parse-clicks, views:")
+	defer os.Unsetenv("ES_TOPIC_PIPELINES")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "geoip", config.Pipeline)
+		assert.Equal(t, map[string]string{"clicks": "parse-clicks", "views": ""}, config.TopicPipelines)
+	}
+
+	os.Setenv("ES_TOPIC_PIPELINES", "clicks")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_DataStreamRequiresCreate(t *testing.T) {
+	os.Setenv("ES_DATA_STREAM", "true")
+	defer os.Unsetenv("ES_DATA_STREAM")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.DataStream)
+	}
+
+	os.Setenv("ES_BULK_ACTION", "index")
+	defer os.Unsetenv("ES_BULK_ACTION")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_TimeSuffix(t *testing.T) {
+	defer os.Unsetenv("ES_TIME_SUFFIX")
+	for value, expected := range map[string]TimeIndexSuffix{
+		"":        TimeSuffixDay,
+		"hourly":  TimeSuffixHour,
+		"week":    TimeSuffixWeek,
+		"monthly": TimeSuffixMonth,
+		"none":    TimeSuffixNone,
+	} {
+		os.Setenv("ES_TIME_SUFFIX", value)
+		config, err := NewConfig()
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, config.TimeSuffix)
+		}
+	}
+
+	os.Setenv("ES_TIME_SUFFIX", "yearly")
+	_, err := NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_IndexTimeSource(t *testing.T) {
+	defer os.Unsetenv("ES_INDEX_TIME_SOURCE")
+	defer os.Unsetenv("ES_INDEX_TIME_FIELD")
+	for value, expected := range map[string]IndexTimeSource{
+		"":                IndexTimeKafkaTimestamp,
+		"kafka_timestamp": IndexTimeKafkaTimestamp,
+		"processing_time": IndexTimeProcessingTime,
+	} {
+		os.Setenv("ES_INDEX_TIME_SOURCE", value)
+		config, err := NewConfig()
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, config.IndexTimeSource)
+		}
+	}
+
+	os.Setenv("ES_INDEX_TIME_SOURCE", "record_field")
+	_, err := NewConfig()
+	assert.Error(t, err)
+	os.Setenv("ES_INDEX_TIME_FIELD", "occurred_at")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, IndexTimeRecordField, config.IndexTimeSource)
+		assert.Equal(t, "occurred_at", config.IndexTimeField)
+	}
+
+	os.Setenv("ES_INDEX_TIME_SOURCE", "event_time")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_TimeLayoutAndZone(t *testing.T) {
+	defer os.Unsetenv("ES_INDEX_TIME_LAYOUT")
+	defer os.Unsetenv("ES_INDEX_TIME_ZONE")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.UTC, config.TimeZone)
+	}
+
+	os.Setenv("ES_INDEX_TIME_LAYOUT", "2006.01.02")
+	os.Setenv("ES_INDEX_TIME_ZONE", "America/Sao_Paulo")
+	config, err = NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2006.01.02", config.TimeLayout)
+		assert.Equal(t, "America/Sao_Paulo", config.TimeZone.String())
+	}
+
+	for _, layout := range []string{"daily", "Jan 2006", "2006/01/02", "15:04"} {
+		os.Setenv("ES_INDEX_TIME_LAYOUT", layout)
+		_, err = NewConfig()
+		assert.Error(t, err, layout)
+	}
+
+	os.Setenv("ES_INDEX_TIME_LAYOUT", "2006.01.02")
+	os.Setenv("ES_INDEX_TIME_ZONE", "Mars/Olympus_Mons")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_SharedIndexRequiresDocIDColumn(t *testing.T) {
+	for _, tc := range []struct {
+		settings map[string]string
+		err      string
+	}{
+		{settings: map[string]string{"KAFKA_TOPICS": "clicks,views"}},
+		{settings: map[string]string{"KAFKA_TOPICS": "clicks,clicks", "ES_INDEX": "events"}},
+		{settings: map[string]string{"KAFKA_TOPICS": "clicks,views", "ES_INDEX": "events", "ES_DOC_ID_COLUMN": "id"}},
+		{
+			settings: map[string]string{"KAFKA_TOPICS": "clicks,views", "ES_INDEX": "events", "ES_INDEX_STATIC": "true"},
+			err:      "topics clicks and views are both written to index events with the default document ids, ES_DOC_ID_COLUMN should be set",
+		},
+		{
+			settings: map[string]string{"KAFKA_TOPICS": "clicks,views", "ES_TOPIC_CONFIG": `{"views": {"index": "clicks"}}`},
+			err:      "topics clicks and views are both written to index clicks with the default document ids, ES_DOC_ID_COLUMN should be set",
+		},
+		{settings: map[string]string{"KAFKA_TOPICS": "clicks,views", "ES_INDEX": "events", "ES_TOPIC_CONFIG": `{"views": {"doc_id_column": "view_id"}}`}},
+		{
+			settings: map[string]string{"KAFKA_TOPICS_PATTERN": "events\\..*", "ES_INDEX": "events"},
+			err:      "the topics of KAFKA_TOPICS_PATTERN are all written to index events with the default document ids, ES_DOC_ID_COLUMN should be set",
+		},
+		{settings: map[string]string{"KAFKA_TOPICS_PATTERN": "events\\..*"}},
+	} {
+		_, err := NewConfigFrom(func(name string) (string, bool) {
+			value, ok := tc.settings[name]
+			return value, ok
+		})
+		if tc.err == "" {
+			assert.NoError(t, err, "%v", tc.settings)
+		} else {
+			assert.EqualError(t, err, tc.err, "%v", tc.settings)
+		}
+	}
+}
+
+func TestNewConfig_DeleteTombstonesRequiresStableIndex(t *testing.T) {
+	for _, tc := range []struct {
+		settings map[string]string
+		err      string
+	}{
+		{settings: map[string]string{}, err: "KAFKA_CONSUMER_DELETE_TOMBSTONES requires ES_INDEX_STATIC, ES_TIME_SUFFIX to be none or an ES_INDEX_COLUMN of the key, time suffixed indices would miss the documents to delete"},
+		{settings: map[string]string{"ES_TIME_SUFFIX": "hour"}, err: "KAFKA_CONSUMER_DELETE_TOMBSTONES requires ES_INDEX_STATIC, ES_TIME_SUFFIX to be none or an ES_INDEX_COLUMN of the key, time suffixed indices would miss the documents to delete"},
+		{settings: map[string]string{"ES_TIME_SUFFIX": "none", "ES_INDEX_TIME_LAYOUT": "2006.01"}, err: "KAFKA_CONSUMER_DELETE_TOMBSTONES requires ES_INDEX_STATIC, ES_TIME_SUFFIX to be none or an ES_INDEX_COLUMN of the key, time suffixed indices would miss the documents to delete"},
+		{settings: map[string]string{"ES_INDEX_COLUMN": "created_at", "ES_INDEX_COLUMN_IS_TIMESTAMP": "true"}, err: "KAFKA_CONSUMER_DELETE_TOMBSTONES requires ES_INDEX_STATIC, ES_TIME_SUFFIX to be none or an ES_INDEX_COLUMN of the key, time suffixed indices would miss the documents to delete"},
+		{settings: map[string]string{"ES_INDEX_STATIC": "true", "ES_DEAD_LETTER_MODE": "index", "ES_EXTRA_INDICES": "rollup:month"}, err: "KAFKA_CONSUMER_DELETE_TOMBSTONES requires the extra indices to have no time suffix, rollup should be rollup:none"},
+		{settings: map[string]string{"ES_INDEX_STATIC": "true", "ES_DEAD_LETTER_MODE": "index", "ES_EXTRA_INDICES": "archive:none"}},
+		{settings: map[string]string{"ES_TIME_SUFFIX": "none"}},
+		{settings: map[string]string{"ES_INDEX_COLUMN": "tenant"}},
+	} {
+		tc.settings["KAFKA_CONSUMER_DELETE_TOMBSTONES"] = "true"
+		_, err := NewConfigFrom(func(name string) (string, bool) {
+			value, ok := tc.settings[name]
+			return value, ok
+		})
+		if tc.err == "" {
+			assert.NoError(t, err, "%v", tc.settings)
+		} else {
+			assert.EqualError(t, err, tc.err, "%v", tc.settings)
+		}
+	}
+}
+
+func TestNewConfig_GeoPointFields(t *testing.T) {
+	settings := map[string]string{
+		"ES_GEO_POINT_FIELDS":         "location:lat/lon,pickup:pickup_lat/pickup_lon",
+		"ES_GEO_POINT_REMOVE_SOURCES": "true",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := settings[name]
+		return value, ok
+	}
+	config, err := NewConfigFrom(lookupEnv)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]models.GeoPoint{
+			"location": {Lat: "lat", Lon: "lon"},
+			"pickup":   {Lat: "pickup_lat", Lon: "pickup_lon"},
+		}, config.GeoPointFields)
+		assert.True(t, config.RemoveGeoSources)
+	}
+
+	settings["ES_GEO_POINT_FIELDS"] = "location:lat"
+	_, err = NewConfigFrom(lookupEnv)
+	assert.EqualError(t, err, `invalid ES_GEO_POINT_FIELDS: columns "lat" of field location should be in the format lat/lon`)
+}
+
+func TestNewConfig_FieldCoercions(t *testing.T) {
+	settings := map[string]string{
+		"ES_FIELD_COERCIONS":       "user_id:long,amount:double,active:boolean,zip:string",
+		"ES_FIELD_COERCION_ERRORS": "skip",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := settings[name]
+		return value, ok
+	}
+	config, err := NewConfigFrom(lookupEnv)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]models.Coercion{
+			"user_id": models.CoerceLong,
+			"amount":  models.CoerceDouble,
+			"active":  models.CoerceBoolean,
+			"zip":     models.CoerceString,
+		}, config.FieldCoercions)
+		assert.Equal(t, CoercionErrorsSkip, config.CoercionErrors)
+	}
+
+	settings["ES_FIELD_COERCIONS"] = "user_id:integer"
+	_, err = NewConfigFrom(lookupEnv)
+	assert.EqualError(t, err, `invalid ES_FIELD_COERCIONS: type "integer" of field user_id should be long, double, boolean or string`)
+
+	settings["ES_FIELD_COERCIONS"] = "user_id:long"
+	settings["ES_FIELD_COERCION_ERRORS"] = "dead-letter"
+	_, err = NewConfigFrom(lookupEnv)
+	assert.EqualError(t, err, "ES_DEAD_LETTER_MODE is required when ES_FIELD_COERCION_ERRORS is dead-letter")
+	settings["ES_DEAD_LETTER_MODE"] = "index"
+	_, err = NewConfigFrom(lookupEnv)
+	assert.NoError(t, err)
+}
+
+func TestNewConfig_ExternalVersionRequiresIndex(t *testing.T) {
+	os.Setenv("ES_EXTERNAL_VERSION", "true")
+	defer os.Unsetenv("ES_EXTERNAL_VERSION")
+	_, err := NewConfig()
+	assert.Error(t, err)
+
+	os.Setenv("ES_BULK_ACTION", "index")
+	defer os.Unsetenv("ES_BULK_ACTION")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.ExternalVersion)
+	}
+}
+
+func TestNewConfig_BulkProcessor(t *testing.T) {
+	os.Setenv("ES_BULK_PROCESSOR", "true")
+	defer os.Unsetenv("ES_BULK_PROCESSOR")
+	os.Setenv("ES_BULK_FLUSH_INTERVAL", "200ms")
+	defer os.Unsetenv("ES_BULK_FLUSH_INTERVAL")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.BulkProcessor)
+		assert.Equal(t, 200*time.Millisecond, config.BulkFlushInterval)
+		assert.Equal(t, 1000, config.BulkFlushActions)
+		assert.Equal(t, 5<<20, config.BulkFlushBytes)
+	}
+
+	os.Setenv("ES_BULK_FLUSH_INTERVAL", "0s")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_CircuitBreaker(t *testing.T) {
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, config.BreakerThreshold)
+		assert.Equal(t, 10*time.Second, config.BreakerInterval)
+	}
+
+	os.Setenv("ES_CIRCUIT_BREAKER_THRESHOLD", "3")
+	defer os.Unsetenv("ES_CIRCUIT_BREAKER_THRESHOLD")
+	os.Setenv("ES_CIRCUIT_BREAKER_PROBE_INTERVAL", "2s")
+	defer os.Unsetenv("ES_CIRCUIT_BREAKER_PROBE_INTERVAL")
+	config, err = NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, config.BreakerThreshold)
+		assert.Equal(t, 2*time.Second, config.BreakerInterval)
+	}
+
+	os.Setenv("ES_CIRCUIT_BREAKER_PROBE_INTERVAL", "0s")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_TopicConfig(t *testing.T) {
+	os.Setenv("ES_TOPIC_CONFIG", `{"clicks": {"index": "events", "doc_id_column": "click_id"}, "views": {"blacklisted_columns": ["ip"]}}`)
+	defer os.Unsetenv("ES_TOPIC_CONFIG")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "events", config.indexFor("clicks"))
+		assert.Equal(t, "click_id", config.docIDColumnFor("clicks"))
+		assert.Equal(t, []string{"ip"}, config.blacklistedColumnsFor("views"))
+		assert.Equal(t, "", config.indexFor("views"))
+	}
+
+	os.Setenv("ES_TOPIC_CONFIG", `{"clicks": {"doc_id": "click_id"}}`)
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_WhitelistedColumns(t *testing.T) {
+	os.Setenv("ES_WHITELISTED_COLUMNS", "id, address.city")
+	defer os.Unsetenv("ES_WHITELISTED_COLUMNS")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"id", "address.city"}, config.WhitelistedColumns)
+	}
+
+	os.Setenv("ES_BLACKLISTED_COLUMNS", "value")
+	defer os.Unsetenv("ES_BLACKLISTED_COLUMNS")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_FieldRenames(t *testing.T) {
+	os.Setenv("ES_FIELD_RENAMES", "usr_id_v2:user_id, ts:timestamp")
+	defer os.Unsetenv("ES_FIELD_RENAMES")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"usr_id_v2": "user_id", "ts": "timestamp"}, config.FieldRenames)
+	}
+
+	for _, invalid := range []string{"usr_id_v2:user_id,usr_id:user_id", "usr_id_v2:"} {
+		os.Setenv("ES_FIELD_RENAMES", invalid)
+		_, err = NewConfig()
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewConfig_HeaderFields(t *testing.T) {
+	os.Setenv("ES_HEADER_FIELDS", "traceparent, x-tenant-id:tenant")
+	defer os.Unsetenv("ES_HEADER_FIELDS")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"traceparent": "traceparent", "x-tenant-id": "tenant"}, config.HeaderFields)
+	}
+
+	for _, invalid := range []string{"x-tenant-id:tenant,tenant", "x-tenant-id:", ":tenant"} {
+		os.Setenv("ES_HEADER_FIELDS", invalid)
+		_, err = NewConfig()
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewConfig_MaskedColumns(t *testing.T) {
+	os.Setenv("ES_MASKED_COLUMNS", "email:sha256, user.card:last4,ssn:redact")
+	os.Setenv("ES_MASK_SALT", "pepper")
+	defer os.Unsetenv("ES_MASKED_COLUMNS")
+	defer os.Unsetenv("ES_MASK_SALT")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]models.MaskStrategy{
+			"email":     models.MaskSHA256,
+			"user.card": models.MaskLast4,
+			"ssn":       models.MaskRedact,
+		}, config.MaskedColumns)
+		assert.Equal(t, "pepper", config.MaskSalt)
+	}
+
+	os.Setenv("ES_MASKED_COLUMNS", "email:md5")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_Readiness(t *testing.T) {
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, ReadinessHealth, config.ReadinessMode)
+		assert.Equal(t, "yellow", config.ReadinessStatus)
+	}
+
+	os.Setenv("ES_READINESS_MODE", "ping")
+	defer os.Unsetenv("ES_READINESS_MODE")
+	os.Setenv("ES_READINESS_MIN_STATUS", "green")
+	defer os.Unsetenv("ES_READINESS_MIN_STATUS")
+	config, err = NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, ReadinessPing, config.ReadinessMode)
+		assert.Equal(t, "green", config.ReadinessStatus)
+	}
+
+	os.Setenv("ES_READINESS_MIN_STATUS", "blue")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_Client(t *testing.T) {
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.False(t, config.DisableSniff)
+		assert.Equal(t, 60*time.Second, config.HealthInterval)
+		assert.Equal(t, 0, config.ClientRetries)
+		assert.Equal(t, 30*time.Second, config.KeepAlive)
+	}
+
+	os.Setenv("ELASTICSEARCH_SNIFF", "false")
+	defer os.Unsetenv("ELASTICSEARCH_SNIFF")
+	os.Setenv("ELASTICSEARCH_CLIENT_RETRIES", "3")
+	defer os.Unsetenv("ELASTICSEARCH_CLIENT_RETRIES")
+	os.Setenv("ELASTICSEARCH_MAX_IDLE_CONNS_PER_HOST", "16")
+	defer os.Unsetenv("ELASTICSEARCH_MAX_IDLE_CONNS_PER_HOST")
+	config, err = NewConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.DisableSniff)
+		assert.Equal(t, 3, config.ClientRetries)
+		assert.Equal(t, 16, config.IdleConnsPerHost)
+	}
+}
+
+func TestNewConfig_RefreshAndActiveShards(t *testing.T) {
+	os.Setenv("ES_BULK_REFRESH", "wait_for")
+	defer os.Unsetenv("ES_BULK_REFRESH")
+	os.Setenv("ES_BULK_WAIT_FOR_ACTIVE_SHARDS", "2")
+	defer os.Unsetenv("ES_BULK_WAIT_FOR_ACTIVE_SHARDS")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "wait_for", config.Refresh)
+		assert.Equal(t, "2", config.ActiveShards)
+	}
+
+	os.Setenv("ES_BULK_WAIT_FOR_ACTIVE_SHARDS", "0")
+	_, err = NewConfig()
+	assert.Error(t, err)
+
+	os.Setenv("ES_BULK_WAIT_FOR_ACTIVE_SHARDS", "all")
+	os.Setenv("ES_BULK_REFRESH", "sometimes")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_ExtraIndices(t *testing.T) {
+	os.Setenv("ES_EXTRA_INDICES", "rollup:month, archive:none,hot")
+	defer os.Unsetenv("ES_EXTRA_INDICES")
+	_, err := NewConfig()
+	assert.EqualError(t, err, "ES_DEAD_LETTER_MODE is required when ES_EXTRA_INDICES is set")
+
+	os.Setenv("ES_DEAD_LETTER_MODE", "index")
+	defer os.Unsetenv("ES_DEAD_LETTER_MODE")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []IndexTarget{
+			{Prefix: "rollup", Suffix: TimeSuffixMonth},
+			{Prefix: "archive", Suffix: TimeSuffixNone},
+			{Prefix: "hot", Suffix: TimeSuffixDay},
+		}, config.ExtraIndices)
+	}
+
+	os.Setenv("ES_EXTRA_INDICES", "rollup:yearly")
+	_, err = NewConfig()
+	assert.Error(t, err)
+
+	os.Setenv("ES_EXTRA_INDICES", ":month")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_TruncateFields(t *testing.T) {
+	os.Setenv("ES_MAX_DOC_BYTES", "1000")
+	os.Setenv("ES_TRUNCATE_FIELDS", "message:100, request.body:20")
+	defer os.Unsetenv("ES_MAX_DOC_BYTES")
+	defer os.Unsetenv("ES_TRUNCATE_FIELDS")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1000), config.MaxDocBytes)
+		assert.Equal(t, map[string]int{"message": 100, "request.body": 20}, config.TruncateFields)
+	}
+
+	os.Setenv("ES_TRUNCATE_FIELDS", "message:0")
+	_, err = NewConfig()
+	assert.Error(t, err)
+
+	os.Setenv("ES_TRUNCATE_FIELDS", "message")
+	_, err = NewConfig()
+	assert.Error(t, err)
+}
+
+func TestNewConfig_ReportsEveryError(t *testing.T) {
+	env := map[string]string{
+		"ES_BULK_TIMEOUT":              "1 second",
+		"ES_BULK_MAX_RETRIES":          "five",
+		"ES_WHITELISTED_COLUMNS":       "id",
+		"ES_BLACKLISTED_COLUMNS":       "value",
+		"ELASTICSEARCH_HOST":           "es-1:9200",
+		"ELASTICSEARCH_API_KEY":        "id:key",
+		"ELASTICSEARCH_USERNAME":       "elastic",
+		"ES_INDEX_COLUMN_IS_TIMESTAMP": "yes",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	_, err := NewConfig()
+	assert.EqualError(t, err, `invalid ES_BULK_TIMEOUT "1 second", should be a positive duration, like 5s; `+
+		`invalid ES_BULK_MAX_RETRIES "five", should be a non negative number; `+
+		`invalid ES_INDEX_COLUMN_IS_TIMESTAMP "yes", should be true or false; `+
+		`only one of ES_WHITELISTED_COLUMNS and ES_BLACKLISTED_COLUMNS should be set; `+
+		`invalid ELASTICSEARCH_HOST "es-1:9200", should be an http or https url with a host; `+
+		`only one of ELASTICSEARCH_API_KEY and ELASTICSEARCH_USERNAME should be set`)
+}
@@ -0,0 +1,130 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// RunDatabaseContractTests checks that a RecordDatabase behaves the way the injector expects, as a subtest per
+// expectation. The factory creates a ready database for each subtest, which is closed once the subtest is over.
+// The records are written to the contract-test index.
+func RunDatabaseContractTests(t *testing.T, factory func(t *testing.T) RecordDatabase) {
+	for _, contract := range []struct {
+		name string
+		test func(t *testing.T, d RecordDatabase)
+	}{
+		{"Insert", contractInsert},
+		{"Insert_Empty", contractInsertEmpty},
+		{"Insert_Concurrent", contractInsertConcurrent},
+		{"Insert_Cancelled", contractInsertCancelled},
+		{"Insert_DeleteMissing", contractInsertDeleteMissing},
+		{"ReadinessCheck", contractReadinessCheck},
+		{"EnsureTemplate", contractEnsureTemplate},
+		{"CloseClient", contractCloseClient},
+	} {
+		contract := contract
+		t.Run(contract.name, func(t *testing.T) {
+			d := factory(t)
+			defer d.CloseClient()
+			contract.test(t, d)
+		})
+	}
+}
+
+// contractRecords are new documents, with ids no other run of the contract uses.
+func contractRecords(n int) []*models.ElasticRecord {
+	prefix := time.Now().UnixNano()
+	records := make([]*models.ElasticRecord, n)
+	for idx := range records {
+		id := fmt.Sprintf("%d-%d", prefix, idx)
+		records[idx] = &models.ElasticRecord{
+			Index: "contract-test",
+			Type:  "contract-test",
+			ID:    id,
+			Json:  map[string]interface{}{"id": id},
+		}
+	}
+	return records
+}
+
+// assertWritten checks that every document of an insert was written.
+func assertWritten(t *testing.T, res *InsertResponse, err error) {
+	if !assert.NoError(t, err) || !assert.NotNil(t, res, "a successful insert should have a response") {
+		return
+	}
+	assert.Empty(t, res.Retry)
+	assert.Empty(t, res.Rejected)
+}
+
+func contractInsert(t *testing.T, d RecordDatabase) {
+	res, err := d.Insert(context.Background(), contractRecords(3))
+	assertWritten(t, res, err)
+}
+
+// contractInsertEmpty checks that an insert without records does nothing and succeeds, be the slice nil or empty.
+func contractInsertEmpty(t *testing.T, d RecordDatabase) {
+	res, err := d.Insert(context.Background(), nil)
+	assertWritten(t, res, err)
+	res, err = d.Insert(context.Background(), []*models.ElasticRecord{})
+	assertWritten(t, res, err)
+}
+
+// contractInsertConcurrent checks that inserts can run at the same time, like the batches of several partitions.
+func contractInsertConcurrent(t *testing.T, d RecordDatabase) {
+	records := contractRecords(40)
+	var wg sync.WaitGroup
+	responses := make([]*InsertResponse, 4)
+	errs := make([]error, len(responses))
+	for idx := range responses {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			batch := records[idx*10 : (idx+1)*10]
+			responses[idx], errs[idx] = d.Insert(context.Background(), batch)
+		}(idx)
+	}
+	wg.Wait()
+	for idx := range responses {
+		assertWritten(t, responses[idx], errs[idx])
+	}
+}
+
+// contractInsertCancelled checks that an insert fails once its context is done, instead of reporting the records
+// as written.
+func contractInsertCancelled(t *testing.T, d RecordDatabase) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := d.Insert(ctx, contractRecords(1))
+	assert.Error(t, err)
+}
+
+// contractInsertDeleteMissing checks that deleting a document that doesn't exist succeeds, the tombstone being
+// applied already.
+func contractInsertDeleteMissing(t *testing.T, d RecordDatabase) {
+	records := contractRecords(1)
+	records[0].Deleted = true
+	res, err := d.Insert(context.Background(), records)
+	assertWritten(t, res, err)
+}
+
+func contractReadinessCheck(t *testing.T, d RecordDatabase) {
+	assert.True(t, d.ReadinessCheck())
+}
+
+// contractEnsureTemplate checks that the template can be ensured before every insert.
+func contractEnsureTemplate(t *testing.T, d RecordDatabase) {
+	assert.NoError(t, d.EnsureTemplate())
+	assert.NoError(t, d.EnsureTemplate())
+}
+
+// contractCloseClient checks that closing a database twice does nothing, the store closes it on shutdown.
+func contractCloseClient(t *testing.T, d RecordDatabase) {
+	d.CloseClient()
+	d.CloseClient()
+}
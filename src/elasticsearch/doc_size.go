@@ -0,0 +1,129 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/olivere/elastic"
+)
+
+// FailureDocumentTooLarge is the type of the failures of documents refused for their size before being sent.
+const FailureDocumentTooLarge = "document_too_large"
+
+// sizedRequest builds the bulk request of a record along with its size. Documents larger than MaxDocBytes have
+// their TruncateFields cut down, the ones still too large are returned as a failure instead of a request.
+func (d recordDatabase) sizedRequest(record *models.ElasticRecord) (elastic.BulkableRequest, int64, *Failure, error) {
+	request, size, err := d.requestWithSize(record)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	maxBytes := d.config.MaxDocBytes
+	if maxBytes <= 0 || size <= maxBytes {
+		return request, size, nil, nil
+	}
+	originalSize := size
+	if len(d.config.TruncateFields) > 0 && !record.Deleted {
+		if truncated, ok := truncateFields(record.Json, d.config.TruncateFields); ok {
+			truncatedRecord := *record
+			truncatedRecord.Json = truncated
+			if request, size, err = d.requestWithSize(&truncatedRecord); err != nil {
+				return nil, 0, nil, err
+			}
+		}
+	}
+	if size <= maxBytes {
+		level.Warn(d.logger).Log(
+			"message", "oversized document truncated",
+			"index", record.Index,
+			"doc_id", record.ID,
+			"size", originalSize,
+			"truncated_size", size,
+		)
+		return request, size, nil, nil
+	}
+	level.Error(d.logger).Log(
+		"message", "oversized document dropped",
+		"index", record.Index,
+		"doc_id", record.ID,
+		"size", size,
+		"max_doc_bytes", maxBytes,
+	)
+	return nil, size, &Failure{
+		Index:    record.Index,
+		DocID:    record.ID,
+		Pipeline: record.Pipeline,
+		Status:   http.StatusRequestEntityTooLarge,
+		Type:     FailureDocumentTooLarge,
+		Reason:   fmt.Sprintf("%d bytes exceed the maximum document size of %d bytes", size, maxBytes),
+	}, nil
+}
+
+func (d recordDatabase) requestWithSize(record *models.ElasticRecord) (elastic.BulkableRequest, int64, error) {
+	request, err := d.bulkableRequest(record)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := bulkableSize(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	return request, size, nil
+}
+
+// truncateFields cuts the string fields down to their maximum number of bytes, fields are dotted paths into
+// nested objects. The document is left untouched, a copy is returned if any field was truncated.
+func truncateFields(document map[string]interface{}, limits map[string]int) (map[string]interface{}, bool) {
+	truncated := document
+	changed := false
+	for field, limit := range limits {
+		if result, ok := truncateField(truncated, strings.Split(field, "."), limit); ok {
+			truncated = result
+			changed = true
+		}
+	}
+	return truncated, changed
+}
+
+func truncateField(document map[string]interface{}, path []string, limit int) (map[string]interface{}, bool) {
+	value, exists := document[path[0]]
+	if !exists {
+		return nil, false
+	}
+	var replacement interface{}
+	if len(path) == 1 {
+		str, ok := value.(string)
+		if !ok || len(str) <= limit {
+			return nil, false
+		}
+		replacement = truncateString(str, limit)
+	} else {
+		nested, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		result, ok := truncateField(nested, path[1:], limit)
+		if !ok {
+			return nil, false
+		}
+		replacement = result
+	}
+	documentCopy := make(map[string]interface{}, len(document))
+	for key, value := range document {
+		documentCopy[key] = value
+	}
+	documentCopy[path[0]] = replacement
+	return documentCopy, true
+}
+
+// truncateString keeps at most limit bytes of the string, without leaving half of a multi byte character behind.
+func truncateString(str string, limit int) string {
+	str = str[:limit]
+	for !utf8.ValidString(str) {
+		str = str[:len(str)-1]
+	}
+	return str
+}
@@ -0,0 +1,61 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateFields(t *testing.T) {
+	document := map[string]interface{}{
+		"message": "ação ação",
+		"count":   10,
+		"request": map[string]interface{}{"body": "abcdef", "method": "GET"},
+	}
+	truncated, ok := truncateFields(document, map[string]int{"message": 4, "request.body": 3, "count": 1, "missing.field": 1})
+	if assert.True(t, ok) {
+		// the cut doesn't split the two bytes of ã
+		assert.Equal(t, "aç", truncated["message"])
+		assert.Equal(t, 10, truncated["count"])
+		assert.Equal(t, map[string]interface{}{"body": "abc", "method": "GET"}, truncated["request"])
+	}
+	assert.Equal(t, "ação ação", document["message"], "the original document should be left untouched")
+	assert.Equal(t, "abcdef", document["request"].(map[string]interface{})["body"])
+
+	_, ok = truncateFields(document, map[string]int{"message": 100})
+	assert.False(t, ok)
+}
+
+func TestRecordDatabase_Insert_MaxDocBytes(t *testing.T) {
+	var bulks [][]string
+	server := newMockElasticsearch(newMockBulk(&bulks, nil))
+	defer server.Close()
+	d := newTestDatabase(t, Config{
+		Hosts:          []string{server.URL},
+		BulkTimeout:    time.Second,
+		MaxDocBytes:    200,
+		TruncateFields: map[string]int{"message": 50},
+	})
+	defer d.CloseClient()
+	records := []*models.ElasticRecord{
+		{Index: "i", Type: "t", ID: "small", Json: map[string]interface{}{"message": "a"}},
+		{Index: "i", Type: "t", ID: "truncated", Json: map[string]interface{}{"message": strings.Repeat("a", 500)}},
+		{Index: "i", Type: "t", ID: "large", Json: map[string]interface{}{"payload": strings.Repeat("a", 500)}},
+	}
+
+	res, err := d.Insert(context.Background(), records)
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]string{{"small", "truncated"}}, bulks)
+		if assert.Len(t, res.Rejected, 1) {
+			assert.Equal(t, "large", res.Rejected[0].DocID)
+			assert.Equal(t, FailureDocumentTooLarge, res.Rejected[0].Type)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, res.Rejected[0].Status)
+		}
+	}
+	assert.Len(t, records[1].Json["message"], 500, "the record should keep its whole field for retries")
+}
@@ -0,0 +1,158 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/olivere/elastic"
+)
+
+// DryRunStdout is the DryRunOutput that writes the documents to the standard output.
+const DryRunStdout = "stdout"
+
+var errDryRun = errors.New("elasticsearch is not contacted in dry run mode")
+
+// dryRunDatabase builds the bulk requests of the records like an insert does and writes them out instead of
+// sending them. Every record is reported as inserted without ever contacting elasticsearch, except the ones
+// an insert would drop for their size.
+type dryRunDatabase struct {
+	recordDatabase
+	output *dryRunOutput
+}
+
+// dryRunOutput writes a json line per document, or logs them when there is no writer.
+type dryRunOutput struct {
+	lock    sync.Mutex
+	writer  io.Writer
+	encoder *json.Encoder
+}
+
+// DryRunDocument is the preview of the bulk item of a record.
+type DryRunDocument struct {
+	Action   string          `json:"action"`
+	Index    string          `json:"index"`
+	Type     string          `json:"type,omitempty"`
+	DocID    string          `json:"doc_id,omitempty"`
+	Routing  string          `json:"routing,omitempty"`
+	Pipeline string          `json:"pipeline,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+}
+
+func newDryRunDatabase(db recordDatabase) (dryRunDatabase, error) {
+	output := &dryRunOutput{}
+	switch db.config.DryRunOutput {
+	case "":
+	case DryRunStdout:
+		output.writer = os.Stdout
+	default:
+		file, err := os.OpenFile(db.config.DryRunOutput, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return dryRunDatabase{}, fmt.Errorf("could not open dry run output %s: %v", db.config.DryRunOutput, err)
+		}
+		output.writer = file
+	}
+	if output.writer != nil {
+		output.encoder = json.NewEncoder(output.writer)
+	}
+	// without a cluster to ask, the document types are omitted like for elasticsearch 7 and later
+	atomic.StoreInt32(&db.conn.majorVersion, 7)
+	return dryRunDatabase{recordDatabase: db, output: output}, nil
+}
+
+func (d dryRunDatabase) GetClient() (*elastic.Client, error) {
+	return nil, errDryRun
+}
+
+func (d dryRunDatabase) Insert(ctx context.Context, records []*models.ElasticRecord) (*InsertResponse, error) {
+	res := &InsertResponse{[]string{}, []*models.ElasticRecord{}, []Failure{}, false}
+	for _, record := range records {
+		request, size, failure, err := d.sizedRequest(record)
+		if err != nil {
+			return nil, err
+		}
+		if failure == nil {
+			failure = d.tooLargeForBulk(record, size)
+		}
+		if failure != nil {
+			res.Rejected = append(res.Rejected, *failure)
+			continue
+		}
+		document, err := d.preview(record, request)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.output.write(d, document); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// preview describes the bulk item of a record from the lines the bulk request would send.
+func (d dryRunDatabase) preview(record *models.ElasticRecord, request elastic.BulkableRequest) (DryRunDocument, error) {
+	lines, err := request.Source()
+	if err != nil {
+		return DryRunDocument{}, err
+	}
+	var meta map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(lines[0]), &meta); err != nil {
+		return DryRunDocument{}, err
+	}
+	document := DryRunDocument{
+		Index:    record.Index,
+		Type:     d.docType(record),
+		DocID:    record.ID,
+		Routing:  record.Routing,
+		Pipeline: record.Pipeline,
+	}
+	for action := range meta {
+		document.Action = action
+	}
+	if len(lines) > 1 {
+		document.Body = json.RawMessage(lines[1])
+	}
+	return document, nil
+}
+
+func (o *dryRunOutput) write(d dryRunDatabase, document DryRunDocument) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.encoder != nil {
+		return o.encoder.Encode(document)
+	}
+	level.Info(d.logger).Log(
+		"message", "dry run document",
+		"action", document.Action,
+		"index", document.Index,
+		"doc_id", document.DocID,
+		"routing", document.Routing,
+		"body", string(document.Body),
+	)
+	return nil
+}
+
+func (d dryRunDatabase) ReadinessCheck() bool {
+	return true
+}
+
+func (d dryRunDatabase) EnsureTemplate() error {
+	return nil
+}
+
+// CloseClient closes the output file, if any.
+func (d dryRunDatabase) CloseClient() {
+	d.output.lock.Lock()
+	defer d.output.lock.Unlock()
+	if file, ok := d.output.writer.(*os.File); ok && file != os.Stdout {
+		file.Close()
+	}
+	d.output.writer, d.output.encoder = nil, nil
+}
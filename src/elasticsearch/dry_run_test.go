@@ -0,0 +1,81 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunDatabase_Insert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dry_run")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "documents.ndjson")
+	// no hosts, elasticsearch is never contacted
+	d := newTestDatabase(t, Config{
+		DryRun:       true,
+		DryRunOutput: output,
+		BulkAction:   BulkActionIndex,
+		MaxDocBytes:  200,
+	})
+	assert.True(t, d.ReadinessCheck())
+	assert.NoError(t, d.EnsureTemplate())
+	_, err = d.GetClient()
+	assert.Error(t, err)
+
+	res, err := d.Insert(context.Background(), []*models.ElasticRecord{
+		{Index: "orders-2026.10.14", Type: "orders", ID: "1", Routing: "br", Json: map[string]interface{}{"user": "a"}},
+		{Index: "orders-2026.10.14", Type: "orders", ID: "2", Deleted: true},
+		{Index: "orders-2026.10.14", Type: "orders", ID: "3", Json: map[string]interface{}{"text": strings.Repeat("x", 300)}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, res.Retry)
+	if assert.Len(t, res.Rejected, 1) {
+		assert.Equal(t, "3", res.Rejected[0].DocID)
+		assert.Equal(t, FailureDocumentTooLarge, res.Rejected[0].Type)
+	}
+	d.CloseClient()
+
+	content, err := ioutil.ReadFile(output)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if !assert.Len(t, lines, 2) {
+		return
+	}
+	var indexed, deleted DryRunDocument
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &indexed))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &deleted))
+	assert.Equal(t, DryRunDocument{
+		Action:  "index",
+		Index:   "orders-2026.10.14",
+		DocID:   "1",
+		Routing: "br",
+		Body:    json.RawMessage(`{"user":"a"}`),
+	}, indexed)
+	assert.Equal(t, DryRunDocument{Action: "delete", Index: "orders-2026.10.14", DocID: "2"}, deleted)
+}
+
+func TestNewConfig_DryRun(t *testing.T) {
+	os.Setenv("DRY_RUN", "true")
+	os.Setenv("DRY_RUN_OUTPUT", DryRunStdout)
+	defer os.Unsetenv("DRY_RUN")
+	defer os.Unsetenv("DRY_RUN_OUTPUT")
+	config, err := NewConfig()
+	if assert.NoError(t, err) {
+		assert.True(t, config.DryRun)
+		assert.Equal(t, DryRunStdout, config.DryRunOutput)
+	}
+}
@@ -2,10 +2,16 @@ package elasticsearch
 
 import (
 	"context"
-
+	"errors"
 	"fmt"
-
+	"hash/fnv"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -13,123 +19,753 @@ import (
 	"github.com/olivere/elastic"
 )
 
-var esClient *elastic.Client
-
 type basicDatabase interface {
-	GetClient() *elastic.Client
+	GetClient() (*elastic.Client, error)
 	CloseClient()
 }
 
+// RecordDatabase is where the store writes the documents, elasticsearch or a custom sink. Its methods may be
+// called concurrently. RunDatabaseContractTests checks an implementation against what the store expects, and
+// FakeDatabase fakes one in tests.
 type RecordDatabase interface {
 	basicDatabase
-	Insert(records []*models.ElasticRecord) (*InsertResponse, error)
+	// Insert writes the records. Without an error the response is not nil and every record it doesn't list was
+	// written, while an error means none of the records count as written. Nil or empty records succeed without
+	// writing anything, deleting a missing document succeeds and the insert fails once the context is done.
+	Insert(ctx context.Context, records []*models.ElasticRecord) (*InsertResponse, error)
+	// ReadinessCheck tells whether the database can take writes.
 	ReadinessCheck() bool
+	// EnsureTemplate is called before each insert, it should be cheap once the template is in place.
+	EnsureTemplate() error
 }
 
 type recordDatabase struct {
 	logger log.Logger
 	config Config
+	conn   *connection
 }
 
-func (d recordDatabase) GetClient() *elastic.Client {
-	if esClient == nil {
-		client, err := elastic.NewClient(elastic.SetURL(d.config.Host))
+// connection is the client of a database and what is known about its cluster, shared by the copies of
+// the database.
+type connection struct {
+	mutex  sync.Mutex
+	client *elastic.Client
+	// majorVersion is the major version of the cluster, 0 while unknown
+	majorVersion int32
+	// templateApplied is set once the configured index template is known to be in place
+	templateApplied int32
+}
+
+// GetClient returns the client of the database, connecting again if it was closed.
+func (d recordDatabase) GetClient() (*elastic.Client, error) {
+	d.conn.mutex.Lock()
+	defer d.conn.mutex.Unlock()
+	if d.conn.client == nil {
+		client, err := newClient(d.config)
 		if err != nil {
 			level.Error(d.logger).Log("err", err, "message", "could not init elasticsearch client")
-			panic(err)
+			return nil, fmt.Errorf("could not init elasticsearch client: %s", err)
 		}
-		esClient = client
+		d.conn.client = client
+	}
+	return d.conn.client, nil
+}
+
+func newClient(config Config) (*elastic.Client, error) {
+	// the client balances requests across all hosts and skips the ones marked as dead
+	options := []elastic.ClientOptionFunc{elastic.SetURL(config.Hosts...)}
+	if config.ConnectTimeout > 0 {
+		// how long the client waits for a node to answer before failing to connect
+		options = append(options,
+			elastic.SetHealthcheckTimeoutStartup(config.ConnectTimeout),
+			elastic.SetSnifferTimeoutStartup(config.ConnectTimeout),
+		)
+	}
+	if len(config.Hosts) > 0 && strings.HasPrefix(config.Hosts[0], "https://") {
+		// nodes found by sniffing are reached with this scheme
+		options = append(options, elastic.SetScheme("https"))
+	}
+	httpClient, err := config.httpClient()
+	if err != nil {
+		return nil, err
 	}
-	return esClient
+	options = append(options, elastic.SetHttpClient(httpClient))
+	if config.DisableSniff {
+		// the nodes may advertise addresses that can't be reached from here, only the configured hosts are used
+		options = append(options, elastic.SetSniff(false))
+	}
+	if config.DisableHealth {
+		options = append(options, elastic.SetHealthcheck(false))
+	} else if config.HealthInterval > 0 {
+		options = append(options, elastic.SetHealthcheckInterval(config.HealthInterval))
+	}
+	if config.ClientRetries > 0 {
+		options = append(options, elastic.SetRetrier(clientRetrier{
+			retries:    config.ClientRetries,
+			backoff:    config.ClientBackoff,
+			maxBackoff: config.ClientMaxBackoff,
+		}))
+	}
+	if config.Username != "" {
+		// the client applies these credentials to every request, pings included
+		options = append(options, elastic.SetBasicAuth(config.Username, config.Password))
+	}
+	return elastic.NewClient(options...)
+}
+
+// bulkClient is the BulkClient of the client of the database, connecting again if it was closed.
+func (d recordDatabase) bulkClient() (BulkClient, error) {
+	client, err := d.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	return olivereClient{client}, nil
 }
 
+// CloseClient stops the client, closing an already closed database does nothing.
 func (d recordDatabase) CloseClient() {
-	if esClient != nil {
-		esClient.Stop()
-		esClient = nil
+	d.conn.mutex.Lock()
+	defer d.conn.mutex.Unlock()
+	if d.conn.client != nil {
+		d.conn.client.Stop()
+		d.conn.client = nil
 	}
+	atomic.StoreInt32(&d.conn.majorVersion, 0)
+	atomic.StoreInt32(&d.conn.templateApplied, 0)
 }
 
+// InsertResponse describes the documents that were not indexed by a bulk request, everything else succeeded.
+// Retry holds the documents that failed with transient errors and can be sent again on their own, while
+// Rejected holds the failures that would happen again on a retry.
 type InsertResponse struct {
 	AlreadyExists []string
 	Retry         []*models.ElasticRecord
+	Rejected      []Failure
 	Overloaded    bool
 }
 
-func (d recordDatabase) Insert(records []*models.ElasticRecord) (*InsertResponse, error) {
-	bulkRequest, err := d.buildBulkRequest(records)
+// Failure describes why elasticsearch refused to index a document.
+type Failure struct {
+	Index    string
+	DocID    string
+	Pipeline string
+	Status   int
+	Type     string
+	Reason   string
+}
+
+// DocumentKey identifies a document by its index and id, since the copies of a record on the extra indices, or
+// records routed to several indices by their index column, share their id.
+type DocumentKey struct {
+	Index string
+	ID    string
+}
+
+// KeyOf is the key of a document.
+func KeyOf(document *models.ElasticRecord) DocumentKey {
+	return DocumentKey{Index: document.Index, ID: document.ID}
+}
+
+// Key is the key of the document that failed.
+func (f Failure) Key() DocumentKey {
+	return DocumentKey{Index: f.Index, ID: f.DocID}
+}
+
+func newFailure(item BulkItem) Failure {
+	return Failure{Index: item.Index, DocID: item.ID, Status: item.Status, Type: item.ErrorType, Reason: item.ErrorReason}
+}
+
+func (f Failure) String() string {
+	if f.Pipeline != "" {
+		return fmt.Sprintf("document %s on index %s with pipeline %s failed with status %d: %s: %s", f.DocID, f.Index, f.Pipeline, f.Status, f.Type, f.Reason)
+	}
+	return fmt.Sprintf("document %s on index %s failed with status %d: %s: %s", f.DocID, f.Index, f.Status, f.Type, f.Reason)
+}
+
+// Insert writes the records with up to BulkConcurrency parallel bulk requests, sharding them by document id so
+// that writes of the same document keep their order. The response gathers the failures of all requests and
+// any request error fails the whole insert. Cancelling the context aborts the requests in flight.
+func (d recordDatabase) Insert(ctx context.Context, records []*models.ElasticRecord) (*InsertResponse, error) {
+	if err := d.ensureMajorVersion(); err != nil {
+		return nil, err
+	}
+	shards := shardByID(records, d.config.BulkConcurrency)
+	if len(shards) <= 1 {
+		return d.insertShard(ctx, records)
+	}
+	responses := make([]*InsertResponse, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for idx, shard := range shards {
+		wg.Add(1)
+		go func(idx int, shard []*models.ElasticRecord) {
+			defer wg.Done()
+			responses[idx], errs[idx] = d.insertShard(ctx, shard)
+		}(idx, shard)
+	}
+	wg.Wait()
+	res := &InsertResponse{[]string{}, []*models.ElasticRecord{}, []Failure{}, false}
+	for idx := range shards {
+		if errs[idx] != nil {
+			return nil, errs[idx]
+		}
+		res.merge(responses[idx])
+	}
+	return res, nil
+}
+
+// shardByID splits the records in up to n groups, records with the same id always fall in the same group
+// and keep their relative order.
+func shardByID(records []*models.ElasticRecord, n int) [][]*models.ElasticRecord {
+	if n <= 1 {
+		return [][]*models.ElasticRecord{records}
+	}
+	shards := make([][]*models.ElasticRecord, n)
+	for _, record := range records {
+		hash := fnv.New32a()
+		hash.Write([]byte(record.ID))
+		idx := hash.Sum32() % uint32(n)
+		shards[idx] = append(shards[idx], record)
+	}
+	nonEmpty := shards[:0]
+	for _, shard := range shards {
+		if len(shard) > 0 {
+			nonEmpty = append(nonEmpty, shard)
+		}
+	}
+	return nonEmpty
+}
+
+func (r *InsertResponse) merge(other *InsertResponse) {
+	r.AlreadyExists = append(r.AlreadyExists, other.AlreadyExists...)
+	r.Retry = append(r.Retry, other.Retry...)
+	r.Rejected = append(r.Rejected, other.Rejected...)
+	r.Overloaded = r.Overloaded || other.Overloaded
+}
+
+// insertShard writes the records with as many sequential bulk requests as needed to keep each under
+// BulkMaxBytes.
+func (d recordDatabase) insertShard(ctx context.Context, records []*models.ElasticRecord) (*InsertResponse, error) {
+	client, err := d.bulkClient()
+	if err != nil {
+		return nil, err
+	}
+	chunks, tooLarge, err := d.buildBulkRequests(records)
 	if err != nil {
 		return nil, err
 	}
-	timeout := d.config.BulkTimeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if len(tooLarge) > 0 {
+		level.Error(d.logger).Log(
+			"message", "documents larger than the maximum bulk size",
+			"batch_size", len(records),
+			"doc_count", len(tooLarge),
+			"index", tooLarge[0].Index,
+			"doc_id", tooLarge[0].DocID,
+			"reason", tooLarge[0].Reason,
+		)
+	}
+	res := &InsertResponse{[]string{}, []*models.ElasticRecord{}, tooLarge, false}
+	for _, chunk := range chunks {
+		chunkRes, err := d.doBulk(ctx, client, chunk.request, chunk.records)
+		if err != nil {
+			return nil, err
+		}
+		res.merge(chunkRes)
+	}
+	return res, nil
+}
+
+// doBulk sends a bulk request, which takes at most BulkTimeout and is aborted sooner if the context is done.
+func (d recordDatabase) doBulk(ctx context.Context, client BulkClient, bulkRequest BulkRequest, records []*models.ElasticRecord) (*InsertResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.config.BulkTimeout)
 	defer cancel()
-	res, err := bulkRequest.Do(ctx)
+	items, err := client.Bulk(ctx, bulkRequest)
 
 	if err != nil {
 		return nil, err
 	}
-	if res.Errors {
-		created := res.Created()
-		var alreadyExistsIds []string
-		for _, c := range created {
-			if c.Status == http.StatusConflict {
-				alreadyExistsIds = append(alreadyExistsIds, c.Id)
-			}
-		}
-		if len(alreadyExistsIds) > 0 {
-			level.Warn(d.logger).Log("message", "document already exists", "doc_count", len(alreadyExistsIds))
+	return d.classifyBulkResponse(items, records), nil
+}
+
+// failedItem is a failed item of a bulk response along with the record it was sent for.
+type failedItem struct {
+	result BulkItem
+	record *models.ElasticRecord
+}
+
+// failedItems are the failed items of a bulk response, the records found by the _index and _id of the items. The
+// items of write aliases and data streams name their backing index, and the ids generated by elasticsearch are
+// unknown beforehand, so those are found by their position, bulk responses keeping the order of the requests.
+func failedItems(items []BulkItem, records []*models.ElasticRecord) []failedItem {
+	var byKey map[DocumentKey]*models.ElasticRecord
+	var failed []failedItem
+	for idx, result := range items {
+		if result.succeeded() {
+			continue
 		}
-		failed := res.Failed()
-		var retry []*models.ElasticRecord
-		overloaded := false
-		if len(failed) > 0 {
-			recordMap := make(map[string]*models.ElasticRecord)
+		if byKey == nil {
+			byKey = make(map[DocumentKey]*models.ElasticRecord, len(records))
 			for _, rec := range records {
-				recordMap[rec.ID] = rec
+				byKey[KeyOf(rec)] = rec
 			}
-			for _, f := range failed {
-				if f.Status == http.StatusConflict {
-					continue
-				}
-				retry = append(retry, recordMap[f.Id])
-				if f.Status == http.StatusTooManyRequests {
-					//es is overloaded, backoff
-					overloaded = true
-				}
+		}
+		rec, ok := byKey[DocumentKey{Index: result.Index, ID: result.ID}]
+		if !ok && idx < len(records) {
+			rec = records[idx]
+		}
+		failed = append(failed, failedItem{result: result, record: rec})
+	}
+	return failed
+}
+
+// itemsOf are the items of the action.
+func itemsOf(items []BulkItem, action string) []BulkItem {
+	var matching []BulkItem
+	for _, item := range items {
+		if item.Action == action {
+			matching = append(matching, item)
+		}
+	}
+	return matching
+}
+
+// classifyBulkResponse sorts the failed items of a bulk response in the ones to retry, the rejected ones and the
+// ones that can be ignored.
+func (d recordDatabase) classifyBulkResponse(items []BulkItem, records []*models.ElasticRecord) *InsertResponse {
+	failed := failedItems(items, records)
+	if len(failed) == 0 {
+		return &InsertResponse{[]string{}, []*models.ElasticRecord{}, []Failure{}, false}
+	}
+	var alreadyExistsIds []string
+	for _, c := range itemsOf(items, "create") {
+		if c.Status == http.StatusConflict {
+			alreadyExistsIds = append(alreadyExistsIds, c.ID)
+		}
+	}
+	if d.config.ExternalVersion {
+		// the document already holds data at least as new as the record
+		for _, item := range append(itemsOf(items, "index"), itemsOf(items, "delete")...) {
+			if item.Status == http.StatusConflict {
+				alreadyExistsIds = append(alreadyExistsIds, item.ID)
 			}
-			if overloaded {
-				level.Warn(d.logger).Log("message", "insert failed: elasticsearch is overloaded", "retry_count", len(retry))
+		}
+	}
+	if len(alreadyExistsIds) > 0 {
+		level.Warn(d.logger).Log("message", "document already exists", "doc_count", len(alreadyExistsIds))
+	}
+	// deleting a document that doesn't exist is not a failure, the tombstone was already applied
+	alreadyDeleted := make(map[DocumentKey]bool)
+	for _, del := range itemsOf(items, "delete") {
+		if del.Status == http.StatusNotFound {
+			alreadyDeleted[DocumentKey{Index: del.Index, ID: del.ID}] = true
+		}
+	}
+	var retry []*models.ElasticRecord
+	var rejected []Failure
+	retryTypes := make(map[string]int)
+	overloaded := false
+	for _, item := range failed {
+		f, rec := item.result, item.record
+		if f.Status == http.StatusConflict && (d.config.BulkAction == BulkActionCreate || d.config.ExternalVersion) {
+			continue
+		}
+		if f.Status == http.StatusNotFound && alreadyDeleted[DocumentKey{Index: f.Index, ID: f.ID}] {
+			continue
+		}
+		if d.config.StaticIndex && f.ErrorType == "index_not_found_exception" {
+			// the write alias may not have been bootstrapped yet, give it time
+			retry = append(retry, rec)
+			continue
+		}
+		if !isRetryableStatus(f.Status) && f.Status != http.StatusConflict {
+			failure := newFailure(f)
+			if rec != nil {
+				// reported on the index the document was sent to, like the alias of the backing index
+				failure.Index = rec.Index
+				failure.Pipeline = rec.Pipeline
 			}
+			rejected = append(rejected, failure)
+			continue
+		}
+		// updates of the same document conflict when concurrent, let them try again
+		retry = append(retry, rec)
+		retryTypes[newFailure(f).kind()]++
+		if f.Status == http.StatusTooManyRequests {
+			//es is overloaded, backoff
+			overloaded = true
 		}
-		return &InsertResponse{alreadyExistsIds, retry, overloaded}, nil
 	}
+	if len(rejected) > 0 {
+		level.Error(d.logger).Log(
+			"message", "documents rejected by elasticsearch",
+			"batch_size", len(records),
+			"doc_count", len(rejected),
+			"by_type", countByType(rejected),
+			"index", rejected[0].Index,
+			"doc_id", rejected[0].DocID,
+			"status", rejected[0].Status,
+			"error_type", rejected[0].Type,
+			"reason", rejected[0].Reason,
+		)
+	}
+	if overloaded {
+		level.Warn(d.logger).Log("message", "insert failed: elasticsearch is overloaded", "retry_count", len(retry), "by_type", formatCounts(retryTypes))
+	}
+	return &InsertResponse{alreadyExistsIds, retry, rejected, overloaded}
+}
 
-	return &InsertResponse{[]string{}, []*models.ElasticRecord{}, false}, nil
+// RejectedError reports documents elasticsearch refused for reasons a retry won't fix, all the other
+// documents of the batch were indexed.
+type RejectedError struct {
+	Failures []Failure
 }
 
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%d documents rejected by elasticsearch(%s), first failure: %s", len(e.Failures), countByType(e.Failures), e.Failures[0])
+}
+
+// kind is the elasticsearch error type of the failure, or its status when elasticsearch gave no type.
+func (f Failure) kind() string {
+	if f.Type != "" {
+		return f.Type
+	}
+	return "status_" + strconv.Itoa(f.Status)
+}
+
+// countByType summarizes failures as the number of each error type, like "mapper_parsing_exception=2".
+func countByType(failures []Failure) string {
+	counts := make(map[string]int)
+	for _, failure := range failures {
+		counts[failure.kind()]++
+	}
+	return formatCounts(counts)
+}
+
+func formatCounts(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	summary := make([]string, len(kinds))
+	for idx, kind := range kinds {
+		summary[idx] = fmt.Sprintf("%s=%d", kind, counts[kind])
+	}
+	return strings.Join(summary, " ")
+}
+
+// IsRetryable tells whether a failed insert is worth retrying. Requests that got no response(timeouts,
+// connection failures) or that were refused because elasticsearch is overloaded are retryable.
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *RejectedError:
+		return false
+	case *elastic.Error:
+		return isRetryableStatus(e.Status)
+	default:
+		return true
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// readinessRequestTimeout is how long a readiness check waits for elasticsearch on top of ReadinessTimeout
+const readinessRequestTimeout = 5 * time.Second
+
+// ReadinessCheck tells whether elasticsearch can take writes: by default whether the cluster has at least the
+// configured health status, or only whether a host answers a ping.
 func (d recordDatabase) ReadinessCheck() bool {
-	info, _, err := d.GetClient().Ping(d.config.Host).Do(context.Background())
+	client, err := d.bulkClient()
+	if err != nil {
+		return false
+	}
+	if d.config.ReadinessMode == ReadinessPing {
+		return d.pingCheck(client)
+	}
+	return d.healthCheck(client)
+}
+
+// healthCheck waits up to ReadinessTimeout for the cluster to reach ReadinessStatus. The write index or alias
+// must also exist when ReadinessIndex is set.
+func (d recordDatabase) healthCheck(client BulkClient) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.ReadinessTimeout+readinessRequestTimeout)
+	defer cancel()
+	// elasticsearch answers with an error status when the cluster doesn't reach the status in time
+	health, err := client.ClusterHealth(ctx, d.config.ReadinessStatus, d.config.ReadinessTimeout)
 	if err != nil {
-		level.Error(d.logger).Log("err", err, "message", "error pinging elasticsearch")
+		level.Error(d.logger).Log("err", err, "message", "elasticsearch cluster is not healthy", "min_status", d.config.ReadinessStatus)
+		return false
+	}
+	if health.TimedOut {
+		level.Error(d.logger).Log("message", "elasticsearch cluster is not healthy", "status", health.Status, "min_status", d.config.ReadinessStatus)
 		return false
 	}
-	level.Info(d.logger).Log("message", fmt.Sprintf("connected to es version %s", info.Version.Number))
+	if d.config.ReadinessIndex && d.config.Index != "" && (d.config.StaticIndex || d.config.DataStream) {
+		exists, err := client.IndexExists(ctx, d.config.Index)
+		if err != nil || !exists {
+			level.Error(d.logger).Log("err", err, "message", "write index does not exist", "index", d.config.Index)
+			return false
+		}
+	}
 	return true
 }
 
-func (d recordDatabase) buildBulkRequest(records []*models.ElasticRecord) (*elastic.BulkService, error) {
-	bulkRequest := d.GetClient().Bulk()
+func (d recordDatabase) pingCheck(client BulkClient) bool {
+	for _, host := range d.config.Hosts {
+		version, err := client.Ping(context.Background(), host)
+		if err != nil {
+			level.Error(d.logger).Log("err", err, "host", host, "message", "error pinging elasticsearch")
+			continue
+		}
+		level.Info(d.logger).Log("message", fmt.Sprintf("connected to es version %s", version), "host", host)
+		d.storeMajorVersion(version)
+		return true
+	}
+	return false
+}
+
+func (d recordDatabase) storeMajorVersion(version string) {
+	if major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0]); err == nil {
+		atomic.StoreInt32(&d.conn.majorVersion, int32(major))
+	}
+}
+
+// ensureMajorVersion detects the elasticsearch version when the default document type depends on it.
+func (d recordDatabase) ensureMajorVersion() error {
+	if d.config.DocType == "" && atomic.LoadInt32(&d.conn.majorVersion) == 0 {
+		return d.detectMajorVersion()
+	}
+	return nil
+}
+
+// detectMajorVersion pings the hosts until one answers with its version.
+func (d recordDatabase) detectMajorVersion() error {
+	client, err := d.bulkClient()
+	if err != nil {
+		return err
+	}
+	for _, host := range d.config.Hosts {
+		var version string
+		version, err = client.Ping(context.Background(), host)
+		if err == nil {
+			d.storeMajorVersion(version)
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no elasticsearch host configured")
+	}
+	return fmt.Errorf("could not detect elasticsearch version: %s", err)
+}
+
+// docType is the document type a record is written with, empty when the type is omitted.
+func (d recordDatabase) docType(record *models.ElasticRecord) string {
+	switch d.config.DocType {
+	case "":
+		if atomic.LoadInt32(&d.conn.majorVersion) >= 7 {
+			return ""
+		}
+		return record.Type
+	case DocTypeTopic:
+		return record.Type
+	case DocTypeNone:
+		return ""
+	default:
+		return d.config.DocType
+	}
+}
+
+type bulkChunk struct {
+	request BulkRequest
+	records []*models.ElasticRecord
+}
+
+// newBulk creates a bulk request with the configured refresh and active shards parameters.
+func (d recordDatabase) newBulk() BulkRequest {
+	return BulkRequest{Refresh: d.config.Refresh, ActiveShards: d.config.ActiveShards}
+}
+
+// buildBulkRequests splits the records in bulk requests of at most BulkMaxBytes, keeping their order.
+// Records that don't fit in a bulk request on their own are returned as failures.
+func (d recordDatabase) buildBulkRequests(records []*models.ElasticRecord) ([]bulkChunk, []Failure, error) {
+	maxBytes := d.config.BulkMaxBytes
+	var chunks []bulkChunk
+	var tooLarge []Failure
+	chunk := bulkChunk{request: d.newBulk()}
+	var chunkBytes int64
 	for _, record := range records {
-		bulkRequest.Add(elastic.NewBulkIndexRequest().OpType("create").
+		request, size, failure, err := d.sizedRequest(record)
+		if err != nil {
+			return nil, nil, err
+		}
+		if failure != nil {
+			tooLarge = append(tooLarge, *failure)
+			continue
+		}
+		if failure := d.tooLargeForBulk(record, size); failure != nil {
+			tooLarge = append(tooLarge, *failure)
+			continue
+		}
+		if maxBytes > 0 && chunkBytes+size > maxBytes && len(chunk.records) > 0 {
+			chunks = append(chunks, chunk)
+			chunk = bulkChunk{request: d.newBulk()}
+			chunkBytes = 0
+		}
+		lines, err := request.Source()
+		if err != nil {
+			return nil, nil, err
+		}
+		chunk.request.Requests = append(chunk.request.Requests, lines)
+		chunk.records = append(chunk.records, record)
+		chunkBytes += size
+	}
+	if len(chunk.records) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks, tooLarge, nil
+}
+
+// tooLargeForBulk is the failure of a record whose request doesn't fit in a bulk request on its own, nil if it
+// fits.
+func (d recordDatabase) tooLargeForBulk(record *models.ElasticRecord, size int64) *Failure {
+	maxBytes := d.config.BulkMaxBytes
+	if maxBytes <= 0 || size <= maxBytes {
+		return nil
+	}
+	return &Failure{
+		Index:    record.Index,
+		DocID:    record.ID,
+		Pipeline: record.Pipeline,
+		Status:   http.StatusRequestEntityTooLarge,
+		Type:     FailureDocumentTooLarge,
+		Reason:   fmt.Sprintf("%d bytes exceed the maximum bulk size of %d bytes", size, maxBytes),
+	}
+}
+
+// bulkableSize is the number of bytes a request takes in the bulk body, a line per action and source.
+func bulkableSize(request elastic.BulkableRequest) (int64, error) {
+	lines, err := request.Source()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+	return size, nil
+}
+
+func (d recordDatabase) bulkableRequest(record *models.ElasticRecord) (elastic.BulkableRequest, error) {
+	if record.Deleted {
+		if record.ID == "" {
+			return nil, fmt.Errorf("cannot delete a document without id on index %s", record.Index)
+		}
+		request := elastic.NewBulkDeleteRequest().
+			Index(record.Index).
+			Type(d.docType(record)).
+			Id(record.ID).
+			Routing(record.Routing)
+		if d.config.ExternalVersion {
+			request.VersionType("external").Version(record.Version)
+		}
+		return request, nil
+	}
+	action := d.config.BulkAction
+	if action == BulkActionScript && record.Script == "" {
+		// documents of the injector itself, like dead letters, have no script and are merged instead
+		action = BulkActionUpsert
+	}
+	switch action {
+	case BulkActionIndex:
+		request := elastic.NewBulkIndexRequest().
 			Index(record.Index).
-			Type(record.Type).
+			Type(d.docType(record)).
 			Id(record.ID).
-			Doc(record.Json))
+			Routing(record.Routing).
+			Pipeline(record.Pipeline).
+			Doc(record.Json)
+		if d.config.ExternalVersion {
+			request.VersionType("external").Version(record.Version)
+		}
+		return request, nil
+	case BulkActionUpsert:
+		if record.ID == "" {
+			return nil, fmt.Errorf("cannot upsert a document without id on index %s", record.Index)
+		}
+		return elastic.NewBulkUpdateRequest().
+			Index(record.Index).
+			Type(d.docType(record)).
+			Id(record.ID).
+			Routing(record.Routing).
+			RetryOnConflict(d.config.RetryOnConflict).
+			Doc(record.Json).
+			DocAsUpsert(true), nil
+	case BulkActionScript:
+		if record.ID == "" {
+			return nil, fmt.Errorf("cannot update a document without id on index %s", record.Index)
+		}
+		upsert := record.Upsert
+		if upsert == nil {
+			upsert = map[string]interface{}{}
+		}
+		// the script also runs on the upsert document, so the first record of a document is counted like the others
+		return elastic.NewBulkUpdateRequest().
+			Index(record.Index).
+			Type(d.docType(record)).
+			Id(record.ID).
+			Routing(record.Routing).
+			RetryOnConflict(d.config.RetryOnConflict).
+			Script(elastic.NewScript(record.Script).Params(record.Json)).
+			ScriptedUpsert(true).
+			Upsert(upsert), nil
+	default:
+		// also used for data streams, which only accept create
+		return elastic.NewBulkIndexRequest().OpType("create").
+			Index(record.Index).
+			Type(d.docType(record)).
+			Id(record.ID).
+			Routing(record.Routing).
+			Pipeline(record.Pipeline).
+			Doc(record.Json), nil
+	}
+}
+
+// NewDatabase connects to elasticsearch, trying again up to ConnectRetries times so that the injector
+// outlives a short elasticsearch restart. In dry run mode elasticsearch is never connected to.
+func NewDatabase(logger log.Logger, config Config) (RecordDatabase, error) {
+	db := newRecordDatabase(logger, config)
+	if config.DryRun {
+		return newDryRunDatabase(db)
+	}
+	client, err := newClient(config)
+	for attempt := 1; err != nil && attempt <= config.ConnectRetries; attempt++ {
+		level.Warn(logger).Log(
+			"message", "could not connect to elasticsearch, retrying",
+			"err", err,
+			"attempt", attempt,
+			"backoff", config.ConnectBackoff,
+		)
+		time.Sleep(config.ConnectBackoff)
+		client, err = newClient(config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not init elasticsearch client: %s", err)
+	}
+	db.conn.client = client
+	if config.BulkProcessor {
+		return newProcessorDatabase(db), nil
 	}
-	return bulkRequest, nil
+	return db, nil
 }
 
-func NewDatabase(logger log.Logger, config Config) RecordDatabase {
-	return recordDatabase{logger: logger, config: config}
+// newRecordDatabase creates a database that connects on first use.
+func newRecordDatabase(logger log.Logger, config Config) recordDatabase {
+	return recordDatabase{logger: logger, config: config, conn: &connection{}}
 }
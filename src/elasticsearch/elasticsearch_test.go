@@ -12,6 +12,14 @@ import (
 	"encoding/json"
 
 	"strconv"
+	"strings"
+
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 
 	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
 	"github.com/inloco/kafka-elasticsearch-injector/src/logger_builder"
@@ -22,13 +30,13 @@ import (
 
 var logger = logger_builder.NewLogger("elasticsearch-test")
 var config = Config{
-	Host:               "http://localhost:9200",
+	Hosts:              []string{"http://localhost:9200"},
 	Index:              "my-topic",
 	IndexColumn:        "",
 	BlacklistedColumns: []string{},
 	BulkTimeout:        10 * time.Second,
 }
-var db = NewDatabase(logger, config)
+var db RecordDatabase
 var template = `
 {
 	"template": "my-topic-*",
@@ -61,6 +69,11 @@ var template = `
 `
 
 func TestMain(m *testing.M) {
+	var err error
+	db, err = NewDatabase(logger, config)
+	if err != nil {
+		panic(err)
+	}
 	setupDB(db)
 	retCode := m.Run()
 	tearDownDB(db)
@@ -74,71 +87,815 @@ func TestRecordDatabase_ReadinessCheck(t *testing.T) {
 
 func TestRecordDatabase_Insert(t *testing.T) {
 	record, id := fixtures.NewElasticRecord()
-	_, err := db.Insert([]*models.ElasticRecord{record})
-	db.GetClient().Refresh("_all").Do(context.Background())
+	_, err := db.Insert(context.Background(), []*models.ElasticRecord{record})
+	testClient(db).Refresh("_all").Do(context.Background())
 	var recordFromES fixtures.FixtureRecord
 	if assert.NoError(t, err) {
-		count, err := db.GetClient().Count(record.Index).Do(context.Background())
+		count, err := testClient(db).Count(record.Index).Do(context.Background())
 		if assert.NoError(t, err) {
 			assert.Equal(t, int64(1), count)
 		}
-		res, err := db.GetClient().Get().Index(record.Index).Type(record.Type).Id(record.ID).Do(context.Background())
+		res, err := testClient(db).Get().Index(record.Index).Type(record.Type).Id(record.ID).Do(context.Background())
 		if assert.NoError(t, err) {
 			json.Unmarshal(*res.Source, &recordFromES)
 		}
 		assert.Equal(t, recordFromES.Id, id)
 	}
-	db.GetClient().DeleteByQuery(record.Index).Query(elastic.MatchAllQuery{}).Do(context.Background())
+	testClient(db).DeleteByQuery(record.Index).Query(elastic.MatchAllQuery{}).Do(context.Background())
+}
+
+func TestRecordDatabase_Contract(t *testing.T) {
+	RunDatabaseContractTests(t, func(t *testing.T) RecordDatabase {
+		return newTestDatabase(t, config)
+	})
 }
 
 func TestRecordDatabase_Insert_RepeatedId(t *testing.T) {
 	record, id := fixtures.NewElasticRecord()
-	_, err := db.Insert([]*models.ElasticRecord{record})
-	db.GetClient().Refresh("_all").Do(context.Background())
-	res, err := db.Insert([]*models.ElasticRecord{record})
+	_, err := db.Insert(context.Background(), []*models.ElasticRecord{record})
+	testClient(db).Refresh("_all").Do(context.Background())
+	res, err := db.Insert(context.Background(), []*models.ElasticRecord{record})
 	assert.Len(t, res.AlreadyExists, 1)
 	assert.Contains(t, res.AlreadyExists, strconv.Itoa(int(id)))
 	var recordFromES fixtures.FixtureRecord
 	if assert.NoError(t, err) {
-		count, err := db.GetClient().Count(record.Index).Do(context.Background())
+		count, err := testClient(db).Count(record.Index).Do(context.Background())
 		if assert.NoError(t, err) {
 			assert.Equal(t, int64(1), count)
 		}
-		res, err := db.GetClient().Get().Index(record.Index).Type(record.Type).Id(record.ID).Do(context.Background())
+		res, err := testClient(db).Get().Index(record.Index).Type(record.Type).Id(record.ID).Do(context.Background())
 		if assert.NoError(t, err) {
 			json.Unmarshal(*res.Source, &recordFromES)
 		}
 		assert.Equal(t, recordFromES.Id, id)
 	}
-	db.GetClient().DeleteByQuery(record.Index).Query(elastic.MatchAllQuery{}).Do(context.Background())
+	testClient(db).DeleteByQuery(record.Index).Query(elastic.MatchAllQuery{}).Do(context.Background())
 }
 
 func TestRecordDatabase_Insert_Multiple(t *testing.T) {
 	record, id := fixtures.NewElasticRecord()
-	_, err := db.Insert([]*models.ElasticRecord{record, record})
-	db.GetClient().Refresh("_all").Do(context.Background())
+	_, err := db.Insert(context.Background(), []*models.ElasticRecord{record, record})
+	testClient(db).Refresh("_all").Do(context.Background())
 	var recordFromES fixtures.FixtureRecord
 	if assert.NoError(t, err) {
-		count, err := db.GetClient().Count(record.Index).Do(context.Background())
+		count, err := testClient(db).Count(record.Index).Do(context.Background())
 		if assert.NoError(t, err) {
 			assert.Equal(t, int64(1), count)
 		}
-		res, err := db.GetClient().Get().Index(record.Index).Type(record.Type).Id(record.ID).Do(context.Background())
+		res, err := testClient(db).Get().Index(record.Index).Type(record.Type).Id(record.ID).Do(context.Background())
 		if assert.NoError(t, err) {
 			json.Unmarshal(*res.Source, &recordFromES)
 		}
 		assert.Equal(t, recordFromES.Id, id)
 	}
-	db.GetClient().DeleteByQuery(record.Index).Query(elastic.MatchAllQuery{}).Do(context.Background())
+	testClient(db).DeleteByQuery(record.Index).Query(elastic.MatchAllQuery{}).Do(context.Background())
+}
+
+func TestRecordDatabase_Insert_ScriptUpdate(t *testing.T) {
+	d := newTestDatabase(t, Config{
+		Hosts:           config.Hosts,
+		BulkTimeout:     config.BulkTimeout,
+		BulkAction:      BulkActionScript,
+		RetryOnConflict: 3,
+	})
+	defer d.CloseClient()
+	record := func(views int) *models.ElasticRecord {
+		return &models.ElasticRecord{
+			Index:  "my-topic-scripted",
+			Type:   "my-topic",
+			ID:     "page-1",
+			Json:   map[string]interface{}{"views": views},
+			Script: "ctx._source.views += params.views",
+			Upsert: map[string]interface{}{"views": 0},
+		}
+	}
+	defer testClient(d).DeleteIndex("my-topic-scripted").Do(context.Background())
+
+	// the first record creates the document, every record increments it
+	_, err := d.Insert(context.Background(), []*models.ElasticRecord{record(1), record(2)})
+	if assert.NoError(t, err) {
+		_, err = d.Insert(context.Background(), []*models.ElasticRecord{record(4)})
+	}
+	if assert.NoError(t, err) {
+		res, err := testClient(d).Get().Index("my-topic-scripted").Type("my-topic").Id("page-1").Do(context.Background())
+		if assert.NoError(t, err) {
+			var document map[string]int
+			json.Unmarshal(*res.Source, &document)
+			assert.Equal(t, 7, document["views"])
+		}
+	}
+}
+
+func TestRecordDatabase_Insert_PartialFailure(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		fmt.Fprint(w, `{"took":1,"errors":true,"items":[
+			{"create":{"_index":"i","_type":"t","_id":"1","status":201}},
+			{"create":{"_index":"i","_type":"t","_id":"2","status":400,
+				"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},
+			{"create":{"_index":"i","_type":"t","_id":"3","status":429,
+				"error":{"type":"es_rejected_execution_exception","reason":"rejected execution"}}},
+			{"create":{"_index":"i","_type":"t","_id":"4","status":409,
+				"error":{"type":"version_conflict_engine_exception","reason":"document already exists"}}},
+			{"delete":{"_index":"i","_type":"t","_id":"5","status":404,"result":"not_found"}}]}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second})
+	defer d.CloseClient()
+	var records []*models.ElasticRecord
+	for _, id := range []string{"1", "2", "3", "4"} {
+		records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: id, Json: map[string]interface{}{}})
+	}
+	records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: "5", Deleted: true})
+
+	res, err := d.Insert(context.Background(), records)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"4"}, res.AlreadyExists)
+		assert.Equal(t, []*models.ElasticRecord{records[2]}, res.Retry)
+		assert.Equal(t, []Failure{{
+			Index:  "i",
+			DocID:  "2",
+			Status: 400,
+			Type:   "mapper_parsing_exception",
+			Reason: "failed to parse",
+		}}, res.Rejected)
+		assert.True(t, res.Overloaded)
+	}
+}
+
+func TestRecordDatabase_Insert_FailuresByIndexAndID(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		// the alias events names its backing index, the same id is written to two indices
+		fmt.Fprint(w, `{"took":1,"errors":true,"items":[
+			{"index":{"_index":"events-a","_type":"t","_id":"1","status":201}},
+			{"index":{"_index":"events-b","_type":"t","_id":"1","status":503,
+				"error":{"type":"unavailable_shards_exception","reason":"primary shard is not active"}}},
+			{"index":{"_index":"events-c","_type":"t","_id":"1","status":400,
+				"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}},
+			{"index":{"_index":"events-000001","_type":"t","_id":"2","status":400,
+				"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, BulkAction: BulkActionIndex})
+	defer d.CloseClient()
+	records := []*models.ElasticRecord{
+		{Index: "events-a", Type: "t", ID: "1", Json: map[string]interface{}{}},
+		{Index: "events-b", Type: "t", ID: "1", Json: map[string]interface{}{}},
+		{Index: "events-c", Type: "t", ID: "1", Json: map[string]interface{}{}},
+		{Index: "events", Type: "t", ID: "2", Json: map[string]interface{}{}},
+	}
+
+	res, err := d.Insert(context.Background(), records)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*models.ElasticRecord{records[1]}, res.Retry)
+		failure := Failure{Status: 400, Type: "mapper_parsing_exception", Reason: "failed to parse"}
+		first, second := failure, failure
+		first.Index, first.DocID = "events-c", "1"
+		second.Index, second.DocID = "events", "2"
+		assert.Equal(t, []Failure{first, second}, res.Rejected)
+	}
+}
+
+func TestRecordDatabase_Insert_StaticIndexNotFound(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		fmt.Fprint(w, `{"took":1,"errors":true,"items":[
+			{"create":{"_index":"events-write","_type":"t","_id":"1","status":404,
+				"error":{"type":"index_not_found_exception","reason":"no such index"}}}]}`)
+		return true
+	})
+	defer server.Close()
+	records := []*models.ElasticRecord{{Index: "events-write", Type: "t", ID: "1", Json: map[string]interface{}{}}}
+	for static, retried := range map[bool]bool{true: true, false: false} {
+		d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, StaticIndex: static})
+
+		res, err := d.Insert(context.Background(), records)
+		if assert.NoError(t, err) {
+			if retried {
+				assert.Equal(t, records, res.Retry)
+				assert.Empty(t, res.Rejected)
+			} else {
+				assert.Empty(t, res.Retry)
+				assert.Len(t, res.Rejected, 1)
+			}
+		}
+		d.CloseClient()
+	}
+}
+
+func TestRecordDatabase_Insert_BulkMaxBytes(t *testing.T) {
+	var bulks [][]string
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		var ids, items []string
+		for i := 0; i < len(lines); i += 2 {
+			var action map[string]map[string]string
+			json.Unmarshal([]byte(lines[i]), &action)
+			id := action["create"]["_id"]
+			ids = append(ids, id)
+			items = append(items, fmt.Sprintf(`{"create":{"_index":"i","_type":"t","_id":"%s","status":201}}`, id))
+		}
+		bulks = append(bulks, ids)
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, BulkMaxBytes: 200})
+	defer d.CloseClient()
+	var records []*models.ElasticRecord
+	for _, id := range []string{"1", "2", "3"} {
+		records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: id, Json: map[string]interface{}{"value": strings.Repeat("a", 20)}})
+	}
+	large := &models.ElasticRecord{Index: "i", Type: "t", ID: "large", Json: map[string]interface{}{"value": strings.Repeat("a", 200)}}
+	records = append(records[:2], large, records[2])
+
+	res, err := d.Insert(context.Background(), records)
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]string{{"1", "2"}, {"3"}}, bulks)
+		if assert.Len(t, res.Rejected, 1) {
+			assert.Equal(t, "large", res.Rejected[0].DocID)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, res.Rejected[0].Status)
+		}
+		assert.Empty(t, res.Retry)
+	}
+}
+
+func TestShardByID(t *testing.T) {
+	var records []*models.ElasticRecord
+	for i := 0; i < 100; i++ {
+		records = append(records, &models.ElasticRecord{ID: strconv.Itoa(i % 10), Version: int64(i)})
+	}
+	shards := shardByID(records, 4)
+	assert.True(t, len(shards) > 1 && len(shards) <= 4)
+	total := 0
+	shardOf := make(map[string]int)
+	for idx, shard := range shards {
+		total += len(shard)
+		var last int64 = -1
+		for _, record := range shard {
+			if previous, ok := shardOf[record.ID]; ok {
+				assert.Equal(t, previous, idx, "records with the same id should be in the same shard")
+			}
+			shardOf[record.ID] = idx
+			assert.True(t, record.Version > last, "records should keep their order")
+			last = record.Version
+		}
+	}
+	assert.Equal(t, len(records), total)
+	assert.Len(t, shardByID(records, 1), 1)
+}
+
+func TestRecordDatabase_Insert_BulkConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	var indexed []string
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		var items []string
+		for i := 0; i < len(lines); i += 2 {
+			var action map[string]map[string]string
+			json.Unmarshal([]byte(lines[i]), &action)
+			id := action["create"]["_id"]
+			lock.Lock()
+			indexed = append(indexed, id)
+			lock.Unlock()
+			status := 201
+			if id == "7" {
+				status = 429
+			}
+			items = append(items, fmt.Sprintf(`{"create":{"_index":"i","_type":"t","_id":"%s","status":%d}}`, id, status))
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, BulkConcurrency: 4})
+	defer d.CloseClient()
+	var records []*models.ElasticRecord
+	for i := 0; i < 20; i++ {
+		records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: strconv.Itoa(i), Json: map[string]interface{}{}})
+	}
+
+	res, err := d.Insert(context.Background(), records)
+	if assert.NoError(t, err) {
+		assert.Len(t, indexed, 20)
+		assert.Equal(t, []*models.ElasticRecord{records[7]}, res.Retry)
+		assert.True(t, res.Overloaded)
+	}
+}
+
+func TestRecordDatabase_BulkableRequest(t *testing.T) {
+	record := &models.ElasticRecord{Index: "my-topic-2018-01-01", Type: "my-topic", ID: "42", Json: map[string]interface{}{"id": 42}}
+	for action, expected := range map[BulkAction][]string{
+		BulkActionCreate: {
+			`{"create":{"_index":"my-topic-2018-01-01","_id":"42","_type":"my-topic"}}`,
+			`{"id":42}`,
+		},
+		BulkActionIndex: {
+			`{"index":{"_index":"my-topic-2018-01-01","_id":"42","_type":"my-topic"}}`,
+			`{"id":42}`,
+		},
+		BulkActionUpsert: {
+			`{"update":{"_index":"my-topic-2018-01-01","_type":"my-topic","_id":"42","retry_on_conflict":3}}`,
+			`{"doc":{"id":42},"doc_as_upsert":true}`,
+		},
+	} {
+		d := newRecordDatabase(logger, Config{BulkAction: action, RetryOnConflict: 3})
+		request, err := d.bulkableRequest(record)
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, source)
+			}
+		}
+	}
+}
+
+func TestRecordDatabase_BulkableRequest_Script(t *testing.T) {
+	d := newRecordDatabase(logger, Config{BulkAction: BulkActionScript, RetryOnConflict: 3})
+	record := &models.ElasticRecord{
+		Index:  "my-topic-2018-01-01",
+		Type:   "my-topic",
+		ID:     "42",
+		Json:   map[string]interface{}{"views": 1},
+		Script: "ctx._source.views += params.views",
+	}
+	for _, test := range []struct {
+		upsert   map[string]interface{}
+		expected string
+	}{
+		{nil, `{"script":{"params":{"views":1},"source":"ctx._source.views += params.views"},"scripted_upsert":true,"upsert":{}}`},
+		{map[string]interface{}{"views": 0}, `{"script":{"params":{"views":1},"source":"ctx._source.views += params.views"},"scripted_upsert":true,"upsert":{"views":0}}`},
+	} {
+		record.Upsert = test.upsert
+		request, err := d.bulkableRequest(record)
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{
+					`{"update":{"_index":"my-topic-2018-01-01","_type":"my-topic","_id":"42","retry_on_conflict":3}}`,
+					test.expected,
+				}, source)
+			}
+		}
+	}
+
+	// documents without script, like dead letters, are merged
+	request, err := d.bulkableRequest(&models.ElasticRecord{Index: "dead-letters", Type: "_doc", ID: "1", Json: map[string]interface{}{"id": 1}})
+	if assert.NoError(t, err) {
+		source, err := request.Source()
+		if assert.NoError(t, err) {
+			assert.Equal(t, `{"doc":{"id":1},"doc_as_upsert":true}`, source[1])
+		}
+	}
+}
+
+func TestRecordDatabase_BulkableRequest_Delete(t *testing.T) {
+	record := &models.ElasticRecord{Index: "my-topic-2018-01-01", Type: "my-topic", ID: "42", Deleted: true}
+	for _, action := range []BulkAction{BulkActionCreate, BulkActionIndex, BulkActionUpsert} {
+		d := newRecordDatabase(logger, Config{BulkAction: action})
+		request, err := d.bulkableRequest(record)
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{`{"delete":{"_index":"my-topic-2018-01-01","_type":"my-topic","_id":"42"}}`}, source)
+			}
+		}
+	}
+}
+
+func TestRecordDatabase_BulkableRequest_Routing(t *testing.T) {
+	record := &models.ElasticRecord{Index: "my-topic-2018-01-01", Type: "my-topic", ID: "42", Routing: "tenant-1", Json: map[string]interface{}{"id": 42}}
+	for action, expected := range map[BulkAction]string{
+		BulkActionCreate: `{"create":{"_index":"my-topic-2018-01-01","_id":"42","_type":"my-topic","routing":"tenant-1"}}`,
+		BulkActionIndex:  `{"index":{"_index":"my-topic-2018-01-01","_id":"42","_type":"my-topic","routing":"tenant-1"}}`,
+		BulkActionUpsert: `{"update":{"_index":"my-topic-2018-01-01","_type":"my-topic","_id":"42","retry_on_conflict":0,"routing":"tenant-1"}}`,
+	} {
+		d := newRecordDatabase(logger, Config{BulkAction: action})
+		request, err := d.bulkableRequest(record)
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, source[0])
+			}
+		}
+	}
+}
+
+func TestRecordDatabase_BulkableRequest_Pipeline(t *testing.T) {
+	record := &models.ElasticRecord{Index: "my-topic-2018-01-01", Type: "my-topic", ID: "42", Pipeline: "geoip", Json: map[string]interface{}{"id": 42}}
+	for action, expected := range map[BulkAction]string{
+		BulkActionCreate: `{"create":{"_index":"my-topic-2018-01-01","_id":"42","_type":"my-topic","pipeline":"geoip"}}`,
+		BulkActionIndex:  `{"index":{"_index":"my-topic-2018-01-01","_id":"42","_type":"my-topic","pipeline":"geoip"}}`,
+	} {
+		d := newRecordDatabase(logger, Config{BulkAction: action})
+		request, err := d.bulkableRequest(record)
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, expected, source[0])
+			}
+		}
+	}
+}
+
+func TestRecordDatabase_Insert_MissingPipeline(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		fmt.Fprint(w, `{"took":1,"errors":true,"items":[
+			{"create":{"_index":"i","_type":"t","_id":"1","status":400,
+				"error":{"type":"illegal_argument_exception","reason":"pipeline with id [geoip] does not exist"}}}]}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second})
+	defer d.CloseClient()
+
+	res, err := d.Insert(context.Background(), []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Pipeline: "geoip", Json: map[string]interface{}{}}})
+	if assert.NoError(t, err) && assert.Len(t, res.Rejected, 1) {
+		assert.Equal(t, "geoip", res.Rejected[0].Pipeline)
+		assert.Contains(t, (&RejectedError{res.Rejected}).Error(), "pipeline geoip")
+	}
+}
+
+func TestRecordDatabase_DocType(t *testing.T) {
+	d := newRecordDatabase(logger, Config{})
+	record := &models.ElasticRecord{Index: "my-topic-2018-01-01", Type: "my-topic", ID: "42"}
+	for docType, expected := range map[string]string{
+		"":           "my-topic",
+		DocTypeTopic: "my-topic",
+		DocTypeNone:  "",
+		"event":      "event",
+	} {
+		d.config.DocType = docType
+		assert.Equal(t, expected, d.docType(record))
+	}
+
+	d.storeMajorVersion("7.10.2")
+	d.config.DocType = ""
+	assert.Equal(t, "", d.docType(record))
+	d.config.DocType = DocTypeTopic
+	assert.Equal(t, "my-topic", d.docType(record))
+}
+
+func TestRecordDatabase_Insert_RefreshAndActiveShards(t *testing.T) {
+	var query url.Values
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		query = r.URL.Query()
+		fmt.Fprint(w, `{"took":1,"errors":false,"items":[{"create":{"_index":"i","_id":"1","status":201}}]}`)
+		return true
+	})
+	defer server.Close()
+	record := &models.ElasticRecord{Index: "i", Type: "t", ID: "1", Json: map[string]interface{}{}}
+
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, DocType: "t", BulkTimeout: time.Second})
+	_, err := d.Insert(context.Background(), []*models.ElasticRecord{record})
+	d.CloseClient()
+	if assert.NoError(t, err) {
+		assert.NotContains(t, query, "refresh")
+		assert.NotContains(t, query, "wait_for_active_shards")
+	}
+
+	d = newTestDatabase(t, Config{Hosts: []string{server.URL}, DocType: "t", BulkTimeout: time.Second, Refresh: "wait_for", ActiveShards: "all"})
+	_, err = d.Insert(context.Background(), []*models.ElasticRecord{record})
+	d.CloseClient()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "wait_for", query.Get("refresh"))
+		assert.Equal(t, "all", query.Get("wait_for_active_shards"))
+	}
+}
+
+func TestRecordDatabase_Insert_DetectsDocType(t *testing.T) {
+	var bulkBody string
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"name":"mock","cluster_name":"mock","version":{"number":"7.10.2"}}`)
+		case "/_bulk":
+			body, _ := ioutil.ReadAll(r.Body)
+			bulkBody = string(body)
+			fmt.Fprint(w, `{"took":1,"errors":false,"items":[{"create":{"_index":"i","_id":"1","status":201}}]}`)
+		default:
+			return false
+		}
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second})
+	defer d.CloseClient()
+
+	_, err := d.Insert(context.Background(), []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Json: map[string]interface{}{}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "{\"create\":{\"_index\":\"i\",\"_id\":\"1\"}}\n{}\n", bulkBody)
+	}
+}
+
+func TestRejectedError_CountsByType(t *testing.T) {
+	err := &RejectedError{[]Failure{
+		{DocID: "1", Status: http.StatusBadRequest, Type: "mapper_parsing_exception"},
+		{DocID: "2", Status: http.StatusRequestEntityTooLarge, Type: "document_too_large"},
+		{DocID: "3", Status: http.StatusBadRequest, Type: "mapper_parsing_exception"},
+		{DocID: "4", Status: http.StatusBadRequest},
+	}}
+	assert.Contains(t, err.Error(), "4 documents rejected by elasticsearch(document_too_large=1 mapper_parsing_exception=2 status_400=1)")
+	assert.False(t, IsRetryable(err))
+}
+
+func TestRecordDatabase_Insert_Cancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		// elasticsearch hangs until the test is over
+		<-release
+		return true
+	})
+	defer server.Close()
+	defer close(release)
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, DocType: "t", BulkTimeout: time.Minute})
+	defer d.CloseClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	begin := time.Now()
+	_, err := d.Insert(ctx, []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Json: map[string]interface{}{}}})
+	assert.Error(t, err)
+	assert.True(t, time.Since(begin) < 10*time.Second)
+}
+
+func TestRecordDatabase_BulkableRequest_ExternalVersion(t *testing.T) {
+	d := newRecordDatabase(logger, Config{BulkAction: BulkActionIndex, ExternalVersion: true})
+	for _, tc := range []struct {
+		record   *models.ElasticRecord
+		expected string
+	}{
+		{
+			&models.ElasticRecord{Index: "i", Type: "t", ID: "42", Version: 7, Json: map[string]interface{}{}},
+			`{"index":{"_index":"i","_id":"42","_type":"t","version":7,"version_type":"external"}}`,
+		},
+		{
+			&models.ElasticRecord{Index: "i", Type: "t", ID: "42", Version: 8, Deleted: true},
+			`{"delete":{"_index":"i","_type":"t","_id":"42","version":8,"version_type":"external"}}`,
+		},
+	} {
+		request, err := d.bulkableRequest(tc.record)
+		if assert.NoError(t, err) {
+			source, err := request.Source()
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, source[0])
+			}
+		}
+	}
+}
+
+func TestRecordDatabase_Insert_ExternalVersionConflict(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		fmt.Fprint(w, `{"took":1,"errors":true,"items":[
+			{"index":{"_index":"i","_type":"t","_id":"1","status":409,
+				"error":{"type":"version_conflict_engine_exception","reason":"current version [9] is higher"}}}]}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, BulkAction: BulkActionIndex, ExternalVersion: true})
+	defer d.CloseClient()
+
+	res, err := d.Insert(context.Background(), []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Version: 3, Json: map[string]interface{}{}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"1"}, res.AlreadyExists)
+		assert.Empty(t, res.Retry)
+		assert.Empty(t, res.Rejected)
+	}
+}
+
+func TestRecordDatabase_BulkableRequest_UpsertWithoutID(t *testing.T) {
+	d := newRecordDatabase(logger, Config{BulkAction: BulkActionUpsert})
+	_, err := d.bulkableRequest(&models.ElasticRecord{Index: "my-topic-2018-01-01", Type: "my-topic"})
+	assert.Error(t, err)
+}
+
+func TestNewClient_BasicAuth(t *testing.T) {
+	var authorizations []string
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		return false
+	})
+	defer server.Close()
+
+	client, err := newClient(Config{Hosts: []string{server.URL}, Username: "elastic", Password: "changeme"})
+	if assert.NoError(t, err) {
+		_, _, err = client.Ping(server.URL).Do(context.Background())
+		assert.NoError(t, err)
+		client.Stop()
+	}
+	if assert.NotEmpty(t, authorizations) {
+		for _, authorization := range authorizations {
+			assert.Equal(t, "Basic ZWxhc3RpYzpjaGFuZ2VtZQ==", authorization)
+		}
+	}
+}
+
+func TestRecordDatabase_ReadinessCheck_AnyHost(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool { return false })
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{"http://127.0.0.1:1", server.URL}, ReadinessMode: ReadinessPing})
+	defer d.CloseClient()
+
+	assert.True(t, d.ReadinessCheck())
+}
+
+func newTestDatabase(t *testing.T, config Config) RecordDatabase {
+	d, err := NewDatabase(logger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testClient(d RecordDatabase) *elastic.Client {
+	client, err := d.GetClient()
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func TestNewDatabase_Unreachable(t *testing.T) {
+	_, err := NewDatabase(logger, Config{Hosts: []string{"http://127.0.0.1:1"}, ConnectTimeout: 100 * time.Millisecond})
+	assert.Error(t, err)
+}
+
+func TestNewDatabase_ConnectRetries(t *testing.T) {
+	// the first attempts fail like while elasticsearch restarts
+	failures := 2
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_nodes/http" || failures == 0 {
+			return false
+		}
+		failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	})
+	defer server.Close()
+
+	_, err := NewDatabase(logger, Config{Hosts: []string{server.URL}, ConnectRetries: 1, ConnectBackoff: time.Millisecond, ConnectTimeout: 100 * time.Millisecond})
+	assert.Error(t, err)
+	d, err := NewDatabase(logger, Config{Hosts: []string{server.URL}, ConnectRetries: 1, ConnectBackoff: time.Millisecond, ConnectTimeout: 100 * time.Millisecond})
+	if assert.NoError(t, err) {
+		d.CloseClient()
+	}
+}
+
+func TestRecordDatabase_ClosedUnreachable(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool { return false })
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, ConnectTimeout: 100 * time.Millisecond})
+	d.CloseClient()
+	server.Close()
+
+	_, err := d.GetClient()
+	assert.Error(t, err)
+	assert.False(t, d.ReadinessCheck())
+	_, err = d.Insert(context.Background(), []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Json: map[string]interface{}{}}})
+	assert.Error(t, err)
+}
+
+func TestRecordDatabase_CloseClient_Concurrent(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool { return false })
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}})
+	other := newTestDatabase(t, Config{Hosts: []string{server.URL}})
+	defer other.CloseClient()
+	assert.True(t, testClient(d) != testClient(other), "databases should not share their client")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d.GetClient()
+		}()
+		go func() {
+			defer wg.Done()
+			d.CloseClient()
+		}()
+	}
+	wg.Wait()
+	d.CloseClient()
+	d.CloseClient()
+	assert.True(t, other.ReadinessCheck())
+}
+
+func TestRecordDatabase_ReadinessCheck_Health(t *testing.T) {
+	var query string
+	status, health, indexStatus := http.StatusOK, `{"status":"green","timed_out":false}`, http.StatusOK
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/_cluster/health":
+			query = r.URL.RawQuery
+			w.WriteHeader(status)
+			fmt.Fprint(w, health)
+		case "/events-write":
+			w.WriteHeader(indexStatus)
+		default:
+			return false
+		}
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{
+		Hosts:            []string{server.URL},
+		Index:            "events-write",
+		StaticIndex:      true,
+		ReadinessStatus:  "yellow",
+		ReadinessTimeout: 500 * time.Millisecond,
+		ReadinessIndex:   true,
+	})
+	defer d.CloseClient()
+
+	assert.True(t, d.ReadinessCheck())
+	assert.Contains(t, query, "wait_for_status=yellow")
+	assert.Contains(t, query, "timeout=500ms")
+
+	// elasticsearch answers 408 when the status isn't reached before the timeout
+	status, health = http.StatusRequestTimeout, `{"status":"red","timed_out":true}`
+	assert.False(t, d.ReadinessCheck())
+	status = http.StatusOK
+	assert.False(t, d.ReadinessCheck())
+
+	health, indexStatus = `{"status":"green","timed_out":false}`, http.StatusNotFound
+	assert.False(t, d.ReadinessCheck(), "the write alias should exist")
+}
+
+// newMockElasticsearch starts a server answering the sniff, ping and cluster health requests made by the elastic client.
+// Every request is handed to handle first, one at a time, which answers it by returning true.
+func newMockElasticsearch(handle func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	server := newUnstartedMockElasticsearch(handle)
+	server.Start()
+	return server
+}
+
+func newMockElasticsearchTLS(handle func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	server := newUnstartedMockElasticsearch(handle)
+	server.StartTLS()
+	return server
+}
+
+func newUnstartedMockElasticsearch(handle func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	var server *httptest.Server
+	var lock sync.Mutex
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		lock.Lock()
+		handled := handle(w, r)
+		lock.Unlock()
+		if handled {
+			return
+		}
+		if r.URL.Path == "/_cluster/health" {
+			fmt.Fprint(w, `{"cluster_name":"mock","status":"green","timed_out":false}`)
+			return
+		}
+		if r.URL.Path == "/_nodes/http" {
+			fmt.Fprintf(w, `{"nodes":{"mock":{"name":"mock","http":{"publish_address":"%s"}}}}`,
+				server.Listener.Addr().String())
+			return
+		}
+		fmt.Fprint(w, `{"name":"mock","cluster_name":"mock","version":{"number":"6.2.4"}}`)
+	}))
+	return server
 }
 
 func setupDB(d RecordDatabase) {
-	templateExists, err := d.GetClient().IndexTemplateExists(config.Index).Do(context.Background())
+	templateExists, err := testClient(d).IndexTemplateExists(config.Index).Do(context.Background())
 	if err != nil {
 		panic(err)
 	}
 	if !templateExists {
-		_, err := d.GetClient().IndexPutTemplate(config.Index).BodyString(template).Do(context.Background())
+		_, err := testClient(d).IndexPutTemplate(config.Index).BodyString(template).Do(context.Background())
 		if err != nil {
 			panic(err)
 		}
@@ -146,6 +903,6 @@ func setupDB(d RecordDatabase) {
 }
 
 func tearDownDB(d RecordDatabase) {
-	d.GetClient().DeleteIndex().Index([]string{"_all"}).Do(context.Background())
+	testClient(d).DeleteIndex().Index([]string{"_all"}).Do(context.Background())
 	d.CloseClient()
 }
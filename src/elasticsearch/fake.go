@@ -0,0 +1,134 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/olivere/elastic"
+)
+
+var errFakeClient = errors.New("the fake database has no elasticsearch client")
+
+// FailureFakeRejected is the failure type of the documents the fake database rejects
+const FailureFakeRejected = "fake_rejected"
+
+// FakeDatabase is a RecordDatabase keeping the records it is given in memory, for the tests of the code writing
+// to a database, like custom sinks. It can be told to fail inserts, reject documents, fail readiness checks and
+// fail putting the template. It is safe for concurrent use and meets RunDatabaseContractTests.
+type FakeDatabase struct {
+	lock        sync.Mutex
+	inserted    []*models.ElasticRecord
+	insertErrs  []error
+	rejectedIDs map[string]bool
+	ready       bool
+	templateErr error
+	closed      bool
+}
+
+// NewFakeDatabase creates an empty fake database that is ready and accepts every document.
+func NewFakeDatabase() *FakeDatabase {
+	return &FakeDatabase{rejectedIDs: make(map[string]bool), ready: true}
+}
+
+// GetClient fails, the fake database doesn't talk to elasticsearch.
+func (d *FakeDatabase) GetClient() (*elastic.Client, error) {
+	return nil, errFakeClient
+}
+
+func (d *FakeDatabase) CloseClient() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.closed = true
+}
+
+// Insert keeps the records, except the rejected ones. It fails with the next error of FailInserts, or the error
+// of the context when it is done, keeping none of the records then.
+func (d *FakeDatabase) Insert(ctx context.Context, records []*models.ElasticRecord) (*InsertResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.insertErrs) > 0 {
+		err := d.insertErrs[0]
+		d.insertErrs = d.insertErrs[1:]
+		return nil, err
+	}
+	if len(records) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	res := &InsertResponse{[]string{}, []*models.ElasticRecord{}, []Failure{}, false}
+	for _, record := range records {
+		if d.rejectedIDs[record.ID] {
+			res.Rejected = append(res.Rejected, Failure{
+				Index:    record.Index,
+				DocID:    record.ID,
+				Pipeline: record.Pipeline,
+				Status:   http.StatusBadRequest,
+				Type:     FailureFakeRejected,
+				Reason:   "rejected by the fake database",
+			})
+			continue
+		}
+		d.inserted = append(d.inserted, record)
+	}
+	return res, nil
+}
+
+func (d *FakeDatabase) ReadinessCheck() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.ready
+}
+
+func (d *FakeDatabase) EnsureTemplate() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.templateErr
+}
+
+// Inserted returns the records kept so far, in the order they were inserted.
+func (d *FakeDatabase) Inserted() []*models.ElasticRecord {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*models.ElasticRecord(nil), d.inserted...)
+}
+
+// FailInserts makes the next inserts fail with the errors, one insert per error.
+func (d *FakeDatabase) FailInserts(errs ...error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.insertErrs = append(d.insertErrs, errs...)
+}
+
+// Reject makes the inserts reject the documents with the ids, like elasticsearch does with mapping conflicts.
+func (d *FakeDatabase) Reject(ids ...string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, id := range ids {
+		d.rejectedIDs[id] = true
+	}
+}
+
+// SetReady sets the result of the readiness checks.
+func (d *FakeDatabase) SetReady(ready bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.ready = ready
+}
+
+// SetTemplateError sets the error of EnsureTemplate, nil for it to succeed.
+func (d *FakeDatabase) SetTemplateError(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.templateErr = err
+}
+
+// Closed tells whether CloseClient was called.
+func (d *FakeDatabase) Closed() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.closed
+}
@@ -0,0 +1,44 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeDatabase_Contract(t *testing.T) {
+	RunDatabaseContractTests(t, func(t *testing.T) RecordDatabase {
+		return NewFakeDatabase()
+	})
+}
+
+func TestFakeDatabase(t *testing.T) {
+	d := NewFakeDatabase()
+	records := []*models.ElasticRecord{{Index: "i", ID: "1"}, {Index: "i", ID: "2"}, {Index: "i", ID: "3"}}
+
+	d.FailInserts(errors.New("unavailable"))
+	_, err := d.Insert(context.Background(), records)
+	assert.EqualError(t, err, "unavailable")
+	assert.Empty(t, d.Inserted())
+
+	d.Reject("2")
+	res, err := d.Insert(context.Background(), records)
+	if assert.NoError(t, err) && assert.Len(t, res.Rejected, 1) {
+		assert.Equal(t, Failure{Index: "i", DocID: "2", Status: 400, Type: FailureFakeRejected, Reason: "rejected by the fake database"}, res.Rejected[0])
+	}
+	assert.Equal(t, []*models.ElasticRecord{records[0], records[2]}, d.Inserted())
+
+	assert.True(t, d.ReadinessCheck())
+	d.SetReady(false)
+	assert.False(t, d.ReadinessCheck())
+
+	d.SetTemplateError(errors.New("invalid template"))
+	assert.EqualError(t, d.EnsureTemplate(), "invalid template")
+
+	assert.False(t, d.Closed())
+	d.CloseClient()
+	assert.True(t, d.Closed())
+}
@@ -0,0 +1,50 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// gzipTransport compresses the bodies of the requests sent to elasticsearch, which decompresses requests
+// with a gzip content encoding.
+type gzipTransport struct {
+	next http.RoundTripper
+}
+
+func (t gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	// round trippers must not modify the request they are given
+	gzipped := new(http.Request)
+	*gzipped = *req
+	gzipped.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		gzipped.Header[key] = values
+	}
+	gzipped.Header.Set("Content-Encoding", "gzip")
+	content := compressed.Bytes()
+	gzipped.ContentLength = int64(len(content))
+	gzipped.Body = ioutil.NopCloser(bytes.NewReader(content))
+	gzipped.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	return t.next.RoundTrip(gzipped)
+}
@@ -0,0 +1,50 @@
+package elasticsearch
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordDatabase_Insert_Gzip(t *testing.T) {
+	var encoding string
+	var lines []string
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		encoding = r.Header.Get("Content-Encoding")
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return true
+		}
+		body, _ := ioutil.ReadAll(reader)
+		lines = strings.Split(strings.TrimSpace(string(body)), "\n")
+		fmt.Fprint(w, `{"took":1,"errors":false,"items":[{"create":{"_index":"i","_type":"t","_id":"1","status":201}}]}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, BulkTimeout: time.Second, Gzip: true})
+	defer d.CloseClient()
+
+	_, err := d.Insert(context.Background(), []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Json: map[string]interface{}{"id": 1}}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gzip", encoding)
+		if assert.Len(t, lines, 2) {
+			var action map[string]map[string]string
+			assert.NoError(t, json.Unmarshal([]byte(lines[0]), &action))
+			assert.Equal(t, "1", action["create"]["_id"])
+			assert.JSONEq(t, `{"id":1}`, lines[1])
+		}
+	}
+}
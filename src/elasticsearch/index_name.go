@@ -0,0 +1,34 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxIndexNameBytes is the longest index name elasticsearch accepts
+const maxIndexNameBytes = 255
+
+// illegalIndexNameChars are replaced by an underscore, elasticsearch refuses index names containing them
+var illegalIndexNameChars = strings.NewReplacer(
+	"\\", "_", "/", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_",
+	"|", "_", ",", "_", "#", "_", ":", "_", " ", "_",
+)
+
+// sanitizeIndexName turns a generated index name into one elasticsearch accepts: lowercase, without
+// illegal characters, not starting with _, - or + and at most 255 bytes long.
+func sanitizeIndexName(name string) (string, error) {
+	sanitized := illegalIndexNameChars.Replace(strings.ToLower(name))
+	sanitized = strings.TrimLeft(sanitized, "_-+")
+	if len(sanitized) > maxIndexNameBytes {
+		sanitized = sanitized[:maxIndexNameBytes]
+		// don't leave half of a multi byte character behind
+		for !utf8.ValidString(sanitized) {
+			sanitized = sanitized[:len(sanitized)-1]
+		}
+	}
+	if sanitized == "" || sanitized == "." || sanitized == ".." {
+		return "", fmt.Errorf("index name %q can't be turned into a valid elasticsearch index name", name)
+	}
+	return sanitized, nil
+}
@@ -0,0 +1,59 @@
+package elasticsearch
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+)
+
+func TestSanitizeIndexName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"my-topic-2018-01-02":           "my-topic-2018-01-02",
+		"MyTopic-2018-01-02":            "mytopic-2018-01-02",
+		"my topic-campaign:42":          "my_topic-campaign_42",
+		`a\b/c*d?e"f<g>h|i,j#k`:         "a_b_c_d_e_f_g_h_i_j_k",
+		"_internal-2018-01-02":          "internal-2018-01-02",
+		"-+_topic":                      "topic",
+		".kibana-like":                  ".kibana-like",
+		"café-2018":                     "café-2018",
+		strings.Repeat("a", 300):        strings.Repeat("a", 255),
+		strings.Repeat("é", 200):        strings.Repeat("é", 127), // é takes two bytes
+		"Events-" + "2018.01.02":        "events-2018.01.02",
+		"__" + strings.Repeat("b", 256): strings.Repeat("b", 255),
+	} {
+		sanitized, err := sanitizeIndexName(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, expected, sanitized)
+			assert.True(t, len(sanitized) <= maxIndexNameBytes)
+		}
+	}
+}
+
+func TestSanitizeIndexName_Invalid(t *testing.T) {
+	for _, name := range []string{"", "_", "-+_", ".", ".."} {
+		_, err := sanitizeIndexName(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestCodec_EncodeElasticRecords_SanitizeIndex(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC))
+	record.Topic = "User Events"
+
+	codec := &basicCodec{config: Config{SanitizeIndex: true}, logger: codecLogger}
+	elasticRecords, err := codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "user_events-2018-01-02", elasticRecords[0].Index)
+	}
+
+	codec.config.SanitizeIndex = false
+	elasticRecords, err = codec.EncodeElasticRecords([]*models.Record{record})
+	if assert.NoError(t, err) && assert.Len(t, elasticRecords, 1) {
+		assert.Equal(t, "User Events-2018-01-02", elasticRecords[0].Index)
+	}
+}
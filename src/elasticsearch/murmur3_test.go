@@ -0,0 +1,17 @@
+package elasticsearch
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur3Digest(t *testing.T) {
+	for input, expected := range map[string]string{
+		"": "00000000000000000000000000000000",
+		"The quick brown fox jumps over the lazy dog": "6c1b07bc7bbc4be347939ac4a93c437a",
+	} {
+		assert.Equal(t, expected, hex.EncodeToString(murmur3Digest([]byte(input))), input)
+	}
+}
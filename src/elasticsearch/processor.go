@@ -0,0 +1,225 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/olivere/elastic"
+)
+
+var errProcessorClosed = errors.New("bulk processor closed before the documents were flushed")
+
+// processorDatabase writes records through an elastic.BulkProcessor, which merges the records of concurrent
+// inserts in bulk requests flushed by count, size or interval. Insert only returns once the processor
+// committed every record of the batch, so the offsets of a batch are never committed before its documents.
+type processorDatabase struct {
+	recordDatabase
+	state *processorState
+}
+
+type processorState struct {
+	// lifecycle is held for reading while requests are added, closing waits for the adds in progress
+	lifecycle sync.RWMutex
+	processor *elastic.BulkProcessor
+
+	mutex   sync.Mutex
+	pending map[elastic.BulkableRequest]pendingRequest
+}
+
+type pendingRequest struct {
+	batch *pendingBatch
+	index int
+}
+
+// pendingBatch gathers the responses of the records of one insert, which may be flushed by different commits.
+type pendingBatch struct {
+	items     []map[string]*elastic.BulkResponseItem
+	remaining int
+	done      chan error
+}
+
+func newProcessorDatabase(db recordDatabase) processorDatabase {
+	return processorDatabase{
+		recordDatabase: db,
+		state:          &processorState{pending: make(map[elastic.BulkableRequest]pendingRequest)},
+	}
+}
+
+// Insert adds the records to the bulk processor and waits until all of them are flushed. If the context is done
+// first the insert fails, but the records already added stay in the processor and may still be flushed.
+func (d processorDatabase) Insert(ctx context.Context, records []*models.ElasticRecord) (*InsertResponse, error) {
+	if err := d.ensureMajorVersion(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return &InsertResponse{[]string{}, []*models.ElasticRecord{}, []Failure{}, false}, nil
+	}
+	var requests []elastic.BulkableRequest
+	var accepted []*models.ElasticRecord
+	var tooLarge []Failure
+	for _, record := range records {
+		request, _, failure, err := d.sizedRequest(record)
+		if err != nil {
+			return nil, err
+		}
+		if failure != nil {
+			tooLarge = append(tooLarge, *failure)
+			continue
+		}
+		requests = append(requests, request)
+		accepted = append(accepted, record)
+	}
+	if len(requests) == 0 {
+		return &InsertResponse{[]string{}, []*models.ElasticRecord{}, tooLarge, false}, nil
+	}
+	records = accepted
+	batch := &pendingBatch{
+		items:     make([]map[string]*elastic.BulkResponseItem, len(records)),
+		remaining: len(records),
+		done:      make(chan error, 1),
+	}
+
+	state := d.state
+	state.lifecycle.RLock()
+	processor, err := d.getProcessor()
+	if err != nil {
+		state.lifecycle.RUnlock()
+		return nil, err
+	}
+	state.mutex.Lock()
+	for idx, request := range requests {
+		state.pending[request] = pendingRequest{batch: batch, index: idx}
+	}
+	state.mutex.Unlock()
+	for _, request := range requests {
+		processor.Add(request)
+	}
+	state.lifecycle.RUnlock()
+
+	select {
+	case err := <-batch.done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		state.mutex.Lock()
+		for _, request := range requests {
+			delete(state.pending, request)
+		}
+		state.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+	response := d.classifyBulkResponse(bulkItems(batch.items), records)
+	response.Rejected = append(response.Rejected, tooLarge...)
+	return response, nil
+}
+
+// getProcessor starts the bulk processor on the first insert, it must be called with the lifecycle lock held.
+func (d processorDatabase) getProcessor() (*elastic.BulkProcessor, error) {
+	state := d.state
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.processor != nil {
+		return state.processor, nil
+	}
+	// the processor disables the limits set to -1
+	actions, size := d.config.BulkFlushActions, d.config.BulkFlushBytes
+	if actions <= 0 {
+		actions = -1
+	}
+	if size <= 0 {
+		size = -1
+	}
+	client, err := d.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	processor, err := client.BulkProcessor().
+		Name("injector").
+		BulkActions(actions).
+		BulkSize(size).
+		FlushInterval(d.config.BulkFlushInterval).
+		Backoff(elastic.NewExponentialBackoff(d.config.Backoff, d.config.MaxBackoff)).
+		After(d.afterCommit).
+		Do(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not start bulk processor: %s", err)
+	}
+	state.processor = processor
+	return processor, nil
+}
+
+// afterCommit acknowledges the records of a commit to the inserts waiting for them. A failed commit keeps its
+// requests queued in the processor, they are sent again with the next flush.
+func (d processorDatabase) afterCommit(id int64, requests []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
+	if err != nil {
+		level.Warn(d.logger).Log("message", "bulk processor commit failed, retrying on next flush", "doc_count", len(requests), "err", err)
+		return
+	}
+	state := d.state
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if res == nil || len(res.Items) != len(requests) {
+		// the requests are no longer queued, the inserts waiting for them have to try again
+		for _, request := range requests {
+			if pending, ok := state.pending[request]; ok {
+				delete(state.pending, request)
+				pending.batch.fail(errors.New("bulk response does not match its requests"))
+			}
+		}
+		return
+	}
+	for idx, request := range requests {
+		pending, ok := state.pending[request]
+		if !ok {
+			continue
+		}
+		delete(state.pending, request)
+		pending.batch.ack(pending.index, res.Items[idx])
+	}
+}
+
+func (b *pendingBatch) ack(index int, item map[string]*elastic.BulkResponseItem) {
+	if b.remaining <= 0 {
+		return
+	}
+	b.items[index] = item
+	b.remaining--
+	if b.remaining == 0 {
+		b.done <- nil
+	}
+}
+
+func (b *pendingBatch) fail(err error) {
+	if b.remaining <= 0 {
+		return
+	}
+	b.remaining = 0
+	b.done <- err
+}
+
+// CloseClient flushes the records added to the bulk processor before closing the client, inserts whose records
+// could not be flushed fail. Like the client, the processor is started again by the next insert.
+func (d processorDatabase) CloseClient() {
+	state := d.state
+	state.lifecycle.Lock()
+	if state.processor != nil {
+		if err := state.processor.Close(); err != nil {
+			level.Error(d.logger).Log("message", "could not flush bulk processor", "err", err)
+		}
+		state.processor = nil
+	}
+	state.lifecycle.Unlock()
+
+	state.mutex.Lock()
+	for request, pending := range state.pending {
+		delete(state.pending, request)
+		pending.batch.fail(errProcessorClosed)
+	}
+	state.mutex.Unlock()
+	d.recordDatabase.CloseClient()
+}
@@ -0,0 +1,143 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMockBulk answers bulk requests with the status given by the document id, 201 by default.
+func newMockBulk(bulks *[][]string, statuses map[string]int) func(w http.ResponseWriter, r *http.Request) bool {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+		var ids, items []string
+		for i := 0; i < len(lines); i += 2 {
+			var action map[string]map[string]string
+			json.Unmarshal([]byte(lines[i]), &action)
+			id := action["create"]["_id"]
+			ids = append(ids, id)
+			status, ok := statuses[id]
+			if !ok {
+				status = 201
+			}
+			items = append(items, fmt.Sprintf(`{"create":{"_index":"i","_type":"t","_id":"%s","status":%d,
+				"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`, id, status))
+		}
+		*bulks = append(*bulks, ids)
+		fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+		return true
+	}
+}
+
+func processorRecords(ids ...int) []*models.ElasticRecord {
+	var records []*models.ElasticRecord
+	for _, id := range ids {
+		records = append(records, &models.ElasticRecord{Index: "i", Type: "t", ID: strconv.Itoa(id), Json: map[string]interface{}{}})
+	}
+	return records
+}
+
+func TestProcessorDatabase_Insert_FlushInterval(t *testing.T) {
+	var bulks [][]string
+	server := newMockElasticsearch(newMockBulk(&bulks, map[string]int{"3": 400}))
+	defer server.Close()
+	d := newTestDatabase(t, Config{
+		Hosts:             []string{server.URL},
+		BulkTimeout:       time.Second,
+		BulkProcessor:     true,
+		BulkFlushInterval: 100 * time.Millisecond,
+		BulkFlushActions:  1000,
+	})
+	defer d.CloseClient()
+
+	// concurrent inserts are flushed together and each gets the result of its own records
+	batches := [][]*models.ElasticRecord{processorRecords(1, 2), processorRecords(3, 4)}
+	responses := make([]*InsertResponse, len(batches))
+	var wg sync.WaitGroup
+	for idx, batch := range batches {
+		wg.Add(1)
+		go func(idx int, batch []*models.ElasticRecord) {
+			defer wg.Done()
+			res, err := d.Insert(context.Background(), batch)
+			assert.NoError(t, err)
+			responses[idx] = res
+		}(idx, batch)
+	}
+	wg.Wait()
+
+	if assert.Len(t, bulks, 1) {
+		assert.Len(t, bulks[0], 4)
+	}
+	assert.Empty(t, responses[0].Rejected)
+	if assert.Len(t, responses[1].Rejected, 1) {
+		assert.Equal(t, "3", responses[1].Rejected[0].DocID)
+	}
+}
+
+func TestProcessorDatabase_Insert_BulkActions(t *testing.T) {
+	var bulks [][]string
+	server := newMockElasticsearch(newMockBulk(&bulks, nil))
+	defer server.Close()
+	d := newTestDatabase(t, Config{
+		Hosts:             []string{server.URL},
+		BulkTimeout:       time.Second,
+		BulkProcessor:     true,
+		BulkFlushInterval: time.Hour,
+		BulkFlushActions:  2,
+	})
+	defer d.CloseClient()
+
+	res, err := d.Insert(context.Background(), processorRecords(1, 2, 3, 4))
+	if assert.NoError(t, err) {
+		assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}}, bulks)
+		assert.Empty(t, res.Retry)
+		assert.Empty(t, res.Rejected)
+	}
+}
+
+func TestProcessorDatabase_CloseClient_Flushes(t *testing.T) {
+	var bulks [][]string
+	server := newMockElasticsearch(newMockBulk(&bulks, nil))
+	defer server.Close()
+	d := newTestDatabase(t, Config{
+		Hosts:             []string{server.URL},
+		BulkTimeout:       time.Second,
+		BulkProcessor:     true,
+		BulkFlushInterval: time.Hour,
+		BulkFlushActions:  1000,
+	})
+	state := d.(processorDatabase).state
+
+	done := make(chan error)
+	go func() {
+		_, err := d.Insert(context.Background(), processorRecords(1, 2))
+		done <- err
+	}()
+	for {
+		state.mutex.Lock()
+		pending := len(state.pending)
+		state.mutex.Unlock()
+		if pending == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.CloseClient()
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, [][]string{{"1", "2"}}, bulks)
+}
@@ -0,0 +1,178 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+)
+
+// sigV4Transport signs the requests sent to Amazon OpenSearch Service with AWS Signature Version 4, so that the
+// domain authorizes them with IAM.
+type sigV4Transport struct {
+	next        http.RoundTripper
+	region      string
+	service     string
+	credentials awsCredentialsProvider
+	// now is the clock of the signatures, time.Now when nil
+	now func() time.Time
+}
+
+func (t sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	credentials, err := t.credentials.retrieve()
+	if err != nil {
+		return nil, fmt.Errorf("could not get aws credentials to sign the request: %s", err)
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	// round trippers must not modify the request they are given
+	signed := new(http.Request)
+	*signed = *req
+	signed.Header = make(http.Header, len(req.Header)+3)
+	for key, values := range req.Header {
+		signed.Header[key] = values
+	}
+	if body != nil {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+		signed.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	t.sign(signed, body, credentials, now().UTC())
+	return t.next.RoundTrip(signed)
+}
+
+func (t sigV4Transport) sign(req *http.Request, body []byte, credentials awsCredentials, at time.Time) {
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", at.Format(sigV4TimeFormat))
+	if credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for key, values := range req.Header {
+		name := strings.ToLower(key)
+		if name == "authorization" || name == "user-agent" || name == "content-length" {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for idx, value := range values {
+			trimmed[idx] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{at.Format(sigV4DateFormat), t.region, t.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		at.Format(sigV4TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.secretAccessKey), at.Format(sigV4DateFormat))
+	for _, part := range []string{t.region, t.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, credentials.accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalURI encodes the already escaped path once more, as every service but S3 expects.
+func canonicalURI(req *http.Request) string {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return awsEscape(path, false)
+}
+
+func canonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent encodes everything but the unreserved characters of RFC 3986, slashes included if asked to.
+func awsEscape(value string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,151 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticCredentials awsCredentials
+
+func (c staticCredentials) retrieve() (awsCredentials, error) {
+	return awsCredentials(c), nil
+}
+
+// the get-vanilla cases of the AWS Signature Version 4 test suite
+func TestSigV4Transport_Sign(t *testing.T) {
+	transport := sigV4Transport{region: "us-east-1", service: "service"}
+	credentials := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	at := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for url, signature := range map[string]string{
+		"https://example.amazonaws.com/":                             "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"https://example.amazonaws.com/?Param2=value2&Param1=value1": "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		transport.sign(req, nil, credentials, at)
+		assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature="+signature, req.Header.Get("Authorization"), url)
+	}
+}
+
+func TestSigV4Transport_RoundTrip(t *testing.T) {
+	var received *http.Request
+	var receivedBody []byte
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		received = r
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		return true
+	})
+	defer server.Close()
+	client := &http.Client{Transport: sigV4Transport{
+		next:        http.DefaultTransport,
+		region:      "us-east-1",
+		service:     "es",
+		credentials: staticCredentials{accessKeyID: "AKID", secretAccessKey: "secret", sessionToken: "token"},
+	}}
+
+	req, _ := http.NewRequest("POST", server.URL+"/_bulk", bytes.NewReader([]byte("{}\n")))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	res, err := client.Do(req)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, "{}\n", string(receivedBody))
+		assert.Equal(t, "token", received.Header.Get("X-Amz-Security-Token"))
+		assert.Contains(t, received.Header.Get("Authorization"), "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token")
+		assert.Empty(t, req.Header.Get("Authorization"), "the original request should be left untouched")
+	}
+}
+
+func TestAWSCredentialsChain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "aws")
+	defer os.RemoveAll(dir)
+	credentialsFile := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(credentialsFile, []byte("[default]\naws_access_key_id = AKIDDEFAULT\naws_secret_access_key = default\n\n"+
+		"[injector]\naws_access_key_id=AKIDINJECTOR\naws_secret_access_key=injector\naws_session_token=token\n"), 0600)
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	os.Setenv("AWS_PROFILE", "injector")
+	defer os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+	defer os.Unsetenv("AWS_PROFILE")
+
+	credentials, err := newAWSCredentialsChain("us-east-1").retrieve()
+	if assert.NoError(t, err) {
+		assert.Equal(t, awsCredentials{accessKeyID: "AKIDINJECTOR", secretAccessKey: "injector", sessionToken: "token"}, credentials)
+	}
+
+	// the environment comes first
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "env")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	credentials, err = newAWSCredentialsChain("us-east-1").retrieve()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "AKIDENV", credentials.accessKeyID)
+	}
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "aws")
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("jwt\n"), 0600)
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/injector")
+	defer os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	defer os.Unsetenv("AWS_ROLE_ARN")
+	var form map[string][]string
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+			<AssumeRoleWithWebIdentityResult><Credentials>
+				<AccessKeyId>ASIAROLE</AccessKeyId><SecretAccessKey>role</SecretAccessKey>
+				<SessionToken>session</SessionToken><Expiration>2030-01-01T00:00:00Z</Expiration>
+			</Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`))
+		return true
+	})
+	defer server.Close()
+
+	credentials, err := webIdentityCredentials{endpoint: server.URL, client: http.DefaultClient}.retrieve()
+	if assert.NoError(t, err) {
+		assert.Equal(t, awsCredentials{
+			accessKeyID:     "ASIAROLE",
+			secretAccessKey: "role",
+			sessionToken:    "session",
+			expires:         time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		}, credentials)
+		assert.Equal(t, []string{"jwt"}, form["WebIdentityToken"])
+		assert.Equal(t, []string{"AssumeRoleWithWebIdentity"}, form["Action"])
+	}
+}
+
+func TestAWSCredentialsChain_RenewsExpiringCredentials(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	chain := &awsCredentialsChain{
+		providers: []awsCredentialsProvider{providerFunc(func() (awsCredentials, error) {
+			calls++
+			return awsCredentials{accessKeyID: strings.Repeat("A", calls), expires: now.Add(10 * time.Minute)}, nil
+		})},
+		now: func() time.Time { return now },
+	}
+	first, _ := chain.retrieve()
+	cached, _ := chain.retrieve()
+	assert.Equal(t, first, cached)
+	now = now.Add(6 * time.Minute)
+	renewed, _ := chain.retrieve()
+	assert.Equal(t, "AA", renewed.accessKeyID)
+}
+
+type providerFunc func() (awsCredentials, error)
+
+func (f providerFunc) retrieve() (awsCredentials, error) {
+	return f()
+}
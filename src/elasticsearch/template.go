@@ -0,0 +1,171 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/olivere/elastic"
+)
+
+type TemplateConfig struct {
+	Name      string
+	Body      string
+	Overwrite bool
+}
+
+func newTemplateConfig(name, body, path string, overwrite bool) (TemplateConfig, error) {
+	if body != "" && path != "" {
+		return TemplateConfig{}, errors.New("only one of ES_TEMPLATE and ES_TEMPLATE_PATH should be set")
+	}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return TemplateConfig{}, fmt.Errorf("could not read index template %s: %s", path, err)
+		}
+		body = string(content)
+	}
+	if body == "" {
+		if name != "" {
+			return TemplateConfig{}, errors.New("ES_TEMPLATE or ES_TEMPLATE_PATH is required when ES_TEMPLATE_NAME is set")
+		}
+		return TemplateConfig{}, nil
+	}
+	if name == "" {
+		return TemplateConfig{}, errors.New("ES_TEMPLATE_NAME is required when an index template is set")
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return TemplateConfig{}, fmt.Errorf("index template %s is not a valid json object: %s", name, err)
+	}
+	return TemplateConfig{Name: name, Body: body, Overwrite: overwrite}, nil
+}
+
+// EnsureTemplate puts the configured index template, unless elasticsearch already has it with the same
+// content. A different template with the same name is only replaced when overwriting is enabled.
+func (d recordDatabase) EnsureTemplate() error {
+	template := d.config.Template
+	if template.Name == "" || atomic.LoadInt32(&d.conn.templateApplied) == 1 {
+		return nil
+	}
+	client, err := d.GetClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.BulkTimeout)
+	defer cancel()
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       "GET",
+		Path:         "/_template/" + template.Name,
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return fmt.Errorf("could not get index template %s: %s", template.Name, err)
+	}
+	if res.StatusCode != http.StatusNotFound {
+		var existing map[string]map[string]interface{}
+		if err := json.Unmarshal(res.Body, &existing); err != nil {
+			return fmt.Errorf("could not parse index template %s: %s", template.Name, err)
+		}
+		if current, ok := existing[template.Name]; ok {
+			var desired map[string]interface{}
+			json.Unmarshal([]byte(template.Body), &desired)
+			if templatesMatch(desired, current) {
+				level.Info(d.logger).Log("message", "index template is up to date", "template", template.Name)
+				atomic.StoreInt32(&d.conn.templateApplied, 1)
+				return nil
+			}
+			if !template.Overwrite {
+				return fmt.Errorf("index template %s differs from the configured one, set ES_TEMPLATE_OVERWRITE to replace it", template.Name)
+			}
+		}
+	}
+	if _, err := client.IndexPutTemplate(template.Name).BodyString(template.Body).Do(ctx); err != nil {
+		return fmt.Errorf("could not put index template %s: %s", template.Name, err)
+	}
+	level.Info(d.logger).Log("message", "index template put", "template", template.Name)
+	atomic.StoreInt32(&d.conn.templateApplied, 1)
+	return nil
+}
+
+// templatesMatch compares a template body with the one returned by elasticsearch, which flattens
+// settings into strings prefixed by "index." and fills in the fields that were left out.
+func templatesMatch(desired, current map[string]interface{}) bool {
+	for _, key := range unionKeys(desired, current) {
+		desiredValue, currentValue := desired[key], current[key]
+		if key == "settings" {
+			desiredValue, currentValue = normalizeSettings(desiredValue), normalizeSettings(currentValue)
+		}
+		if isEmptyJSON(desiredValue) && isEmptyJSON(currentValue) {
+			continue
+		}
+		if !reflect.DeepEqual(desiredValue, currentValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func unionKeys(a, b map[string]interface{}) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func normalizeSettings(settings interface{}) interface{} {
+	flat := make(map[string]interface{})
+	flattenSettings("", settings, flat)
+	normalized := make(map[string]interface{}, len(flat))
+	for key, value := range flat {
+		if !strings.HasPrefix(key, "index.") {
+			key = "index." + key
+		}
+		normalized[key] = fmt.Sprint(value)
+	}
+	return normalized
+}
+
+func flattenSettings(prefix string, value interface{}, flat map[string]interface{}) {
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		if value != nil {
+			flat[prefix] = value
+		}
+		return
+	}
+	for key, nestedValue := range nested {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenSettings(key, nestedValue, flat)
+	}
+}
+
+func isEmptyJSON(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case float64:
+		return v == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,114 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTemplate = `{
+	"index_patterns": ["my-topic-*"],
+	"settings": {"number_of_shards": 1},
+	"mappings": {"my-topic": {"properties": {"ip": {"type": "ip"}}}}
+}`
+
+// the same template, as elasticsearch returns it
+const storedTestTemplate = `{"my-template": {
+	"order": 0,
+	"index_patterns": ["my-topic-*"],
+	"settings": {"index": {"number_of_shards": "1"}},
+	"mappings": {"my-topic": {"properties": {"ip": {"type": "ip"}}}},
+	"aliases": {}
+}}`
+
+func TestTemplatesMatch(t *testing.T) {
+	var desired map[string]interface{}
+	var stored map[string]map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(testTemplate), &desired))
+	assert.NoError(t, json.Unmarshal([]byte(storedTestTemplate), &stored))
+	assert.True(t, templatesMatch(desired, stored["my-template"]))
+
+	desired["settings"] = map[string]interface{}{"index.number_of_shards": 2}
+	assert.False(t, templatesMatch(desired, stored["my-template"]))
+}
+
+func TestRecordDatabase_EnsureTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		stored    string
+		overwrite bool
+		put       bool
+		err       bool
+	}{
+		{stored: "", put: true},
+		{stored: storedTestTemplate, put: false},
+		{stored: `{"my-template": {"index_patterns": ["other-*"]}}`, err: true},
+		{stored: `{"my-template": {"index_patterns": ["other-*"]}}`, overwrite: true, put: true},
+	} {
+		var putBody string
+		server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Path != "/_template/my-template" {
+				return false
+			}
+			switch r.Method {
+			case "GET":
+				if tc.stored == "" {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprint(w, `{}`)
+				} else {
+					fmt.Fprint(w, tc.stored)
+				}
+			case "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				putBody = string(body)
+				fmt.Fprint(w, `{"acknowledged":true}`)
+			}
+			return true
+		})
+		d := newTestDatabase(t, Config{
+			Hosts:       []string{server.URL},
+			BulkTimeout: time.Second,
+			Template:    TemplateConfig{Name: "my-template", Body: testTemplate, Overwrite: tc.overwrite},
+		})
+
+		err := d.EnsureTemplate()
+		if tc.err {
+			assert.Error(t, err)
+		} else if assert.NoError(t, err) {
+			if tc.put {
+				assert.JSONEq(t, testTemplate, putBody)
+			} else {
+				assert.Empty(t, putBody)
+			}
+		}
+		d.CloseClient()
+		server.Close()
+	}
+}
+
+func TestNewTemplateConfig(t *testing.T) {
+	_, err := newTemplateConfig("my-template", "", "", false)
+	assert.Error(t, err)
+	_, err = newTemplateConfig("", testTemplate, "", false)
+	assert.Error(t, err)
+	_, err = newTemplateConfig("my-template", "{not json", "", false)
+	assert.Error(t, err)
+	_, err = newTemplateConfig("my-template", "", "/does/not/exist.json", false)
+	assert.Error(t, err)
+
+	file, err := ioutil.TempFile("", "template")
+	if assert.NoError(t, err) {
+		defer os.Remove(file.Name())
+		file.WriteString(testTemplate)
+		file.Close()
+		template, err := newTemplateConfig("my-template", "", file.Name(), true)
+		if assert.NoError(t, err) {
+			assert.Equal(t, TemplateConfig{Name: "my-template", Body: testTemplate, Overwrite: true}, template)
+		}
+	}
+}
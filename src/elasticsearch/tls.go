@@ -0,0 +1,39 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+func (c Config) tlsEnabled() bool {
+	return c.CACertPath != "" || c.ClientCertPath != "" || c.ClientKeyPath != "" || c.InsecureSkipVerify
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(c.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read elasticsearch CA certificate %s: %v", c.CACertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no PEM certificates found in elasticsearch CA certificate %s", c.CACertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCertPath != "" || c.ClientKeyPath != "" {
+		if c.ClientCertPath == "" || c.ClientKeyPath == "" {
+			return nil, errors.New("elasticsearch client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertPath, c.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load elasticsearch client certificate %s: %v", c.ClientCertPath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,49 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClient_CACert(t *testing.T) {
+	server := newMockElasticsearchTLS(func(w http.ResponseWriter, r *http.Request) bool { return false })
+	defer server.Close()
+	caCert, err := ioutil.TempFile("", "es-ca")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(caCert.Name())
+	pem.Encode(caCert, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caCert.Close()
+
+	client, err := newClient(Config{Hosts: []string{server.URL}, CACertPath: caCert.Name()})
+	if assert.NoError(t, err) {
+		_, _, err = client.Ping(server.URL).Do(context.Background())
+		assert.NoError(t, err)
+		client.Stop()
+	}
+}
+
+func TestNewConfig_InvalidCACertPath(t *testing.T) {
+	os.Setenv("ELASTICSEARCH_CA_CERT_PATH", "/does/not/exist.pem")
+	defer os.Unsetenv("ELASTICSEARCH_CA_CERT_PATH")
+
+	_, err := NewConfig()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "/does/not/exist.pem")
+	}
+}
+
+func TestNewConfig_ClientCertWithoutKey(t *testing.T) {
+	os.Setenv("ELASTICSEARCH_CLIENT_CERT_PATH", "/etc/ssl/client.pem")
+	defer os.Unsetenv("ELASTICSEARCH_CLIENT_CERT_PATH")
+
+	_, err := NewConfig()
+	assert.Error(t, err)
+}
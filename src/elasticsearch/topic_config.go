@@ -0,0 +1,129 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TopicConfig overrides the global index, document id, blacklist and script settings for the records of a topic.
+// Settings left out fall back to the global ones.
+type TopicConfig struct {
+	Index              string                 `json:"index"`
+	DocIDColumn        *string                `json:"doc_id_column"`
+	BlacklistedColumns []string               `json:"blacklisted_columns"`
+	Script             *string                `json:"script"`
+	ScriptUpsert       map[string]interface{} `json:"script_upsert"`
+}
+
+// newTopicConfigs parses a json object keyed by topic, given inline or as the path of a file.
+func newTopicConfigs(body, path string) (map[string]TopicConfig, error) {
+	if body != "" && path != "" {
+		return nil, errors.New("only one of ES_TOPIC_CONFIG and ES_TOPIC_CONFIG_PATH should be set")
+	}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read topic config %s: %s", path, err)
+		}
+		body = string(content)
+	}
+	if body == "" {
+		return nil, nil
+	}
+	var configs map[string]TopicConfig
+	decoder := json.NewDecoder(bytes.NewReader([]byte(body)))
+	// a misspelled setting would otherwise be silently replaced by the global one
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&configs); err != nil {
+		return nil, fmt.Errorf("invalid topic config: %s", err)
+	}
+	return configs, nil
+}
+
+// parseScriptUpsert parses the json object a scripted update starts from when the document doesn't exist yet.
+func parseScriptUpsert(body string) (map[string]interface{}, error) {
+	if body == "" {
+		return nil, nil
+	}
+	var upsert map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &upsert); err != nil {
+		return nil, fmt.Errorf("not a valid json object: %s", err)
+	}
+	return upsert, nil
+}
+
+func topicConfigsHaveScript(configs map[string]TopicConfig) bool {
+	for _, topicConfig := range configs {
+		if topicConfig.Script != nil && *topicConfig.Script != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFor is the index prefix of the records of a topic.
+func (c Config) indexFor(topic string) string {
+	if topicConfig, ok := c.TopicConfigs[topic]; ok && topicConfig.Index != "" {
+		return topicConfig.Index
+	}
+	return c.Index
+}
+
+// validateSharedIndices rejects topics written to the same indices with the default document ids, made of the
+// partition and offset of the records, which every topic has: the records of a topic would overwrite the ones of
+// the other topics. The topics of topicsPattern are only known once consumed, they share the index of ES_INDEX.
+func (c Config) validateSharedIndices(topics []string, topicsPattern string) error {
+	writers := make(map[string]string)
+	for _, topic := range topics {
+		if c.docIDColumnFor(topic) != "" {
+			continue
+		}
+		index := c.indexFor(topic)
+		if index == "" {
+			index = topic
+		}
+		if other, ok := writers[index]; ok && other != topic {
+			return fmt.Errorf("topics %s and %s are both written to index %s with the default document ids, ES_DOC_ID_COLUMN should be set", other, topic, index)
+		}
+		writers[index] = topic
+	}
+	if topicsPattern != "" && c.Index != "" && c.DocIDColumn == "" {
+		return fmt.Errorf("the topics of KAFKA_TOPICS_PATTERN are all written to index %s with the default document ids, ES_DOC_ID_COLUMN should be set", c.Index)
+	}
+	return nil
+}
+
+// docIDColumnFor is the document id column of the records of a topic, empty to use their partition and offset.
+func (c Config) docIDColumnFor(topic string) string {
+	if topicConfig, ok := c.TopicConfigs[topic]; ok && topicConfig.DocIDColumn != nil {
+		return *topicConfig.DocIDColumn
+	}
+	return c.DocIDColumn
+}
+
+// scriptFor is the source of the script updating the documents of a topic.
+func (c Config) scriptFor(topic string) string {
+	if topicConfig, ok := c.TopicConfigs[topic]; ok && topicConfig.Script != nil {
+		return *topicConfig.Script
+	}
+	return c.Script
+}
+
+// scriptUpsertFor is the document the script of a topic starts from when the document doesn't exist yet.
+func (c Config) scriptUpsertFor(topic string) map[string]interface{} {
+	if topicConfig, ok := c.TopicConfigs[topic]; ok && topicConfig.ScriptUpsert != nil {
+		return topicConfig.ScriptUpsert
+	}
+	return c.ScriptUpsert
+}
+
+// blacklistedColumnsFor are the columns left out of the documents of a topic.
+func (c Config) blacklistedColumnsFor(topic string) []string {
+	if topicConfig, ok := c.TopicConfigs[topic]; ok && topicConfig.BlacklistedColumns != nil {
+		return topicConfig.BlacklistedColumns
+	}
+	return c.BlacklistedColumns
+}
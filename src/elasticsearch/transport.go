@@ -0,0 +1,95 @@
+package elasticsearch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// the defaults of http.DefaultTransport, which the client used before its transport became configurable
+const (
+	defaultKeepAlive           = 30 * time.Second
+	defaultMaxIdleConns        = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+func (c Config) httpClient() (*http.Client, error) {
+	keepAlive := c.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = defaultKeepAlive
+	}
+	// a slow tcp connect fails on its own instead of using up the bulk timeout
+	dialer := &net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: keepAlive}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: c.IdleConnsPerHost,
+		IdleConnTimeout:     defaultIdleConnTimeout,
+		TLSHandshakeTimeout: defaultTLSHandshakeTimeout,
+	}
+	if c.tlsEnabled() {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	var roundTripper http.RoundTripper = transport
+	if c.APIKey != "" {
+		roundTripper = apiKeyTransport{next: roundTripper, authorization: "ApiKey " + c.APIKey}
+	}
+	if c.AWSSigV4 {
+		roundTripper = sigV4Transport{
+			next:        roundTripper,
+			region:      c.AWSRegion,
+			service:     c.AWSService,
+			credentials: newAWSCredentialsChain(c.AWSRegion),
+		}
+	}
+	if c.Gzip {
+		// the signature covers the compressed body
+		roundTripper = gzipTransport{next: roundTripper}
+	}
+	return &http.Client{Transport: roundTripper}, nil
+}
+
+// apiKeyTransport authenticates every request to elasticsearch, pings and health checks included, with an api key.
+type apiKeyTransport struct {
+	next          http.RoundTripper
+	authorization string
+}
+
+func (t apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// round trippers must not modify the request they are given
+	authenticated := new(http.Request)
+	*authenticated = *req
+	authenticated.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		authenticated.Header[key] = values
+	}
+	authenticated.Header.Set("Authorization", t.authorization)
+	return t.next.RoundTrip(authenticated)
+}
+
+// clientRetrier retries requests that got no response from a node, like on a connection reset, up to a number
+// of times. Requests answered with an error status are left to the bulk retries.
+type clientRetrier struct {
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Retry doubles the backoff on each retry, up to maxBackoff.
+func (r clientRetrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if retry > r.retries || ctx.Err() != nil {
+		return 0, false, nil
+	}
+	wait := r.backoff << uint(retry-1)
+	if wait > r.maxBackoff || wait <= 0 {
+		wait = r.maxBackoff
+	}
+	return wait, true, nil
+}
@@ -0,0 +1,87 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClient_Retries(t *testing.T) {
+	resets := 2
+	bulks := 0
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_bulk" {
+			return false
+		}
+		bulks++
+		if resets > 0 {
+			resets--
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return true
+		}
+		fmt.Fprint(w, `{"took":1,"errors":false,"items":[{"create":{"_index":"i","_id":"1","status":201}}]}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{
+		Hosts:            []string{server.URL},
+		DocType:          "t",
+		BulkTimeout:      time.Second,
+		ClientRetries:    2,
+		ClientBackoff:    time.Millisecond,
+		ClientMaxBackoff: time.Millisecond,
+	})
+	defer d.CloseClient()
+
+	_, err := d.Insert(context.Background(), []*models.ElasticRecord{{Index: "i", Type: "t", ID: "1", Json: map[string]interface{}{}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, bulks)
+}
+
+func TestNewClient_DisableSniff(t *testing.T) {
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/_nodes/http" {
+			return false
+		}
+		// a private address the injector can't reach
+		fmt.Fprint(w, `{"nodes":{"mock":{"name":"mock","http":{"publish_address":"10.255.255.1:9200"}}}}`)
+		return true
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, DisableSniff: true, ConnectTimeout: 100 * time.Millisecond})
+	defer d.CloseClient()
+
+	assert.True(t, d.ReadinessCheck())
+}
+
+func TestNewClient_APIKey(t *testing.T) {
+	authorizations := make(map[string]bool)
+	server := newMockElasticsearch(func(w http.ResponseWriter, r *http.Request) bool {
+		authorizations[r.Header.Get("Authorization")] = true
+		return false
+	})
+	defer server.Close()
+	d := newTestDatabase(t, Config{Hosts: []string{server.URL}, APIKey: "dGVzdDprZXk="})
+	defer d.CloseClient()
+
+	assert.True(t, d.ReadinessCheck())
+	assert.Equal(t, map[string]bool{"ApiKey dGVzdDprZXk=": true}, authorizations)
+}
+
+func TestClientRetrier_Retry(t *testing.T) {
+	retrier := clientRetrier{retries: 3, backoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+	for retry, expected := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond} {
+		wait, ok, err := retrier.Retry(context.Background(), retry, nil, nil, nil)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, expected, wait)
+	}
+	_, ok, _ := retrier.Retry(context.Background(), 4, nil, nil, nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,170 @@
+// Package injector consumes the records of kafka into elasticsearch. Config, New and Injector embed it in another
+// service, which keeps its own config, metrics and lifecycle, and are kept compatible across minor versions; the
+// rest of the package wires the injector binary and may change.
+package injector
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/injector/store"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
+)
+
+// Config is the config of an embedded injector, read from the env vars by NewConfig or built by the service.
+type Config struct {
+	// KafkaAddress is the address of the kafka brokers, like KAFKA_ADDRESS
+	KafkaAddress string
+	// Kafka is the consumer, its settings in the format of the KAFKA_ env vars
+	Kafka *kafka.Config
+	// SchemaRegistry is how the schemas are fetched, its Logger defaults to the logger of the injector
+	SchemaRegistry schema_registry.Config
+	// Elasticsearch is the client and the documents, which Database writes when it is set
+	Elasticsearch elasticsearch.Config
+	// Transform changes the decoded records before they are written, nil to keep them as they are
+	Transform TransformFunc
+	// Database is where the documents are written instead of the elasticsearch of the config, like a custom sink
+	Database elasticsearch.RecordDatabase
+	// MetricsPublisher publishes the metrics, the ones of the process when nil
+	MetricsPublisher metrics.MetricsPublisher
+	// Tracer traces the batches, nil to disable tracing
+	Tracer *tracing.Tracer
+}
+
+// NewConfig reads the config of a pipeline, the env vars for the zero Pipeline, failing with every invalid setting
+// found like the injector binary does on startup.
+func NewConfig(pipeline config_file.Pipeline) (Config, error) {
+	if err := validatePipeline(pipeline).Err(); err != nil {
+		return Config{}, err
+	}
+	schemaRegistry, err := newSchemaRegistryConfig(pipeline)
+	if err != nil {
+		return Config{}, err
+	}
+	esConfig, err := elasticsearch.NewConfigFrom(pipeline.LookupEnv)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		KafkaAddress:   pipeline.Getenv("KAFKA_ADDRESS"),
+		Kafka:          NewKafkaConfig(pipeline),
+		SchemaRegistry: schemaRegistry,
+		Elasticsearch:  esConfig,
+	}, nil
+}
+
+// runner is the consumer created by kafka.NewKafka.
+type runner interface {
+	Start(signals chan os.Signal, notifications chan<- kafka.Notification)
+	Replay(signals chan os.Signal) (kafka.ReplaySummary, error)
+	Health() *kafka.Health
+}
+
+// Injector consumes the records of kafka and writes them to elasticsearch, or to the database of its config.
+type Injector struct {
+	service  Service
+	consumer runner
+	replay   bool
+	once     sync.Once
+}
+
+// New creates an injector, connecting to elasticsearch unless the config has a database of its own. Nothing is
+// consumed until Run.
+func New(config Config, logger log.Logger) (*Injector, error) {
+	if config.Kafka == nil {
+		return nil, fmt.Errorf("the kafka config is required")
+	}
+	metricsPublisher := config.MetricsPublisher
+	if metricsPublisher == nil {
+		metricsPublisher = metrics.NewMetricsPublisher()
+	}
+	if config.SchemaRegistry.Logger == nil {
+		config.SchemaRegistry.Logger = logger
+	}
+	schemaRegistry, err := schema_registry.NewSchemaRegistryWithConfig(config.SchemaRegistry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema registry client: %s", err)
+	}
+	var s store.Store
+	if config.Database != nil {
+		s, err = store.NewStoreWithDatabase(logger, metricsPublisher, config.Elasticsearch, config.Database)
+	} else {
+		s, err = store.NewStoreWithConfig(logger, metricsPublisher, config.Elasticsearch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	service := newService(s, metricsPublisher)
+	if config.Transform != nil {
+		service = transformingMiddleware{transform: config.Transform, next: service}
+	}
+	consumer, err := MakeKafkaConsumer(MakeEndpoints(service), logger, schemaRegistry, config.Kafka)
+	if err != nil {
+		service.Close()
+		return nil, err
+	}
+	consumer.Tracer = config.Tracer
+	k := kafka.NewKafka(config.KafkaAddress, consumer, metricsPublisher)
+	return &Injector{service: service, consumer: &k, replay: consumer.Replay != nil}, nil
+}
+
+// Run consumes until the context is done, then waits for the inserts in flight and closes the database. A replay,
+// set by the ReplayStart of the kafka config, returns once its end is reached instead. It fails when consuming
+// fails, like when kafka can't be reached. An injector is only run once.
+func (i *Injector) Run(ctx context.Context) (err error) {
+	ran := false
+	i.once.Do(func() { ran = true })
+	if !ran {
+		return fmt.Errorf("the injector was already run")
+	}
+	defer i.service.Close()
+	// the consumer panics when it fails, the way the injector binary exits
+	defer func() {
+		if failure := recover(); failure != nil {
+			err = fmt.Errorf("consuming failed: %v", failure)
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			signals <- os.Interrupt
+		case <-done:
+		}
+	}()
+	if i.replay {
+		_, err = i.consumer.Replay(signals)
+		return err
+	}
+	notifications := make(chan kafka.Notification, 10)
+	go func() {
+		for {
+			select {
+			case <-notifications:
+			case <-done:
+				return
+			}
+		}
+	}()
+	i.consumer.Start(signals, notifications)
+	return nil
+}
+
+// Ready tells whether the injector is consuming and its database is healthy, like the readiness probe of the
+// injector binary.
+func (i *Injector) Ready() bool {
+	if !i.service.ReadinessCheck() {
+		return false
+	}
+	return i.replay || i.consumer.Health().Ready()
+}
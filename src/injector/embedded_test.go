@@ -0,0 +1,38 @@
+package injector
+
+import (
+	"testing"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/logger_builder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConfig(t *testing.T) {
+	config, err := NewConfig(config_file.Pipeline{Name: "orders", Settings: map[string]string{
+		"KAFKA_ADDRESS":        "kafka:9092",
+		"KAFKA_TOPICS":         "orders",
+		"KAFKA_CONSUMER_GROUP": "orders-injector",
+		"SCHEMA_REGISTRY_URL":  "http://schema-registry:8081",
+		"ELASTICSEARCH_HOST":   "http://elasticsearch:9200",
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "kafka:9092", config.KafkaAddress)
+	assert.Equal(t, []string{"orders"}, config.Kafka.Topics)
+	assert.Equal(t, "orders-injector", config.Kafka.ConsumerGroup)
+	assert.Equal(t, "http://schema-registry:8081", config.SchemaRegistry.URL)
+
+	_, err = NewConfig(config_file.Pipeline{Name: "orders", Settings: map[string]string{
+		"KAFKA_ADDRESS":       "kafka:9092",
+		"SCHEMA_REGISTRY_URL": "http://schema-registry:8081",
+		"ELASTICSEARCH_HOST":  "http://elasticsearch:9200",
+	}})
+	assert.Error(t, err)
+}
+
+func TestNew_RequiresKafka(t *testing.T) {
+	_, err := New(Config{}, logger_builder.NewLogger("injector-test"))
+	assert.EqualError(t, err, "the kafka config is required")
+}
@@ -29,6 +29,7 @@ func makeInsertEndpoint(svc Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 		records := request.([]*models.Record)
 
-		return nil, svc.Insert(records)
+		// the results tell the consumer which offsets it can commit when the insert fails
+		return svc.InsertRecords(ctx, records)
 	}
 }
@@ -1,51 +1,316 @@
 package injector
 
 import (
+	"errors"
+	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/inloco/kafka-elasticsearch-injector/src/kafka"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
 	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/validation"
 )
 
+// consumerConfig is the consumer parsed from the config, before it is given its endpoint and schema registry.
+type consumerConfig struct {
+	consumer            kafka.Consumer
+	decoder             *kafka.Decoder
+	readerSchemas       map[string]kafka.ReaderSchemaConfig
+	readerSchemaRefresh time.Duration
+}
+
 func MakeKafkaConsumer(endpoints Endpoints, logger log.Logger, schemaRegistry *schema_registry.SchemaRegistry, kafkaConfig *kafka.Config) (kafka.Consumer, error) {
-	concurrency, err := strconv.Atoi(kafkaConfig.Concurrency)
+	config, err := parseConsumer(kafkaConfig)
 	if err != nil {
-		level.Warn(logger).Log("err", err, "message", "failed to get consumer concurrency")
-		concurrency = 1
+		return kafka.Consumer{}, err
 	}
-	batchSize, err := strconv.Atoi(kafkaConfig.BatchSize)
-	if err != nil {
-		level.Warn(logger).Log("err", err, "message", "failed to get consumer batch size")
-		batchSize = 100
+	deserializer := config.decoder
+	deserializer.SchemaRegistry = schemaRegistry
+	if len(config.readerSchemas) > 0 {
+		readerSchemas, err := kafka.NewReaderSchemas(config.readerSchemas, schemaRegistry, deserializer, logger)
+		if err != nil {
+			return kafka.Consumer{}, err
+		}
+		deserializer.ReaderSchemas = readerSchemas
+		if config.readerSchemaRefresh > 0 {
+			go readerSchemas.Refresh(config.readerSchemaRefresh)
+		}
+	}
+	consumer := config.consumer
+	consumer.Endpoint = endpoints.Insert()
+	consumer.Decoder = deserializer.DeserializerFor(kafkaConfig.RecordType)
+	consumer.Logger = logger
+	return consumer, nil
+}
+
+// parseConsumer parses the config of the consumer without connecting anywhere, failing with every invalid
+// setting found.
+func parseConsumer(kafkaConfig *kafka.Config) (consumerConfig, error) {
+	var errs validation.Errors
+	if len(kafkaConfig.Topics) == 0 && kafkaConfig.TopicsPattern == "" {
+		errs.Add(errors.New("KAFKA_TOPICS or KAFKA_TOPICS_PATTERN is required"))
+	}
+	var topicsPattern *regexp.Regexp
+	if kafkaConfig.TopicsPattern != "" {
+		var err error
+		// anchored, so that the pattern has to match the whole topic name
+		topicsPattern, err = regexp.Compile("^(?:" + kafkaConfig.TopicsPattern + ")$")
+		if err != nil {
+			errs.Addf("invalid KAFKA_TOPICS_PATTERN: %s", err)
+		}
 	}
-	metricsUpdateInterval, err := time.ParseDuration(kafkaConfig.MetricsUpdateInterval)
+	concurrency := errs.Int("KAFKA_CONSUMER_CONCURRENCY", kafkaConfig.Concurrency, 1, false)
+	batchSize := errs.Int("KAFKA_CONSUMER_BATCH_SIZE", kafkaConfig.BatchSize, 100, false)
+	batchLinger := errs.Duration("KAFKA_CONSUMER_BATCH_LINGER", kafkaConfig.BatchLinger, 0, true)
+	shutdownTimeout := errs.Duration("KAFKA_CONSUMER_SHUTDOWN_TIMEOUT", kafkaConfig.ShutdownTimeout, 20*time.Second, true)
+	healthCheckInterval := errs.Duration("KAFKA_HEALTH_CHECK_INTERVAL", kafkaConfig.HealthCheckInterval, kafka.DefaultHealthCheckInterval, false)
+	livenessTimeout := errs.Duration("KAFKA_LIVENESS_TIMEOUT", kafkaConfig.LivenessTimeout, kafka.DefaultLivenessTimeout, false)
+	if livenessTimeout <= healthCheckInterval {
+		errs.Addf("KAFKA_LIVENESS_TIMEOUT %s should be longer than KAFKA_HEALTH_CHECK_INTERVAL %s", livenessTimeout, healthCheckInterval)
+	}
+	stallTimeout := errs.Duration("KAFKA_CONSUMER_STALL_TIMEOUT", kafkaConfig.StallTimeout, kafka.DefaultStallTimeout, true)
+	metricsUpdateInterval := errs.Duration("KAFKA_CONSUMER_METRICS_UPDATE_INTERVAL", kafkaConfig.MetricsUpdateInterval, 30*time.Second, false)
+	metadataRefresh := errs.Duration("KAFKA_METADATA_REFRESH_INTERVAL", kafkaConfig.MetadataRefresh, 0, true)
+
+	sasl, err := kafka.NewSASL(kafkaConfig.SASLMechanism, kafkaConfig.SASLUsername, kafkaConfig.SASLPassword)
+	errs.Add(err)
+	tlsConfig, err := kafka.NewTLSConfig(
+		errs.Bool("KAFKA_TLS", kafkaConfig.TLS, false),
+		kafkaConfig.TLSCACertPath,
+		kafkaConfig.TLSClientCertPath,
+		kafkaConfig.TLSClientKeyPath,
+		errs.Bool("KAFKA_TLS_INSECURE_SKIP_VERIFY", kafkaConfig.TLSInsecure, false),
+	)
+	errs.Add(err)
+
+	startOffset, err := kafka.ParseStartOffset(
+		kafkaConfig.StartOffset,
+		errs.Bool("KAFKA_FORCE_SEEK", kafkaConfig.ForceSeek, false),
+	)
 	if err != nil {
-		level.Warn(logger).Log("err", err, "message", "failed to get consumer metrics update interval")
-		metricsUpdateInterval = 30 * time.Second
+		errs.Addf("invalid KAFKA_START_OFFSET: %s", err)
 	}
 
-	bufferSize, err := strconv.Atoi(kafkaConfig.BufferSize)
+	replay, err := parseReplay(kafkaConfig.ReplayStart, kafkaConfig.ReplayEnd, kafkaConfig.ReplayRate)
+	errs.Add(err)
+
+	bufferSize := errs.Int("KAFKA_CONSUMER_BUFFER_SIZE", kafkaConfig.BufferSize, batchSize*concurrency, true)
+
+	version, err := kafka.ParseVersion(kafkaConfig.Version)
+	errs.Add(err)
+
+	maxInFlight, resumeInFlight, err := parseInFlight(kafkaConfig.MaxInFlight, kafkaConfig.ResumeInFlight, batchSize*concurrency)
+	errs.Add(err)
+
+	dispatch := kafkaConfig.Dispatch
+	switch dispatch {
+	case "":
+		dispatch = kafka.DispatchShared
+	case kafka.DispatchShared, kafka.DispatchPartition, kafka.DispatchKey:
+	default:
+		errs.Addf(
+			"KAFKA_CONSUMER_DISPATCH should be %s, %s or %s",
+			kafka.DispatchShared, kafka.DispatchPartition, kafka.DispatchKey,
+		)
+	}
+
+	decodeErrorPolicy := kafkaConfig.DecodeErrorPolicy
+	switch decodeErrorPolicy {
+	case "":
+		decodeErrorPolicy = kafka.DecodeErrorSkip
+	case kafka.DecodeErrorSkip, kafka.DecodeErrorFail, kafka.DecodeErrorDeadLetter:
+	case kafka.DecodeErrorDeadLetterTopic:
+		if kafkaConfig.DeadLetterTopic == "" {
+			errs.Addf("KAFKA_DEAD_LETTER_TOPIC is required when KAFKA_CONSUMER_DECODE_ERROR_POLICY is %s", kafka.DecodeErrorDeadLetterTopic)
+		}
+	default:
+		errs.Addf(
+			"KAFKA_CONSUMER_DECODE_ERROR_POLICY should be %s, %s, %s or %s",
+			kafka.DecodeErrorSkip, kafka.DecodeErrorFail, kafka.DecodeErrorDeadLetter, kafka.DecodeErrorDeadLetterTopic,
+		)
+	}
+	var deadLetterBrokers []string
+	for _, broker := range strings.Split(kafkaConfig.DeadLetterBrokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			deadLetterBrokers = append(deadLetterBrokers, broker)
+		}
+	}
+
+	maxRecordsPerSecond := errs.Int("KAFKA_CONSUMER_MAX_RECORDS_PER_SECOND", kafkaConfig.MaxRecordsPerSecond, 0, true)
+	maxBytesPerSecond := errs.Int("KAFKA_CONSUMER_MAX_BYTES_PER_SECOND", kafkaConfig.MaxBytesPerSecond, 0, true)
+
+	var filter *models.Filter
+	if kafkaConfig.Filter != "" {
+		filter, err = models.ParseFilter(kafkaConfig.Filter)
+		if err != nil {
+			errs.Addf("invalid KAFKA_CONSUMER_FILTER: %s", err)
+		}
+	}
+
+	// invalid DRY_RUN values are reported by the elasticsearch config
+	dryRun, _ := strconv.ParseBool(kafkaConfig.DryRun)
+	dryRunCommit := errs.Bool("DRY_RUN_COMMIT", kafkaConfig.DryRunCommit, false)
+
+	deleteTombstones := errs.Bool("KAFKA_CONSUMER_DELETE_TOMBSTONES", kafkaConfig.DeleteTombstones, false)
+
+	timestampFormat := kafkaConfig.AvroTimestampFormat
+	switch timestampFormat {
+	case "":
+		timestampFormat = kafka.AvroTimestampRFC3339
+	case kafka.AvroTimestampRFC3339, kafka.AvroTimestampEpochMillis:
+	default:
+		errs.Addf(
+			"KAFKA_CONSUMER_AVRO_TIMESTAMP_FORMAT should be %s or %s", kafka.AvroTimestampRFC3339, kafka.AvroTimestampEpochMillis,
+		)
+	}
+	decimalFormat := kafkaConfig.AvroDecimalFormat
+	switch decimalFormat {
+	case "":
+		decimalFormat = kafka.AvroDecimalString
+	case kafka.AvroDecimalString, kafka.AvroDecimalFloat:
+	default:
+		errs.Addf(
+			"KAFKA_CONSUMER_AVRO_DECIMAL_FORMAT should be %s or %s", kafka.AvroDecimalString, kafka.AvroDecimalFloat,
+		)
+	}
+
+	omitNulls := errs.Bool("KAFKA_CONSUMER_AVRO_OMIT_NULLS", kafkaConfig.AvroOmitNulls, false)
+
+	binaryFormat := kafkaConfig.AvroBinaryFormat
+	switch binaryFormat {
+	case "":
+		binaryFormat = kafka.AvroBinaryBase64
+	case kafka.AvroBinaryBase64, kafka.AvroBinaryHex, kafka.AvroBinaryDrop:
+	default:
+		errs.Addf(
+			"KAFKA_CONSUMER_AVRO_BINARY_FORMAT should be %s, %s or %s", kafka.AvroBinaryBase64, kafka.AvroBinaryHex, kafka.AvroBinaryDrop,
+		)
+	}
+	binaryFields, err := kafka.ParseBinaryFields(kafkaConfig.AvroBinaryFields)
 	if err != nil {
-		bufferSize = batchSize * concurrency
+		errs.Addf("invalid KAFKA_CONSUMER_AVRO_BINARY_FIELDS: %s", err)
 	}
 
-	deserializer := &kafka.Decoder{
-		SchemaRegistry: schemaRegistry,
+	validateJSONSchemas := errs.Bool("KAFKA_CONSUMER_JSON_SCHEMA_VALIDATE", kafkaConfig.JSONSchemaValidate, false)
+
+	readerSchemas, err := kafka.ParseReaderSchemas(kafkaConfig.ReaderSchemas, kafkaConfig.ReaderSchemasPath)
+	if err != nil {
+		errs.Addf("invalid KAFKA_CONSUMER_READER_SCHEMAS: %s", err)
+	}
+	readerSchemaRefresh := errs.Duration("KAFKA_CONSUMER_READER_SCHEMA_REFRESH_INTERVAL", kafkaConfig.ReaderSchemaRefresh, 5*time.Minute, true)
+	if err := errs.Err(); err != nil {
+		return consumerConfig{}, err
 	}
 
-	return kafka.Consumer{
-		Topics:                kafkaConfig.Topics,
-		Group:                 kafkaConfig.ConsumerGroup,
-		Endpoint:              endpoints.Insert(),
-		Decoder:               deserializer.DeserializerFor(kafkaConfig.RecordType),
-		Logger:                logger,
-		Concurrency:           concurrency,
-		BatchSize:             batchSize,
-		MetricsUpdateInterval: metricsUpdateInterval,
-		BufferSize:            bufferSize,
+	return consumerConfig{
+		consumer: kafka.Consumer{
+			Topics:                kafkaConfig.Topics,
+			TopicsPattern:         topicsPattern,
+			MetadataRefresh:       metadataRefresh,
+			SASL:                  sasl,
+			TLS:                   tlsConfig,
+			StartOffset:           startOffset,
+			Replay:                replay,
+			MaxInFlight:           maxInFlight,
+			ResumeInFlight:        resumeInFlight,
+			BatchLinger:           batchLinger,
+			ShutdownTimeout:       shutdownTimeout,
+			HealthCheckInterval:   healthCheckInterval,
+			LivenessTimeout:       livenessTimeout,
+			StallTimeout:          stallTimeout,
+			Version:               version,
+			DecodeErrorPolicy:     decodeErrorPolicy,
+			Dispatch:              dispatch,
+			DeadLetterTopic:       kafkaConfig.DeadLetterTopic,
+			DeadLetterBrokers:     deadLetterBrokers,
+			Filter:                filter,
+			NoCommit:              dryRun && !dryRunCommit,
+			RateLimiter:           kafka.NewRateLimiter(maxRecordsPerSecond, maxBytesPerSecond),
+			Group:                 kafkaConfig.ConsumerGroup,
+			Concurrency:           concurrency,
+			BatchSize:             batchSize,
+			MetricsUpdateInterval: metricsUpdateInterval,
+			BufferSize:            bufferSize,
+		},
+		decoder: &kafka.Decoder{
+			DeleteTombstones:    deleteTombstones,
+			TimestampFormat:     timestampFormat,
+			DecimalFormat:       decimalFormat,
+			OmitNulls:           omitNulls,
+			BinaryFormat:        binaryFormat,
+			BinaryFields:        binaryFields,
+			ValidateJSONSchemas: validateJSONSchemas,
+		},
+		readerSchemas:       readerSchemas,
+		readerSchemaRefresh: readerSchemaRefresh,
 	}, nil
 }
+
+// parseInFlight parses the flow control marks. Records waiting for their batch to fill are in flight too, so
+// consumption could never resume below the records of a batch per worker.
+func parseInFlight(maxValue, resumeValue string, batched int) (int, int, error) {
+	if maxValue == "" {
+		return 0, 0, nil
+	}
+	max, err := strconv.Atoi(maxValue)
+	if err != nil || max < 0 {
+		return 0, 0, fmt.Errorf("invalid KAFKA_CONSUMER_MAX_IN_FLIGHT: %s", maxValue)
+	}
+	if max == 0 {
+		return 0, 0, nil
+	}
+	resume := max / 2
+	if resume < batched {
+		resume = batched
+	}
+	if resumeValue != "" {
+		resume, err = strconv.Atoi(resumeValue)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid KAFKA_CONSUMER_RESUME_IN_FLIGHT: %s", resumeValue)
+		}
+	}
+	if resume < batched {
+		return 0, 0, fmt.Errorf("KAFKA_CONSUMER_RESUME_IN_FLIGHT must be at least KAFKA_CONSUMER_BATCH_SIZE times KAFKA_CONSUMER_CONCURRENCY(%d)", batched)
+	}
+	if resume >= max {
+		return 0, 0, errors.New("KAFKA_CONSUMER_RESUME_IN_FLIGHT must be lower than KAFKA_CONSUMER_MAX_IN_FLIGHT")
+	}
+	return max, resume, nil
+}
+
+// parseReplay parses the range of records to replay, nil when not replaying.
+func parseReplay(startValue, endValue, rateValue string) (*kafka.Replay, error) {
+	if startValue == "" {
+		if endValue != "" || rateValue != "" {
+			return nil, errors.New("KAFKA_REPLAY_START is required when KAFKA_REPLAY_END or KAFKA_REPLAY_RATE is set")
+		}
+		return nil, nil
+	}
+	start, err := kafka.ParseReplayBoundary(startValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KAFKA_REPLAY_START: %s", err)
+	}
+	if endValue == "" {
+		endValue = kafka.StartLatest
+	}
+	end, err := kafka.ParseReplayBoundary(endValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KAFKA_REPLAY_END: %s", err)
+	}
+	if start.Offsets == nil && end.Offsets == nil && start.Time >= 0 && end.Time >= 0 && end.Time <= start.Time {
+		return nil, errors.New("KAFKA_REPLAY_END must be after KAFKA_REPLAY_START")
+	}
+	rate := 0
+	if rateValue != "" {
+		rate, err = strconv.Atoi(rateValue)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid KAFKA_REPLAY_RATE: %s", rateValue)
+		}
+	}
+	return &kafka.Replay{Start: start, End: end, Rate: rate}, nil
+}
@@ -1,8 +1,12 @@
 package injector
 
 import (
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/injector/store"
 	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 	"github.com/inloco/kafka-elasticsearch-injector/src/models"
 )
@@ -12,13 +16,105 @@ type instrumentingMiddleware struct {
 	next             Service
 }
 
-func (s instrumentingMiddleware) Insert(records []*models.Record) error {
+func (s instrumentingMiddleware) Insert(ctx context.Context, records []*models.Record) error {
+	_, err := s.InsertRecords(ctx, records)
+	return err
+}
+
+func (s instrumentingMiddleware) InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error) {
 	begin := time.Now()
-	err := s.next.Insert(records)
+	results, err := s.next.InsertRecords(ctx, records)
 	s.metricsPublisher.RecordEndpointLatency(time.Since(begin).Seconds())
-	return err
+	return results, err
 }
 
 func (s instrumentingMiddleware) ReadinessCheck() bool {
 	return s.next.ReadinessCheck()
 }
+
+func (s instrumentingMiddleware) Status() store.Status {
+	return s.next.Status()
+}
+
+func (s instrumentingMiddleware) SetTransforms(config elasticsearch.Config) {
+	s.next.SetTransforms(config)
+}
+
+func (s instrumentingMiddleware) Close() {
+	s.next.Close()
+}
+
+// TransformFunc changes a decoded record before it is written, returning nil to skip it.
+type TransformFunc func(record *models.Record) (*models.Record, error)
+
+// transformingMiddleware transforms the records before they are written. The records skipped are reported as
+// skipped, and the ones the transform fails on are handled like the messages that could not be decoded.
+type transformingMiddleware struct {
+	transform TransformFunc
+	next      Service
+}
+
+func (s transformingMiddleware) Insert(ctx context.Context, records []*models.Record) error {
+	_, err := s.InsertRecords(ctx, records)
+	return err
+}
+
+func (s transformingMiddleware) InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error) {
+	transformed := make([]*models.Record, 0, len(records))
+	// skipped tells the records left out of the insert, whose results are filled in afterwards
+	skipped := make([]bool, len(records))
+	for idx, record := range records {
+		if record.DecodeErr != nil {
+			transformed = append(transformed, record)
+			continue
+		}
+		result, err := s.transform(record)
+		if err != nil {
+			failed := *record
+			failed.DecodeErr = fmt.Errorf("could not transform the record: %s", err)
+			transformed = append(transformed, &failed)
+			continue
+		}
+		if result == nil {
+			skipped[idx] = true
+			continue
+		}
+		transformed = append(transformed, result)
+	}
+	if len(transformed) == 0 {
+		results := make([]models.RecordResult, len(records))
+		for idx := range results {
+			results[idx] = models.RecordResult{Succeeded: true, Skipped: true}
+		}
+		return results, nil
+	}
+	results, err := s.next.InsertRecords(ctx, transformed)
+	if results == nil {
+		return nil, err
+	}
+	aligned := make([]models.RecordResult, len(records))
+	for idx := range records {
+		if skipped[idx] {
+			aligned[idx] = models.RecordResult{Succeeded: true, Skipped: true}
+			continue
+		}
+		aligned[idx], results = results[0], results[1:]
+	}
+	return aligned, err
+}
+
+func (s transformingMiddleware) ReadinessCheck() bool {
+	return s.next.ReadinessCheck()
+}
+
+func (s transformingMiddleware) Status() store.Status {
+	return s.next.Status()
+}
+
+func (s transformingMiddleware) SetTransforms(config elasticsearch.Config) {
+	s.next.SetTransforms(config)
+}
+
+func (s transformingMiddleware) Close() {
+	s.next.Close()
+}
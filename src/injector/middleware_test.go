@@ -0,0 +1,75 @@
+package injector
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeService struct {
+	Service
+	inserted []*models.Record
+}
+
+func (s *fakeService) InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error) {
+	s.inserted = records
+	results := make([]models.RecordResult, len(records))
+	for idx, record := range records {
+		results[idx] = models.RecordResult{Succeeded: record.DecodeErr == nil, Err: record.DecodeErr}
+	}
+	return results, nil
+}
+
+func TestTransformingMiddleware_InsertRecords(t *testing.T) {
+	next := &fakeService{}
+	s := transformingMiddleware{
+		transform: func(record *models.Record) (*models.Record, error) {
+			switch record.Offset {
+			case 1:
+				return nil, nil
+			case 2:
+				return nil, errors.New("missing id")
+			}
+			transformed := *record
+			transformed.Json = map[string]interface{}{"id": record.Offset}
+			return &transformed, nil
+		},
+		next: next,
+	}
+	undecodable := &models.Record{Offset: 3, DecodeErr: errors.New("unknown schema")}
+	records := []*models.Record{{Offset: 0}, {Offset: 1}, {Offset: 2}, undecodable}
+
+	results, err := s.InsertRecords(context.Background(), records)
+	assert.NoError(t, err)
+	if !assert.Len(t, next.inserted, 3) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{"id": int64(0)}, next.inserted[0].Json)
+	assert.EqualError(t, next.inserted[1].DecodeErr, "could not transform the record: missing id")
+	assert.Nil(t, records[2].DecodeErr)
+	assert.Equal(t, undecodable, next.inserted[2])
+
+	if !assert.Len(t, results, 4) {
+		return
+	}
+	assert.True(t, results[0].Succeeded)
+	assert.Equal(t, models.RecordResult{Succeeded: true, Skipped: true}, results[1])
+	assert.False(t, results[2].Succeeded)
+	assert.EqualError(t, results[3].Err, "unknown schema")
+}
+
+func TestTransformingMiddleware_InsertRecords_AllSkipped(t *testing.T) {
+	next := &fakeService{}
+	s := transformingMiddleware{
+		transform: func(record *models.Record) (*models.Record, error) { return nil, nil },
+		next:      next,
+	}
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{{Offset: 0}, {Offset: 1}})
+	assert.NoError(t, err)
+	assert.Nil(t, next.inserted)
+	assert.Equal(t, []models.RecordResult{{Succeeded: true, Skipped: true}, {Succeeded: true, Skipped: true}}, results)
+}
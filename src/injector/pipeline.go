@@ -0,0 +1,120 @@
+package injector
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+)
+
+// DefaultRestartBackoff is how long a pipeline of the config file that failed waits before starting again, while
+// the other pipelines keep running.
+const DefaultRestartBackoff = 30 * time.Second
+
+// Pipelines are the pipelines the process runs, each with its own consumer, schema registry and elasticsearch:
+// the ones of the config file, or the single pipeline of the env vars, without a name.
+func Pipelines() []config_file.Pipeline {
+	if pipelines := config_file.Pipelines(); len(pipelines) > 0 {
+		return pipelines
+	}
+	return []config_file.Pipeline{{}}
+}
+
+// NewKafkaConfig reads the config of the kafka consumer of a pipeline.
+func NewKafkaConfig(pipeline config_file.Pipeline) *kafka.Config {
+	getenv := pipeline.Getenv
+	return &kafka.Config{
+		Type:                  kafka.ConsumerType,
+		Topics:                kafka.ParseTopics(getenv("KAFKA_TOPICS")),
+		TopicsPattern:         getenv("KAFKA_TOPICS_PATTERN"),
+		MetadataRefresh:       getenv("KAFKA_METADATA_REFRESH_INTERVAL"),
+		SASLMechanism:         getenv("KAFKA_SASL_MECHANISM"),
+		SASLUsername:          getenv("KAFKA_SASL_USERNAME"),
+		SASLPassword:          getenv("KAFKA_SASL_PASSWORD"),
+		TLS:                   getenv("KAFKA_TLS"),
+		TLSCACertPath:         getenv("KAFKA_TLS_CA_CERT_PATH"),
+		TLSClientCertPath:     getenv("KAFKA_TLS_CLIENT_CERT_PATH"),
+		TLSClientKeyPath:      getenv("KAFKA_TLS_CLIENT_KEY_PATH"),
+		TLSInsecure:           getenv("KAFKA_TLS_INSECURE_SKIP_VERIFY"),
+		StartOffset:           getenv("KAFKA_START_OFFSET"),
+		ForceSeek:             getenv("KAFKA_FORCE_SEEK"),
+		ReplayStart:           getenv("KAFKA_REPLAY_START"),
+		ReplayEnd:             getenv("KAFKA_REPLAY_END"),
+		ReplayRate:            getenv("KAFKA_REPLAY_RATE"),
+		MaxInFlight:           getenv("KAFKA_CONSUMER_MAX_IN_FLIGHT"),
+		ResumeInFlight:        getenv("KAFKA_CONSUMER_RESUME_IN_FLIGHT"),
+		Version:               getenv("KAFKA_VERSION"),
+		ConsumerGroup:         getenv("KAFKA_CONSUMER_GROUP"),
+		Concurrency:           getenv("KAFKA_CONSUMER_CONCURRENCY"),
+		Dispatch:              getenv("KAFKA_CONSUMER_DISPATCH"),
+		BatchSize:             getenv("KAFKA_CONSUMER_BATCH_SIZE"),
+		BatchLinger:           getenv("KAFKA_CONSUMER_BATCH_LINGER"),
+		ShutdownTimeout:       getenv("KAFKA_CONSUMER_SHUTDOWN_TIMEOUT"),
+		HealthCheckInterval:   getenv("KAFKA_HEALTH_CHECK_INTERVAL"),
+		LivenessTimeout:       getenv("KAFKA_LIVENESS_TIMEOUT"),
+		StallTimeout:          getenv("KAFKA_CONSUMER_STALL_TIMEOUT"),
+		BufferSize:            getenv("KAFKA_CONSUMER_BUFFER_SIZE"),
+		MaxRecordsPerSecond:   getenv("KAFKA_CONSUMER_MAX_RECORDS_PER_SECOND"),
+		MaxBytesPerSecond:     getenv("KAFKA_CONSUMER_MAX_BYTES_PER_SECOND"),
+		MetricsUpdateInterval: getenv("KAFKA_CONSUMER_METRICS_UPDATE_INTERVAL"),
+		RecordType:            getenv("KAFKA_CONSUMER_RECORD_TYPE"),
+		AvroTimestampFormat:   getenv("KAFKA_CONSUMER_AVRO_TIMESTAMP_FORMAT"),
+		AvroDecimalFormat:     getenv("KAFKA_CONSUMER_AVRO_DECIMAL_FORMAT"),
+		AvroOmitNulls:         getenv("KAFKA_CONSUMER_AVRO_OMIT_NULLS"),
+		AvroBinaryFormat:      getenv("KAFKA_CONSUMER_AVRO_BINARY_FORMAT"),
+		AvroBinaryFields:      getenv("KAFKA_CONSUMER_AVRO_BINARY_FIELDS"),
+		JSONSchemaValidate:    getenv("KAFKA_CONSUMER_JSON_SCHEMA_VALIDATE"),
+		ReaderSchemas:         getenv("KAFKA_CONSUMER_READER_SCHEMAS"),
+		ReaderSchemasPath:     getenv("KAFKA_CONSUMER_READER_SCHEMAS_PATH"),
+		ReaderSchemaRefresh:   getenv("KAFKA_CONSUMER_READER_SCHEMA_REFRESH_INTERVAL"),
+		DecodeErrorPolicy:     getenv("KAFKA_CONSUMER_DECODE_ERROR_POLICY"),
+		DeadLetterTopic:       getenv("KAFKA_DEAD_LETTER_TOPIC"),
+		DeadLetterBrokers:     getenv("KAFKA_DEAD_LETTER_BROKERS"),
+		DeleteTombstones:      getenv("KAFKA_CONSUMER_DELETE_TOMBSTONES"),
+		Filter:                getenv("KAFKA_CONSUMER_FILTER"),
+		DryRun:                getenv("DRY_RUN"),
+		DryRunCommit:          getenv("DRY_RUN_COMMIT"),
+	}
+}
+
+// NewSchemaRegistry creates the schema registry client of a pipeline.
+func NewSchemaRegistry(pipeline config_file.Pipeline, logger log.Logger) (*schema_registry.SchemaRegistry, error) {
+	config, err := newSchemaRegistryConfig(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	config.Logger = logger
+	return schema_registry.NewSchemaRegistryWithConfig(config)
+}
+
+func newSchemaRegistryConfig(pipeline config_file.Pipeline) (schema_registry.Config, error) {
+	persistSchemas := false
+	if value := pipeline.Getenv("SCHEMA_REGISTRY_PERSIST_SCHEMAS"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return schema_registry.Config{}, err
+		}
+		persistSchemas = parsed
+	}
+	var probeInterval time.Duration
+	if value := pipeline.Getenv("SCHEMA_REGISTRY_PROBE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return schema_registry.Config{}, err
+		}
+		probeInterval = parsed
+	}
+	return schema_registry.Config{
+		URL:            pipeline.Getenv("SCHEMA_REGISTRY_URL"),
+		Username:       pipeline.Getenv("SCHEMA_REGISTRY_USERNAME"),
+		Password:       pipeline.Getenv("SCHEMA_REGISTRY_PASSWORD"),
+		Authorization:  pipeline.Getenv("SCHEMA_REGISTRY_AUTHORIZATION"),
+		CACertPath:     pipeline.Getenv("SCHEMA_REGISTRY_CA_CERT_PATH"),
+		LocalSchemaDir: pipeline.Getenv("SCHEMA_REGISTRY_LOCAL_SCHEMA_DIR"),
+		PersistSchemas: persistSchemas,
+		ProbeInterval:  probeInterval,
+	}, nil
+}
@@ -0,0 +1,59 @@
+package injector
+
+import (
+	"fmt"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka"
+	"github.com/inloco/kafka-elasticsearch-injector/src/logger_builder"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/reload"
+	"github.com/inloco/kafka-elasticsearch-injector/src/validation"
+)
+
+// FilterSetter replaces the filter of the records while running, like the kafka consumer does.
+type FilterSetter interface {
+	SetFilter(filter *models.Filter)
+}
+
+// HandleReloads registers the settings of a pipeline that can be reloaded while running: the transforms of the
+// documents, the filter of the records and the rate limits. The settings of the pipeline in the config file are
+// the ones loaded on startup, only the shared settings are reloaded.
+func HandleReloads(reloader *reload.Reloader, pipeline config_file.Pipeline, service Service, consumer FilterSetter, rateLimiter *kafka.RateLimiter) {
+	reloader.Handle(elasticsearch.TransformSettings, func() (func(), error) {
+		config, err := elasticsearch.NewConfigFrom(pipeline.LookupEnv)
+		if err != nil {
+			return nil, err
+		}
+		return func() { service.SetTransforms(config) }, nil
+	})
+	reloader.Handle([]string{"KAFKA_CONSUMER_FILTER"}, func() (func(), error) {
+		var filter *models.Filter
+		if value := pipeline.Getenv("KAFKA_CONSUMER_FILTER"); value != "" {
+			var err error
+			if filter, err = models.ParseFilter(value); err != nil {
+				return nil, fmt.Errorf("invalid KAFKA_CONSUMER_FILTER: %s", err)
+			}
+		}
+		return func() { consumer.SetFilter(filter) }, nil
+	})
+	reloader.Handle([]string{"KAFKA_CONSUMER_MAX_RECORDS_PER_SECOND", "KAFKA_CONSUMER_MAX_BYTES_PER_SECOND"}, func() (func(), error) {
+		var errs validation.Errors
+		limits := kafka.RateLimits{
+			RecordsPerSecond: errs.Int("KAFKA_CONSUMER_MAX_RECORDS_PER_SECOND", pipeline.Getenv("KAFKA_CONSUMER_MAX_RECORDS_PER_SECOND"), 0, true),
+			BytesPerSecond:   errs.Int("KAFKA_CONSUMER_MAX_BYTES_PER_SECOND", pipeline.Getenv("KAFKA_CONSUMER_MAX_BYTES_PER_SECOND"), 0, true),
+		}
+		if err := errs.Err(); err != nil {
+			return nil, err
+		}
+		return func() { rateLimiter.SetLimits(limits) }, nil
+	})
+}
+
+// HandleLevelReloads registers the log levels, shared by the pipelines, as settings that can be reloaded.
+func HandleLevelReloads(reloader *reload.Reloader) {
+	reloader.Handle(logger_builder.LevelSettings, func() (func(), error) {
+		return logger_builder.ReloadLevels, nil
+	})
+}
@@ -1,34 +1,74 @@
 package injector
 
 import (
+	"context"
+
 	"github.com/go-kit/kit/log"
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
 	"github.com/inloco/kafka-elasticsearch-injector/src/injector/store"
 	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 	"github.com/inloco/kafka-elasticsearch-injector/src/models"
 )
 
 type Service interface {
-	Insert(records []*models.Record) error
+	Insert(ctx context.Context, records []*models.Record) error
+	InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error)
 	ReadinessCheck() bool
+	Status() store.Status
+	SetTransforms(config elasticsearch.Config)
+	Close()
 }
 
 type basicService struct {
 	store store.Store
 }
 
-func (s basicService) Insert(records []*models.Record) error {
-	return s.store.Insert(records)
+func (s basicService) Insert(ctx context.Context, records []*models.Record) error {
+	return s.store.Insert(ctx, records)
+}
+
+func (s basicService) InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error) {
+	return s.store.InsertRecords(ctx, records)
 }
 
 func (s basicService) ReadinessCheck() bool {
 	return s.store.ReadinessCheck()
 }
 
-func NewService(logger log.Logger, metrics metrics.MetricsPublisher) Service {
+func (s basicService) Status() store.Status {
+	return s.store.Status()
+}
+
+func (s basicService) SetTransforms(config elasticsearch.Config) {
+	s.store.SetTransforms(config)
+}
+
+func (s basicService) Close() {
+	s.store.Close()
+}
+
+func NewService(logger log.Logger, metrics metrics.MetricsPublisher) (Service, error) {
+	s, err := store.NewStore(logger, metrics)
+	if err != nil {
+		return nil, err
+	}
+	return newService(s, metrics), nil
+}
+
+// NewServiceWithConfig creates a service writing to the elasticsearch of a config, like the one of a pipeline.
+func NewServiceWithConfig(logger log.Logger, metrics metrics.MetricsPublisher, config elasticsearch.Config) (Service, error) {
+	s, err := store.NewStoreWithConfig(logger, metrics, config)
+	if err != nil {
+		return nil, err
+	}
+	return newService(s, metrics), nil
+}
+
+func newService(s store.Store, metrics metrics.MetricsPublisher) Service {
 	return instrumentingMiddleware{
 		metricsPublisher: metrics,
 		next: basicService{
-			store.NewStore(logger),
+			s,
 		},
 	}
 }
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+)
+
+// States of the circuit breaker in the status of the store.
+const (
+	breakerDisabled = "disabled"
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+)
+
+// circuitBreaker stops the inserts once elasticsearch failed a number of consecutive batches. While it is open
+// the consumer workers wait in Insert, so no offset is committed and kafka stops being fetched once the consumer
+// buffer is full. elasticsearch is probed at an interval, the circuit closes as soon as a probe succeeds.
+// A nil breaker is disabled.
+type circuitBreaker struct {
+	logger           log.Logger
+	metricsPublisher metrics.MetricsPublisher
+	threshold        int
+	interval         time.Duration
+	probe            func() bool
+
+	mutex    sync.Mutex
+	failures int
+	// closed is closed itself when the circuit closes, nil while the circuit is closed
+	closed  chan struct{}
+	stopped chan struct{}
+}
+
+func newCircuitBreaker(logger log.Logger, metricsPublisher metrics.MetricsPublisher, threshold int, interval time.Duration, probe func() bool) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		logger:           logger,
+		metricsPublisher: metricsPublisher,
+		threshold:        threshold,
+		interval:         interval,
+		probe:            probe,
+		stopped:          make(chan struct{}),
+	}
+}
+
+// wait blocks while the circuit is open, failing with the context's error if it is done first.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	closed := b.closed
+	b.mutex.Unlock()
+	if closed != nil {
+		select {
+		case <-closed:
+		case <-b.stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// done counts the outcome of an insert. Documents rejected by elasticsearch don't count as a failure, since
+// elasticsearch was up to reject them.
+func (b *circuitBreaker) done(err error) {
+	if b == nil {
+		return
+	}
+	if _, rejected := err.(*elasticsearch.RejectedError); err == nil || rejected {
+		b.mutex.Lock()
+		b.failures = 0
+		b.mutex.Unlock()
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.failures < b.threshold || b.closed != nil {
+		return
+	}
+	b.closed = make(chan struct{})
+	level.Error(b.logger).Log(
+		"message", "circuit breaker opened, pausing consumption until elasticsearch recovers",
+		"failures", b.failures,
+		"err", err,
+	)
+	b.metricsPublisher.CircuitBreakerOpen(true)
+	go b.probeUntilHealthy(b.closed)
+}
+
+func (b *circuitBreaker) probeUntilHealthy(closed chan struct{}) {
+	opened := time.Now()
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.stopped:
+			return
+		}
+		if !b.probe() {
+			level.Warn(b.logger).Log("message", "circuit breaker probe failed, consumption still paused", "open_for", time.Since(opened))
+			continue
+		}
+		b.mutex.Lock()
+		b.failures = 0
+		b.closed = nil
+		b.mutex.Unlock()
+		close(closed)
+		level.Info(b.logger).Log("message", "circuit breaker closed, resuming consumption", "open_for", time.Since(opened))
+		b.metricsPublisher.CircuitBreakerOpen(false)
+		return
+	}
+}
+
+// state is disabled, closed or open, along with the consecutive failures counted.
+func (b *circuitBreaker) state() (string, int) {
+	if b == nil {
+		return breakerDisabled, 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed != nil {
+		return breakerOpen, b.failures
+	}
+	return breakerClosed, b.failures
+}
+
+// stop ends the probes and releases the inserts waiting for the circuit to close.
+func (b *circuitBreaker) stop() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.stopped:
+	default:
+		close(b.stopped)
+	}
+}
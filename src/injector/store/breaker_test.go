@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/olivere/elastic"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasicStore_Insert_CircuitBreaker(t *testing.T) {
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusBadRequest}},
+		{nil, &elastic.Error{Status: http.StatusBadRequest}},
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+	var healthy int32
+	s := newTestStore(db)
+	metricsPublisher := s.metricsPublisher.(*fakeMetricsPublisher)
+	s.breaker = newCircuitBreaker(logger, metricsPublisher, 2, 5*time.Millisecond, func() bool {
+		return atomic.LoadInt32(&healthy) == 1
+	})
+	defer s.breaker.stop()
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	assert.Error(t, s.Insert(context.Background(), []*models.Record{record}))
+	assert.Empty(t, metricsPublisher.breakerTransitions())
+	assert.Equal(t, Status{CircuitBreaker: breakerClosed, ConsecutiveFailures: 1}, s.Status())
+	assert.Error(t, s.Insert(context.Background(), []*models.Record{record}))
+	assert.Equal(t, []bool{true}, metricsPublisher.breakerTransitions())
+	assert.Equal(t, Status{CircuitBreaker: breakerOpen, ConsecutiveFailures: 2}, s.Status())
+
+	done := make(chan error)
+	go func() {
+		done <- s.Insert(context.Background(), []*models.Record{record})
+	}()
+	select {
+	case <-done:
+		t.Fatal("insert did not wait for the circuit to close")
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt32(&healthy, 1)
+
+	assert.NoError(t, <-done)
+	assert.Len(t, db.calls, 3)
+	assert.Equal(t, []bool{true, false}, metricsPublisher.breakerTransitions())
+	assert.Equal(t, Status{CircuitBreaker: breakerClosed}, s.Status())
+}
+
+func TestBasicStore_Insert_CircuitBreakerIgnoresRejections(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	failure := elasticsearch.Failure{DocID: record.GetId(), Status: http.StatusBadRequest}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{failure}}, nil},
+	}}
+	s := newTestStore(db)
+	metricsPublisher := s.metricsPublisher.(*fakeMetricsPublisher)
+	s.breaker = newCircuitBreaker(logger, metricsPublisher, 1, time.Millisecond, func() bool { return true })
+	defer s.breaker.stop()
+
+	assert.IsType(t, &elasticsearch.RejectedError{}, s.Insert(context.Background(), []*models.Record{record}))
+	assert.Empty(t, metricsPublisher.breakerTransitions())
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+)
+
+const deadLetterType = "dead-letter"
+
+// FailureDecodeError is the failure type of the dead letters of messages that could not be decoded
+const FailureDecodeError = "decode_error"
+
+// DeadLetter is a record elasticsearch refused to index, along with the document built from it and the reason.
+// Records that could not be decoded have no document, their raw message value is kept instead.
+type DeadLetter struct {
+	Record   *models.Record
+	Document *models.ElasticRecord
+	Failure  elasticsearch.Failure
+}
+
+// DeadLetterQueue keeps the dead letters somewhere they can be inspected, so that consumption can move past them.
+// Close releases what the queue holds once the store is closed, no dead letter is sent after it.
+type DeadLetterQueue interface {
+	Send(ctx context.Context, deadLetters []DeadLetter) error
+	Close() error
+}
+
+func newDeadLetterQueue(config elasticsearch.Config, db elasticsearch.RecordDatabase) (DeadLetterQueue, error) {
+	switch config.DeadLetterMode {
+	case elasticsearch.DeadLetterIndex:
+		return indexDeadLetterQueue{db: db, index: config.DeadLetterIndex}, nil
+	case elasticsearch.DeadLetterFile:
+		file, err := os.OpenFile(config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open dead letter file %s: %v", config.DeadLetterFile, err)
+		}
+		return &fileDeadLetterQueue{file: file, encoder: json.NewEncoder(file)}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// toMap flattens the dead letter into a json object. The rejected document is kept as a string so it can't
+// trigger the same mapping failure again.
+func (dl DeadLetter) toMap() (map[string]interface{}, error) {
+	document := dl.Record.Value
+	if dl.Document != nil {
+		var err error
+		document, err = json.Marshal(dl.Document.Json)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{
+		"topic":        dl.Record.Topic,
+		"partition":    dl.Record.Partition,
+		"offset":       dl.Record.Offset,
+		"index":        dl.Failure.Index,
+		"doc_id":       dl.Failure.DocID,
+		"status":       dl.Failure.Status,
+		"error_type":   dl.Failure.Type,
+		"error_reason": dl.Failure.Reason,
+		"document":     string(document),
+		"failed_at":    time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// id identifies the dead letter of a document, or of a message for the records without one.
+func (dl DeadLetter) id() string {
+	if dl.Document == nil {
+		return fmt.Sprintf("%s:%s", dl.Record.Topic, dl.Record.GetId())
+	}
+	return fmt.Sprintf("%s:%s", dl.Failure.Index, dl.Failure.DocID)
+}
+
+type indexDeadLetterQueue struct {
+	db    elasticsearch.RecordDatabase
+	index string
+}
+
+func (q indexDeadLetterQueue) Send(ctx context.Context, deadLetters []DeadLetter) error {
+	documents := make([]*models.ElasticRecord, len(deadLetters))
+	for idx, deadLetter := range deadLetters {
+		entry, err := deadLetter.toMap()
+		if err != nil {
+			return err
+		}
+		documents[idx] = &models.ElasticRecord{
+			Index: q.index,
+			Type:  deadLetterType,
+			ID:    deadLetter.id(),
+			Json:  entry,
+		}
+	}
+	res, err := q.db.Insert(ctx, documents)
+	if err != nil {
+		return err
+	}
+	if failed := len(res.Retry) + len(res.Rejected); failed > 0 {
+		return fmt.Errorf("could not index %d dead letters on %s", failed, q.index)
+	}
+	return nil
+}
+
+// Close does nothing, the database is closed by the store.
+func (q indexDeadLetterQueue) Close() error {
+	return nil
+}
+
+type fileDeadLetterQueue struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func (q *fileDeadLetterQueue) Send(ctx context.Context, deadLetters []DeadLetter) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, deadLetter := range deadLetters {
+		entry, err := deadLetter.toMap()
+		if err != nil {
+			return err
+		}
+		if err := q.encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs the dead letters written to the disk and closes the file.
+func (q *fileDeadLetterQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.file.Sync(); err != nil {
+		q.file.Close()
+		return err
+	}
+	return q.file.Close()
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDeadLetterQueue_Send(t *testing.T) {
+	file, err := ioutil.TempFile("", "dead-letters")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	q, err := newDeadLetterQueue(elasticsearch.Config{
+		DeadLetterMode: elasticsearch.DeadLetterFile,
+		DeadLetterFile: file.Name(),
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	deadLetter := DeadLetter{
+		Record:   record,
+		Document: &models.ElasticRecord{Index: "my-topic-2018-01-01", ID: "1:2", Json: map[string]interface{}{"id": "abc"}},
+		Failure: elasticsearch.Failure{
+			Index:  "my-topic-2018-01-01",
+			DocID:  "1:2",
+			Status: 400,
+			Type:   "mapper_parsing_exception",
+			Reason: "failed to parse [id]",
+		},
+	}
+
+	assert.NoError(t, q.Send(context.Background(), []DeadLetter{deadLetter, deadLetter}))
+	assert.NoError(t, q.Close())
+	assert.Error(t, q.Send(context.Background(), []DeadLetter{deadLetter}), "the file should be closed")
+	content, err := os.Open(file.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer content.Close()
+	lines := 0
+	scanner := bufio.NewScanner(content)
+	for scanner.Scan() {
+		lines++
+		var entry map[string]interface{}
+		if assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry)) {
+			assert.Equal(t, record.Topic, entry["topic"])
+			assert.Equal(t, "1:2", entry["doc_id"])
+			assert.Equal(t, "mapper_parsing_exception", entry["error_type"])
+			assert.Equal(t, "failed to parse [id]", entry["error_reason"])
+			assert.Equal(t, `{"id":"abc"}`, entry["document"])
+		}
+	}
+	assert.Equal(t, 2, lines)
+}
@@ -1,55 +1,713 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
 )
 
 type Store interface {
-	Insert(records []*models.Record) error
+	Insert(ctx context.Context, records []*models.Record) error
+	InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error)
 	ReadinessCheck() bool
+	Status() Status
+	// SetTransforms applies the transforms of the documents of a config, from the next batch on
+	SetTransforms(config elasticsearch.Config)
+	Close()
+}
+
+// Status is a snapshot of the store for debugging, served by the debug endpoints.
+type Status struct {
+	// CircuitBreaker is disabled, closed or open
+	CircuitBreaker      string `json:"circuit_breaker"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	// InFlightBulks is the number of bulk requests waiting for elasticsearch
+	InFlightBulks int64 `json:"in_flight_bulks"`
 }
 
 type basicStore struct {
-	db      elasticsearch.RecordDatabase
-	codec   elasticsearch.Codec
-	backoff time.Duration
+	db               elasticsearch.RecordDatabase
+	codec            elasticsearch.Codec
+	deadLetters      DeadLetterQueue
+	logger           log.Logger
+	metricsPublisher metrics.MetricsPublisher
+	backoff          time.Duration
+	maxBackoff       time.Duration
+	maxRetries       int
+	dedupeInBatch    bool
+	breaker          *circuitBreaker
+	inFlightBulks    *int64
+	// transforms holds the config and codec of the last transforms set, nil to always use codec
+	transforms *atomic.Value
+}
+
+// transformed is a config along with the codec of its transforms.
+type transformed struct {
+	config elasticsearch.Config
+	codec  elasticsearch.Codec
+}
+
+// Insert writes the records, retrying transient failures until they succeed, run out of retries or the context
+// is done.
+func (s basicStore) Insert(ctx context.Context, records []*models.Record) error {
+	_, err := s.InsertRecords(ctx, records)
+	return err
+}
+
+// InsertRecords is Insert, also telling what became of each record. The results are aligned with the records,
+// they are nil when the insert failed before writing any record. Records that could not be decoded are sent to
+// the dead letter queue instead.
+func (s basicStore) InsertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error) {
+	var decoded, undecodable []*models.Record
+	for _, record := range records {
+		if record.DecodeErr != nil {
+			undecodable = append(undecodable, record)
+		} else {
+			decoded = append(decoded, record)
+		}
+	}
+	if len(undecodable) == 0 {
+		return s.insertRecords(ctx, records)
+	}
+	deadLetterErr := s.deadLetterUndecodable(ctx, undecodable)
+	decodedResults, err := s.insertRecords(ctx, decoded)
+	if decodedResults == nil && err != nil {
+		return nil, err
+	}
+	if err == nil {
+		err = deadLetterErr
+	}
+	results := make([]models.RecordResult, 0, len(records))
+	for _, record := range records {
+		if record.DecodeErr != nil {
+			results = append(results, models.RecordResult{
+				Succeeded:    deadLetterErr == nil,
+				Err:          deadLetterErr,
+				DeadLettered: deadLetterErr == nil && s.deadLetters != nil,
+			})
+		} else {
+			results = append(results, decodedResults[0])
+			decodedResults = decodedResults[1:]
+		}
+	}
+	return results, err
 }
 
-func (s basicStore) Insert(records []*models.Record) error {
-	elasticRecords, err := s.codec.EncodeElasticRecords(records)
+func (s basicStore) insertRecords(ctx context.Context, records []*models.Record) ([]models.RecordResult, error) {
+	if err := s.breaker.wait(ctx); err != nil {
+		return nil, err
+	}
+	// records are only written once their mappings are in place
+	if err := s.db.EnsureTemplate(); err != nil {
+		s.breaker.done(err)
+		return nil, err
+	}
+	// a single codec encodes the whole batch, even if the transforms change meanwhile
+	codec := s.currentCodec()
+	_, transformSpan := tracing.StartSpan(ctx, "transform")
+	documents, err := codec.EncodeElasticRecords(records)
+	if transformSpan != nil {
+		transformSpan.SetAttribute("records", len(records))
+	}
+	transformSpan.End(err)
+	var deadLettered map[int]bool
+	if uncoercible, ok := err.(*elasticsearch.UncoercibleError); ok {
+		deadLettered, err = s.deadLetterUncoercible(ctx, records, uncoercible)
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	uniqueRecords, uniqueDocuments := s.withoutSkipped(records, documents, deadLettered)
+	if s.dedupeInBatch {
+		uniqueRecords, uniqueDocuments = s.dedupe(uniqueRecords, uniqueDocuments)
+	}
+	insertCtx, insertSpan := tracing.StartSpan(ctx, "elasticsearch.insert")
+	if insertSpan != nil {
+		insertSpan.SetAttribute("bulk_size", len(uniqueDocuments))
+		insertSpan.SetAttribute("retry_count", 0)
+	}
+	failures, rejected, err := s.write(insertCtx, uniqueRecords, uniqueDocuments)
+	if insertSpan != nil {
+		insertSpan.SetAttribute("failed_documents", len(failures))
+	}
+	insertSpan.End(err)
+	if ctx.Err() == nil {
+		// a cancelled insert says nothing about the health of elasticsearch
+		s.breaker.done(err)
+	}
+	// collapsed records share the outcome of the record that replaced them, skipped records are done with
+	results := make([]models.RecordResult, len(documents))
+	for idx, document := range documents {
+		if document == nil {
+			results[idx] = models.RecordResult{Succeeded: true, DeadLettered: deadLettered[idx], Skipped: !deadLettered[idx]}
+		} else if failure, failed := failures[elasticsearch.KeyOf(document)]; failed {
+			results[idx] = models.RecordResult{Err: failure}
+		} else {
+			results[idx] = models.RecordResult{Succeeded: true, DeadLettered: rejected[elasticsearch.KeyOf(document)]}
+		}
+	}
+	var written []*models.Record
+	var writtenDocuments []*models.ElasticRecord
+	for idx, document := range uniqueDocuments {
+		if _, failed := failures[elasticsearch.KeyOf(document)]; !failed {
+			written = append(written, uniqueRecords[idx])
+			writtenDocuments = append(writtenDocuments, document)
+		}
+	}
+	if ctx.Err() == nil {
+		s.writeExtraIndices(ctx, codec, written, writtenDocuments)
+	}
+	return results, err
+}
+
+// writeExtraIndices copies the records written to their index to the extra indices, one bulk per extra index.
+// Their failures don't fail the insert, so a problem with an extra index doesn't hold back consumption: the
+// failed documents are sent to the dead letter queue, which the config requires along with extra indices, or only
+// logged when the config is built without one.
+func (s basicStore) writeExtraIndices(ctx context.Context, codec elasticsearch.Codec, records []*models.Record, documents []*models.ElasticRecord) {
+	if len(documents) == 0 {
+		return
+	}
+	targets, err := codec.EncodeExtraIndices(documents, records)
+	if err != nil {
+		level.Error(s.logger).Log("message", "could not encode documents for the extra indices", "err", err)
+		return
+	}
+	if len(targets) == 0 {
+		return
+	}
+	ctx, span := tracing.StartSpan(ctx, "elasticsearch.extra_indices")
+	defer span.End(nil)
+	for _, targetDocuments := range targets {
+		unwritten, rejected, err := s.insertDocuments(ctx, recordTopics(records), targetDocuments)
+		s.publishOutcome(records, targetDocuments, unwritten, rejected)
+		failures := rejected
+		for _, document := range unwritten {
+			failures = append(failures, elasticsearch.Failure{
+				Index:  document.Index,
+				DocID:  document.ID,
+				Type:   "write_failed",
+				Reason: err.Error(),
+			})
+		}
+		if len(failures) == 0 {
+			continue
+		}
+		if s.deadLetters == nil {
+			level.Error(s.logger).Log(
+				"message", "documents could not be written to an extra index",
+				"topic", strings.Join(recordTopics(records), ","),
+				"index", failures[0].Index,
+				"batch_size", len(targetDocuments),
+				"doc_count", len(failures),
+				"doc_id", failures[0].DocID,
+				"err", &elasticsearch.RejectedError{Failures: failures},
+			)
+			continue
+		}
+		if err := s.deadLetter(ctx, records, targetDocuments, failures); err != nil {
+			level.Error(s.logger).Log(
+				"message", "could not dead letter the documents of an extra index",
+				"index", failures[0].Index,
+				"doc_count", len(failures),
+				"err", err,
+			)
+		}
+	}
+}
+
+// write returns the errors of the documents that could not be written, by index and document id, along with the
+// documents rejected by elasticsearch that were sent to the dead letter queue.
+func (s basicStore) write(ctx context.Context, records []*models.Record, documents []*models.ElasticRecord) (map[elasticsearch.DocumentKey]error, map[elasticsearch.DocumentKey]bool, error) {
+	unwritten, rejected, err := s.insertDocuments(ctx, recordTopics(records), documents)
+	s.publishOutcome(records, documents, unwritten, rejected)
+	s.publishEndToEndLatency(records, documents, unwritten, rejected)
+	failures := make(map[elasticsearch.DocumentKey]error, len(unwritten)+len(rejected))
+	for _, document := range unwritten {
+		failures[elasticsearch.KeyOf(document)] = err
+	}
+	var deadLettered map[elasticsearch.DocumentKey]bool
+	if err == nil && len(rejected) > 0 {
+		if s.deadLetters == nil {
+			err = &elasticsearch.RejectedError{Failures: rejected}
+		} else if err = s.deadLetter(ctx, records, documents, rejected); err == nil {
+			// the rejected records are kept in the dead letter queue, consumption moves past them
+			deadLettered = make(map[elasticsearch.DocumentKey]bool, len(rejected))
+			for _, failure := range rejected {
+				deadLettered[failure.Key()] = true
+			}
+			rejected = nil
+		}
+	}
+	for _, failure := range rejected {
+		failures[failure.Key()] = &elasticsearch.RejectedError{Failures: []elasticsearch.Failure{failure}}
+	}
+	return failures, deadLettered, err
+}
+
+// Outcomes of the bulk requests, as counted by the metrics.
+const (
+	bulkSucceeded = "success"
+	// bulkPartial is a bulk request some of whose documents were rejected or have to be retried
+	bulkPartial = "partial"
+	bulkFailed  = "error"
+)
+
+// recordTopics are the distinct topics of the records.
+func recordTopics(records []*models.Record) []string {
+	seen := make(map[string]bool)
+	var topics []string
+	for _, record := range records {
+		if !seen[record.Topic] {
+			seen[record.Topic] = true
+			topics = append(topics, record.Topic)
+		}
+	}
+	return topics
+}
+
+// insertDocuments retries the documents that failed with transient errors. It returns the documents left
+// unwritten when it gives up, along with the documents rejected by elasticsearch. Every bulk request is counted
+// for each of the topics of the batch.
+func (s basicStore) insertDocuments(ctx context.Context, topics []string, documents []*models.ElasticRecord) ([]*models.ElasticRecord, []elasticsearch.Failure, error) {
+	if len(documents) == 0 {
+		// every record of the batch was skipped
+		return nil, nil, nil
 	}
-	for {
-		res, err := s.db.Insert(elasticRecords)
+	elasticRecords := documents
+	var rejected []elasticsearch.Failure
+	span := tracing.SpanFromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		bulkSpan := span.Child("elasticsearch.bulk")
+		begin := time.Now()
+		atomic.AddInt64(s.inFlightBulks, 1)
+		res, err := s.db.Insert(ctx, elasticRecords)
+		atomic.AddInt64(s.inFlightBulks, -1)
+		s.metricsPublisher.RecordBulk(len(elasticRecords), time.Since(begin).Seconds())
+		status := bulkSucceeded
+		if err != nil {
+			status = bulkFailed
+		} else if len(res.Rejected) > 0 || len(res.Retry) > 0 {
+			status = bulkPartial
+		}
+		if bulkSpan != nil {
+			span.SetAttribute("retry_count", attempt-1)
+			bulkSpan.SetAttribute("bulk_size", len(elasticRecords))
+			bulkSpan.SetAttribute("attempt", attempt)
+			bulkSpan.SetAttribute("status", status)
+		}
+		bulkSpan.End(err)
+		for _, topic := range topics {
+			s.metricsPublisher.IncrementBulkRequests(topic, status)
+		}
 		if err != nil {
-			return err
+			if ctx.Err() != nil {
+				return elasticRecords, rejected, ctx.Err()
+			}
+			if !elasticsearch.IsRetryable(err) || attempt > s.maxRetries {
+				return elasticRecords, rejected, err
+			}
+			if err := s.wait(ctx, attempt, len(elasticRecords), append(insertFields(topics, documents), "err", err)...); err != nil {
+				return elasticRecords, rejected, err
+			}
+			continue
+		}
+		rejected = append(rejected, res.Rejected...)
+		if len(res.AlreadyExists) > 0 {
+			s.metricsPublisher.IncrementRecordsAlreadyExisting(len(res.AlreadyExists))
 		}
 		if len(res.Retry) == 0 {
-			break
+			return nil, rejected, nil
+		}
+		if attempt > s.maxRetries {
+			return res.Retry, rejected, fmt.Errorf("%d documents failed to index after %d retries", len(res.Retry), s.maxRetries)
+		}
+		//some records failed to index, backoff then retry only those
+		elasticRecords = res.Retry
+		if err := s.wait(ctx, attempt, len(elasticRecords), append(insertFields(topics, documents), "overloaded", res.Overloaded)...); err != nil {
+			return elasticRecords, rejected, err
+		}
+	}
+}
+
+// insertFields are the log fields of the inserts of the documents: the topics of their records, their indices and the
+// size of the batch they belong to.
+func insertFields(topics []string, documents []*models.ElasticRecord) []interface{} {
+	seen := make(map[string]bool)
+	var indices []string
+	for _, document := range documents {
+		if !seen[document.Index] {
+			seen[document.Index] = true
+			indices = append(indices, document.Index)
 		}
-		//some records failed to index, backoff(if overloaded) then retry
-		if res.Overloaded {
-			time.Sleep(s.backoff)
+	}
+	return []interface{}{
+		"topic", strings.Join(topics, ","),
+		"index", strings.Join(indices, ","),
+		"batch_size", len(documents),
+	}
+}
+
+// withoutSkipped leaves out the records the codec skipped, which have no document. The records already sent to the
+// dead letter queue have none either, without being counted as skipped.
+func (s basicStore) withoutSkipped(records []*models.Record, documents []*models.ElasticRecord, deadLettered map[int]bool) ([]*models.Record, []*models.ElasticRecord) {
+	skipped := make(map[string]int)
+	for idx, document := range documents {
+		if document == nil && !deadLettered[idx] {
+			skipped[records[idx].Topic]++
+		}
+	}
+	if len(skipped) == 0 && len(deadLettered) == 0 {
+		return records, documents
+	}
+	keptRecords := make([]*models.Record, 0, len(records))
+	keptDocuments := make([]*models.ElasticRecord, 0, len(documents))
+	for idx, document := range documents {
+		if document != nil {
+			keptRecords = append(keptRecords, records[idx])
+			keptDocuments = append(keptDocuments, document)
+		}
+	}
+	for topic, count := range skipped {
+		s.metricsPublisher.IncrementRecordsSkipped(topic, count)
+	}
+	return keptRecords, keptDocuments
+}
+
+// dedupe keeps only the last record of each document id, since the earlier ones would be overwritten within the
+// same batch anyway. Records are in partition order, documents without id are generated by elasticsearch and
+// are always kept.
+func (s basicStore) dedupe(records []*models.Record, documents []*models.ElasticRecord) ([]*models.Record, []*models.ElasticRecord) {
+	type docKey struct{ index, id string }
+	last := make(map[docKey]int, len(documents))
+	for idx, document := range documents {
+		if document.ID != "" {
+			last[docKey{document.Index, document.ID}] = idx
 		}
-		s.db.Insert(res.Retry)
+	}
+	if len(last) == len(documents) {
+		return records, documents
+	}
+	uniqueRecords := make([]*models.Record, 0, len(last))
+	uniqueDocuments := make([]*models.ElasticRecord, 0, len(last))
+	collapsed := make(map[string]int)
+	for idx, document := range documents {
+		if document.ID != "" && last[docKey{document.Index, document.ID}] != idx {
+			collapsed[records[idx].Topic]++
+			continue
+		}
+		uniqueRecords = append(uniqueRecords, records[idx])
+		uniqueDocuments = append(uniqueDocuments, document)
+	}
+	for topic, count := range collapsed {
+		s.metricsPublisher.IncrementRecordsCollapsed(topic, count)
+	}
+	return uniqueRecords, uniqueDocuments
+}
+
+// failedDocuments are the keys of the documents left unwritten or rejected.
+func failedDocuments(unwritten []*models.ElasticRecord, rejected []elasticsearch.Failure) map[elasticsearch.DocumentKey]bool {
+	failed := make(map[elasticsearch.DocumentKey]bool, len(unwritten)+len(rejected))
+	for _, document := range unwritten {
+		failed[elasticsearch.KeyOf(document)] = true
+	}
+	for _, failure := range rejected {
+		failed[failure.Key()] = true
+	}
+	return failed
+}
+
+// publishEndToEndLatency observes the time between the kafka timestamp of the records inserted and now, as their
+// insert was just acknowledged. Records without timestamp, written by brokers older than 0.10, are left out.
+func (s basicStore) publishEndToEndLatency(records []*models.Record, documents []*models.ElasticRecord, unwritten []*models.ElasticRecord, rejected []elasticsearch.Failure) {
+	failed := failedDocuments(unwritten, rejected)
+	now := time.Now()
+	for idx, document := range documents {
+		timestamp := records[idx].Timestamp
+		if failed[elasticsearch.KeyOf(document)] || !timestamp.After(time.Unix(0, 0)) {
+			continue
+		}
+		s.metricsPublisher.ObserveEndToEndLatency(records[idx].Topic, now.Sub(timestamp).Seconds())
+	}
+}
+
+// publishOutcome counts the documents indexed and the ones that failed, either left unwritten or rejected, by
+// topic and index.
+func (s basicStore) publishOutcome(records []*models.Record, documents []*models.ElasticRecord, unwritten []*models.ElasticRecord, rejected []elasticsearch.Failure) {
+	failed := failedDocuments(unwritten, rejected)
+	type target struct{ topic, index string }
+	indexed := make(map[target]int)
+	failedCount := make(map[target]int)
+	for idx, document := range documents {
+		key := target{records[idx].Topic, document.Index}
+		if failed[elasticsearch.KeyOf(document)] {
+			failedCount[key]++
+		} else {
+			indexed[key]++
+		}
+	}
+	for key, count := range indexed {
+		s.metricsPublisher.IncrementRecordsIndexed(key.topic, key.index, count)
+	}
+	for key, count := range failedCount {
+		s.metricsPublisher.IncrementRecordsFailed(key.topic, key.index, count)
+	}
+	oversized := make(map[elasticsearch.DocumentKey]bool)
+	for _, failure := range rejected {
+		if failure.Type == elasticsearch.FailureDocumentTooLarge {
+			oversized[failure.Key()] = true
+		}
+	}
+	if len(oversized) == 0 {
+		return
+	}
+	oversizedCount := make(map[string]int)
+	for idx, document := range documents {
+		if oversized[elasticsearch.KeyOf(document)] {
+			oversizedCount[records[idx].Topic]++
+		}
+	}
+	for topic, count := range oversizedCount {
+		s.metricsPublisher.IncrementRecordsOversized(topic, count)
+	}
+}
+
+func (s basicStore) deadLetter(ctx context.Context, records []*models.Record, documents []*models.ElasticRecord, failures []elasticsearch.Failure) error {
+	byKey := make(map[elasticsearch.DocumentKey]int)
+	for idx, document := range documents {
+		byKey[elasticsearch.KeyOf(document)] = idx
+	}
+	deadLetters := make([]DeadLetter, 0, len(failures))
+	countByTopic := make(map[string]int)
+	for _, failure := range failures {
+		idx, ok := byKey[failure.Key()]
+		if !ok {
+			return fmt.Errorf("could not find the record of rejected document %s on index %s", failure.DocID, failure.Index)
+		}
+		deadLetters = append(deadLetters, DeadLetter{Record: records[idx], Document: documents[idx], Failure: failure})
+		countByTopic[records[idx].Topic]++
+	}
+	if err := s.deadLetters.Send(ctx, deadLetters); err != nil {
+		level.Error(s.logger).Log(
+			"message", "could not send records to the dead letter queue",
+			"topic", strings.Join(recordTopics(records), ","),
+			"batch_size", len(documents),
+			"doc_count", len(failures),
+			"doc_id", failures[0].DocID,
+			"err", err,
+		)
+		return &elasticsearch.RejectedError{Failures: failures}
+	}
+	for topic, count := range countByTopic {
+		level.Warn(s.logger).Log(
+			"message", "records rejected by elasticsearch sent to the dead letter queue",
+			"topic", topic,
+			"doc_count", count,
+		)
+		s.metricsPublisher.IncrementRecordsDeadLettered(topic, count)
 	}
 	return nil
 }
 
+// deadLetterUncoercible sends the records holding fields that can't be coerced to the dead letter queue, along with
+// their uncoerced documents. It returns the positions of the records sent, the batch fails when they can't be.
+func (s basicStore) deadLetterUncoercible(ctx context.Context, records []*models.Record, uncoercible *elasticsearch.UncoercibleError) (map[int]bool, error) {
+	if s.deadLetters == nil {
+		return nil, uncoercible
+	}
+	deadLetters := make([]DeadLetter, len(uncoercible.Records))
+	deadLettered := make(map[int]bool, len(uncoercible.Records))
+	countByTopic := make(map[string]int)
+	for idx, uncoercibleRecord := range uncoercible.Records {
+		record := records[uncoercibleRecord.Position]
+		deadLetters[idx] = DeadLetter{Record: record, Document: uncoercibleRecord.Document, Failure: uncoercibleRecord.Failure}
+		deadLettered[uncoercibleRecord.Position] = true
+		countByTopic[record.Topic]++
+	}
+	if err := s.deadLetters.Send(ctx, deadLetters); err != nil {
+		level.Error(s.logger).Log(
+			"message", "could not send records that could not be coerced to the dead letter queue",
+			"topic", strings.Join(recordTopics(records), ","),
+			"doc_count", len(deadLetters),
+			"err", err,
+		)
+		return nil, err
+	}
+	for topic, count := range countByTopic {
+		level.Warn(s.logger).Log(
+			"message", "records holding fields that can't be coerced sent to the dead letter queue",
+			"topic", topic,
+			"doc_count", count,
+			"reason", uncoercible.Records[0].Failure.Reason,
+		)
+		s.metricsPublisher.IncrementRecordsDeadLettered(topic, count)
+	}
+	return deadLettered, nil
+}
+
+// deadLetterUndecodable sends the records of the messages that could not be decoded to the dead letter queue, or
+// only logs them without one so that consumption moves past them all the same.
+func (s basicStore) deadLetterUndecodable(ctx context.Context, records []*models.Record) error {
+	if s.deadLetters == nil {
+		level.Error(s.logger).Log(
+			"message", "dropping messages that could not be decoded, ES_DEAD_LETTER_MODE is not set",
+			"doc_count", len(records),
+		)
+		return nil
+	}
+	deadLetters := make([]DeadLetter, len(records))
+	countByTopic := make(map[string]int)
+	for idx, record := range records {
+		deadLetters[idx] = DeadLetter{
+			Record:  record,
+			Failure: elasticsearch.Failure{Type: FailureDecodeError, Reason: record.DecodeErr.Error()},
+		}
+		countByTopic[record.Topic]++
+	}
+	if err := s.deadLetters.Send(ctx, deadLetters); err != nil {
+		level.Error(s.logger).Log(
+			"message", "could not send undecodable records to the dead letter queue",
+			"topic", strings.Join(recordTopics(records), ","),
+			"doc_count", len(records),
+			"err", err,
+		)
+		return err
+	}
+	for topic, count := range countByTopic {
+		level.Warn(s.logger).Log(
+			"message", "records that could not be decoded sent to the dead letter queue",
+			"topic", topic,
+			"doc_count", count,
+		)
+		s.metricsPublisher.IncrementRecordsDeadLettered(topic, count)
+	}
+	return nil
+}
+
+// wait sleeps the backoff of the attempt, failing with the context's error if it is done first.
+func (s basicStore) wait(ctx context.Context, attempt int, docCount int, keyvals ...interface{}) error {
+	backoff := s.backoffFor(attempt)
+	keyvals = append(keyvals,
+		"message", "insert failed, retrying",
+		"attempt", attempt,
+		"doc_count", docCount,
+		"backoff", backoff,
+	)
+	level.Warn(s.logger).Log(keyvals...)
+	select {
+	case <-time.After(backoff):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoffFor doubles the configured backoff on each attempt, up to maxBackoff. Half of it is
+// randomized so that concurrent workers don't retry in lockstep.
+func (s basicStore) backoffFor(attempt int) time.Duration {
+	backoff := s.backoff << uint(attempt-1)
+	if backoff > s.maxBackoff || backoff <= 0 {
+		backoff = s.maxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
 func (s basicStore) ReadinessCheck() bool {
-	return s.db.ReadinessCheck()
+	if !s.db.ReadinessCheck() {
+		return false
+	}
+	if err := s.db.EnsureTemplate(); err != nil {
+		level.Error(s.logger).Log("message", "could not ensure index template", "err", err)
+		return false
+	}
+	return true
+}
+
+func (s basicStore) Status() Status {
+	breaker, failures := s.breaker.state()
+	return Status{
+		CircuitBreaker:      breaker,
+		ConsecutiveFailures: failures,
+		InFlightBulks:       atomic.LoadInt64(s.inFlightBulks),
+	}
+}
+
+func (s basicStore) currentCodec() elasticsearch.Codec {
+	if s.transforms == nil {
+		return s.codec
+	}
+	return s.transforms.Load().(transformed).codec
+}
+
+func (s basicStore) SetTransforms(config elasticsearch.Config) {
+	if s.transforms == nil {
+		return
+	}
+	merged := s.transforms.Load().(transformed).config.WithTransforms(config)
+	s.transforms.Store(transformed{config: merged, codec: elasticsearch.NewCodec(s.logger, merged)})
 }
 
-func NewStore(logger log.Logger) Store {
-	config := elasticsearch.NewConfig()
-	return basicStore{
-		db:      elasticsearch.NewDatabase(logger, config),
-		codec:   elasticsearch.NewCodec(logger, config),
-		backoff: config.Backoff,
+// Close flushes the documents still buffered, closes the dead letter queue and releases the elasticsearch client.
+func (s basicStore) Close() {
+	s.breaker.stop()
+	if s.deadLetters != nil {
+		if err := s.deadLetters.Close(); err != nil {
+			level.Error(s.logger).Log("message", "could not close the dead letter queue", "err", err)
+		}
+	}
+	s.db.CloseClient()
+}
+
+func NewStore(logger log.Logger, metricsPublisher metrics.MetricsPublisher) (Store, error) {
+	config, err := elasticsearch.NewConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreWithConfig(logger, metricsPublisher, config)
+}
+
+// NewStoreWithConfig creates a store writing to the elasticsearch of a config, like the one of a pipeline.
+func NewStoreWithConfig(logger log.Logger, metricsPublisher metrics.MetricsPublisher, config elasticsearch.Config) (Store, error) {
+	db, err := elasticsearch.NewDatabase(logger, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewStoreWithDatabase(logger, metricsPublisher, config, db)
+}
+
+// NewStoreWithDatabase creates a store writing to a database of its own, like a custom sink. The config sets how
+// the records are turned into documents and retried.
+func NewStoreWithDatabase(logger log.Logger, metricsPublisher metrics.MetricsPublisher, config elasticsearch.Config, db elasticsearch.RecordDatabase) (Store, error) {
+	deadLetters, err := newDeadLetterQueue(config, db)
+	if err != nil {
+		return nil, err
+	}
+	codec := elasticsearch.NewCodec(logger, config)
+	transforms := &atomic.Value{}
+	transforms.Store(transformed{config: config, codec: codec})
+	s := basicStore{
+		db:               db,
+		codec:            codec,
+		deadLetters:      deadLetters,
+		logger:           logger,
+		metricsPublisher: metricsPublisher,
+		backoff:          config.Backoff,
+		maxBackoff:       config.MaxBackoff,
+		maxRetries:       config.MaxRetries,
+		dedupeInBatch:    config.DedupeInBatch,
+		inFlightBulks:    new(int64),
+		transforms:       transforms,
 	}
+	s.breaker = newCircuitBreaker(logger, metricsPublisher, config.BreakerThreshold, config.BreakerInterval, s.ReadinessCheck)
+	return s, nil
 }
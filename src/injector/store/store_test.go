@@ -0,0 +1,800 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
+	"github.com/inloco/kafka-elasticsearch-injector/src/logger_builder"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
+	"github.com/olivere/elastic"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = logger_builder.NewLogger("store-test")
+
+type insertResult struct {
+	res *elasticsearch.InsertResponse
+	err error
+}
+
+type fakeDatabase struct {
+	elasticsearch.RecordDatabase
+	results     []insertResult
+	calls       [][]*models.ElasticRecord
+	templateErr error
+	closed      bool
+}
+
+func (d *fakeDatabase) CloseClient() {
+	d.closed = true
+}
+
+func (d *fakeDatabase) EnsureTemplate() error {
+	return d.templateErr
+}
+
+func (d *fakeDatabase) Insert(ctx context.Context, records []*models.ElasticRecord) (*elasticsearch.InsertResponse, error) {
+	d.calls = append(d.calls, records)
+	result := d.results[0]
+	if len(d.results) > 1 {
+		d.results = d.results[1:]
+	}
+	return result.res, result.err
+}
+
+type fakeDeadLetterQueue struct {
+	sent   []DeadLetter
+	err    error
+	closed bool
+}
+
+func (q *fakeDeadLetterQueue) Send(ctx context.Context, deadLetters []DeadLetter) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.sent = append(q.sent, deadLetters...)
+	return nil
+}
+
+func (q *fakeDeadLetterQueue) Close() error {
+	q.closed = true
+	return nil
+}
+
+type fakeMetricsPublisher struct {
+	metrics.MetricsPublisher
+	deadLettered    map[string]int
+	alreadyExisting int
+
+	indexed   map[string]int
+	failed    map[string]int
+	oversized map[string]int
+	collapsed map[string]int
+	skipped   map[string]int
+	bulks     []int
+	// bulkStatuses are the statuses of the bulk requests, as topic/status
+	bulkStatuses []string
+	// latencies are the end to end latencies observed, by topic
+	latencies map[string][]float64
+
+	mutex       sync.Mutex
+	breakerOpen []bool
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsIndexed(topic string, index string, count int) {
+	if m.indexed == nil {
+		m.indexed = make(map[string]int)
+	}
+	m.indexed[topic+"/"+index] += count
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsFailed(topic string, index string, count int) {
+	if m.failed == nil {
+		m.failed = make(map[string]int)
+	}
+	m.failed[topic+"/"+index] += count
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsOversized(topic string, count int) {
+	if m.oversized == nil {
+		m.oversized = make(map[string]int)
+	}
+	m.oversized[topic] += count
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsCollapsed(topic string, count int) {
+	if m.collapsed == nil {
+		m.collapsed = make(map[string]int)
+	}
+	m.collapsed[topic] += count
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsSkipped(topic string, count int) {
+	if m.skipped == nil {
+		m.skipped = make(map[string]int)
+	}
+	m.skipped[topic] += count
+}
+
+func (m *fakeMetricsPublisher) RecordBulk(size int, latency float64) {
+	m.bulks = append(m.bulks, size)
+}
+
+func (m *fakeMetricsPublisher) IncrementBulkRequests(topic string, status string) {
+	m.bulkStatuses = append(m.bulkStatuses, topic+"/"+status)
+}
+
+func (m *fakeMetricsPublisher) ObserveEndToEndLatency(topic string, seconds float64) {
+	if m.latencies == nil {
+		m.latencies = make(map[string][]float64)
+	}
+	m.latencies[topic] = append(m.latencies[topic], seconds)
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsDeadLettered(topic string, count int) {
+	m.deadLettered[topic] += count
+}
+
+func (m *fakeMetricsPublisher) IncrementRecordsAlreadyExisting(count int) {
+	m.alreadyExisting += count
+}
+
+func (m *fakeMetricsPublisher) CircuitBreakerOpen(open bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.breakerOpen = append(m.breakerOpen, open)
+}
+
+func (m *fakeMetricsPublisher) breakerTransitions() []bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]bool(nil), m.breakerOpen...)
+}
+
+// testIndex is the index of the records written by the codec of newTestStore.
+func testIndex(record *models.Record) string {
+	return record.Topic + "-" + record.FormatTimestampDay()
+}
+
+func newTestStore(db *fakeDatabase) basicStore {
+	return basicStore{
+		db:               db,
+		codec:            elasticsearch.NewCodec(logger, elasticsearch.Config{}),
+		logger:           logger,
+		metricsPublisher: &fakeMetricsPublisher{deadLettered: make(map[string]int)},
+		backoff:          time.Millisecond,
+		maxBackoff:       4 * time.Millisecond,
+		maxRetries:       3,
+		inFlightBulks:    new(int64),
+	}
+}
+
+func TestBasicStore_Insert_RetriesTransientErrors(t *testing.T) {
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusServiceUnavailable}},
+		{nil, errors.New("connection reset by peer")},
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	err := newTestStore(db).Insert(context.Background(), []*models.Record{record})
+	assert.NoError(t, err)
+	assert.Len(t, db.calls, 3)
+}
+
+func TestBasicStore_Insert_Traced(t *testing.T) {
+	exported := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		exported <- body
+	}))
+	defer collector.Close()
+	tracer := tracing.NewTracer(tracing.Config{Endpoint: collector.URL, Timeout: time.Second, FlushInterval: time.Hour})
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusServiceUnavailable}},
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	batch := tracer.Start("kafka.batch")
+	err := newTestStore(db).Insert(tracing.ContextWithSpan(context.Background(), batch), []*models.Record{record})
+	assert.NoError(t, err)
+	batch.End(nil)
+	tracer.Close()
+
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Name       string
+					Attributes []struct {
+						Key   string
+						Value struct{ IntValue string }
+					}
+				}
+			}
+		}
+	}
+	if !assert.NoError(t, json.Unmarshal(<-exported, &request)) {
+		return
+	}
+	attributes := make(map[string]map[string]string)
+	var names []string
+	for _, span := range request.ResourceSpans[0].ScopeSpans[0].Spans {
+		names = append(names, span.Name)
+		if attributes[span.Name] == nil {
+			attributes[span.Name] = make(map[string]string)
+		}
+		for _, attribute := range span.Attributes {
+			attributes[span.Name][attribute.Key] = attribute.Value.IntValue
+		}
+	}
+	assert.Equal(t, []string{"transform", "elasticsearch.bulk", "elasticsearch.bulk", "elasticsearch.insert", "kafka.batch"}, names)
+	assert.Equal(t, "1", attributes["elasticsearch.insert"]["bulk_size"])
+	assert.Equal(t, "1", attributes["elasticsearch.insert"]["retry_count"])
+	assert.Equal(t, "2", attributes["elasticsearch.bulk"]["attempt"])
+}
+
+func TestBasicStore_Insert_StopsRetryingWhenCancelled(t *testing.T) {
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusServiceUnavailable}},
+	}}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	s := newTestStore(db)
+	s.backoff, s.maxBackoff = time.Hour, time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err := s.Insert(ctx, []*models.Record{record})
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, db.calls, 1)
+}
+
+func TestBasicStore_Insert_RetriesOnlyFailedDocuments(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	retry := &models.ElasticRecord{Index: testIndex(second), ID: second.GetId()}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Retry: []*models.ElasticRecord{retry}, Overloaded: true}, nil},
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+
+	err := newTestStore(db).Insert(context.Background(), []*models.Record{first, second})
+	if assert.NoError(t, err) && assert.Len(t, db.calls, 2) {
+		assert.Len(t, db.calls[0], 2)
+		assert.Equal(t, []*models.ElasticRecord{retry}, db.calls[1])
+	}
+}
+
+func TestBasicStore_Insert_CountsAlreadyExistingDocuments(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{AlreadyExists: []string{record.GetId()}}, nil},
+	}}
+	s := newTestStore(db)
+
+	err := s.Insert(context.Background(), []*models.Record{record})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.metricsPublisher.(*fakeMetricsPublisher).alreadyExisting)
+}
+
+func TestBasicStore_Insert_PublishesOutcomeByTopicAndIndex(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	third, _, _ := fixtures.NewRecord(time.Now())
+	retry := &models.ElasticRecord{Index: testIndex(third), ID: third.GetId()}
+	failure := elasticsearch.Failure{Index: testIndex(second), DocID: second.GetId(), Status: http.StatusBadRequest}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Retry: []*models.ElasticRecord{retry}, Rejected: []elasticsearch.Failure{failure}}, nil},
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+	s := newTestStore(db)
+	metricsPublisher := s.metricsPublisher.(*fakeMetricsPublisher)
+
+	s.Insert(context.Background(), []*models.Record{first, second, third})
+	documents, _ := s.codec.EncodeElasticRecords([]*models.Record{first})
+	target := first.Topic + "/" + documents[0].Index
+	assert.Equal(t, map[string]int{target: 2}, metricsPublisher.indexed)
+	assert.Equal(t, map[string]int{target: 1}, metricsPublisher.failed)
+	assert.Equal(t, []int{3, 1}, metricsPublisher.bulks)
+	assert.Equal(t, []string{first.Topic + "/partial", first.Topic + "/success"}, metricsPublisher.bulkStatuses)
+}
+
+func TestBasicStore_Insert_ObservesEndToEndLatency(t *testing.T) {
+	inserted, _, _ := fixtures.NewRecord(time.Now().Add(-time.Minute))
+	rejected, _, _ := fixtures.NewRecord(time.Now())
+	untimed, _, _ := fixtures.NewRecord(time.Now())
+	untimed.Timestamp = time.Time{}
+	failure := elasticsearch.Failure{Index: testIndex(rejected), DocID: rejected.GetId(), Status: http.StatusBadRequest}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{failure}}, nil},
+	}}
+	s := newTestStore(db)
+	metricsPublisher := s.metricsPublisher.(*fakeMetricsPublisher)
+
+	s.Insert(context.Background(), []*models.Record{inserted, rejected, untimed})
+	latencies := metricsPublisher.latencies[inserted.Topic]
+	if assert.Len(t, latencies, 1) {
+		assert.InDelta(t, 60, latencies[0], 5)
+	}
+}
+
+func TestBasicStore_Insert_PublishesUnwrittenAsFailed(t *testing.T) {
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusBadRequest}},
+	}}
+	record, _, _ := fixtures.NewRecord(time.Now())
+	s := newTestStore(db)
+	metricsPublisher := s.metricsPublisher.(*fakeMetricsPublisher)
+
+	assert.Error(t, s.Insert(context.Background(), []*models.Record{record}))
+	assert.Empty(t, metricsPublisher.indexed)
+	assert.Len(t, metricsPublisher.failed, 1)
+	assert.Equal(t, []string{record.Topic + "/error"}, metricsPublisher.bulkStatuses)
+}
+
+func TestBasicStore_InsertRecords_FailureInTheMiddle(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	third, _, _ := fixtures.NewRecord(time.Now())
+	failure := elasticsearch.Failure{Index: testIndex(second), DocID: second.GetId(), Status: http.StatusBadRequest, Type: "mapper_parsing_exception"}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{failure}}, nil},
+	}}
+
+	results, err := newTestStore(db).InsertRecords(context.Background(), []*models.Record{first, second, third})
+	assert.IsType(t, &elasticsearch.RejectedError{}, err)
+	if assert.Len(t, results, 3) {
+		assert.True(t, results[0].Succeeded)
+		assert.False(t, results[1].Succeeded)
+		assert.IsType(t, &elasticsearch.RejectedError{}, results[1].Err)
+		assert.True(t, results[2].Succeeded)
+	}
+}
+
+func TestBasicStore_InsertRecords_FailuresByIndexAndID(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	first.Json["tenant"] = "a"
+	second, _, _ := fixtures.NewRecord(time.Now())
+	second.Json["id"] = first.Json["id"]
+	second.Json["tenant"] = "b"
+	failure := elasticsearch.Failure{Index: second.Topic + "-b", DocID: fmt.Sprint(second.Json["id"]), Status: http.StatusBadRequest}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{failure}}, nil},
+	}}
+	s := newTestStore(db)
+	s.codec = elasticsearch.NewCodec(logger, elasticsearch.Config{DocIDColumn: "id", IndexColumn: "tenant"})
+	metricsPublisher := s.metricsPublisher.(*fakeMetricsPublisher)
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{first, second})
+	assert.IsType(t, &elasticsearch.RejectedError{}, err)
+	if assert.Len(t, results, 2) {
+		assert.True(t, results[0].Succeeded, "the rejection of the other index shouldn't fail the document")
+		assert.False(t, results[1].Succeeded)
+	}
+	assert.Equal(t, map[string]int{first.Topic + "/" + first.Topic + "-a": 1}, metricsPublisher.indexed)
+	assert.Equal(t, map[string]int{second.Topic + "/" + second.Topic + "-b": 1}, metricsPublisher.failed)
+}
+
+func TestBasicStore_InsertRecords_RetriesExhausted(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	retry := &models.ElasticRecord{Index: testIndex(second), ID: second.GetId()}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Retry: []*models.ElasticRecord{retry}}, nil},
+	}}
+
+	results, err := newTestStore(db).InsertRecords(context.Background(), []*models.Record{first, second})
+	assert.Error(t, err)
+	assert.Equal(t, []bool{true, false}, []bool{results[0].Succeeded, results[1].Succeeded})
+}
+
+func TestBasicStore_InsertRecords_DedupeInBatch(t *testing.T) {
+	now := time.Now()
+	first, _, _ := fixtures.NewRecord(now)
+	second, _, _ := fixtures.NewRecord(now)
+	third, _, _ := fixtures.NewRecord(now)
+	third.Json["id"] = first.Json["id"]
+	db := &fakeDatabase{results: []insertResult{{&elasticsearch.InsertResponse{}, nil}}}
+	metricsPublisher := &fakeMetricsPublisher{deadLettered: make(map[string]int)}
+	s := newTestStore(db)
+	s.codec = elasticsearch.NewCodec(logger, elasticsearch.Config{DocIDColumn: "id"})
+	s.metricsPublisher = metricsPublisher
+	s.dedupeInBatch = true
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{first, second, third})
+	if assert.NoError(t, err) && assert.Len(t, db.calls, 1) && assert.Len(t, db.calls[0], 2) {
+		assert.Equal(t, second.Json["value"], db.calls[0][0].Json["value"])
+		assert.Equal(t, third.Json["value"], db.calls[0][1].Json["value"], "the last record of the id should be kept")
+	}
+	assert.Equal(t, []bool{true, true, true}, []bool{results[0].Succeeded, results[1].Succeeded, results[2].Succeeded})
+	assert.Equal(t, map[string]int{first.Topic: 1}, metricsPublisher.collapsed)
+}
+
+// TestBasicStore_InsertRecords_DedupeWithoutDocuments checks that the records left without a document, skipped or
+// dead lettered, are left out before the batch is deduped.
+func TestBasicStore_InsertRecords_DedupeWithoutDocuments(t *testing.T) {
+	internalFilter, err := models.ParseFilter("kind != internal")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, tc := range []struct {
+		name         string
+		config       elasticsearch.Config
+		shape        func(first, duplicate, withoutDocument *models.Record)
+		filter       *models.Filter
+		deadLettered int
+	}{
+		{
+			name: "skipped for a missing column",
+			config: elasticsearch.Config{
+				DocIDColumn:  "id",
+				IndexColumn:  "campaign_id",
+				MissingIndex: elasticsearch.MissingColumnSkip,
+			},
+			shape: func(first, duplicate, withoutDocument *models.Record) {
+				first.Json["campaign_id"] = "42"
+				duplicate.Json["campaign_id"] = "42"
+			},
+		},
+		{
+			name: "left out by the filter",
+			config: elasticsearch.Config{
+				DocIDColumn:  "id",
+				IndexColumn:  "campaign_id",
+				MissingIndex: elasticsearch.MissingColumnSkip,
+			},
+			shape: func(first, duplicate, withoutDocument *models.Record) {
+				first.Json["campaign_id"] = "42"
+				duplicate.Json["campaign_id"] = "42"
+				withoutDocument.Json["kind"] = "external"
+			},
+			filter: internalFilter,
+		},
+		{
+			name: "dead lettered for a coercion error",
+			config: elasticsearch.Config{
+				DocIDColumn:    "id",
+				FieldCoercions: map[string]models.Coercion{"amount": models.CoerceDouble},
+				CoercionErrors: elasticsearch.CoercionErrorsDeadLetter,
+			},
+			shape: func(first, duplicate, withoutDocument *models.Record) {
+				withoutDocument.Json["amount"] = "ten"
+			},
+			deadLettered: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			first, _, _ := fixtures.NewRecord(time.Now())
+			duplicate, _, _ := fixtures.NewRecord(time.Now())
+			duplicate.Json["id"] = first.Json["id"]
+			withoutDocument, _, _ := fixtures.NewRecord(time.Now())
+			internal, _, _ := fixtures.NewRecord(time.Now())
+			internal.Json["kind"] = "internal"
+			tc.shape(first, duplicate, withoutDocument)
+			batch := []*models.Record{first, withoutDocument, internal, duplicate}
+			if tc.filter != nil {
+				// the consumer drops the records the filter leaves out before they reach the store
+				var matched []*models.Record
+				for _, record := range batch {
+					if tc.filter.Match(record) {
+						matched = append(matched, record)
+					}
+				}
+				batch = matched
+			} else {
+				batch = []*models.Record{first, withoutDocument, duplicate}
+			}
+			db := &fakeDatabase{results: []insertResult{{&elasticsearch.InsertResponse{}, nil}}}
+			deadLetters := &fakeDeadLetterQueue{}
+			s := newTestStore(db)
+			s.codec = elasticsearch.NewCodec(logger, tc.config)
+			s.deadLetters = deadLetters
+			s.dedupeInBatch = true
+
+			results, err := s.InsertRecords(context.Background(), batch)
+			if assert.NoError(t, err) && assert.Len(t, db.calls, 1) && assert.Len(t, db.calls[0], 1) {
+				assert.Equal(t, duplicate.Json["value"], db.calls[0][0].Json["value"], "the last record of the id should be kept")
+			}
+			assert.Len(t, results, len(batch))
+			for _, result := range results {
+				assert.True(t, result.Succeeded)
+			}
+			assert.Len(t, deadLetters.sent, tc.deadLettered)
+		})
+	}
+}
+
+func TestBasicStore_InsertRecords_SkipsRecordsMissingColumns(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	first.Json["campaign_id"] = "42"
+	db := &fakeDatabase{results: []insertResult{{&elasticsearch.InsertResponse{}, nil}}}
+	metricsPublisher := &fakeMetricsPublisher{deadLettered: make(map[string]int)}
+	s := newTestStore(db)
+	s.codec = elasticsearch.NewCodec(logger, elasticsearch.Config{IndexColumn: "campaign_id", MissingIndex: elasticsearch.MissingColumnSkip})
+	s.metricsPublisher = metricsPublisher
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{first, second})
+	if assert.NoError(t, err) && assert.Len(t, db.calls, 1) && assert.Len(t, db.calls[0], 1) {
+		assert.Equal(t, first.GetId(), db.calls[0][0].ID)
+	}
+	// skipped records succeed so that their offsets are committed
+	assert.Equal(t, []models.RecordResult{{Succeeded: true}, {Succeeded: true, Skipped: true}}, results)
+	assert.Equal(t, map[string]int{second.Topic: 1}, metricsPublisher.skipped)
+}
+
+func TestBasicStore_Dedupe_KeepsDocumentsWithoutID(t *testing.T) {
+	var records []*models.Record
+	for i := 0; i < 4; i++ {
+		record, _, _ := fixtures.NewRecord(time.Now())
+		records = append(records, record)
+	}
+	documents := []*models.ElasticRecord{
+		{Index: "i", ID: ""},
+		{Index: "i", ID: ""},
+		{Index: "i", ID: "1"},
+		{Index: "other", ID: "1"},
+	}
+
+	uniqueRecords, uniqueDocuments := newTestStore(&fakeDatabase{}).dedupe(records, documents)
+	assert.Equal(t, records, uniqueRecords)
+	assert.Equal(t, documents, uniqueDocuments)
+}
+
+func TestBasicStore_Insert_ExtraIndexFailureDoesNotFailInsert(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{}, nil},
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{{Index: "rollup", DocID: record.GetId(), Status: http.StatusBadRequest}}}, nil},
+	}}
+	deadLetters := &fakeDeadLetterQueue{}
+	s := newTestStore(db)
+	s.codec = elasticsearch.NewCodec(logger, elasticsearch.Config{ExtraIndices: []elasticsearch.IndexTarget{{Prefix: "rollup", Suffix: elasticsearch.TimeSuffixNone}}})
+	s.deadLetters = deadLetters
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{record})
+	assert.NoError(t, err)
+	assert.True(t, results[0].Succeeded)
+	if assert.Len(t, db.calls, 2) {
+		assert.Equal(t, "rollup", db.calls[1][0].Index)
+		assert.Equal(t, db.calls[0][0].ID, db.calls[1][0].ID)
+	}
+	if assert.Len(t, deadLetters.sent, 1) {
+		assert.Equal(t, "rollup", deadLetters.sent[0].Failure.Index)
+	}
+}
+
+func TestBasicStore_Insert_GivesUpAfterMaxRetries(t *testing.T) {
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusTooManyRequests}},
+	}}
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	err := newTestStore(db).Insert(context.Background(), []*models.Record{record})
+	assert.Error(t, err)
+	assert.Len(t, db.calls, 4)
+}
+
+func TestBasicStore_Insert_DoesNotRetryPermanentErrors(t *testing.T) {
+	db := &fakeDatabase{results: []insertResult{
+		{nil, &elastic.Error{Status: http.StatusBadRequest}},
+	}}
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	err := newTestStore(db).Insert(context.Background(), []*models.Record{record})
+	assert.Error(t, err)
+	assert.Len(t, db.calls, 1)
+}
+
+func TestBasicStore_Insert_ReportsRejectedDocuments(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	third, _, _ := fixtures.NewRecord(time.Now())
+	retry := &models.ElasticRecord{Index: testIndex(third), ID: third.GetId()}
+	failure := elasticsearch.Failure{
+		Index:  testIndex(second),
+		DocID:  second.GetId(),
+		Status: http.StatusBadRequest,
+		Type:   "mapper_parsing_exception",
+		Reason: "failed to parse",
+	}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{
+			Retry:    []*models.ElasticRecord{retry},
+			Rejected: []elasticsearch.Failure{failure},
+		}, nil},
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+
+	err := newTestStore(db).Insert(context.Background(), []*models.Record{first, second, third})
+	if assert.IsType(t, &elasticsearch.RejectedError{}, err) {
+		assert.Equal(t, []elasticsearch.Failure{failure}, err.(*elasticsearch.RejectedError).Failures)
+		assert.Contains(t, err.Error(), "mapper_parsing_exception")
+	}
+	if assert.Len(t, db.calls, 2) {
+		assert.Equal(t, []*models.ElasticRecord{retry}, db.calls[1])
+	}
+}
+
+func TestBasicStore_Insert_DeadLettersRejectedDocuments(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	failure := elasticsearch.Failure{Index: testIndex(second), DocID: second.GetId(), Status: http.StatusBadRequest, Type: "mapper_parsing_exception"}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{failure}}, nil},
+	}}
+	deadLetters := &fakeDeadLetterQueue{}
+	metricsPublisher := &fakeMetricsPublisher{deadLettered: make(map[string]int)}
+	s := newTestStore(db)
+	s.deadLetters = deadLetters
+	s.metricsPublisher = metricsPublisher
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{first, second})
+	if assert.NoError(t, err) && assert.Len(t, deadLetters.sent, 1) {
+		assert.Equal(t, []models.RecordResult{{Succeeded: true}, {Succeeded: true, DeadLettered: true}}, results)
+		assert.Equal(t, second, deadLetters.sent[0].Record)
+		assert.Equal(t, second.GetId(), deadLetters.sent[0].Document.ID)
+		assert.Equal(t, failure, deadLetters.sent[0].Failure)
+	}
+	assert.Equal(t, map[string]int{second.Topic: 1}, metricsPublisher.deadLettered)
+}
+
+func TestBasicStore_Insert_DeadLettersUndecodableRecords(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	undecodable := &models.Record{Topic: first.Topic, Partition: 1, Offset: 7, Value: []byte("not json"), DecodeErr: errors.New("invalid json message")}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+	deadLetters := &fakeDeadLetterQueue{}
+	metricsPublisher := &fakeMetricsPublisher{deadLettered: make(map[string]int)}
+	s := newTestStore(db)
+	s.deadLetters = deadLetters
+	s.metricsPublisher = metricsPublisher
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{undecodable, first})
+	if assert.NoError(t, err) && assert.Len(t, deadLetters.sent, 1) {
+		assert.Equal(t, undecodable, deadLetters.sent[0].Record)
+		assert.Nil(t, deadLetters.sent[0].Document)
+		assert.Equal(t, FailureDecodeError, deadLetters.sent[0].Failure.Type)
+		assert.Equal(t, []models.RecordResult{{Succeeded: true, DeadLettered: true}, {Succeeded: true}}, results)
+	}
+	if assert.Len(t, db.calls, 1) && assert.Len(t, db.calls[0], 1) {
+		assert.Equal(t, first.GetId(), db.calls[0][0].ID)
+	}
+	assert.Equal(t, map[string]int{first.Topic: 1}, metricsPublisher.deadLettered)
+
+	deadLetters.err = errors.New("disk full")
+	results, err = s.InsertRecords(context.Background(), []*models.Record{undecodable})
+	if assert.Error(t, err) && assert.Len(t, results, 1) {
+		assert.False(t, results[0].Succeeded)
+	}
+}
+
+func TestBasicStore_Insert_DeadLettersUncoercibleRecords(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	uncoercible, _, _ := fixtures.NewRecord(time.Now())
+	uncoercible.Json["amount"] = "ten"
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{}, nil},
+	}}
+	deadLetters := &fakeDeadLetterQueue{}
+	metricsPublisher := &fakeMetricsPublisher{deadLettered: make(map[string]int)}
+	s := newTestStore(db)
+	s.codec = elasticsearch.NewCodec(logger, elasticsearch.Config{
+		FieldCoercions: map[string]models.Coercion{"amount": models.CoerceDouble},
+		CoercionErrors: elasticsearch.CoercionErrorsDeadLetter,
+	})
+	s.deadLetters = deadLetters
+	s.metricsPublisher = metricsPublisher
+
+	results, err := s.InsertRecords(context.Background(), []*models.Record{first, uncoercible})
+	if assert.NoError(t, err) && assert.Len(t, deadLetters.sent, 1) {
+		assert.Equal(t, uncoercible, deadLetters.sent[0].Record)
+		assert.Equal(t, "ten", deadLetters.sent[0].Document.Json["amount"])
+		assert.Equal(t, elasticsearch.FailureCoercionError, deadLetters.sent[0].Failure.Type)
+		assert.Equal(t, []models.RecordResult{{Succeeded: true}, {Succeeded: true, DeadLettered: true}}, results)
+	}
+	if assert.Len(t, db.calls, 1) && assert.Len(t, db.calls[0], 1) {
+		assert.Equal(t, first.GetId(), db.calls[0][0].ID)
+	}
+	assert.Equal(t, map[string]int{first.Topic: 1}, metricsPublisher.deadLettered)
+	assert.Empty(t, metricsPublisher.skipped)
+
+	deadLetters.err = errors.New("disk full")
+	_, err = s.InsertRecords(context.Background(), []*models.Record{first, uncoercible})
+	assert.EqualError(t, err, "disk full")
+}
+
+func TestBasicStore_Insert_CountsOversizedDocuments(t *testing.T) {
+	first, _, _ := fixtures.NewRecord(time.Now())
+	second, _, _ := fixtures.NewRecord(time.Now())
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{
+			{Index: testIndex(first), DocID: first.GetId(), Status: http.StatusBadRequest, Type: "mapper_parsing_exception"},
+			{Index: testIndex(second), DocID: second.GetId(), Status: http.StatusRequestEntityTooLarge, Type: elasticsearch.FailureDocumentTooLarge},
+		}}, nil},
+	}}
+	metricsPublisher := &fakeMetricsPublisher{deadLettered: make(map[string]int)}
+	s := newTestStore(db)
+	s.deadLetters = &fakeDeadLetterQueue{}
+	s.metricsPublisher = metricsPublisher
+
+	assert.NoError(t, s.Insert(context.Background(), []*models.Record{first, second}))
+	assert.Equal(t, map[string]int{second.Topic: 1}, metricsPublisher.oversized)
+}
+
+func TestBasicStore_Insert_DeadLetterQueueUnavailable(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	failure := elasticsearch.Failure{Index: testIndex(record), DocID: record.GetId(), Status: http.StatusBadRequest}
+	db := &fakeDatabase{results: []insertResult{
+		{&elasticsearch.InsertResponse{Rejected: []elasticsearch.Failure{failure}}, nil},
+	}}
+	s := newTestStore(db)
+	s.deadLetters = &fakeDeadLetterQueue{err: errors.New("disk full")}
+
+	err := s.Insert(context.Background(), []*models.Record{record})
+	assert.IsType(t, &elasticsearch.RejectedError{}, err)
+}
+
+func TestBasicStore_Insert_RequiresTemplate(t *testing.T) {
+	db := &fakeDatabase{templateErr: errors.New("mapper_parsing_exception")}
+	record, _, _ := fixtures.NewRecord(time.Now())
+
+	err := newTestStore(db).Insert(context.Background(), []*models.Record{record})
+	assert.Error(t, err)
+	assert.Empty(t, db.calls)
+}
+
+func TestBasicStore_Close(t *testing.T) {
+	db := &fakeDatabase{}
+	deadLetters := &fakeDeadLetterQueue{}
+	s := newTestStore(db)
+	s.deadLetters = deadLetters
+
+	s.Close()
+	assert.True(t, deadLetters.closed)
+	assert.True(t, db.closed)
+}
+
+func TestBasicStore_BackoffFor(t *testing.T) {
+	s := basicStore{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		backoff := s.backoffFor(attempt + 1)
+		assert.True(t, backoff >= expected*time.Millisecond/2 && backoff <= expected*time.Millisecond,
+			"attempt %d: backoff %s", attempt+1, backoff)
+	}
+	assert.True(t, s.backoffFor(100) <= time.Second)
+}
+
+func TestBasicStore_SetTransforms(t *testing.T) {
+	record, _, _ := fixtures.NewRecord(time.Now())
+	db := &fakeDatabase{results: []insertResult{{&elasticsearch.InsertResponse{}, nil}, {&elasticsearch.InsertResponse{}, nil}}}
+	s := newTestStore(db)
+	config := elasticsearch.Config{Index: "orders"}
+	s.transforms = &atomic.Value{}
+	s.transforms.Store(transformed{config: config, codec: elasticsearch.NewCodec(logger, config)})
+
+	assert.NoError(t, s.Insert(context.Background(), []*models.Record{record}))
+	// only the transforms are applied, the index stays the same
+	s.SetTransforms(elasticsearch.Config{Index: "other", BlacklistedColumns: []string{"value"}})
+	assert.NoError(t, s.Insert(context.Background(), []*models.Record{record}))
+	if assert.Len(t, db.calls, 2) {
+		assert.Contains(t, db.calls[0][0].Json, "value")
+		assert.NotContains(t, db.calls[1][0].Json, "value")
+		assert.Equal(t, db.calls[0][0].Index, db.calls[1][0].Index)
+	}
+}
@@ -0,0 +1,84 @@
+package injector
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/elasticsearch"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
+	"github.com/inloco/kafka-elasticsearch-injector/src/validation"
+)
+
+// ValidateConfig checks the whole config at startup, before anything connects to kafka, elasticsearch or the
+// schema registry. It returns every invalid setting, none when the config is valid. The errors of the pipelines
+// of the config file are prefixed with their name.
+func ValidateConfig(pipelines []config_file.Pipeline) validation.Errors {
+	var errs validation.Errors
+	for _, required := range []string{
+		"PROBES_PORT",
+		"K8S_LIVENESS_ROUTE",
+		"K8S_READINESS_ROUTE",
+		"METRICS_PORT",
+	} {
+		errs.Required(required, os.Getenv(required))
+	}
+	for _, port := range []string{"PROBES_PORT", "METRICS_PORT", "DEBUG_PORT"} {
+		errs.Int(port, os.Getenv(port), 0, false)
+	}
+	errs.Duration("CONFIG_FILE_WATCH_INTERVAL", os.Getenv("CONFIG_FILE_WATCH_INTERVAL"), 0, true)
+	errs.Duration("PIPELINES_RESTART_BACKOFF", os.Getenv("PIPELINES_RESTART_BACKOFF"), DefaultRestartBackoff, false)
+	_, err := tracing.NewConfig(nil)
+	errs.Add(err)
+
+	groups := make(map[string]string)
+	for _, pipeline := range pipelines {
+		pipelineErrs := validatePipeline(pipeline)
+		if pipeline.Name == "" {
+			errs.Add(pipelineErrs)
+			continue
+		}
+		for _, err := range pipelineErrs {
+			errs.Addf("pipeline %s: %s", pipeline.Name, err)
+		}
+		if pipeline.Getenv("KAFKA_REPLAY_START") != "" {
+			errs.Addf("pipeline %s: KAFKA_REPLAY_START can't be set for a pipeline, replays run a single pipeline", pipeline.Name)
+		}
+		// the pipelines would be rebalanced together, failing together
+		group := pipeline.Getenv("KAFKA_CONSUMER_GROUP")
+		if other, shared := groups[group]; shared && group != "" {
+			errs.Addf("pipelines %s and %s have the same KAFKA_CONSUMER_GROUP %s, each pipeline needs its own group", other, pipeline.Name, group)
+		}
+		groups[group] = pipeline.Name
+	}
+	return errs
+}
+
+// validatePipeline checks the config of the consumer, the schema registry and the elasticsearch of a pipeline.
+func validatePipeline(pipeline config_file.Pipeline) validation.Errors {
+	var errs validation.Errors
+	for _, required := range []string{
+		"KAFKA_ADDRESS",
+		"KAFKA_CONSUMER_GROUP",
+		"SCHEMA_REGISTRY_URL",
+	} {
+		errs.Required(required, pipeline.Getenv(required))
+	}
+	if dryRun, _ := strconv.ParseBool(pipeline.Getenv("DRY_RUN")); !dryRun {
+		// dry runs never contact elasticsearch
+		errs.Required("ELASTICSEARCH_HOST", pipeline.Getenv("ELASTICSEARCH_HOST"))
+	}
+
+	errs.URLs("SCHEMA_REGISTRY_URL", pipeline.Getenv("SCHEMA_REGISTRY_URL"))
+	if pipeline.Getenv("SCHEMA_REGISTRY_USERNAME") != "" && pipeline.Getenv("SCHEMA_REGISTRY_AUTHORIZATION") != "" {
+		errs.Addf("only one of SCHEMA_REGISTRY_USERNAME and SCHEMA_REGISTRY_AUTHORIZATION should be set")
+	}
+	errs.Bool("SCHEMA_REGISTRY_PERSIST_SCHEMAS", pipeline.Getenv("SCHEMA_REGISTRY_PERSIST_SCHEMAS"), false)
+	errs.Duration("SCHEMA_REGISTRY_PROBE_INTERVAL", pipeline.Getenv("SCHEMA_REGISTRY_PROBE_INTERVAL"), 0, false)
+
+	_, err := parseConsumer(NewKafkaConfig(pipeline))
+	errs.Add(err)
+	_, err = elasticsearch.NewConfigFrom(pipeline.LookupEnv)
+	errs.Add(err)
+	return errs
+}
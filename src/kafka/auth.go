@@ -0,0 +1,74 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// SASL holds the credentials the consumer authenticates to the brokers with, it is disabled when Mechanism is empty.
+type SASL struct {
+	Mechanism string
+	User      string
+	Password  string
+}
+
+func NewSASL(mechanism, user, password string) (SASL, error) {
+	mechanism = strings.ToUpper(mechanism)
+	switch mechanism {
+	case "":
+		if user != "" {
+			return SASL{}, errors.New("KAFKA_SASL_MECHANISM is required when KAFKA_SASL_USERNAME is set")
+		}
+		return SASL{}, nil
+	case SASLPlain:
+	case SASLScramSHA256, SASLScramSHA512:
+		// the kafka client in use only implements PLAIN
+		return SASL{}, fmt.Errorf("SASL mechanism %s is not supported yet, only %s is", mechanism, SASLPlain)
+	default:
+		return SASL{}, fmt.Errorf("unknown SASL mechanism %s", mechanism)
+	}
+	if user == "" || password == "" {
+		return SASL{}, errors.New("KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD are required when KAFKA_SASL_MECHANISM is set")
+	}
+	return SASL{Mechanism: mechanism, User: user, Password: password}, nil
+}
+
+// checkAuthentication connects to the brokers until one accepts the credentials. The client would otherwise
+// retry rejected credentials until it runs out of brokers, failing with no hint of why.
+func checkAuthentication(brokers []string, config *sarama.Config) error {
+	var err error
+	for _, address := range brokers {
+		broker := sarama.NewBroker(address)
+		if err := broker.Open(config); err != nil {
+			return err
+		}
+		var connected bool
+		connected, err = broker.Connected()
+		if connected {
+			broker.Close()
+			return nil
+		}
+		if _, unreachable := err.(net.Error); unreachable {
+			err = fmt.Errorf("could not connect to kafka broker %s: %s", address, err)
+			continue
+		}
+		return fmt.Errorf(
+			"kafka broker %s rejected the SASL %s authentication of %s, check KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD: %v",
+			address, SASLPlain, config.Net.SASL.User, err,
+		)
+	}
+	if err == nil {
+		err = errors.New("no kafka broker configured")
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package kafka
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSASL(t *testing.T) {
+	sasl, err := NewSASL("plain", "injector", "secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, SASL{Mechanism: SASLPlain, User: "injector", Password: "secret"}, sasl)
+	}
+	sasl, err = NewSASL("", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, SASL{}, sasl)
+	}
+	_, err = NewSASL(SASLScramSHA512, "injector", "secret")
+	assert.Error(t, err)
+	_, err = NewSASL("GSSAPI", "injector", "secret")
+	assert.Error(t, err)
+	_, err = NewSASL(SASLPlain, "", "secret")
+	assert.Error(t, err)
+	_, err = NewSASL(SASLPlain, "injector", "")
+	assert.Error(t, err)
+	_, err = NewSASL("", "injector", "secret")
+	assert.Error(t, err)
+}
+
+func TestCheckAuthentication_Rejected(t *testing.T) {
+	// the broker closes the connection of rejected credentials
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1024))
+			conn.Close()
+		}
+	}()
+	config := sarama.NewConfig()
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = "injector"
+	config.Net.SASL.Password = "wrong"
+
+	err = checkAuthentication([]string{listener.Addr().String()}, config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rejected the SASL PLAIN authentication of injector")
+	}
+}
+
+func TestCheckAuthentication_Unreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	config := sarama.NewConfig()
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = "injector"
+	config.Net.SASL.Password = "secret"
+	config.Net.DialTimeout = time.Second
+
+	err = checkAuthentication([]string{address}, config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not connect to kafka broker")
+	}
+}
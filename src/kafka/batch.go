@@ -0,0 +1,75 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// batchSignals tell a worker what to do with its partial batch: drop the messages of the revoked partitions, on
+// rebalance, and insert the others before exiting, on shutdown. Every worker has its own revoked, stop is closed
+// for all of them at once.
+type batchSignals struct {
+	revoked chan struct{}
+	stop    chan struct{}
+}
+
+func newBatchSignals(stop chan struct{}) batchSignals {
+	return batchSignals{revoked: make(chan struct{}, 1), stop: stop}
+}
+
+// revoke signals the revocation unless one is already pending.
+func (s batchSignals) revoke() {
+	select {
+	case s.revoked <- struct{}{}:
+	default:
+	}
+}
+
+// fillBatches gathers the messages in batches of up to size messages, handing each one to insert once it
+// is full or its first message waited for linger. linger 0 only hands full batches. Messages are taken at the
+// pace of the rate limiter. The messages of revoked partitions are left out of the batches. It returns when stopped, after inserting the partial batch, when the
+// context is done or when an insert fails.
+func (k *kafka) fillBatches(ctx context.Context, messages <-chan *sarama.ConsumerMessage, size int, linger time.Duration, signals batchSignals, insert func([]*sarama.ConsumerMessage) bool) {
+	batch := make([]*sarama.ConsumerMessage, 0, size)
+	// lingering is only set while the batch holds messages
+	var timer *time.Timer
+	var lingering <-chan time.Time
+	for {
+		full := false
+		select {
+		case kafkaMsg := <-messages:
+			if !k.consumer.RateLimiter.wait(ctx, messageSize(kafkaMsg)) {
+				return
+			}
+			batch = append(batch, kafkaMsg)
+			if len(batch) == 1 && linger > 0 {
+				timer = time.NewTimer(linger)
+				lingering = timer.C
+			}
+			full = len(batch) >= size
+		case <-lingering:
+			full = true
+		case <-signals.revoked:
+			batch = k.offsets.tracked(batch)
+		case <-signals.stop:
+			if batch = k.offsets.tracked(batch); len(batch) > 0 {
+				insert(batch)
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+		if full {
+			if batch = k.offsets.tracked(batch); len(batch) > 0 && !insert(batch) {
+				return
+			}
+			batch = batch[:0]
+		}
+		if len(batch) == 0 && timer != nil {
+			timer.Stop()
+			timer, lingering = nil, nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBatchingKafka() *kafka {
+	return &kafka{
+		consumerChs: newConsumerChannels(DispatchShared, 1, 10),
+		offsets:     newOffsetTracker(),
+		drained:     make(chan struct{}, 1),
+	}
+}
+
+// consume hands messages of partition t/0 to the workers, like the consumer loop does.
+func consume(k *kafka, offsets ...int64) {
+	for _, offset := range offsets {
+		msg := &sarama.ConsumerMessage{Topic: "t", Partition: 0, Offset: offset}
+		k.offsets.consumed(msg)
+		k.consumerChs[0] <- msg
+	}
+}
+
+// batchRecorder runs fillBatches, sending the batches it inserts on a channel.
+func batchRecorder(k *kafka, size int, linger time.Duration, signals batchSignals) (<-chan []int64, <-chan struct{}) {
+	batches := make(chan []int64, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.fillBatches(context.Background(), k.messagesOf(0), size, linger, signals, func(batch []*sarama.ConsumerMessage) bool {
+			var offsets []int64
+			for _, msg := range batch {
+				offsets = append(offsets, msg.Offset)
+			}
+			batches <- offsets
+			return true
+		})
+	}()
+	return batches, done
+}
+
+func TestKafka_FillBatches(t *testing.T) {
+	k := newBatchingKafka()
+	stop := make(chan struct{})
+	batches, done := batchRecorder(k, 2, 50*time.Millisecond, newBatchSignals(stop))
+
+	// full batches are inserted right away
+	consume(k, 1, 2)
+	assert.Equal(t, []int64{1, 2}, <-batches)
+
+	// partial batches once their first message waited for the linger
+	begin := time.Now()
+	consume(k, 3)
+	assert.Equal(t, []int64{3}, <-batches)
+	assert.True(t, time.Since(begin) >= 50*time.Millisecond)
+
+	// and before stopping
+	consume(k, 4)
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	assert.Equal(t, []int64{4}, <-batches)
+	<-done
+}
+
+func TestKafka_FillBatches_WithoutLinger(t *testing.T) {
+	k := newBatchingKafka()
+	stop := make(chan struct{})
+	batches, done := batchRecorder(k, 2, 0, newBatchSignals(stop))
+
+	consume(k, 1)
+	select {
+	case batch := <-batches:
+		t.Fatalf("partial batch %v inserted without linger", batch)
+	case <-time.After(50 * time.Millisecond):
+	}
+	consume(k, 2)
+	assert.Equal(t, []int64{1, 2}, <-batches)
+	close(stop)
+	<-done
+	assert.Empty(t, batches)
+}
+
+func TestKafka_FillBatches_Revoked(t *testing.T) {
+	k := newBatchingKafka()
+	stop := make(chan struct{})
+	signals := newBatchSignals(stop)
+	batches, done := batchRecorder(k, 3, time.Hour, signals)
+
+	// the partial batch of a revoked partition is dropped, without waiting for the linger
+	consume(k, 1, 2)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 2, k.revokePartitions([]batchSignals{signals}))
+	time.Sleep(10 * time.Millisecond)
+
+	// consumed again from the committed offset once assigned again
+	consume(k, 1, 2, 3)
+	assert.Equal(t, []int64{1, 2, 3}, <-batches)
+	close(stop)
+	<-done
+	assert.Empty(t, batches)
+}
+
+func TestKafka_FillBatches_RevokedDuringInsert(t *testing.T) {
+	k := newBatchingKafka()
+	stop := make(chan struct{})
+	signals := newBatchSignals(stop)
+	inserting := make(chan []*sarama.ConsumerMessage)
+	release := make(chan struct{})
+	marks := make(chan []topicPartitionOffset, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.fillBatches(context.Background(), k.messagesOf(0), 2, 0, signals, func(batch []*sarama.ConsumerMessage) bool {
+			inserting <- batch
+			<-release
+			marks <- k.offsets.inserted(batch)
+			return true
+		})
+	}()
+
+	consume(k, 10, 11)
+	<-inserting
+	// buffered behind the insert in flight when the partition is revoked
+	consume(k, 12)
+	assert.Equal(t, 3, k.revokePartitions([]batchSignals{signals}))
+	assert.Empty(t, k.consumerChs[0])
+	assert.Equal(t, 0, k.offsets.inFlight())
+
+	// the insert in flight finishes, but its offsets are not marked, the next owner consumes them again
+	release <- struct{}{}
+	assert.Empty(t, <-marks)
+
+	consume(k, 10, 11)
+	batch := <-inserting
+	assert.Len(t, batch, 2)
+	release <- struct{}{}
+	assert.Equal(t, []topicPartitionOffset{{"t", 0, 11}}, <-marks)
+	close(stop)
+	<-done
+}
+
+func TestNewKafka_BatchLinger(t *testing.T) {
+	k := NewKafka("localhost:9092", Consumer{BatchLinger: time.Second}, nil)
+	assert.Equal(t, time.Second+k.config.Consumer.MaxProcessingTime, k.config.Group.Offsets.Synchronization.DwellTime)
+	assert.NoError(t, k.config.Validate())
+
+	k = NewKafka("localhost:9092", Consumer{BatchLinger: time.Hour}, nil)
+	assert.Equal(t, maxDwellTime, k.config.Group.Offsets.Synchronization.DwellTime)
+}
@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// How the values of avro bytes and fixed fields are written to the documents.
+const (
+	AvroBinaryBase64 = "base64"
+	AvroBinaryHex    = "hex"
+	// AvroBinaryDrop leaves the binary fields out of the documents
+	AvroBinaryDrop = "drop"
+)
+
+// ParseBinaryFields parses a comma separated list of field:format pairs, the fields given by their path.
+func ParseBinaryFields(value string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		idx := strings.LastIndex(pair, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("%q should be a field:format pair", pair)
+		}
+		field, format := pair[:idx], pair[idx+1:]
+		if err := validateBinaryFormat(format); err != nil {
+			return nil, fmt.Errorf("field %s: %s", field, err)
+		}
+		fields[field] = format
+	}
+	return fields, nil
+}
+
+func validateBinaryFormat(format string) error {
+	switch format {
+	case AvroBinaryBase64, AvroBinaryHex, AvroBinaryDrop:
+		return nil
+	}
+	return fmt.Errorf("binary format %q should be %s, %s or %s", format, AvroBinaryBase64, AvroBinaryHex, AvroBinaryDrop)
+}
+
+// encodeBinary encodes the bytes nested in the value of the field at path, as goavro decodes bytes and fixed
+// fields, to strings, returning false when the value is dropped. The items of arrays share the path of their
+// array. Decimals and uuids are already decoded by then, they are left alone.
+func (d *Decoder) encodeBinary(path string, value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case []byte:
+		format, ok := d.BinaryFields[path]
+		if !ok {
+			format = d.BinaryFormat
+		}
+		switch format {
+		case AvroBinaryDrop:
+			return nil, false
+		case AvroBinaryHex:
+			return hex.EncodeToString(v), true
+		default:
+			return base64.StdEncoding.EncodeToString(v), true
+		}
+	case map[string]interface{}:
+		for key, field := range v {
+			if encoded, ok := d.encodeBinary(path+"."+key, field); ok {
+				v[key] = encoded
+			} else {
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		items := v[:0]
+		for _, item := range v {
+			if encoded, ok := d.encodeBinary(path, item); ok {
+				items = append(items, encoded)
+			}
+		}
+		return items, true
+	}
+	return value, true
+}
@@ -0,0 +1,104 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBinaryMessage(t *testing.T) (*sarama.ConsumerMessage, *schema_registry.SchemaRegistry, func()) {
+	event := &fixtures.BinaryRecord{
+		Id: "event-1",
+		// not valid UTF-8
+		Payload:     []byte{0xff, 0xfe, 0x00, 0xc3, 0x28, 'a'},
+		Checksum:    []byte{0xde, 0xad, 0xbe, 0xef},
+		Thumbnail:   []byte{0x89, 'P', 'N', 'G'},
+		Attachments: [][]byte{{0xe2, 0x82}, {0x80}},
+		Signatures:  map[string][]byte{"primary": {0xf0, 0x9f}},
+	}
+	schema, err := json.Marshal(map[string]string{"schema": event.Schema()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(schema)
+	}))
+	registry, err := schema_registry.NewSchemaRegistry(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := event.ToAvroSerialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &sarama.ConsumerMessage{Topic: "test", Value: append([]byte{0, 0, 0, 0, 1}, value...)}
+	return msg, registry, server.Close
+}
+
+func TestDecoder_BinaryBase64(t *testing.T) {
+	msg, registry, closeRegistry := newBinaryMessage(t)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}
+
+	record, err := d.AvroMessageToRecord(context.Background(), msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "//4Awyhh", record.Json["payload"])
+	assert.Equal(t, "3q2+7w==", record.Json["checksum"])
+	assert.Equal(t, "iVBORw==", record.Json["thumbnail"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"content": "4oI="}, map[string]interface{}{"content": "gA=="}}, record.Json["attachments"])
+	assert.Equal(t, map[string]interface{}{"primary": "8J8="}, record.Json["signatures"])
+
+	// the column settings read the encoded form
+	checksum, err := record.GetValueForField("checksum")
+	assert.NoError(t, err)
+	assert.Equal(t, "3q2+7w==", checksum)
+	document, err := json.Marshal(record.FilteredFieldsJSON(nil))
+	assert.NoError(t, err)
+	assert.Contains(t, string(document), `"payload":"//4Awyhh"`)
+}
+
+func TestDecoder_BinaryFields(t *testing.T) {
+	msg, registry, closeRegistry := newBinaryMessage(t)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}, BinaryFormat: AvroBinaryHex, BinaryFields: map[string]string{
+		"payload":             AvroBinaryDrop,
+		"signatures.primary":  AvroBinaryBase64,
+		"attachments.content": AvroBinaryDrop,
+	}}
+
+	record, err := d.AvroMessageToRecord(context.Background(), msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, record.Json, "payload")
+	assert.Equal(t, "deadbeef", record.Json["checksum"])
+	assert.Equal(t, "89504e47", record.Json["thumbnail"])
+	assert.Equal(t, []interface{}{map[string]interface{}{}, map[string]interface{}{}}, record.Json["attachments"])
+	assert.Equal(t, map[string]interface{}{"primary": "8J8="}, record.Json["signatures"])
+	assert.Equal(t, "event-1", record.Json["id"])
+}
+
+func TestParseBinaryFields(t *testing.T) {
+	fields, err := ParseBinaryFields("checksum:hex, attachments.content:drop")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"checksum": AvroBinaryHex, "attachments.content": AvroBinaryDrop}, fields)
+
+	fields, err = ParseBinaryFields("")
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+
+	_, err = ParseBinaryFields("checksum")
+	assert.EqualError(t, err, `"checksum" should be a field:format pair`)
+	_, err = ParseBinaryFields("checksum:utf8")
+	assert.EqualError(t, err, `field checksum: binary format "utf8" should be base64, hex or drop`)
+}
@@ -1,5 +1,12 @@
 package kafka
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
 const (
 	ConsumerType = "consumer"
 )
@@ -7,10 +14,80 @@ const (
 type Config struct {
 	Type                  string
 	Topics                []string
+	TopicsPattern         string
+	MetadataRefresh       string
+	SASLMechanism         string
+	SASLUsername          string
+	SASLPassword          string
+	TLS                   string
+	TLSCACertPath         string
+	TLSClientCertPath     string
+	TLSClientKeyPath      string
+	TLSInsecure           string
+	StartOffset           string
+	ForceSeek             string
+	ReplayStart           string
+	ReplayEnd             string
+	ReplayRate            string
+	MaxInFlight           string
+	ResumeInFlight        string
+	Version               string
 	ConsumerGroup         string
 	Concurrency           string
+	Dispatch              string
 	BatchSize             string
+	BatchLinger           string
+	ShutdownTimeout       string
+	HealthCheckInterval   string
+	LivenessTimeout       string
+	StallTimeout          string
 	MetricsUpdateInterval string
 	BufferSize            string
+	MaxRecordsPerSecond   string
+	MaxBytesPerSecond     string
 	RecordType            string
+	AvroTimestampFormat   string
+	AvroDecimalFormat     string
+	AvroOmitNulls         string
+	AvroBinaryFormat      string
+	AvroBinaryFields      string
+	JSONSchemaValidate    string
+	ReaderSchemas         string
+	ReaderSchemasPath     string
+	ReaderSchemaRefresh   string
+	DecodeErrorPolicy     string
+	DeadLetterTopic       string
+	DeadLetterBrokers     string
+	DeleteTombstones      string
+	Filter                string
+	DryRun                string
+	DryRunCommit          string
+}
+
+// ParseTopics splits a comma separated list of topics, ignoring blanks and repeated topics.
+func ParseTopics(value string) []string {
+	var topics []string
+	seen := make(map[string]bool)
+	for _, topic := range strings.Split(value, ",") {
+		topic = strings.TrimSpace(topic)
+		if topic == "" || seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// ParseVersion parses the kafka version the brokers are spoken to with, like "1.0.0", the oldest supported one
+// when empty.
+func ParseVersion(value string) (sarama.KafkaVersion, error) {
+	if value == "" {
+		return sarama.V0_10_0_0, nil
+	}
+	version, err := sarama.ParseKafkaVersion(value)
+	if err != nil {
+		return sarama.KafkaVersion{}, fmt.Errorf("invalid KAFKA_VERSION: %s", err)
+	}
+	return version, nil
 }
@@ -2,7 +2,14 @@ package kafka
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 
 	"time"
 
@@ -13,22 +20,42 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
 )
 
 type Notification int32
 
+// maxDwellTime is the longest the consumer is allowed to wait for messages to be processed on rebalance
+const maxDwellTime = 10 * time.Minute
+
 const (
 	Ready Notification = iota
 	Inserted
+	// ShuttingDown is sent once a signal is received, before the workers are stopped
+	ShuttingDown
 )
 
 type kafka struct {
 	consumer         Consumer
-	consumerCh       chan *sarama.ConsumerMessage
 	offsetCh         chan *topicPartitionOffset
+	offsets          *offsetTracker
 	config           *cluster.Config
 	brokers          []string
 	metricsPublisher metrics.MetricsPublisher
+	// drained is signaled when inserted records are marked, for paused consumption to check whether to resume
+	drained chan struct{}
+	// failed receives the error that stops consumption, like a message failing to decode with DecodeErrorFail
+	failed chan error
+	// consumerChs buffer the consumed messages for the workers, a single one unless they are dispatched by
+	// partition or key, each worker then having its own
+	consumerChs []chan *sarama.ConsumerMessage
+	// deadLetters produces the messages that fail to decode with DecodeErrorDeadLetterTopic
+	deadLetters sarama.SyncProducer
+	health      *Health
+	stalls      *stallDetector
+	assignment  *assignment
+	// filter holds the filter set while running, Consumer.Filter until then
+	filter *atomic.Value
 }
 
 type Consumer struct {
@@ -41,8 +68,64 @@ type Consumer struct {
 	BatchSize             int
 	MetricsUpdateInterval time.Duration
 	BufferSize            int
+	// TopicsPattern subscribes to the topics matching it on top of Topics, the topics created later included
+	TopicsPattern   *regexp.Regexp
+	MetadataRefresh time.Duration
+	SASL            SASL
+	// TLS is the config the brokers are reached with, nil for plaintext
+	TLS         *tls.Config
+	StartOffset StartOffset
+	// MaxInFlight is the number of records consumed and not inserted yet that pauses consumption until they
+	// drain to ResumeInFlight, 0 to never pause
+	MaxInFlight    int
+	ResumeInFlight int
+	// BatchLinger is how long the first message of a batch waits for the batch to fill before it is inserted
+	// anyway, 0 to only insert full batches
+	BatchLinger time.Duration
+	// ShutdownTimeout is how long the inserts in flight are waited for on shutdown before being cancelled, 0 to
+	// wait for a second signal
+	ShutdownTimeout time.Duration
+	// Version is the protocol version spoken to the brokers, 0.10.0 unless higher. Headers need 0.11.
+	Version sarama.KafkaVersion
+	// DecodeErrorPolicy is one of DecodeErrorSkip, DecodeErrorFail, DecodeErrorDeadLetter or
+	// DecodeErrorDeadLetterTopic
+	DecodeErrorPolicy string
+	// Dispatch is one of DispatchShared, DispatchPartition or DispatchKey
+	Dispatch string
+	// Replay is the range of records consumed once by Replay, nil unless replaying
+	Replay *Replay
+	// DeadLetterTopic receives the messages that fail to decode with DecodeErrorDeadLetterTopic
+	DeadLetterTopic string
+	// DeadLetterBrokers are the brokers of DeadLetterTopic, the consumer's when empty
+	DeadLetterBrokers []string
+	// Filter selects the records to insert, nil to insert all of them
+	Filter *models.Filter
+	// NoCommit leaves the offsets of the inserted records uncommitted, like for dry runs
+	NoCommit bool
+	// RateLimiter paces the messages the workers batch, nil for no limit
+	RateLimiter *RateLimiter
+	// Tracer traces the batches from their consumption to their insert, nil to disable tracing
+	Tracer *tracing.Tracer
+	// HealthCheckInterval is how often the brokers are polled for the health checks, DefaultHealthCheckInterval
+	// when 0
+	HealthCheckInterval time.Duration
+	// LivenessTimeout is how long the consumer stays alive without a successful poll, DefaultLivenessTimeout when 0
+	LivenessTimeout time.Duration
+	// StallTimeout is how long a partition with lag goes without advancing before it is stalled, 0 to never stall
+	StallTimeout time.Duration
+}
+
+// offsetMarker marks the offsets of the inserted records, the consumer group does when consuming and the
+// progress of the replay when replaying.
+type offsetMarker interface {
+	MarkPartitionOffset(topic string, partition int32, offset int64, metadata string)
 }
 
+// noopMarker marks no offset.
+type noopMarker struct{}
+
+func (noopMarker) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {}
+
 type topicPartitionOffset struct {
 	topic     string
 	partition int32
@@ -56,29 +139,123 @@ func NewKafka(address string, consumer Consumer, metrics metrics.MetricsPublishe
 	config.Group.Return.Notifications = true
 
 	config.Version = sarama.V0_10_0_0
+	if consumer.Version.IsAtLeast(config.Version) {
+		config.Version = consumer.Version
+	}
+	if consumer.TopicsPattern != nil {
+		// new topics are looked for at half the metadata refresh interval, which needs the metadata of all topics
+		config.Group.Topics.Whitelist = consumer.TopicsPattern
+		config.Metadata.Full = true
+	}
+	if consumer.StartOffset.Time != sarama.OffsetNewest {
+		// partitions of topics created after seeking are consumed from their beginning
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	replayByTimestamp := consumer.Replay != nil && (consumer.Replay.Start.byTimestamp() || consumer.Replay.End.byTimestamp())
+	if (consumer.StartOffset.Time >= 0 || replayByTimestamp) && !config.Version.IsAtLeast(sarama.V0_10_1_0) {
+		// looking offsets up by timestamp needs kafka 0.10.1
+		config.Version = sarama.V0_10_1_0
+	}
+	if consumer.SASL.Mechanism != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = consumer.SASL.User
+		config.Net.SASL.Password = consumer.SASL.Password
+	}
+	if consumer.TLS != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = consumer.TLS
+	}
+	if consumer.MetadataRefresh > 0 {
+		config.Metadata.RefreshFrequency = consumer.MetadataRefresh
+	}
+	if consumer.BatchLinger > 0 {
+		// offsets are committed at the end of the dwell time when partitions are released, by then the partial
+		// batches of the released partitions are inserted
+		dwell := config.Group.Offsets.Synchronization.DwellTime + consumer.BatchLinger
+		if dwell > maxDwellTime {
+			dwell = maxDwellTime
+		}
+		config.Group.Offsets.Synchronization.DwellTime = dwell
+	}
+
+	if consumer.HealthCheckInterval <= 0 {
+		consumer.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	if consumer.LivenessTimeout <= 0 {
+		consumer.LivenessTimeout = DefaultLivenessTimeout
+	}
 
+	filter := &atomic.Value{}
+	filter.Store(consumer.Filter)
 	return kafka{
+		health:           NewHealth(consumer.LivenessTimeout),
+		stalls:           newStallDetector(consumer.StallTimeout),
+		assignment:       &assignment{},
+		filter:           filter,
 		brokers:          brokers,
 		config:           config,
 		consumer:         consumer,
 		metricsPublisher: metrics,
-		consumerCh:       make(chan *sarama.ConsumerMessage, consumer.BufferSize),
+		consumerChs:      newConsumerChannels(consumer.Dispatch, consumer.Concurrency, consumer.BufferSize),
 		offsetCh:         make(chan *topicPartitionOffset),
+		offsets:          newOffsetTracker(),
+		drained:          make(chan struct{}, 1),
+		failed:           make(chan error, 1),
 	}
 }
 
+// Health is the health of the consumer started by Start.
+func (k *kafka) Health() *Health {
+	return k.health
+}
+
 func (k *kafka) Start(signals chan os.Signal, notifications chan<- Notification) {
 	topics := k.consumer.Topics
 	concurrency := k.consumer.Concurrency
-	consumer, err := cluster.NewConsumer(k.brokers, k.consumer.Group, topics, k.config)
+	if k.config.Net.SASL.Enable {
+		if err := checkAuthentication(k.brokers, &k.config.Config); err != nil {
+			level.Error(k.consumer.Logger).Log("message", "could not authenticate to kafka", "err", err)
+			panic(err)
+		}
+	}
+	if k.consumer.StartOffset.needsSeek() {
+		if err := k.seek(); err != nil {
+			level.Error(k.consumer.Logger).Log("message", "could not seek to the start offset", "err", err)
+			panic(err)
+		}
+	}
+	if err := k.openDeadLetterTopic(); err != nil {
+		level.Error(k.consumer.Logger).Log("message", "could not connect to the dead letter topic", "err", err)
+		panic(err)
+	}
+	defer k.closeDeadLetterTopic()
+	// the client is kept to poll the brokers for the health checks
+	client, err := cluster.NewClient(k.brokers, k.config)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+	consumer, err := cluster.NewConsumerFromClient(client, k.consumer.Group, topics)
 	if err != nil {
 		panic(err)
 	}
 	defer consumer.Close()
+	// cancelled on shutdown, before the consumer is closed, aborting the inserts in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	buffSize := k.consumer.BatchSize
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	var workerSignals []batchSignals
 	for i := 0; i < concurrency; i++ {
-		go k.worker(consumer, buffSize, notifications)
+		signals := newBatchSignals(stop)
+		workerSignals = append(workerSignals, signals)
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			k.worker(ctx, consumer, k.messagesOf(worker), buffSize, signals, notifications)
+		}(i)
 	}
 	go func() {
 		for {
@@ -89,31 +266,65 @@ func (k *kafka) Start(signals chan os.Signal, notifications chan<- Notification)
 
 	go func() {
 		for range time.Tick(k.consumer.MetricsUpdateInterval) {
-			k.metricsPublisher.PublishOffsetMetrics(consumer.HighWaterMarks())
+			highWaterMarks := assignedHighWaterMarks(consumer.HighWaterMarks(), consumer.Subscriptions())
+			k.metricsPublisher.PublishOffsetMetrics(highWaterMarks)
+			committed := k.offsets.committed()
+			k.metricsPublisher.PublishLag(highWaterMarks, committed)
+			k.publishStalls(highWaterMarks, committed)
+			k.metricsPublisher.PublishEndToEndLatencyMax()
 		}
 	}()
 
+	flow := &flowControl{max: k.consumer.MaxInFlight, resume: k.consumer.ResumeInFlight}
+	messages := consumer.Messages()
+	healthTicker := time.NewTicker(k.consumer.HealthCheckInterval)
+	defer healthTicker.Stop()
 	// consume messages, watch errors and notifications
 	for {
 		select {
-		case msg, more := <-consumer.Messages():
+		case <-healthTicker.C:
+			// polled from the consume loop, so that the consumer is no longer alive once the loop is stuck
+			k.health.poll(func() error {
+				return client.RefreshCoordinator(k.consumer.Group)
+			})
+		case <-k.drained:
+			if flow.update(k.offsets.inFlight()) {
+				level.Info(k.consumer.Logger).Log("message", "consumption resumed", "in_flight", k.offsets.inFlight())
+				k.metricsPublisher.ConsumptionPaused(false)
+				messages = consumer.Messages()
+			}
+		case msg, more := <-messages:
 			if more {
-				if len(k.consumerCh) >= cap(k.consumerCh) {
+				workerCh := k.workerChannel(msg)
+				if len(workerCh) >= cap(workerCh) {
 					level.Warn(k.consumer.Logger).Log(
 						"message", "Buffer is full ",
-						"channelSize", cap(k.consumerCh),
+						"channelSize", cap(workerCh),
 					)
 					k.metricsPublisher.BufferFull(true)
 				}
-				k.consumerCh <- msg
+				k.offsets.consumed(msg)
+				workerCh <- msg
 				k.metricsPublisher.BufferFull(false)
+				if flow.update(k.offsets.inFlight()) {
+					level.Warn(k.consumer.Logger).Log("message", "consumption paused, too many records not inserted yet", "in_flight", k.offsets.inFlight())
+					k.metricsPublisher.ConsumptionPaused(true)
+					messages = nil
+				}
 			}
+		case err := <-k.failed:
+			level.Error(k.consumer.Logger).Log("message", "stopping consumption", "err", err)
+			panic(err)
 		case err, more := <-consumer.Errors():
 			if more {
 				level.Error(k.consumer.Logger).Log(
 					"message", "Failed to consume message",
 					"err", err.Error(),
 				)
+				if groupErr, ok := err.(*cluster.Error); ok && (groupErr.Ctx == "heartbeat" || groupErr.Ctx == "rebalance") {
+					// fenced from the group until it rebalances again
+					k.health.leftGroup()
+				}
 			}
 		case ntf, more := <-consumer.Notifications():
 			if more {
@@ -121,51 +332,412 @@ func (k *kafka) Start(signals chan os.Signal, notifications chan<- Notification)
 					"message", "Partitions rebalanced",
 					"notification", ntf,
 				)
+				if ntf.Type == cluster.RebalanceStart {
+					k.assignment.set(nil)
+					revoked := k.revokePartitions(workerSignals)
+					level.Info(k.consumer.Logger).Log("message", "partitions released, dropping the records not inserted yet", "dropped", revoked)
+				}
+				if ntf.Type == cluster.RebalanceError {
+					k.health.leftGroup()
+				}
 				if ntf.Type == cluster.RebalanceOK {
+					k.health.joinedGroup()
+					k.assignment.set(ntf.Current)
+					k.stalls.reset()
+					k.metricsPublisher.ResetPartitions(ntf.Current)
 					notifications <- Ready
 				}
 			}
 		case <-signals:
+			// no more messages are consumed, the workers insert their partial batches and stop before the
+			// consumer is closed, committing the offsets of the inserted records and leaving the group
+			level.Info(k.consumer.Logger).Log("message", "shutting down, waiting for the inserts in flight", "timeout", k.consumer.ShutdownTimeout)
+			notifications <- ShuttingDown
+			close(stop)
+			k.awaitWorkers(&workers, signals, cancel)
 			return
 		}
 	}
 }
 
-func (k *kafka) worker(consumer *cluster.Consumer, buffSize int, notifications chan<- Notification) {
-	buf := make([]*sarama.ConsumerMessage, buffSize)
-	var decoded []*models.Record
-	idx := 0
-	for {
-		kafkaMsg := <-k.consumerCh
-		buf[idx] = kafkaMsg
-		idx++
-		for idx == buffSize {
-			if decoded == nil {
-				for _, msg := range buf {
-					req, err := k.consumer.Decoder(nil, msg)
-					if err != nil {
-						level.Error(k.consumer.Logger).Log(
-							"message", "Error decoding message",
-							"err", err.Error(),
-						)
-						continue
-					}
-					decoded = append(decoded, req)
-				}
+// publishStalls exports the progress of the assigned partitions, warning about the ones that just stalled.
+func (k *kafka) publishStalls(highWaterMarks map[string]map[int32]int64, committed map[string]map[int32]int64) {
+	progress, stalled := k.stalls.update(highWaterMarks, committed, time.Now())
+	for _, partition := range stalled {
+		level.Warn(k.consumer.Logger).Log(
+			"message", "partition stalled, its committed offset is not advancing",
+			"topic", partition.topic,
+			"partition", partition.partition,
+			"offset", partition.offset,
+			"lag", partition.lag,
+			"stalled_for", partition.since,
+		)
+	}
+	k.metricsPublisher.PublishPartitionStalls(progress)
+}
+
+// revokePartitions drops the messages consumed and not inserted yet, once the partitions are released on rebalance
+// and their marked offsets committed. Inserting them would write them twice, as their partitions are consumed
+// again from the committed offsets. The inserts in flight finish, but their offsets are no longer marked. It
+// returns the number of messages dropped.
+func (k *kafka) revokePartitions(workers []batchSignals) int {
+	revoked := k.offsets.revoke()
+	for _, consumerCh := range k.consumerChs {
+		for empty := false; !empty; {
+			select {
+			case <-consumerCh:
+			default:
+				empty = true
 			}
-			if res, err := k.consumer.Endpoint(context.Background(), decoded); err != nil {
-				level.Error(k.consumer.Logger).Log("message", "error on endpoint call", "err", err.Error())
-				var _ = res // ignore res (for now)
+		}
+	}
+	for _, worker := range workers {
+		worker.revoke()
+	}
+	// consumption paused by flow control resumes, nothing is in flight anymore
+	select {
+	case k.drained <- struct{}{}:
+	default:
+	}
+	return revoked
+}
+
+// awaitWorkers waits for the workers to stop, cancelling the inserts still in flight once the shutdown timeout
+// expires or a second signal is received. It only returns once every worker stopped, so that no offset is marked
+// after the consumer is closed.
+func (k *kafka) awaitWorkers(workers *sync.WaitGroup, signals <-chan os.Signal, cancel context.CancelFunc) {
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	var timeout <-chan time.Time
+	if k.consumer.ShutdownTimeout > 0 {
+		timer := time.NewTimer(k.consumer.ShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-stopped:
+		return
+	case <-timeout:
+		level.Warn(k.consumer.Logger).Log("message", "shutdown timeout expired, cancelling the inserts in flight")
+	case <-signals:
+		level.Warn(k.consumer.Logger).Log("message", "signal received again, cancelling the inserts in flight")
+	}
+	cancel()
+	<-stopped
+}
+
+func (k *kafka) seek() error {
+	client, err := sarama.NewClient(k.brokers, &k.config.Config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return seekStartOffsets(client, k.consumer.Group, k.consumer.Topics, k.consumer.TopicsPattern, k.consumer.StartOffset, k.consumer.Logger)
+}
+
+func (k *kafka) worker(ctx context.Context, consumer *cluster.Consumer, messages <-chan *sarama.ConsumerMessage, buffSize int, signals batchSignals, notifications chan<- Notification) {
+	k.fillBatches(ctx, messages, buffSize, k.consumer.BatchLinger, signals, func(batch []*sarama.ConsumerMessage) bool {
+		if !k.insertBatch(ctx, consumer, batch) {
+			return false
+		}
+		notifications <- Inserted
+		return true
+	})
+}
+
+// insertBatch sends the batch to the endpoint until all of its records are inserted, committing their offsets.
+// When an insert fails with per record results, the offsets of each partition are committed up to its first
+// failed record and only the records from there on are sent again. It returns false if the context is done first.
+func (k *kafka) insertBatch(ctx context.Context, consumer *cluster.Consumer, batch []*sarama.ConsumerMessage) bool {
+	span := k.startBatchSpan(batch)
+	decoded, _, err := k.decodeTraced(span, batch)
+	if err != nil {
+		span.End(err)
+		// the batch is left uncommitted, so that the message is consumed again once the decoding is fixed
+		k.fail(err)
+		return false
+	}
+	var marker offsetMarker = consumer
+	if k.consumer.NoCommit {
+		// the records are consumed again from the committed offsets after a restart
+		marker = noopMarker{}
+	}
+	_, inserted := k.insertDecoded(tracing.ContextWithSpan(ctx, span), marker, batch, decoded)
+	span.End(nil)
+	return inserted
+}
+
+// maxBatchLinks is the most producer spans a batch span is linked to.
+const maxBatchLinks = 128
+
+// startBatchSpan starts the span of the batch, linked to the spans of the W3C traceparent headers of its messages.
+// It is nil when tracing is disabled.
+func (k *kafka) startBatchSpan(batch []*sarama.ConsumerMessage) *tracing.Span {
+	if k.consumer.Tracer == nil {
+		return nil
+	}
+	var links []tracing.SpanContext
+	seen := make(map[tracing.SpanContext]bool)
+	var topics []string
+	seenTopics := make(map[string]bool)
+	for _, msg := range batch {
+		if !seenTopics[msg.Topic] {
+			seenTopics[msg.Topic] = true
+			topics = append(topics, msg.Topic)
+		}
+		for _, header := range msg.Headers {
+			if string(header.Key) != "traceparent" || len(links) >= maxBatchLinks {
 				continue
 			}
-			notifications <- Inserted
-			k.metricsPublisher.IncrementRecordsConsumed(buffSize)
-			for _, msg := range buf {
-				k.offsetCh <- &topicPartitionOffset{msg.Topic, msg.Partition, msg.Offset}
-				consumer.MarkOffset(msg, "") // mark message as processed
+			if link, ok := tracing.ParseTraceparent(string(header.Value)); ok && !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+	span := k.consumer.Tracer.Start("kafka.batch", links...)
+	span.SetAttribute("messaging.system", "kafka")
+	span.SetAttribute("messaging.destination.name", strings.Join(topics, ","))
+	span.SetAttribute("messaging.batch.message_count", len(batch))
+	return span
+}
+
+// decodeTraced is decode within a child span of the batch span.
+func (k *kafka) decodeTraced(span *tracing.Span, batch []*sarama.ConsumerMessage) ([]*models.Record, int, error) {
+	decodeSpan := span.Child("decode")
+	decoded, failed, err := k.decode(batch)
+	if decodeSpan != nil {
+		decodeSpan.SetAttribute("records", len(decoded))
+		decodeSpan.SetAttribute("decode_errors", failed)
+	}
+	decodeSpan.End(err)
+	return decoded, failed, err
+}
+
+// insertDecoded sends the records decoded from the batch to the endpoint, see insertBatch. Once inserted, it
+// returns the results of the records, aligned with them, or nil when the endpoint doesn't tell them.
+func (k *kafka) insertDecoded(ctx context.Context, marker offsetMarker, batch []*sarama.ConsumerMessage, decoded []*models.Record) ([]models.RecordResult, bool) {
+	all := decoded
+	// outcomes holds the result of each record, the records sent again take the result of the last attempt
+	outcomes := make(map[*models.Record]models.RecordResult, len(decoded))
+	for {
+		res, err := k.consumer.Endpoint(ctx, decoded)
+		results, ok := res.([]models.RecordResult)
+		ok = ok && len(results) == len(decoded)
+		if ok {
+			for idx, record := range decoded {
+				outcomes[record] = results[idx]
+			}
+		}
+		if err == nil {
+			k.commit(marker, batch)
+			if !ok {
+				return nil, true
+			}
+			aligned := make([]models.RecordResult, len(all))
+			for idx, record := range all {
+				aligned[idx] = outcomes[record]
+			}
+			return aligned, true
+		}
+		if ctx.Err() != nil {
+			// the batch is left uncommitted, it is consumed again after a restart
+			level.Info(k.consumer.Logger).Log("message", "batch cancelled on shutdown", "doc_count", len(decoded))
+			return nil, false
+		}
+		level.Error(k.consumer.Logger).Log("message", "error on endpoint call", "batch_size", len(decoded), "err", err.Error())
+		if !ok {
+			continue
+		}
+		var committed []*sarama.ConsumerMessage
+		committed, batch, decoded = splitFailedTail(batch, decoded, results)
+		k.commit(marker, committed)
+	}
+}
+
+// SetFilter replaces the filter of the records from the next batch on, nil to insert all of them.
+func (k *kafka) SetFilter(filter *models.Filter) {
+	k.filter.Store(filter)
+}
+
+func (k *kafka) recordFilter() *models.Filter {
+	if k.filter == nil {
+		return k.consumer.Filter
+	}
+	return k.filter.Load().(*models.Filter)
+}
+
+// fail stops consumption with the error, unless it is already stopping.
+func (k *kafka) fail(err error) {
+	select {
+	case k.failed <- err:
+	default:
+	}
+}
+
+// decode decodes the messages of the batch, handling the ones that fail to decode according to the decode error
+// policy: they are left out, fail the batch, are passed on as records holding the error, to be dead lettered, or
+// are produced to the dead letter topic. The records left out by the filter are dropped, their offsets committed
+// with the batch. It returns the number of messages that failed to decode along with the records.
+func (k *kafka) decode(batch []*sarama.ConsumerMessage) ([]*models.Record, int, error) {
+	var decoded []*models.Record
+	var undecodable []*sarama.ConsumerMessage
+	var errs []error
+	failed := 0
+	// a single filter selects the records of the whole batch, even if it is replaced meanwhile
+	filter := k.recordFilter()
+	k.publishBatch(batch)
+	for _, msg := range batch {
+		req, err := k.consumer.Decoder(nil, msg)
+		if err != nil {
+			level.Error(k.consumer.Logger).Log(
+				"message", "Error decoding message",
+				"err", err.Error(),
+				"error_type", decodeErrorKind(err),
+				"topic", msg.Topic,
+				"partition", msg.Partition,
+				"offset", msg.Offset,
+				"policy", k.consumer.DecodeErrorPolicy,
+			)
+			k.metricsPublisher.IncrementDecodeErrors(msg.Topic, 1)
+			failed++
+			switch k.consumer.DecodeErrorPolicy {
+			case DecodeErrorFail:
+				return nil, failed, fmt.Errorf("could not decode message %s/%d/%d: %s", msg.Topic, msg.Partition, msg.Offset, err)
+			case DecodeErrorDeadLetter:
+				decoded = append(decoded, &models.Record{
+					Topic:     msg.Topic,
+					Partition: msg.Partition,
+					Offset:    msg.Offset,
+					Timestamp: msg.Timestamp,
+					Key:       msg.Key,
+					DecodeErr: err,
+					Value:     msg.Value,
+				})
+			case DecodeErrorDeadLetterTopic:
+				undecodable = append(undecodable, msg)
+				errs = append(errs, err)
 			}
-			decoded = nil
-			idx = 0
+			continue
+		}
+		k.metricsPublisher.IncrementRecordsDecoded(msg.Topic, 1)
+		if req == nil {
+			continue
+		}
+		req.Headers = k.decodeHeaders(msg)
+		// deletes are never filtered, their records only hold the fields of the key
+		if filter != nil && !req.Deleted && !filter.Match(req) {
+			k.metricsPublisher.IncrementRecordsFiltered(msg.Topic, 1)
+			continue
+		}
+		decoded = append(decoded, req)
+	}
+	if err := k.produceDeadLetters(undecodable, errs); err != nil {
+		// the batch fails, its messages are consumed again after a restart
+		return nil, failed, err
+	}
+	return decoded, failed, nil
+}
+
+// publishBatch counts the messages of a batch by topic, before they are decoded.
+func (k *kafka) publishBatch(batch []*sarama.ConsumerMessage) {
+	sizes := make(map[string]int)
+	for _, msg := range batch {
+		sizes[msg.Topic]++
+	}
+	for topic, size := range sizes {
+		k.metricsPublisher.IncrementMessagesConsumed(topic, size)
+		k.metricsPublisher.ObserveBatchSize(topic, size)
+	}
+}
+
+// decodeHeaders keeps the headers of a message with UTF-8 values, the others can't be written to a document.
+func (k *kafka) decodeHeaders(msg *sarama.ConsumerMessage) map[string]string {
+	if len(msg.Headers) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		if !utf8.Valid(header.Value) {
+			level.Warn(k.consumer.Logger).Log(
+				"message", "skipping header that is not valid UTF-8",
+				"header", string(header.Key),
+				"topic", msg.Topic,
+				"partition", msg.Partition,
+				"offset", msg.Offset,
+			)
+			k.metricsPublisher.IncrementInvalidHeaders(msg.Topic, 1)
+			continue
+		}
+		headers[string(header.Key)] = string(header.Value)
+	}
+	return headers
+}
+
+func (k *kafka) commit(marker offsetMarker, msgs []*sarama.ConsumerMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	consumed := make(map[string]int)
+	for _, msg := range msgs {
+		consumed[msg.Topic]++
+	}
+	for topic, count := range consumed {
+		k.metricsPublisher.IncrementRecordsConsumed(topic, count)
+	}
+	for _, msg := range msgs {
+		k.offsetCh <- &topicPartitionOffset{msg.Topic, msg.Partition, msg.Offset}
+	}
+	// marked offsets are committed by the consumer at its commit interval and when it is closed
+	for _, mark := range k.offsets.inserted(msgs) {
+		marker.MarkPartitionOffset(mark.topic, mark.partition, mark.offset, "")
+	}
+	select {
+	case k.drained <- struct{}{}:
+	default:
+	}
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// splitFailedTail splits a batch at the first failed record of each partition. The messages before it can be
+// committed, the ones from it on are returned with their records to be sent again, succeeded ones included, so
+// that offsets are committed in order.
+func splitFailedTail(batch []*sarama.ConsumerMessage, decoded []*models.Record, results []models.RecordResult) ([]*sarama.ConsumerMessage, []*sarama.ConsumerMessage, []*models.Record) {
+	firstFailed := make(map[topicPartition]int64)
+	for idx, result := range results {
+		if result.Succeeded {
+			continue
+		}
+		record := decoded[idx]
+		key := topicPartition{record.Topic, record.Partition}
+		if offset, ok := firstFailed[key]; !ok || record.Offset < offset {
+			firstFailed[key] = record.Offset
+		}
+	}
+	inTail := func(topic string, partition int32, offset int64) bool {
+		first, ok := firstFailed[topicPartition{topic, partition}]
+		return ok && offset >= first
+	}
+	var committed, remaining []*sarama.ConsumerMessage
+	for _, msg := range batch {
+		if inTail(msg.Topic, msg.Partition, msg.Offset) {
+			remaining = append(remaining, msg)
+		} else {
+			committed = append(committed, msg)
+		}
+	}
+	var retry []*models.Record
+	for _, record := range decoded {
+		if inTail(record.Topic, record.Partition, record.Offset) {
+			retry = append(retry, record)
 		}
 	}
+	return committed, remaining, retry
 }
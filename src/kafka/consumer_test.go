@@ -11,6 +11,11 @@ import (
 	"fmt"
 
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
 
 	"github.com/Shopify/sarama"
 	"github.com/go-kit/kit/endpoint"
@@ -20,6 +25,7 @@ import (
 	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 	"github.com/inloco/kafka-elasticsearch-injector/src/models"
 	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
 	"github.com/olivere/elastic"
 	"github.com/stretchr/testify/assert"
 )
@@ -29,12 +35,12 @@ type fixtureService struct {
 	codec elasticsearch.Codec
 }
 
-func (s fixtureService) Insert(records []*models.Record) error {
+func (s fixtureService) Insert(ctx context.Context, records []*models.Record) error {
 	elasticRecords, err := s.codec.EncodeElasticRecords(records)
 	if err != nil {
 		return err
 	}
-	_, err = s.db.Insert(elasticRecords)
+	_, err = s.db.Insert(ctx, elasticRecords)
 	return err
 }
 
@@ -53,18 +59,18 @@ func (be *fixtureEndpoints) Insert() endpoint.Endpoint {
 var (
 	logger = logger_builder.NewLogger("consumer-test")
 	config = elasticsearch.Config{
-		Host:        "http://localhost:9200",
+		Hosts:       []string{"http://localhost:9200"},
 		Index:       fixtures.DefaultTopic,
 		BulkTimeout: 10 * time.Second,
 	}
-	db        = elasticsearch.NewDatabase(logger, config)
+	db        elasticsearch.RecordDatabase
 	codec     = elasticsearch.NewCodec(logger, config)
-	service   = fixtureService{db, codec}
+	service   fixtureService
 	endpoints = &fixtureEndpoints{
 		func(ctx context.Context, request interface{}) (response interface{}, err error) {
 			records := request.([]*models.Record)
 
-			return nil, service.Insert(records)
+			return nil, service.Insert(ctx, records)
 		},
 	}
 	schemaRegistry *schema_registry.SchemaRegistry
@@ -96,6 +102,16 @@ func TestMain(m *testing.M) {
 }
 
 func TestKafka_Start(t *testing.T) {
+	var err error
+	db, err = elasticsearch.NewDatabase(logger, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service = fixtureService{db, codec}
+	esClient, err := db.GetClient()
+	if err != nil {
+		t.Fatal(err)
+	}
 	signals := make(chan os.Signal, 1)
 	notifications := make(chan Notification, 1)
 	go k.Start(signals, notifications)
@@ -121,9 +137,9 @@ func TestKafka_Start(t *testing.T) {
 	<-notifications
 	esIndex := fmt.Sprintf("%s-%s", msg.Topic, time.Now().Format("2006-01-02"))
 	esId := fmt.Sprintf("%d:%d", msg.Partition, msg.Offset)
-	_, err = db.GetClient().Refresh(esIndex).Do(context.Background())
+	_, err = esClient.Refresh(esIndex).Do(context.Background())
 	if assert.NoError(t, err) {
-		res, err := db.GetClient().Get().Index(esIndex).
+		res, err := esClient.Get().Index(esIndex).
 			Type(msg.Topic).Id(esId).Do(context.Background())
 		var r fixtures.FixtureRecord
 		if assert.NoError(t, err) {
@@ -136,6 +152,215 @@ func TestKafka_Start(t *testing.T) {
 		}
 		signals <- os.Interrupt
 	}
-	db.GetClient().DeleteByQuery(esIndex).Query(elastic.MatchAllQuery{}).Do(context.Background())
+	esClient.DeleteByQuery(esIndex).Query(elastic.MatchAllQuery{}).Do(context.Background())
 	db.CloseClient()
 }
+
+func TestSplitFailedTail(t *testing.T) {
+	var batch []*sarama.ConsumerMessage
+	var decoded []*models.Record
+	for _, msg := range []struct {
+		partition int32
+		offset    int64
+	}{{0, 10}, {1, 20}, {0, 11}, {1, 21}, {0, 12}, {1, 22}} {
+		batch = append(batch, &sarama.ConsumerMessage{Topic: "t", Partition: msg.partition, Offset: msg.offset})
+		decoded = append(decoded, &models.Record{Topic: "t", Partition: msg.partition, Offset: msg.offset})
+	}
+	// the record at offset 11 of partition 0 failed in the middle of the batch
+	results := []models.RecordResult{{Succeeded: true}, {Succeeded: true}, {Err: errors.New("failed")}, {Succeeded: true}, {Succeeded: true}, {Succeeded: true}}
+
+	committed, remaining, retry := splitFailedTail(batch, decoded, results)
+	assert.Equal(t, []*sarama.ConsumerMessage{batch[0], batch[1], batch[3], batch[5]}, committed)
+	assert.Equal(t, []*sarama.ConsumerMessage{batch[2], batch[4]}, remaining)
+	assert.Equal(t, []*models.Record{decoded[2], decoded[4]}, retry)
+}
+
+func TestSplitFailedTail_Topics(t *testing.T) {
+	var batch []*sarama.ConsumerMessage
+	var decoded []*models.Record
+	for _, msg := range []struct {
+		topic  string
+		offset int64
+	}{{"clicks", 10}, {"views", 10}, {"clicks", 11}, {"views", 11}} {
+		batch = append(batch, &sarama.ConsumerMessage{Topic: msg.topic, Partition: 0, Offset: msg.offset})
+		decoded = append(decoded, &models.Record{Topic: msg.topic, Partition: 0, Offset: msg.offset})
+	}
+	// partition 0 of views failed, partition 0 of clicks is committed anyway
+	results := []models.RecordResult{{Succeeded: true}, {Err: errors.New("failed")}, {Succeeded: true}, {Succeeded: true}}
+
+	committed, remaining, retry := splitFailedTail(batch, decoded, results)
+	assert.Equal(t, []*sarama.ConsumerMessage{batch[0], batch[2]}, committed)
+	assert.Equal(t, []*sarama.ConsumerMessage{batch[1], batch[3]}, remaining)
+	assert.Equal(t, []*models.Record{decoded[1], decoded[3]}, retry)
+}
+
+func TestParseTopics(t *testing.T) {
+	assert.Equal(t, []string{"clicks", "views"}, ParseTopics(" clicks, views,,clicks "))
+	assert.Empty(t, ParseTopics(""))
+}
+
+func TestNewKafka_TopicsPattern(t *testing.T) {
+	pattern := regexp.MustCompile(`^(?:events\.tenant-.*)$`)
+	k := NewKafka("localhost:9092", Consumer{TopicsPattern: pattern, MetadataRefresh: time.Minute}, nil)
+	assert.Equal(t, pattern, k.config.Group.Topics.Whitelist)
+	assert.True(t, k.config.Metadata.Full)
+	assert.Equal(t, time.Minute, k.config.Metadata.RefreshFrequency)
+	assert.NoError(t, k.config.Validate())
+}
+
+func TestKafka_DecodeHeaders(t *testing.T) {
+	headers := k.decodeHeaders(&sarama.ConsumerMessage{
+		Topic: "test",
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("traceparent"), Value: []byte("00-abc-01")},
+			{Key: []byte("binary"), Value: []byte{0xff, 0xfe}},
+			{Key: []byte("empty"), Value: nil},
+		},
+	})
+	assert.Equal(t, map[string]string{"traceparent": "00-abc-01", "empty": ""}, headers)
+	assert.Nil(t, k.decodeHeaders(&sarama.ConsumerMessage{Topic: "test"}))
+}
+
+func TestKafka_StartBatchSpan(t *testing.T) {
+	exported := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		exported <- request
+	}))
+	defer collector.Close()
+	tracer := tracing.NewTracer(tracing.Config{Endpoint: collector.URL, Timeout: time.Second, FlushInterval: time.Hour})
+	traced := kafka{consumer: Consumer{Tracer: tracer}}
+	traceparent := func(value string) []*sarama.RecordHeader {
+		return []*sarama.RecordHeader{{Key: []byte("traceparent"), Value: []byte(value)}}
+	}
+
+	assert.Nil(t, k.startBatchSpan([]*sarama.ConsumerMessage{{Topic: "test"}}))
+	span := traced.startBatchSpan([]*sarama.ConsumerMessage{
+		{Topic: "clicks", Headers: traceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+		{Topic: "clicks", Headers: traceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+		{Topic: "views", Headers: traceparent("00-abc-01")},
+		{Topic: "views"},
+	})
+	span.End(nil)
+	tracer.Close()
+
+	request := <-exported
+	encoded, _ := json.Marshal(request["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0])
+	var batchSpan struct {
+		Name  string
+		Links []struct{ TraceID, SpanID string }
+	}
+	json.Unmarshal(encoded, &batchSpan)
+	assert.Equal(t, "kafka.batch", batchSpan.Name)
+	if assert.Len(t, batchSpan.Links, 1) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", batchSpan.Links[0].TraceID)
+		assert.Equal(t, "00f067aa0ba902b7", batchSpan.Links[0].SpanID)
+	}
+	assert.Contains(t, string(encoded), `"stringValue":"clicks,views"`)
+}
+
+func TestKafka_Decode_ErrorPolicy(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "test", Offset: 1, Value: []byte(`{"id":"alo"}`)},
+		{Topic: "test", Offset: 2, Value: []byte(`not json`)},
+	}
+	for _, policy := range []string{DecodeErrorSkip, DecodeErrorFail, DecodeErrorDeadLetter} {
+		decoder := kafka{
+			consumer:         Consumer{Decoder: d.DeserializerFor("json"), Logger: logger, DecodeErrorPolicy: policy},
+			metricsPublisher: k.metricsPublisher,
+		}
+		decoded, _, err := decoder.decode(batch)
+		switch policy {
+		case DecodeErrorSkip:
+			assert.NoError(t, err)
+			assert.Len(t, decoded, 1)
+		case DecodeErrorFail:
+			assert.Error(t, err)
+			assert.Nil(t, decoded)
+		case DecodeErrorDeadLetter:
+			if assert.NoError(t, err) && assert.Len(t, decoded, 2) {
+				assert.Nil(t, decoded[0].DecodeErr)
+				assert.Error(t, decoded[1].DecodeErr)
+				assert.Equal(t, int64(2), decoded[1].Offset)
+				assert.Equal(t, []byte(`not json`), decoded[1].Value)
+			}
+		}
+	}
+}
+
+func TestKafka_AwaitWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		// an insert in flight, only cancelled by the timeout
+		<-ctx.Done()
+	}()
+	waiting := kafka{consumer: Consumer{Logger: logger, ShutdownTimeout: 20 * time.Millisecond}}
+	begin := time.Now()
+	waiting.awaitWorkers(&workers, make(chan os.Signal), cancel)
+	assert.True(t, time.Since(begin) >= 20*time.Millisecond)
+	assert.Error(t, ctx.Err())
+
+	// a second signal cancels the inserts without waiting for the timeout
+	ctx, cancel = context.WithCancel(context.Background())
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		<-ctx.Done()
+	}()
+	signals := make(chan os.Signal, 1)
+	signals <- os.Interrupt
+	waiting.consumer.ShutdownTimeout = 0
+	waiting.awaitWorkers(&workers, signals, cancel)
+	assert.Error(t, ctx.Err())
+}
+
+func TestKafka_Decode_Filter(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}, DeleteTombstones: true}
+	filter, err := models.ParseFilter("country == BR")
+	if !assert.NoError(t, err) {
+		return
+	}
+	filtering := kafka{
+		consumer:         Consumer{Decoder: d.DeserializerFor("json"), Logger: logger, Filter: filter},
+		metricsPublisher: k.metricsPublisher,
+	}
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "test", Offset: 1, Value: []byte(`{"id":"a","country":"BR"}`)},
+		{Topic: "test", Offset: 2, Value: []byte(`{"id":"b","country":"AR"}`)},
+		{Topic: "test", Offset: 3, Key: []byte(`{"id":"c"}`)},
+	}
+	decoded, failed, err := filtering.decode(batch)
+	if assert.NoError(t, err) && assert.Len(t, decoded, 2) {
+		assert.Equal(t, 0, failed)
+		assert.Equal(t, int64(1), decoded[0].Offset)
+		// the tombstone is deleted anyway
+		assert.True(t, decoded[1].Deleted)
+	}
+}
+
+func TestKafka_SetFilter(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	filter, err := models.ParseFilter("country == BR")
+	if !assert.NoError(t, err) {
+		return
+	}
+	filtering := NewKafka("localhost:9092", Consumer{Decoder: d.DeserializerFor("json"), Logger: logger, Filter: filter}, k.metricsPublisher)
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "test", Offset: 1, Value: []byte(`{"id":"a","country":"BR"}`)},
+		{Topic: "test", Offset: 2, Value: []byte(`{"id":"b","country":"AR"}`)},
+	}
+	decoded, _, err := filtering.decode(batch)
+	if assert.NoError(t, err) {
+		assert.Len(t, decoded, 1)
+	}
+	filtering.SetFilter(nil)
+	decoded, _, err = filtering.decode(batch)
+	if assert.NoError(t, err) {
+		assert.Len(t, decoded, 2)
+	}
+}
@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+)
+
+// Headers added to the messages produced to the dead letter topic, on top of their own.
+const (
+	DeadLetterErrorHeader     = "dead-letter-error"
+	DeadLetterErrorTypeHeader = "dead-letter-error-type"
+	// DeadLetterSourceHeader is the topic, partition and offset the message was consumed from, like "events/3/1500"
+	DeadLetterSourceHeader = "dead-letter-source"
+)
+
+// openDeadLetterTopic creates the producer of the dead letter topic, when messages that fail to decode go to it.
+func (k *kafka) openDeadLetterTopic() error {
+	if k.consumer.DecodeErrorPolicy != DecodeErrorDeadLetterTopic {
+		return nil
+	}
+	brokers := k.consumer.DeadLetterBrokers
+	if len(brokers) == 0 {
+		brokers = k.brokers
+	}
+	// the brokers are reached like the consumer does, every message of a batch is acknowledged by all the replicas
+	config := k.config.Config
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewSyncProducer(brokers, &config)
+	if err != nil {
+		return fmt.Errorf("could not create the producer of dead letter topic %s: %s", k.consumer.DeadLetterTopic, err)
+	}
+	k.deadLetters = producer
+	return nil
+}
+
+func (k *kafka) closeDeadLetterTopic() {
+	if k.deadLetters != nil {
+		k.deadLetters.Close()
+	}
+}
+
+// deadLetterMessage is the message produced to the dead letter topic for a message that failed to decode: its raw
+// key, value and headers, along with the error.
+func (k *kafka) deadLetterMessage(msg *sarama.ConsumerMessage, err error) *sarama.ProducerMessage {
+	deadLetter := &sarama.ProducerMessage{
+		Topic: k.consumer.DeadLetterTopic,
+		// headers are only produced from kafka 0.11 on
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(DeadLetterErrorHeader), Value: []byte(err.Error())},
+			{Key: []byte(DeadLetterErrorTypeHeader), Value: []byte(decodeErrorKind(err))},
+			{Key: []byte(DeadLetterSourceHeader), Value: []byte(msg.Topic + "/" + strconv.Itoa(int(msg.Partition)) + "/" + strconv.FormatInt(msg.Offset, 10))},
+		},
+	}
+	if msg.Key != nil {
+		deadLetter.Key = sarama.ByteEncoder(msg.Key)
+	}
+	if msg.Value != nil {
+		deadLetter.Value = sarama.ByteEncoder(msg.Value)
+	}
+	for _, header := range msg.Headers {
+		deadLetter.Headers = append(deadLetter.Headers, *header)
+	}
+	return deadLetter
+}
+
+// produceDeadLetters produces the messages that failed to decode to the dead letter topic, so that their offsets
+// can be committed.
+func (k *kafka) produceDeadLetters(msgs []*sarama.ConsumerMessage, errs []error) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	deadLetters := make([]*sarama.ProducerMessage, len(msgs))
+	for idx, msg := range msgs {
+		deadLetters[idx] = k.deadLetterMessage(msg, errs[idx])
+	}
+	if err := k.deadLetters.SendMessages(deadLetters); err != nil {
+		return fmt.Errorf("could not produce %d messages to dead letter topic %s: %s", len(msgs), k.consumer.DeadLetterTopic, err)
+	}
+	for idx, msg := range msgs {
+		k.metricsPublisher.IncrementMessagesDeadLettered(msg.Topic, decodeErrorKind(errs[idx]), 1)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package kafka
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSyncProducer struct {
+	produced []*sarama.ProducerMessage
+	err      error
+}
+
+func (p *fakeSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, p.SendMessages([]*sarama.ProducerMessage{msg})
+}
+
+func (p *fakeSyncProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.produced = append(p.produced, msgs...)
+	return nil
+}
+
+func (p *fakeSyncProducer) Close() error {
+	return nil
+}
+
+func newDeadLetteringKafka(producer sarama.SyncProducer) *kafka {
+	d := &Decoder{CodecCache: sync.Map{}}
+	return &kafka{
+		consumer: Consumer{
+			Decoder:           d.DeserializerFor("json"),
+			Logger:            logger,
+			DecodeErrorPolicy: DecodeErrorDeadLetterTopic,
+			DeadLetterTopic:   "events.dlq",
+		},
+		metricsPublisher: k.metricsPublisher,
+		deadLetters:      producer,
+	}
+}
+
+func TestKafka_Decode_DeadLetterTopic(t *testing.T) {
+	producer := &fakeSyncProducer{}
+	deadLettering := newDeadLetteringKafka(producer)
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "events", Partition: 3, Offset: 1, Value: []byte(`{"id":"alo"}`)},
+		{
+			Topic: "events", Partition: 3, Offset: 2, Key: []byte("k"), Value: []byte(`not json`),
+			Headers: []*sarama.RecordHeader{{Key: []byte("trace"), Value: []byte("abc")}},
+		},
+	}
+	decoded, failed, err := deadLettering.decode(batch)
+	if assert.NoError(t, err) {
+		assert.Len(t, decoded, 1)
+		assert.Equal(t, 1, failed)
+	}
+	if assert.Len(t, producer.produced, 1) {
+		deadLetter := producer.produced[0]
+		assert.Equal(t, "events.dlq", deadLetter.Topic)
+		assert.Equal(t, sarama.ByteEncoder("k"), deadLetter.Key)
+		assert.Equal(t, sarama.ByteEncoder("not json"), deadLetter.Value)
+		headers := make(map[string]string)
+		for _, header := range deadLetter.Headers {
+			headers[string(header.Key)] = string(header.Value)
+		}
+		assert.Contains(t, headers[DeadLetterErrorHeader], "invalid json message")
+		assert.Equal(t, DecodeErrorJSON, headers[DeadLetterErrorTypeHeader])
+		assert.Equal(t, "events/3/2", headers[DeadLetterSourceHeader])
+		assert.Equal(t, "abc", headers["trace"])
+	}
+
+	// all decoded, nothing produced
+	producer.produced = nil
+	_, failed, err = deadLettering.decode(batch[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, 0, failed)
+	assert.Empty(t, producer.produced)
+}
+
+func TestKafka_Decode_DeadLetterTopicUnavailable(t *testing.T) {
+	deadLettering := newDeadLetteringKafka(&fakeSyncProducer{err: errors.New("leader not available")})
+	batch := []*sarama.ConsumerMessage{{Topic: "events", Offset: 2, Value: []byte(`not json`)}}
+	decoded, _, err := deadLettering.decode(batch)
+	assert.Error(t, err)
+	assert.Nil(t, decoded)
+}
+
+func TestDecodeErrorKind(t *testing.T) {
+	d := &Decoder{}
+	_, err := d.decodeAvro([]byte{0, 1})
+	assert.Equal(t, DecodeErrorSchema, decodeErrorKind(err))
+	_, err = decodeJSON([]byte(`[1]`))
+	assert.Equal(t, DecodeErrorJSON, decodeErrorKind(err))
+	assert.Equal(t, DecodeErrorOther, decodeErrorKind(errors.New("boom")))
+}
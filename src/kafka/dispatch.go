@@ -0,0 +1,50 @@
+package kafka
+
+import (
+	"hash/fnv"
+
+	"github.com/Shopify/sarama"
+)
+
+// How the consumed messages are spread across the workers.
+const (
+	// DispatchShared lets any worker take any message, records of a partition may be inserted out of order
+	DispatchShared = "shared"
+	// DispatchPartition hands all the messages of a partition to the same worker, which inserts them in order
+	DispatchPartition = "partition"
+	// DispatchKey hands the messages with the same key to the same worker, the ones without key by partition
+	DispatchKey = "key"
+)
+
+// newConsumerChannels creates the buffers the workers take the consumed messages from: a single one shared by
+// the workers, or one per worker splitting the buffer size when messages are dispatched by partition or key.
+func newConsumerChannels(dispatch string, workers int, bufferSize int) []chan *sarama.ConsumerMessage {
+	if dispatch == "" || dispatch == DispatchShared || workers <= 1 {
+		return []chan *sarama.ConsumerMessage{make(chan *sarama.ConsumerMessage, bufferSize)}
+	}
+	channels := make([]chan *sarama.ConsumerMessage, workers)
+	for idx := range channels {
+		channels[idx] = make(chan *sarama.ConsumerMessage, bufferSize/workers)
+	}
+	return channels
+}
+
+// workerChannel is the buffer of the worker the message is dispatched to.
+func (k *kafka) workerChannel(msg *sarama.ConsumerMessage) chan *sarama.ConsumerMessage {
+	if len(k.consumerChs) == 1 {
+		return k.consumerChs[0]
+	}
+	hash := fnv.New32a()
+	if k.consumer.Dispatch == DispatchKey && len(msg.Key) > 0 {
+		hash.Write(msg.Key)
+	} else {
+		hash.Write([]byte(msg.Topic))
+		hash.Write([]byte{byte(msg.Partition >> 24), byte(msg.Partition >> 16), byte(msg.Partition >> 8), byte(msg.Partition)})
+	}
+	return k.consumerChs[hash.Sum32()%uint32(len(k.consumerChs))]
+}
+
+// messagesOf is the buffer a worker takes its messages from.
+func (k *kafka) messagesOf(worker int) <-chan *sarama.ConsumerMessage {
+	return k.consumerChs[worker%len(k.consumerChs)]
+}
@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConsumerChannels(t *testing.T) {
+	shared := newConsumerChannels(DispatchShared, 4, 400)
+	if assert.Len(t, shared, 1) {
+		assert.Equal(t, 400, cap(shared[0]))
+	}
+	keyed := newConsumerChannels(DispatchKey, 4, 400)
+	if assert.Len(t, keyed, 4) {
+		assert.Equal(t, 100, cap(keyed[0]))
+	}
+	assert.Len(t, newConsumerChannels(DispatchPartition, 1, 400), 1)
+}
+
+func TestKafka_WorkerChannel(t *testing.T) {
+	byPartition := &kafka{
+		consumer:    Consumer{Dispatch: DispatchPartition},
+		consumerChs: newConsumerChannels(DispatchPartition, 4, 40),
+	}
+	first := byPartition.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 1, Offset: 1, Key: []byte("a")})
+	for offset := int64(2); offset < 10; offset++ {
+		assert.Equal(t, first, byPartition.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 1, Offset: offset}))
+	}
+	used := make(map[chan *sarama.ConsumerMessage]bool)
+	for partition := int32(0); partition < 16; partition++ {
+		used[byPartition.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: partition})] = true
+	}
+	assert.True(t, len(used) > 1)
+
+	byKey := &kafka{
+		consumer:    Consumer{Dispatch: DispatchKey},
+		consumerChs: newConsumerChannels(DispatchKey, 4, 40),
+	}
+	keyed := byKey.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 0, Key: []byte("user-42")})
+	assert.Equal(t, keyed, byKey.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 3, Key: []byte("user-42")}))
+	used = make(map[chan *sarama.ConsumerMessage]bool)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		used[byKey.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 0, Key: []byte(key)})] = true
+	}
+	assert.True(t, len(used) > 1)
+	unkeyed := byKey.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 5})
+	assert.Equal(t, unkeyed, byKey.workerChannel(&sarama.ConsumerMessage{Topic: "t", Partition: 5, Offset: 9}))
+
+	// every worker takes from its own channel
+	assert.Equal(t, (<-chan *sarama.ConsumerMessage)(byKey.consumerChs[2]), byKey.messagesOf(2))
+}
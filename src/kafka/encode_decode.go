@@ -1,8 +1,11 @@
 package kafka
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"time"
 
@@ -10,80 +13,334 @@ import (
 
 	"sync"
 
-	"github.com/inloco/kafka-elasticsearch-injector/src/models"
-	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
 	"github.com/Shopify/sarama"
 	"github.com/inloco/goavro"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
 )
 
 // DecodeMessageFunc extracts a user-domain request object from an Kafka
 // message object. It's designed to be used in Kafka consumers.
 // One straightforward DecodeMessageFunc could be something that
 // Avro decodes the message body to the concrete response type.
+// A nil record without error means the message should be skipped.
 type DecodeMessageFunc func(context.Context, *sarama.ConsumerMessage) (record *models.Record, err error)
 
 const kafkaTimestampKey = "@timestamp"
 
+// What the consumer does with the messages it fails to decode.
+const (
+	DecodeErrorSkip       = "skip"
+	DecodeErrorFail       = "fail"
+	DecodeErrorDeadLetter = "dead-letter"
+	// DecodeErrorDeadLetterTopic produces them, raw, to a kafka topic
+	DecodeErrorDeadLetterTopic = "dlq"
+)
+
+// Kinds of decode errors.
+const (
+	// DecodeErrorSchema is a value without schema id, or whose schema can't be fetched or parsed
+	DecodeErrorSchema = "schema"
+	// DecodeErrorAvro is a value that doesn't match its schema, or that isn't a record
+	DecodeErrorAvro = "avro"
+	// DecodeErrorJSON is a value that isn't a json object
+	DecodeErrorJSON = "json"
+	// DecodeErrorValidation is a value that doesn't match its JSON Schema, when they are validated
+	DecodeErrorValidation = "validation"
+	// DecodeErrorResolution is an avro value whose writer schema can't be resolved to the reader schema of its topic
+	DecodeErrorResolution = "resolution"
+	// DecodeErrorOther is any other error returned by a decoder
+	DecodeErrorOther = "other"
+)
+
+// DecodeError is an error decoding a message along with its kind.
+type DecodeError struct {
+	Kind string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+// decodeErrorKind is the kind of a decode error, DecodeErrorOther unless it is a DecodeError.
+func decodeErrorKind(err error) string {
+	if decodeErr, ok := err.(*DecodeError); ok {
+		return decodeErr.Kind
+	}
+	return DecodeErrorOther
+}
+
 type Decoder struct {
-	SchemaRegistry *schema_registry.SchemaRegistry
-	CodecCache     sync.Map
+	SchemaRegistry   *schema_registry.SchemaRegistry
+	CodecCache       sync.Map
+	DeleteTombstones bool
+	// TimestampFormat is AvroTimestampRFC3339, the default, or AvroTimestampEpochMillis
+	TimestampFormat string
+	// DecimalFormat is AvroDecimalString, the default, or AvroDecimalFloat
+	DecimalFormat string
+	// OmitNulls leaves the null avro fields out of the records, instead of setting them to nil
+	OmitNulls bool
+	// ReaderSchemas are the schemas the values of some topics are resolved to, nil when none is
+	ReaderSchemas *ReaderSchemas
+	// BinaryFormat is how the bytes and fixed fields are written, AvroBinaryBase64, the default, AvroBinaryHex or
+	// AvroBinaryDrop
+	BinaryFormat string
+	// BinaryFields overrides BinaryFormat for some fields, by path
+	BinaryFields map[string]string
+	// ValidateJSONSchemas checks the values written with a JSON Schema against it
+	ValidateJSONSchemas bool
+}
+
+// avroCodec is the codec of a schema along with the converter of its logical types.
+type avroCodec struct {
+	codec   *goavro.Codec
+	logical logicalConverter
 }
 
 func (d *Decoder) DeserializerFor(recordType string) DecodeMessageFunc {
+	decode := d.AvroMessageToRecord
 	if recordType == "json" {
-		return d.JsonMessageToRecord
-	} else {
-		return d.AvroMessageToRecord
+		decode = d.JsonMessageToRecord
+	}
+	return func(context context.Context, msg *sarama.ConsumerMessage) (*models.Record, error) {
+		if msg.Value == nil {
+			return d.TombstoneToRecord(context, msg)
+		}
+		return decode(context, msg)
+	}
+}
+
+// TombstoneToRecord turns a message without value into a record flagged as deleted, or skips it
+// when tombstones are not deleted. The key fields are decoded, if possible, so that document ids
+// can be resolved the same way they are for inserts.
+func (d *Decoder) TombstoneToRecord(context context.Context, msg *sarama.ConsumerMessage) (*models.Record, error) {
+	if !d.DeleteTombstones {
+		return nil, nil
+	}
+	keyFields := make(map[string]interface{})
+	if isAvroWireFormat(msg.Key) {
+		if native, err := d.decodeAvro(msg.Key); err == nil {
+			keyFields = native
+		}
+	} else if native, err := decodeJSON(msg.Key); err == nil {
+		keyFields = native
 	}
+
+	return &models.Record{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: msg.Timestamp,
+		Key:       msg.Key,
+		KeyString: d.keyString(msg.Key),
+		Deleted:   true,
+		Json:      keyFields,
+	}, nil
 }
 
 func (d *Decoder) AvroMessageToRecord(context context.Context, msg *sarama.ConsumerMessage) (*models.Record, error) {
-	schemaId := getSchemaId(msg)
-	avroRecord := msg.Value[5:]
-	schema, err := d.SchemaRegistry.GetSchema(schemaId)
+	parsedNative, err := d.decodeAvroValue(msg.Topic, msg.Value)
 	if err != nil {
 		return nil, err
 	}
-	var codec *goavro.Codec
-	if codecI, ok := d.CodecCache.Load(schemaId); ok {
-		codec, ok = codecI.(*goavro.Codec)
-	}
 
-	if codec == nil {
-		codec, err = goavro.NewCodec(schema)
+	parsedNative[kafkaTimestampKey] = makeTimestamp(msg.Timestamp)
+
+	return &models.Record{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: msg.Timestamp,
+		Key:       msg.Key,
+		KeyString: d.keyString(msg.Key),
+		Json:      parsedNative,
+	}, nil
+}
+
+// keyString decodes the avro keys serialized with the schema registry wire format for the key column. It is empty
+// for the other keys, and for the keys whose schema can't be found, which the record uses as raw bytes.
+func (d *Decoder) keyString(key []byte) string {
+	if !isAvroWireFormat(key) || d.SchemaRegistry == nil {
+		return ""
+	}
+	native, err := d.decodeAvroNative(key)
+	if err != nil {
+		return ""
+	}
+	switch value := native.(type) {
+	case string:
+		return value
+	case map[string]interface{}:
+		// record keys, like composite ones, are written as json objects, with their fields sorted
+		encoded, err := json.Marshal(value)
 		if err != nil {
-			return nil, err
+			return ""
 		}
+		return string(encoded)
+	default:
+		return fmt.Sprint(value)
+	}
+}
 
-		d.CodecCache.Store(schemaId, codec)
+func isAvroWireFormat(value []byte) bool {
+	return len(value) > 5 && value[0] == 0
+}
+
+// decodeAvro decodes a value serialized with the schema registry wire format: a magic byte, the
+// schema id and the avro payload.
+func (d *Decoder) decodeAvro(value []byte) (map[string]interface{}, error) {
+	native, err := d.decodeAvroNative(value)
+	if err != nil {
+		return nil, err
 	}
+	return d.avroFields(native)
+}
 
-	native, _, err := codec.NativeFromBinary(avroRecord)
+// decodeAvroValue decodes the value of a message of the topic, resolved to the reader schema of the topic if it
+// has one. Values written with a JSON Schema are decoded as json instead.
+func (d *Decoder) decodeAvroValue(topic string, value []byte) (map[string]interface{}, error) {
+	schemaId, schema, err := d.schemaOf(value)
 	if err != nil {
 		return nil, err
 	}
+	if schema.Type == schema_registry.SchemaTypeJSON {
+		native, err := d.decodeJSONSchemaPayload(schemaId, schema.Schema, value[5:])
+		if err != nil {
+			return nil, err
+		}
+		object, ok := native.(map[string]interface{})
+		if !ok {
+			return nil, &DecodeError{DecodeErrorJSON, errors.New("json schema message is not an object")}
+		}
+		return object, nil
+	}
+	native, codec, err := d.decodeAvroPayload(schemaId, schema, value[5:])
+	if err != nil {
+		return nil, err
+	}
+	reader := d.ReaderSchemas.readerFor(topic)
+	if reader == nil {
+		if codec.logical != nil {
+			native = codec.logical(native)
+		}
+		return d.avroFields(native)
+	}
+	if native, err = reader.resolver.resolve(native); err != nil {
+		return nil, &DecodeError{DecodeErrorResolution, fmt.Errorf("could not resolve the value to the reader schema of topic %s: %s", topic, err)}
+	}
+	if reader.logical != nil {
+		native = reader.logical(native)
+	}
+	return d.avroFields(native)
+}
 
+// avroFields are the fields of a decoded avro record, with their binary values encoded to strings.
+func (d *Decoder) avroFields(native interface{}) (map[string]interface{}, error) {
 	parsedNative := make(map[string]interface{})
 	nativeType := reflect.ValueOf(native)
 	if nativeType.Kind() != reflect.Map {
-		return nil, errors.New("could not unmarshall record JSON into map")
+		return nil, &DecodeError{DecodeErrorAvro, errors.New("could not unmarshall record JSON into map")}
 	}
 	for _, key := range nativeType.MapKeys() {
 		if key.Kind() != reflect.String {
-			return nil, errors.New("could not unmarshall record JSON into map keyed by string")
+			return nil, &DecodeError{DecodeErrorAvro, errors.New("could not unmarshall record JSON into map keyed by string")}
+		}
+		field, ok := d.encodeBinary(key.String(), nativeType.MapIndex(key).Interface())
+		if !ok {
+			continue
 		}
-		parsedNative[key.String()] = nativeType.MapIndex(key).Interface()
+		if d.OmitNulls {
+			if field == nil {
+				continue
+			}
+			field = omitNulls(field)
+		}
+		parsedNative[key.String()] = field
 	}
+	return parsedNative, nil
+}
 
-	parsedNative[kafkaTimestampKey] = makeTimestamp(msg.Timestamp)
+// omitNulls removes the null fields of the records nested in the value, and the null values of its maps. goavro
+// already decodes unions to the value of their branch, nulls are the only thing left of the optional fields.
+func omitNulls(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if field == nil {
+				delete(v, key)
+			} else {
+				v[key] = omitNulls(field)
+			}
+		}
+	case []interface{}:
+		// nulls are kept in arrays, so that the positions of the other items don't change
+		for idx, item := range v {
+			v[idx] = omitNulls(item)
+		}
+	}
+	return value
+}
 
-	return &models.Record{
-		Topic:     msg.Topic,
-		Partition: msg.Partition,
-		Offset:    msg.Offset,
-		Timestamp: msg.Timestamp,
-		Json:      parsedNative,
-	}, nil
+// decodeAvroNative decodes a value serialized with the schema registry wire format, with the logical types of its
+// schema, or as json when its schema is a JSON Schema.
+func (d *Decoder) decodeAvroNative(value []byte) (interface{}, error) {
+	schemaId, schema, err := d.schemaOf(value)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Type == schema_registry.SchemaTypeJSON {
+		return d.decodeJSONSchemaPayload(schemaId, schema.Schema, value[5:])
+	}
+	native, codec, err := d.decodeAvroPayload(schemaId, schema, value[5:])
+	if err != nil {
+		return nil, err
+	}
+	if codec.logical != nil {
+		native = codec.logical(native)
+	}
+	return native, nil
+}
+
+// schemaOf fetches the schema whose id is in the header of a value serialized with the schema registry wire format.
+func (d *Decoder) schemaOf(value []byte) (int32, schema_registry.RegisteredSchema, error) {
+	if len(value) < 5 {
+		return 0, schema_registry.RegisteredSchema{}, &DecodeError{DecodeErrorSchema, errors.New("message is too short to hold a schema id")}
+	}
+	schemaId := getSchemaId(value)
+	schema, err := d.SchemaRegistry.GetRegisteredSchema(schemaId)
+	if err != nil {
+		return 0, schema_registry.RegisteredSchema{}, &DecodeError{DecodeErrorSchema, err}
+	}
+	return schemaId, schema, nil
+}
+
+// decodeAvroPayload decodes an avro payload with its writer schema, as goavro does, along with the codec of the
+// schema.
+func (d *Decoder) decodeAvroPayload(schemaId int32, schema schema_registry.RegisteredSchema, payload []byte) (interface{}, *avroCodec, error) {
+	if schema.Type != schema_registry.SchemaTypeAvro {
+		return nil, nil, &DecodeError{DecodeErrorSchema, fmt.Errorf("schema %d is a %s schema, which can't be decoded", schemaId, schema.Type)}
+	}
+	var codec *avroCodec
+	if codecI, ok := d.CodecCache.Load(schemaId); ok {
+		codec, ok = codecI.(*avroCodec)
+	}
+
+	if codec == nil {
+		avro, err := goavro.NewCodec(schema.Schema)
+		if err != nil {
+			return nil, nil, &DecodeError{DecodeErrorSchema, err}
+		}
+		codec = &avroCodec{codec: avro, logical: d.newLogicalConverter(schema.Schema)}
+
+		d.CodecCache.Store(schemaId, codec)
+	}
+
+	native, _, err := codec.codec.NativeFromBinary(payload)
+	if err != nil {
+		return nil, nil, &DecodeError{DecodeErrorAvro, err}
+	}
+	return native, codec, nil
 }
 
 func makeTimestamp(timestamp time.Time) int64 {
@@ -91,24 +348,42 @@ func makeTimestamp(timestamp time.Time) int64 {
 }
 
 func (d *Decoder) JsonMessageToRecord(context context.Context, msg *sarama.ConsumerMessage) (*models.Record, error) {
-	var jsonValue map[string]interface{}
-	err := json.Unmarshal(msg.Value, &jsonValue)
-	jsonValue[kafkaTimestampKey] = makeTimestamp(msg.Timestamp)
-
+	jsonValue, err := decodeJSON(msg.Value)
 	if err != nil {
 		return nil, err
 	}
+	jsonValue[kafkaTimestampKey] = makeTimestamp(msg.Timestamp)
 
 	return &models.Record{
 		Topic:     msg.Topic,
 		Partition: msg.Partition,
 		Offset:    msg.Offset,
 		Timestamp: msg.Timestamp,
+		Key:       msg.Key,
+		KeyString: d.keyString(msg.Key),
 		Json:      jsonValue,
 	}, nil
 }
 
-func getSchemaId(msg *sarama.ConsumerMessage) int32 {
-	schemaIdBytes := msg.Value[1:5]
+// decodeJSON decodes a json object, keeping its numbers as json.Number so that integers too large for a float64,
+// like int64 ids, are indexed and used as columns unchanged.
+func decodeJSON(value []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, &DecodeError{DecodeErrorJSON, fmt.Errorf("invalid json message: %s", err)}
+	}
+	if object == nil {
+		return nil, &DecodeError{DecodeErrorJSON, errors.New("invalid json message: not an object")}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, &DecodeError{DecodeErrorJSON, errors.New("invalid json message: unexpected data after the object")}
+	}
+	return object, nil
+}
+
+func getSchemaId(value []byte) int32 {
+	schemaIdBytes := value[1:5]
 	return int32(schemaIdBytes[0])<<24 | int32(schemaIdBytes[1])<<16 | int32(schemaIdBytes[2])<<8 | int32(schemaIdBytes[3])
 }
@@ -3,11 +3,15 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/inloco/goavro"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +39,173 @@ func TestDecoder_JsonMessageToRecord(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, val, returnedVal)
 }
+
+func TestDecoder_JsonMessageToRecord_KeepsNumbers(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	record, err := d.JsonMessageToRecord(context.Background(), &sarama.ConsumerMessage{
+		Value:     []byte(`{"id":9007199254740993,"ratio":0.5}`),
+		Topic:     "test",
+		Timestamp: time.Now(),
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, json.Number("9007199254740993"), record.Json["id"])
+		assert.Equal(t, json.Number("0.5"), record.Json["ratio"])
+		id, err := record.GetValueForField("id")
+		assert.NoError(t, err)
+		assert.Equal(t, "9007199254740993", id)
+	}
+}
+
+func TestDecoder_JsonMessageToRecord_Invalid(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	for _, value := range []string{`{"id":`, `null`, `[1,2]`, `{"id":1} {"id":2}`} {
+		_, err := d.JsonMessageToRecord(context.Background(), &sarama.ConsumerMessage{Value: []byte(value), Topic: "test"})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestDecoder_DeserializerFor_Tombstone(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}, DeleteTombstones: true}
+	msg := &sarama.ConsumerMessage{
+		Key:       []byte(`{"id":"alo"}`),
+		Topic:     "test",
+		Partition: 1,
+		Offset:    54,
+		Timestamp: time.Now(),
+	}
+	record, err := d.DeserializerFor("json")(context.Background(), msg)
+	if assert.NoError(t, err) && assert.NotNil(t, record) {
+		assert.True(t, record.Deleted)
+		assert.Equal(t, msg.Key, record.Key)
+		assert.Equal(t, map[string]interface{}{"id": "alo"}, record.Json)
+	}
+
+	msg.Key = []byte("alo")
+	record, err = d.DeserializerFor("avro")(context.Background(), msg)
+	if assert.NoError(t, err) && assert.NotNil(t, record) {
+		assert.True(t, record.Deleted)
+		assert.Empty(t, record.Json)
+	}
+}
+
+func TestDecoder_DeserializerFor_TombstoneSkipped(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	record, err := d.DeserializerFor("avro")(context.Background(), &sarama.ConsumerMessage{
+		Key:       []byte("alo"),
+		Topic:     "test",
+		Timestamp: time.Now(),
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestDecoder_KeyString(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schemas/ids/1" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+			return
+		}
+		w.Write([]byte(`{"schema":"\"string\""}`))
+	}))
+	defer server.Close()
+	registry, err := schema_registry.NewSchemaRegistry(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}
+
+	// magic byte, schema id 1 and the avro string "user-42"
+	avroKey := append([]byte{0, 0, 0, 0, 1, 14}, "user-42"...)
+	assert.Equal(t, "user-42", d.keyString(avroKey))
+	unknownSchema := append([]byte{0, 0, 0, 0, 2, 14}, "user-42"...)
+	assert.Empty(t, d.keyString(unknownSchema))
+	assert.Empty(t, d.keyString([]byte("user-42")))
+
+	record, err := d.JsonMessageToRecord(context.Background(), &sarama.ConsumerMessage{
+		Key:   avroKey,
+		Value: []byte(`{"name":"alo"}`),
+		Topic: "test",
+	})
+	if assert.NoError(t, err) {
+		id, err := record.GetValueForField("@key")
+		assert.NoError(t, err)
+		assert.Equal(t, "user-42", id)
+	}
+}
+
+const unionsSchema = `{"type": "record", "name": "Unions", "fields": [
+	{"name": "name", "type": ["null", "string"]},
+	{"name": "nickname", "type": ["null", "string"]},
+	{"name": "score", "type": ["null", "string", "long"]},
+	{"name": "address", "type": ["null", {"type": "record", "name": "Address", "fields": [
+		{"name": "city", "type": ["null", "string"]},
+		{"name": "zip", "type": ["null", "string"]}
+	]}]},
+	{"name": "tags", "type": {"type": "array", "items": ["null", "string"]}}
+]}`
+
+func newUnionsDecoder(t *testing.T) (*Decoder, []byte, func()) {
+	schema, _ := json.Marshal(map[string]string{"schema": unionsSchema})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(schema)
+	}))
+	registry, err := schema_registry.NewSchemaRegistry(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := goavro.NewCodec(unionsSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"name":     map[string]interface{}{"string": "alice"},
+		"nickname": nil,
+		"score":    map[string]interface{}{"long": int64(42)},
+		"address":  map[string]interface{}{"Address": map[string]interface{}{"city": map[string]interface{}{"string": "Recife"}, "zip": nil}},
+		"tags":     []interface{}{map[string]interface{}{"string": "a"}, nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}, append([]byte{0, 0, 0, 0, 1}, value...), server.Close
+}
+
+func TestDecoder_AvroUnions(t *testing.T) {
+	d, value, closeRegistry := newUnionsDecoder(t)
+	defer closeRegistry()
+
+	record, err := d.AvroMessageToRecord(context.Background(), &sarama.ConsumerMessage{Topic: "test", Value: value})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// unions hold the value of their branch, without the type
+	assert.Equal(t, "alice", record.Json["name"])
+	assert.Contains(t, record.Json, "nickname")
+	assert.Nil(t, record.Json["nickname"])
+	assert.Equal(t, int64(42), record.Json["score"])
+	assert.Equal(t, map[string]interface{}{"city": "Recife", "zip": nil}, record.Json["address"])
+	assert.Equal(t, []interface{}{"a", nil}, record.Json["tags"])
+	name, err := record.GetValueForField("name")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", name)
+	score, err := record.GetValueForField("score")
+	assert.NoError(t, err)
+	assert.Equal(t, "42", score)
+}
+
+func TestDecoder_AvroUnions_OmitNulls(t *testing.T) {
+	d, value, closeRegistry := newUnionsDecoder(t)
+	defer closeRegistry()
+	d.OmitNulls = true
+
+	record, err := d.AvroMessageToRecord(context.Background(), &sarama.ConsumerMessage{Topic: "test", Value: value})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, record.Json, "nickname")
+	assert.Equal(t, map[string]interface{}{"city": "Recife"}, record.Json["address"])
+	assert.Equal(t, []interface{}{"a", nil}, record.Json["tags"])
+	_, err = record.GetValueForField("nickname")
+	assert.EqualError(t, err, "could not get value from column nickname")
+}
@@ -59,3 +59,114 @@ func NewElasticRecord() (*models.ElasticRecord, int32) {
 		Json:  map[string]interface{}{"id": id},
 	}, id
 }
+
+// LogicalTypesRecord has a field of each avro logical type decoded by the consumer.
+type LogicalTypesRecord struct {
+	CreatedAt  int64
+	UpdatedAt  int64
+	Birthday   int32
+	Price      []byte
+	Balance    []byte
+	Id         string
+	FixedId    []byte
+	OptionalAt *int64
+	History    []int64
+}
+
+func (r *LogicalTypesRecord) Topic() string {
+	return DefaultTopic
+}
+
+func (r *LogicalTypesRecord) Schema() string {
+	return `{"type": "record", "name": "LogicalTypesRecord", "namespace": "fixtures", "fields": [
+		{"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "updated_at", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "birthday", "type": {"type": "int", "logicalType": "date"}},
+		{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}},
+		{"name": "balance", "type": {"type": "fixed", "name": "Balance", "size": 4, "logicalType": "decimal", "precision": 9, "scale": 3}},
+		{"name": "id", "type": {"type": "string", "logicalType": "uuid"}},
+		{"name": "fixed_id", "type": {"type": "fixed", "name": "Uuid", "size": 16, "logicalType": "uuid"}},
+		{"name": "optional_at", "type": ["null", {"type": "long", "logicalType": "timestamp-millis"}], "default": null},
+		{"name": "history", "type": {"type": "array", "items": {"type": "long", "logicalType": "timestamp-millis"}}}
+	]}`
+}
+
+func (r *LogicalTypesRecord) ToAvroSerialization() ([]byte, error) {
+	codec, err := goavro.NewCodec(r.Schema())
+	if err != nil {
+		return nil, err
+	}
+	var optionalAt interface{}
+	if r.OptionalAt != nil {
+		optionalAt = map[string]interface{}{"long": *r.OptionalAt}
+	}
+	history := make([]interface{}, len(r.History))
+	for idx, ts := range r.History {
+		history[idx] = ts
+	}
+	return codec.BinaryFromNative(nil, map[string]interface{}{
+		"created_at":  r.CreatedAt,
+		"updated_at":  r.UpdatedAt,
+		"birthday":    r.Birthday,
+		"price":       r.Price,
+		"balance":     r.Balance,
+		"id":          r.Id,
+		"fixed_id":    r.FixedId,
+		"optional_at": optionalAt,
+		"history":     history,
+	})
+}
+
+// BinaryRecord has avro bytes and fixed fields, at the top level and nested.
+type BinaryRecord struct {
+	Id          string
+	Payload     []byte
+	Checksum    []byte
+	Thumbnail   []byte
+	Attachments [][]byte
+	Signatures  map[string][]byte
+}
+
+func (r *BinaryRecord) Topic() string {
+	return DefaultTopic
+}
+
+func (r *BinaryRecord) Schema() string {
+	return `{"type": "record", "name": "BinaryRecord", "namespace": "fixtures", "fields": [
+		{"name": "id", "type": "string"},
+		{"name": "payload", "type": "bytes"},
+		{"name": "checksum", "type": {"type": "fixed", "name": "Checksum", "size": 4}},
+		{"name": "thumbnail", "type": ["null", "bytes"], "default": null},
+		{"name": "attachments", "type": {"type": "array", "items": {"type": "record", "name": "Attachment", "fields": [
+			{"name": "content", "type": "bytes"}
+		]}}},
+		{"name": "signatures", "type": {"type": "map", "values": "bytes"}}
+	]}`
+}
+
+func (r *BinaryRecord) ToAvroSerialization() ([]byte, error) {
+	codec, err := goavro.NewCodec(r.Schema())
+	if err != nil {
+		return nil, err
+	}
+	var thumbnail interface{}
+	if r.Thumbnail != nil {
+		thumbnail = map[string]interface{}{"bytes": r.Thumbnail}
+	}
+	attachments := make([]interface{}, len(r.Attachments))
+	for idx, content := range r.Attachments {
+		attachments[idx] = map[string]interface{}{"content": content}
+	}
+	signatures := make(map[string]interface{}, len(r.Signatures))
+	for key, signature := range r.Signatures {
+		signatures[key] = signature
+	}
+	return codec.BinaryFromNative(nil, map[string]interface{}{
+		"id":          r.Id,
+		"payload":     r.Payload,
+		"checksum":    r.Checksum,
+		"thumbnail":   thumbnail,
+		"attachments": attachments,
+		"signatures":  signatures,
+	})
+}
@@ -0,0 +1,28 @@
+package kafka
+
+// flowControl pauses the consumption while too many records consumed are not inserted yet, which happens when
+// elasticsearch falls behind. Paused consumption stops reading the messages of the consumer, so its partition
+// consumers stop fetching once their buffers are full while the group membership keeps being heartbeated.
+// A flow control with no maximum never pauses.
+type flowControl struct {
+	max    int
+	resume int
+	paused bool
+}
+
+// update pauses once the records in flight reach the maximum and resumes once they drain to the resume mark,
+// telling whether the state changed.
+func (f *flowControl) update(inFlight int) bool {
+	switch {
+	case f.max <= 0:
+		return false
+	case !f.paused && inFlight >= f.max:
+		f.paused = true
+		return true
+	case f.paused && inFlight <= f.resume:
+		f.paused = false
+		return true
+	default:
+		return false
+	}
+}
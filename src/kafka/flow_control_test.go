@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowControl_Update(t *testing.T) {
+	flow := &flowControl{max: 100, resume: 50}
+	assert.False(t, flow.update(99))
+	assert.True(t, flow.update(100))
+	assert.True(t, flow.paused)
+	// stays paused until drained to the resume mark
+	assert.False(t, flow.update(51))
+	assert.True(t, flow.update(50))
+	assert.False(t, flow.paused)
+
+	disabled := &flowControl{}
+	assert.False(t, disabled.update(1000000))
+	assert.False(t, disabled.paused)
+}
+
+func TestOffsetTracker_InFlight(t *testing.T) {
+	tracker := newOffsetTracker()
+	first := trackedMessages(tracker, "t", 0, 10, 11)
+	second := trackedMessages(tracker, "t", 0, 12)
+	assert.Equal(t, 3, tracker.inFlight())
+
+	// inserted out of order, the records held back still count
+	tracker.inserted(second)
+	assert.Equal(t, 3, tracker.inFlight())
+	tracker.inserted(first)
+	assert.Equal(t, 0, tracker.inFlight())
+
+	// consumed again after a rebalance, the records consumed before no longer count
+	trackedMessages(tracker, "t", 0, 13, 14)
+	trackedMessages(tracker, "t", 0, 13)
+	assert.Equal(t, 1, tracker.inFlight())
+}
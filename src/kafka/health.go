@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of the health checks of the consumer.
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultLivenessTimeout     = 2 * time.Minute
+)
+
+// Health tells whether the consumer is alive and ready. The consume loop polls the brokers every check interval,
+// with a request to find the coordinator of the consumer group: the consumer is alive while a poll succeeded
+// within the liveness timeout, so idle topics don't make it look stuck, and ready while the last poll succeeded and
+// it is a member of the consumer group.
+type Health struct {
+	threshold time.Duration
+	now       func() time.Time
+
+	lock     sync.Mutex
+	lastPoll time.Time
+	pollErr  error
+	polling  bool
+	inGroup  bool
+}
+
+// NewHealth is the health of a consumer that starts now, it is alive until the liveness timeout has passed without
+// a successful poll.
+func NewHealth(livenessTimeout time.Duration) *Health {
+	h := &Health{threshold: livenessTimeout, now: time.Now}
+	h.lastPoll = h.now()
+	return h
+}
+
+// Alive is false when no poll succeeded within the liveness timeout.
+func (h *Health) Alive() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.now().Sub(h.lastPoll) <= h.threshold
+}
+
+// Ready is false when the last poll failed, or the consumer is not a member of the consumer group.
+func (h *Health) Ready() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.inGroup && h.pollErr == nil && h.now().Sub(h.lastPoll) <= h.threshold
+}
+
+// poll runs the poll in a goroutine of its own, so that an unreachable broker doesn't hold the consume loop back,
+// unless the previous poll is still running.
+func (h *Health) poll(poll func() error) {
+	h.lock.Lock()
+	if h.polling {
+		h.lock.Unlock()
+		return
+	}
+	h.polling = true
+	h.lock.Unlock()
+	go func() {
+		err := poll()
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		h.polling = false
+		h.pollErr = err
+		if err == nil {
+			h.lastPoll = h.now()
+		}
+	}()
+}
+
+// joinedGroup marks the consumer as a member of the group, once partitions are assigned to it.
+func (h *Health) joinedGroup() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.inGroup = true
+}
+
+// leftGroup marks the consumer as fenced from the group, until it rebalances successfully.
+func (h *Health) leftGroup() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.inGroup = false
+}
@@ -0,0 +1,84 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// awaitPoll waits for the poll in flight to be recorded.
+func awaitPoll(h *Health) {
+	for {
+		h.lock.Lock()
+		polling := h.polling
+		h.lock.Unlock()
+		if !polling {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pollNow runs a poll and waits for it to be recorded.
+func pollNow(h *Health, err error) {
+	awaitPoll(h)
+	h.poll(func() error { return err })
+	awaitPoll(h)
+}
+
+func TestHealth(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := NewHealth(time.Minute)
+	h.now = func() time.Time { return now }
+	h.lastPoll = now
+
+	// alive from the start, ready once partitions are assigned
+	assert.True(t, h.Alive())
+	assert.False(t, h.Ready())
+	h.joinedGroup()
+	assert.True(t, h.Ready())
+
+	// idle topics don't matter, polls do
+	now = now.Add(50 * time.Second)
+	pollNow(h, nil)
+	now = now.Add(50 * time.Second)
+	assert.True(t, h.Alive())
+	assert.True(t, h.Ready())
+
+	// a failed poll makes the consumer unready until the brokers answer again, then dead after the timeout
+	pollNow(h, errors.New("kafka: client has run out of available brokers"))
+	assert.True(t, h.Alive())
+	assert.False(t, h.Ready())
+	now = now.Add(11 * time.Second)
+	assert.False(t, h.Alive())
+	pollNow(h, nil)
+	assert.True(t, h.Alive())
+	assert.True(t, h.Ready())
+
+	// fenced from the group
+	h.leftGroup()
+	assert.True(t, h.Alive())
+	assert.False(t, h.Ready())
+}
+
+func TestHealth_PollInFlight(t *testing.T) {
+	h := NewHealth(time.Minute)
+	release := make(chan struct{})
+	polls := 0
+	h.poll(func() error {
+		polls++
+		<-release
+		return nil
+	})
+	// skipped while the previous poll hangs on an unreachable broker
+	h.poll(func() error {
+		polls++
+		return nil
+	})
+	close(release)
+	awaitPoll(h)
+	pollNow(h, nil)
+	assert.Equal(t, 1, polls)
+}
@@ -0,0 +1,461 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema validates values against a JSON Schema registered in the schema registry. Only the validation
+// keywords are checked: type, enum, const, the numeric, string and array bounds, pattern, properties, required,
+// additionalProperties, items, allOf, anyOf, oneOf, not, and the $ref to the definitions of the same schema. The
+// formats, the remote references and the other keywords are ignored.
+type jsonSchema struct {
+	root interface{}
+	// patterns are the compiled regular expressions of the schema, by source
+	patterns map[string]*regexp.Regexp
+}
+
+func newJSONSchema(schema string) (*jsonSchema, error) {
+	var root interface{}
+	decoder := json.NewDecoder(strings.NewReader(schema))
+	decoder.UseNumber()
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid json schema: %s", err)
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, fmt.Errorf("invalid json schema: should be an object or a boolean")
+	}
+	s := &jsonSchema{root: root, patterns: make(map[string]*regexp.Regexp)}
+	if err := s.compilePatterns(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compilePatterns compiles the patterns of the schema up front, so that an invalid one fails the schema rather than
+// every value.
+func (s *jsonSchema) compilePatterns(schema interface{}) error {
+	switch v := schema.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if pattern, ok := child.(string); ok && key == "pattern" {
+				compiled, err := regexp.Compile(pattern)
+				if err != nil {
+					return fmt.Errorf("invalid json schema pattern %q: %s", pattern, err)
+				}
+				s.patterns[pattern] = compiled
+				continue
+			}
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate tells why the value, decoded with json.Number numbers, doesn't match the schema, nil when it does.
+func (s *jsonSchema) validate(value interface{}) error {
+	return s.check(s.root, value, "$", 0)
+}
+
+// maxRefDepth bounds the references followed, which may be recursive.
+const maxRefDepth = 100
+
+func (s *jsonSchema) check(schema interface{}, value interface{}, path string, depth int) error {
+	if allowed, ok := schema.(bool); ok {
+		if !allowed {
+			return fmt.Errorf("%s: no value is allowed", path)
+		}
+		return nil
+	}
+	keywords, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if ref, ok := keywords["$ref"].(string); ok {
+		if depth >= maxRefDepth {
+			return fmt.Errorf("%s: too many nested references", path)
+		}
+		target, err := s.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if err := s.check(target, value, path, depth+1); err != nil {
+			return err
+		}
+	}
+	if types, ok := keywords["type"]; ok && !matchesType(types, value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, describeTypes(types), jsonType(value))
+	}
+	if enum, ok := keywords["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the enum", path)
+		}
+	}
+	if constant, ok := keywords["const"]; ok && !jsonEqual(constant, value) {
+		return fmt.Errorf("%s: value is not the const", path)
+	}
+	var err error
+	switch v := value.(type) {
+	case json.Number:
+		err = s.checkNumber(keywords, v, path)
+	case string:
+		err = s.checkString(keywords, v, path)
+	case []interface{}:
+		err = s.checkArray(keywords, v, path, depth)
+	case map[string]interface{}:
+		err = s.checkObject(keywords, v, path, depth)
+	}
+	if err != nil {
+		return err
+	}
+	return s.checkCombinations(keywords, value, path, depth)
+}
+
+func (s *jsonSchema) checkNumber(keywords map[string]interface{}, value json.Number, path string) error {
+	number, err := value.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: invalid number %s", path, value)
+	}
+	// draft 4 gives exclusive bounds as booleans next to the bounds, later drafts as numbers
+	exclusiveMinimum, _ := keywords["exclusiveMinimum"].(bool)
+	exclusiveMaximum, _ := keywords["exclusiveMaximum"].(bool)
+	if minimum, ok := keywordNumber(keywords, "minimum"); ok && (number < minimum || exclusiveMinimum && number == minimum) {
+		return fmt.Errorf("%s: %s is less than the minimum %v", path, value, minimum)
+	}
+	if maximum, ok := keywordNumber(keywords, "maximum"); ok && (number > maximum || exclusiveMaximum && number == maximum) {
+		return fmt.Errorf("%s: %s is more than the maximum %v", path, value, maximum)
+	}
+	if minimum, ok := keywordNumber(keywords, "exclusiveMinimum"); ok && number <= minimum {
+		return fmt.Errorf("%s: %s is not more than the exclusive minimum %v", path, value, minimum)
+	}
+	if maximum, ok := keywordNumber(keywords, "exclusiveMaximum"); ok && number >= maximum {
+		return fmt.Errorf("%s: %s is not less than the exclusive maximum %v", path, value, maximum)
+	}
+	if multiple, ok := keywordNumber(keywords, "multipleOf"); ok && multiple > 0 {
+		if quotient := number / multiple; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			return fmt.Errorf("%s: %s is not a multiple of %v", path, value, multiple)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkString(keywords map[string]interface{}, value string, path string) error {
+	length := utf8.RuneCountInString(value)
+	if minLength, ok := keywordNumber(keywords, "minLength"); ok && float64(length) < minLength {
+		return fmt.Errorf("%s: string is shorter than %v", path, minLength)
+	}
+	if maxLength, ok := keywordNumber(keywords, "maxLength"); ok && float64(length) > maxLength {
+		return fmt.Errorf("%s: string is longer than %v", path, maxLength)
+	}
+	if pattern, ok := keywords["pattern"].(string); ok {
+		if compiled := s.patterns[pattern]; compiled != nil && !compiled.MatchString(value) {
+			return fmt.Errorf("%s: string doesn't match the pattern %s", path, pattern)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkArray(keywords map[string]interface{}, value []interface{}, path string, depth int) error {
+	if minItems, ok := keywordNumber(keywords, "minItems"); ok && float64(len(value)) < minItems {
+		return fmt.Errorf("%s: array has fewer than %v items", path, minItems)
+	}
+	if maxItems, ok := keywordNumber(keywords, "maxItems"); ok && float64(len(value)) > maxItems {
+		return fmt.Errorf("%s: array has more than %v items", path, maxItems)
+	}
+	if unique, _ := keywords["uniqueItems"].(bool); unique {
+		for idx := range value {
+			for other := idx + 1; other < len(value); other++ {
+				if jsonEqual(value[idx], value[other]) {
+					return fmt.Errorf("%s: items %d and %d are equal", path, idx, other)
+				}
+			}
+		}
+	}
+	switch items := keywords["items"].(type) {
+	case []interface{}:
+		// tuples, the items past the listed ones are checked by additionalItems
+		for idx, item := range value {
+			itemSchema, ok := keywords["additionalItems"]
+			if idx < len(items) {
+				itemSchema, ok = items[idx], true
+			}
+			if !ok {
+				continue
+			}
+			if err := s.check(itemSchema, item, path+"["+strconv.Itoa(idx)+"]", depth); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		for idx, item := range value {
+			if err := s.check(items, item, path+"["+strconv.Itoa(idx)+"]", depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkObject(keywords map[string]interface{}, value map[string]interface{}, path string, depth int) error {
+	if required, ok := keywords["required"].([]interface{}); ok {
+		for _, field := range required {
+			if name, ok := field.(string); ok {
+				if _, exists := value[name]; !exists {
+					return fmt.Errorf("%s: missing required property %s", path, name)
+				}
+			}
+		}
+	}
+	if minProperties, ok := keywordNumber(keywords, "minProperties"); ok && float64(len(value)) < minProperties {
+		return fmt.Errorf("%s: object has fewer than %v properties", path, minProperties)
+	}
+	if maxProperties, ok := keywordNumber(keywords, "maxProperties"); ok && float64(len(value)) > maxProperties {
+		return fmt.Errorf("%s: object has more than %v properties", path, maxProperties)
+	}
+	properties, _ := keywords["properties"].(map[string]interface{})
+	additional, hasAdditional := keywords["additionalProperties"]
+	// sorted, so that the same error is returned every time
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propertyPath := path + "." + name
+		if propertySchema, ok := properties[name]; ok {
+			if err := s.check(propertySchema, value[name], propertyPath, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		if !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			return fmt.Errorf("%s: additional property %s is not allowed", path, name)
+		}
+		if err := s.check(additional, value[name], propertyPath, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) checkCombinations(keywords map[string]interface{}, value interface{}, path string, depth int) error {
+	if all, ok := keywords["allOf"].([]interface{}); ok {
+		for _, schema := range all {
+			if err := s.check(schema, value, path, depth); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := keywords["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, schema := range anyOf {
+			if s.check(schema, value, path, depth) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value matches none of anyOf", path)
+		}
+	}
+	if oneOf, ok := keywords["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, schema := range oneOf {
+			if s.check(schema, value, path, depth) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: value matches %d of oneOf instead of one", path, matches)
+		}
+	}
+	if not, ok := keywords["not"]; ok && s.check(not, value, path, depth) == nil {
+		return fmt.Errorf("%s: value matches not", path)
+	}
+	return nil
+}
+
+// resolveRef resolves a json pointer to the schema itself, like `#/definitions/address`.
+func (s *jsonSchema) resolveRef(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported reference %s, only references within the schema are", ref)
+	}
+	target := s.root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		object, ok := target.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %s", ref)
+		}
+		if target, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolvable reference %s", ref)
+		}
+	}
+	return target, nil
+}
+
+func keywordNumber(keywords map[string]interface{}, keyword string) (float64, bool) {
+	number, ok := keywords[keyword].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Float64()
+	return value, err == nil
+}
+
+func matchesType(types interface{}, value interface{}) bool {
+	switch t := types.(type) {
+	case string:
+		return matchesSingleType(t, value)
+	case []interface{}:
+		for _, option := range t {
+			if name, ok := option.(string); ok && matchesSingleType(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesSingleType(name string, value interface{}) bool {
+	actual := jsonType(value)
+	if name == "number" && actual == "integer" {
+		return true
+	}
+	return name == actual
+}
+
+func describeTypes(types interface{}) string {
+	if options, ok := types.([]interface{}); ok {
+		names := make([]string, len(options))
+		for idx, option := range options {
+			names[idx] = fmt.Sprint(option)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+// jsonType is the JSON Schema type of a value, integer for the numbers without a fractional part.
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if number, err := v.Float64(); err == nil && number == math.Trunc(number) && !math.IsInf(number, 0) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return reflect.TypeOf(value).String()
+}
+
+// jsonEqual compares json values, numbers by their value, so that 1 and 1.0 are equal.
+func jsonEqual(a, b interface{}) bool {
+	an, aIsNumber := a.(json.Number)
+	bn, bIsNumber := b.(json.Number)
+	if aIsNumber && bIsNumber {
+		af, aErr := an.Float64()
+		bf, bErr := bn.Float64()
+		if aErr == nil && bErr == nil {
+			return af == bf
+		}
+		return an == bn
+	}
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for idx := range av {
+			if !jsonEqual(av[idx], bv[idx]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, value := range av {
+			other, ok := bv[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// decodeJSONSchemaPayload decodes the json payload of a value written with a JSON Schema, validating it when the
+// decoder validates them.
+func (d *Decoder) decodeJSONSchemaPayload(schemaId int32, schema string, payload []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, &DecodeError{DecodeErrorJSON, fmt.Errorf("invalid json schema message: %s", err)}
+	}
+	if !d.ValidateJSONSchemas {
+		return value, nil
+	}
+	var validator *jsonSchema
+	if cached, ok := d.CodecCache.Load(schemaId); ok {
+		validator, _ = cached.(*jsonSchema)
+	}
+	if validator == nil {
+		var err error
+		if validator, err = newJSONSchema(schema); err != nil {
+			return nil, &DecodeError{DecodeErrorSchema, fmt.Errorf("schema %d: %s", schemaId, err)}
+		}
+		d.CodecCache.Store(schemaId, validator)
+	}
+	if err := validator.validate(value); err != nil {
+		return nil, &DecodeError{DecodeErrorValidation, fmt.Errorf("message doesn't match json schema %d: %s", schemaId, err)}
+	}
+	return value, nil
+}
@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/stretchr/testify/assert"
+)
+
+const orderJSONSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"status": {"enum": ["open", "closed"]},
+		"customer": {"$ref": "#/definitions/customer"},
+		"items": {"type": "array", "items": {"type": "string", "maxLength": 8}, "minItems": 1}
+	},
+	"required": ["id", "status"],
+	"additionalProperties": false,
+	"definitions": {
+		"customer": {"type": "object", "properties": {"email": {"type": "string", "pattern": "@"}}, "required": ["email"]}
+	}
+}`
+
+// newJSONSchemaRegistry serves the JSON Schema as id 1 and a protobuf schema as id 2.
+func newJSONSchemaRegistry(t *testing.T) (*schema_registry.SchemaRegistry, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schema := map[string]string{"schema": orderJSONSchema, "schemaType": "JSON"}
+		if strings.HasSuffix(r.URL.Path, "/2") {
+			schema = map[string]string{"schema": `syntax = "proto3"; message Order {}`, "schemaType": "PROTOBUF"}
+		}
+		encoded, _ := json.Marshal(schema)
+		w.Write(encoded)
+	}))
+	registry, err := schema_registry.NewSchemaRegistry(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry, server.Close
+}
+
+func newJSONSchemaMessage(schemaId byte, payload string) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{Topic: "orders", Value: append([]byte{0, 0, 0, 0, schemaId}, payload...)}
+}
+
+func TestDecoder_JSONSchema(t *testing.T) {
+	registry, closeRegistry := newJSONSchemaRegistry(t)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}
+
+	record, err := d.AvroMessageToRecord(context.Background(), newJSONSchemaMessage(1, `{"id": 9007199254740993, "status": "open", "items": ["a"]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, json.Number("9007199254740993"), record.Json["id"])
+	assert.Equal(t, "open", record.Json["status"])
+	id, err := record.GetValueForField("id")
+	assert.NoError(t, err)
+	assert.Equal(t, "9007199254740993", id)
+
+	// invalid values are decoded when they are not validated
+	record, err = d.AvroMessageToRecord(context.Background(), newJSONSchemaMessage(1, `{"id": 0, "status": "lost"}`))
+	assert.NoError(t, err)
+
+	_, err = d.AvroMessageToRecord(context.Background(), newJSONSchemaMessage(1, `[1, 2]`))
+	assert.EqualError(t, err, "json schema message is not an object")
+	assert.Equal(t, DecodeErrorJSON, decodeErrorKind(err))
+
+	_, err = d.AvroMessageToRecord(context.Background(), newJSONSchemaMessage(2, `{}`))
+	assert.EqualError(t, err, "schema 2 is a PROTOBUF schema, which can't be decoded")
+	assert.Equal(t, DecodeErrorSchema, decodeErrorKind(err))
+}
+
+func TestDecoder_JSONSchema_Validate(t *testing.T) {
+	registry, closeRegistry := newJSONSchemaRegistry(t)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}, ValidateJSONSchemas: true}
+
+	_, err := d.AvroMessageToRecord(context.Background(), newJSONSchemaMessage(1, `{"id": 1, "status": "closed", "customer": {"email": "a@b.c"}}`))
+	assert.NoError(t, err)
+
+	for payload, expected := range map[string]string{
+		`{"id": 0, "status": "open"}`:                                  "$.id: 0 is less than the minimum 1",
+		`{"id": 1.5, "status": "open"}`:                                "$.id: expected integer, got number",
+		`{"id": 1}`:                                                    "$: missing required property status",
+		`{"id": 1, "status": "lost"}`:                                  "$.status: value is not one of the enum",
+		`{"id": 1, "status": "open", "extra": true}`:                   "$: additional property extra is not allowed",
+		`{"id": 1, "status": "open", "customer": {"email": "nobody"}}`: "$.customer.email: string doesn't match the pattern @",
+		`{"id": 1, "status": "open", "items": []}`:                     "$.items: array has fewer than 1 items",
+		`{"id": 1, "status": "open", "items": ["a", "too long!"]}`:     "$.items[1]: string is longer than 8",
+	} {
+		_, err := d.AvroMessageToRecord(context.Background(), newJSONSchemaMessage(1, payload))
+		assert.EqualError(t, err, "message doesn't match json schema 1: "+expected, payload)
+		assert.Equal(t, DecodeErrorValidation, decodeErrorKind(err))
+	}
+}
+
+func TestJSONSchema_Combinations(t *testing.T) {
+	schema, err := newJSONSchema(`{
+		"oneOf": [{"type": "string"}, {"type": "number", "exclusiveMinimum": 0}],
+		"not": {"const": "forbidden"},
+		"definitions": {"node": {"type": "object", "properties": {"next": {"$ref": "#/definitions/node"}}}}
+	}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, schema.validate("text"))
+	assert.NoError(t, schema.validate(json.Number("2.5")))
+	assert.EqualError(t, schema.validate(json.Number("0")), "$: value matches 0 of oneOf instead of one")
+	assert.EqualError(t, schema.validate("forbidden"), "$: value matches not")
+
+	recursive, err := newJSONSchema(`{"$ref": "#/definitions/node", "definitions": {"node": {"type": "object", "properties": {"next": {"$ref": "#/definitions/node"}}}}}`)
+	if assert.NoError(t, err) {
+		value := map[string]interface{}{"next": map[string]interface{}{"next": map[string]interface{}{"next": "end"}}}
+		assert.EqualError(t, recursive.validate(value), "$.next.next.next: expected object, got string")
+	}
+
+	_, err = newJSONSchema(`{"properties": {"code": {"pattern": "("}}}`)
+	assert.Error(t, err)
+	_, err = newJSONSchema(`"string"`)
+	assert.EqualError(t, err, "invalid json schema: should be an object or a boolean")
+}
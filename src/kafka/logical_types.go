@@ -0,0 +1,271 @@
+package kafka
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How avro timestamp-millis, timestamp-micros and date fields are decoded.
+const (
+	// AvroTimestampRFC3339 decodes timestamps to times, written as rfc3339 strings, and dates to yyyy-MM-dd strings
+	AvroTimestampRFC3339 = "rfc3339"
+	// AvroTimestampEpochMillis keeps timestamps as epoch millis, timestamp-micros are truncated to millis, and
+	// dates as days since the epoch
+	AvroTimestampEpochMillis = "epoch_millis"
+)
+
+// How avro decimal fields are decoded.
+const (
+	AvroDecimalString = "string"
+	AvroDecimalFloat  = "float"
+)
+
+const avroDateLayout = "2006-01-02"
+
+// logicalConverter converts a native value decoded by goavro to the value of its logical type.
+type logicalConverter func(native interface{}) interface{}
+
+// logicalTypes builds the converters of the logical types of a schema.
+type logicalTypes struct {
+	timestampFormat string
+	decimalFormat   string
+	// named are the converters of the named types, by name and full name
+	named map[string]logicalConverter
+}
+
+// newLogicalConverter is the converter of the logical types of the schema, nil when it has none or can't be parsed,
+// leaving the values as goavro decodes them.
+func (d *Decoder) newLogicalConverter(schema string) logicalConverter {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(schema), &parsed); err != nil {
+		return nil
+	}
+	types := logicalTypes{timestampFormat: d.TimestampFormat, decimalFormat: d.DecimalFormat, named: make(map[string]logicalConverter)}
+	return types.converter(parsed, "")
+}
+
+func (l logicalTypes) converter(schema interface{}, namespace string) logicalConverter {
+	switch s := schema.(type) {
+	case string:
+		if convert, ok := l.named[s]; ok {
+			return convert
+		}
+		if convert, ok := l.named[fullName(s, namespace)]; ok {
+			return convert
+		}
+		return nil
+	case []interface{}:
+		return l.unionConverter(s, namespace)
+	case map[string]interface{}:
+		if logicalType, ok := s["logicalType"].(string); ok {
+			if convert := l.logicalConverter(logicalType, s); convert != nil {
+				l.name(s, namespace, convert)
+				return convert
+			}
+		}
+		switch s["type"] {
+		case "record", "error":
+			return l.recordConverter(s, namespace)
+		case "array":
+			if items := l.converter(s["items"], namespace); items != nil {
+				return func(native interface{}) interface{} {
+					if values, ok := native.([]interface{}); ok {
+						for idx, value := range values {
+							values[idx] = items(value)
+						}
+					}
+					return native
+				}
+			}
+		case "map":
+			if values := l.converter(s["values"], namespace); values != nil {
+				return func(native interface{}) interface{} {
+					if entries, ok := native.(map[string]interface{}); ok {
+						for key, value := range entries {
+							entries[key] = values(value)
+						}
+					}
+					return native
+				}
+			}
+		case "enum", "fixed":
+		default:
+			// a primitive type written as an object
+			return l.converter(s["type"], namespace)
+		}
+	}
+	return nil
+}
+
+func (l logicalTypes) recordConverter(schema map[string]interface{}, namespace string) logicalConverter {
+	name, _ := schema["name"].(string)
+	if ns, ok := schema["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	} else if idx := strings.LastIndex(name, "."); idx >= 0 {
+		namespace = name[:idx]
+	}
+	fields := make(map[string]logicalConverter)
+	// fields may refer to the record itself, so it is named before its fields are
+	convert := func(native interface{}) interface{} {
+		if values, ok := native.(map[string]interface{}); ok {
+			for field, fieldConvert := range fields {
+				if value, ok := values[field]; ok {
+					values[field] = fieldConvert(value)
+				}
+			}
+		}
+		return native
+	}
+	l.name(schema, namespace, convert)
+	fieldSchemas, _ := schema["fields"].([]interface{})
+	for _, fieldSchema := range fieldSchemas {
+		field, ok := fieldSchema.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fieldName, _ := field["name"].(string)
+		if fieldConvert := l.converter(field["type"], namespace); fieldConvert != nil {
+			fields[fieldName] = fieldConvert
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return convert
+}
+
+// unionConverter converts the values of the branches with logical types. goavro decodes unions to the value of
+// their branch, without its name, so every converter is tried, they leave the values of other types untouched.
+func (l logicalTypes) unionConverter(branches []interface{}, namespace string) logicalConverter {
+	var converters []logicalConverter
+	for _, branch := range branches {
+		if convert := l.converter(branch, namespace); convert != nil {
+			converters = append(converters, convert)
+		}
+	}
+	if len(converters) == 0 {
+		return nil
+	}
+	return func(native interface{}) interface{} {
+		for _, convert := range converters {
+			native = convert(native)
+		}
+		return native
+	}
+}
+
+// name registers the converter of a named type, so that it applies where the type is referred to by name.
+func (l logicalTypes) name(schema map[string]interface{}, namespace string, convert logicalConverter) {
+	name, ok := schema["name"].(string)
+	if !ok {
+		return
+	}
+	if ns, ok := schema["namespace"].(string); ok {
+		namespace = ns
+	}
+	l.named[name] = convert
+	l.named[fullName(name, namespace)] = convert
+}
+
+func fullName(name, namespace string) string {
+	if namespace == "" || strings.Contains(name, ".") {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// logicalConverter is the converter of a logical type, nil for the unknown ones and the ones on the wrong
+// primitive, which keep their primitive value as the avro spec says.
+func (l logicalTypes) logicalConverter(logicalType string, schema map[string]interface{}) logicalConverter {
+	primitive := schema["type"]
+	switch {
+	case logicalType == "timestamp-millis" && primitive == "long":
+		return l.timestampConverter(time.Millisecond)
+	case logicalType == "timestamp-micros" && primitive == "long":
+		return l.timestampConverter(time.Microsecond)
+	case logicalType == "date" && primitive == "int":
+		if l.timestampFormat == AvroTimestampEpochMillis {
+			return nil
+		}
+		return func(native interface{}) interface{} {
+			if days, ok := native.(int32); ok {
+				return time.Unix(int64(days)*24*60*60, 0).UTC().Format(avroDateLayout)
+			}
+			return native
+		}
+	case logicalType == "decimal" && (primitive == "bytes" || primitive == "fixed"):
+		scale, _ := schema["scale"].(float64)
+		return l.decimalConverter(int(scale))
+	case logicalType == "uuid" && primitive == "fixed":
+		return func(native interface{}) interface{} {
+			if id, ok := native.([]byte); ok && len(id) == 16 {
+				encoded := hex.EncodeToString(id)
+				return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+			}
+			return native
+		}
+	}
+	// uuids on strings are already decoded to their string form
+	return nil
+}
+
+func (l logicalTypes) timestampConverter(unit time.Duration) logicalConverter {
+	if l.timestampFormat == AvroTimestampEpochMillis {
+		if unit == time.Millisecond {
+			return nil
+		}
+		return func(native interface{}) interface{} {
+			if epoch, ok := native.(int64); ok {
+				return epoch * int64(unit) / int64(time.Millisecond)
+			}
+			return native
+		}
+	}
+	return func(native interface{}) interface{} {
+		if epoch, ok := native.(int64); ok {
+			return time.Unix(0, epoch*int64(unit)).UTC()
+		}
+		return native
+	}
+}
+
+// decimalConverter decodes the big endian two's complement unscaled value of decimals.
+func (l logicalTypes) decimalConverter(scale int) logicalConverter {
+	return func(native interface{}) interface{} {
+		unscaled, ok := native.([]byte)
+		if !ok {
+			return native
+		}
+		decimal := formatDecimal(unscaled, scale)
+		if l.decimalFormat == AvroDecimalFloat {
+			if value, err := strconv.ParseFloat(decimal, 64); err == nil {
+				return value
+			}
+		}
+		return decimal
+	}
+}
+
+func formatDecimal(unscaled []byte, scale int) string {
+	value := new(big.Int).SetBytes(unscaled)
+	if len(unscaled) > 0 && unscaled[0]&0x80 != 0 {
+		value.Sub(value, new(big.Int).Lsh(big.NewInt(1), uint(len(unscaled)*8)))
+	}
+	sign := ""
+	if value.Sign() < 0 {
+		sign = "-"
+		value.Neg(value)
+	}
+	digits := value.String()
+	if scale <= 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
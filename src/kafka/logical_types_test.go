@@ -0,0 +1,102 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/inloco/kafka-elasticsearch-injector/src/kafka/fixtures"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLogicalTypesMessage(t *testing.T) (*sarama.ConsumerMessage, *schema_registry.SchemaRegistry, func()) {
+	optionalAt := int64(1709650000000)
+	event := &fixtures.LogicalTypesRecord{
+		CreatedAt: 1709650000123,
+		UpdatedAt: 1709650000123456,
+		Birthday:  19787,
+		// 12345 and -1234567 unscaled
+		Price:      []byte{0x30, 0x39},
+		Balance:    []byte{0xff, 0xed, 0x29, 0x79},
+		Id:         "5f0c1f52-6f4e-4a7c-9a6b-0b1f2c3d4e5f",
+		FixedId:    []byte{0x5f, 0x0c, 0x1f, 0x52, 0x6f, 0x4e, 0x4a, 0x7c, 0x9a, 0x6b, 0x0b, 0x1f, 0x2c, 0x3d, 0x4e, 0x5f},
+		OptionalAt: &optionalAt,
+		History:    []int64{0, 1000},
+	}
+	schema, err := json.Marshal(map[string]string{"schema": event.Schema()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(schema)
+	}))
+	registry, err := schema_registry.NewSchemaRegistry(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := event.ToAvroSerialization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &sarama.ConsumerMessage{Topic: "test", Value: append([]byte{0, 0, 0, 0, 1}, value...)}
+	return msg, registry, server.Close
+}
+
+func TestDecoder_LogicalTypes(t *testing.T) {
+	msg, registry, closeRegistry := newLogicalTypesMessage(t)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}
+
+	record, err := d.AvroMessageToRecord(context.Background(), msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, time.Date(2024, 3, 5, 14, 46, 40, 123000000, time.UTC), record.Json["created_at"])
+	assert.Equal(t, time.Date(2024, 3, 5, 14, 46, 40, 123456000, time.UTC), record.Json["updated_at"])
+	assert.Equal(t, "2024-03-05", record.Json["birthday"])
+	assert.Equal(t, "123.45", record.Json["price"])
+	assert.Equal(t, "-1234.567", record.Json["balance"])
+	assert.Equal(t, "5f0c1f52-6f4e-4a7c-9a6b-0b1f2c3d4e5f", record.Json["id"])
+	assert.Equal(t, "5f0c1f52-6f4e-4a7c-9a6b-0b1f2c3d4e5f", record.Json["fixed_id"])
+	assert.Equal(t, time.Date(2024, 3, 5, 14, 46, 40, 0, time.UTC), record.Json["optional_at"])
+	assert.Equal(t, []interface{}{time.Unix(0, 0).UTC(), time.Unix(1, 0).UTC()}, record.Json["history"])
+
+	createdAt, err := record.GetValueForField("created_at")
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-03-05T14:46:40.123Z", createdAt)
+
+	document, err := json.Marshal(record.Json["created_at"])
+	assert.NoError(t, err)
+	assert.Equal(t, `"2024-03-05T14:46:40.123Z"`, string(document))
+}
+
+func TestDecoder_LogicalTypes_Passthrough(t *testing.T) {
+	msg, registry, closeRegistry := newLogicalTypesMessage(t)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}, TimestampFormat: AvroTimestampEpochMillis, DecimalFormat: AvroDecimalFloat}
+
+	record, err := d.AvroMessageToRecord(context.Background(), msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1709650000123), record.Json["created_at"])
+	assert.Equal(t, int64(1709650000123), record.Json["updated_at"])
+	assert.Equal(t, int32(19787), record.Json["birthday"])
+	assert.Equal(t, 123.45, record.Json["price"])
+	assert.Equal(t, -1234.567, record.Json["balance"])
+	assert.Equal(t, int64(1709650000000), record.Json["optional_at"])
+}
+
+func TestFormatDecimal(t *testing.T) {
+	assert.Equal(t, "0.05", formatDecimal([]byte{0x05}, 2))
+	assert.Equal(t, "-0.05", formatDecimal([]byte{0xfb}, 2))
+	assert.Equal(t, "128", formatDecimal([]byte{0x00, 0x80}, 0))
+	assert.Equal(t, "-128", formatDecimal([]byte{0x80}, 0))
+	assert.Equal(t, "0", formatDecimal(nil, 0))
+}
@@ -0,0 +1,157 @@
+package kafka
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetTracker tells which offsets can be marked once the messages of a batch are inserted. The workers insert
+// the batches of a partition concurrently and may finish them out of order, while marking an offset commits every
+// message before it, so an offset is only marked once all the messages consumed before it are inserted too.
+type offsetTracker struct {
+	mutex      sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+	// pending is the number of offsets consumed and not marked yet across partitions
+	pending int
+}
+
+// partitionOffsets are the offsets of a partition consumed but not marked yet, in the order they were consumed.
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]bool
+	// next is the offset the partition is consumed from once its marked offset is committed
+	next int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[topicPartition]*partitionOffsets)}
+}
+
+// consumed adds the offset of a message handed to the workers.
+func (t *offsetTracker) consumed(msg *sarama.ConsumerMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	key := topicPartition{msg.Topic, msg.Partition}
+	partition, ok := t.partitions[key]
+	if !ok {
+		partition = &partitionOffsets{done: make(map[int64]bool), next: msg.Offset}
+		t.partitions[key] = partition
+	}
+	if n := len(partition.pending); n > 0 && msg.Offset <= partition.pending[n-1] {
+		// after a rebalance the partition is consumed again from its marked offset, the messages consumed before
+		// are either inserted by the batches still in flight or consumed again
+		t.pending -= len(partition.pending)
+		partition.pending = nil
+		partition.done = make(map[int64]bool)
+		partition.next = msg.Offset
+	}
+	partition.pending = append(partition.pending, msg.Offset)
+	t.pending++
+}
+
+// inserted acknowledges the messages of a batch, returning for each partition the highest offset that can be
+// marked, if any.
+func (t *offsetTracker) inserted(msgs []*sarama.ConsumerMessage) []topicPartitionOffset {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	touched := make(map[topicPartition]bool)
+	for _, msg := range msgs {
+		key := topicPartition{msg.Topic, msg.Partition}
+		partition, ok := t.partitions[key]
+		if !ok {
+			continue
+		}
+		idx := sort.Search(len(partition.pending), func(i int) bool { return partition.pending[i] >= msg.Offset })
+		if idx < len(partition.pending) && partition.pending[idx] == msg.Offset {
+			partition.done[msg.Offset] = true
+			touched[key] = true
+		}
+	}
+	var marks []topicPartitionOffset
+	for key := range touched {
+		partition := t.partitions[key]
+		marked := int64(-1)
+		for len(partition.pending) > 0 && partition.done[partition.pending[0]] {
+			marked = partition.pending[0]
+			delete(partition.done, marked)
+			partition.pending = partition.pending[1:]
+			t.pending--
+		}
+		if marked >= 0 {
+			partition.next = marked + 1
+			marks = append(marks, topicPartitionOffset{key.topic, key.partition, marked})
+		}
+	}
+	return marks
+}
+
+// revoke forgets the offsets of every partition, since they are all released on rebalance. The messages not
+// inserted by then are consumed again by the next owner of their partition, this instance included, so they are
+// dropped. It returns the number of offsets forgotten.
+func (t *offsetTracker) revoke() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	revoked := t.pending
+	t.partitions = make(map[topicPartition]*partitionOffsets)
+	t.pending = 0
+	return revoked
+}
+
+// tracked keeps the messages of the batch whose offsets are still to be inserted, leaving out the ones consumed
+// before their partition was revoked. The batch is filtered in place.
+func (t *offsetTracker) tracked(msgs []*sarama.ConsumerMessage) []*sarama.ConsumerMessage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		partition, ok := t.partitions[topicPartition{msg.Topic, msg.Partition}]
+		if !ok {
+			continue
+		}
+		idx := sort.Search(len(partition.pending), func(i int) bool { return partition.pending[i] >= msg.Offset })
+		if idx < len(partition.pending) && partition.pending[idx] == msg.Offset && !partition.done[msg.Offset] {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// inFlight is the number of records consumed and not marked yet, inserted or not.
+func (t *offsetTracker) inFlight() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.pending
+}
+
+// committed is the offset each partition consumed is committed at, or is about to once marked.
+func (t *offsetTracker) committed() map[string]map[int32]int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	committed := make(map[string]map[int32]int64)
+	for key, partition := range t.partitions {
+		if committed[key.topic] == nil {
+			committed[key.topic] = make(map[int32]int64)
+		}
+		committed[key.topic][key.partition] = partition.next
+	}
+	return committed
+}
+
+// assignedHighWaterMarks leaves out the partitions that are no longer assigned to this instance, whose lag is
+// reported by the instance they were assigned to.
+func assignedHighWaterMarks(highWaterMarks map[string]map[int32]int64, subscriptions map[string][]int32) map[string]map[int32]int64 {
+	assigned := make(map[string]map[int32]int64)
+	for topic, partitions := range subscriptions {
+		for _, partition := range partitions {
+			if offset, ok := highWaterMarks[topic][partition]; ok {
+				if assigned[topic] == nil {
+					assigned[topic] = make(map[int32]int64)
+				}
+				assigned[topic][partition] = offset
+			}
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,70 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func trackedMessages(tracker *offsetTracker, topic string, partition int32, offsets ...int64) []*sarama.ConsumerMessage {
+	var msgs []*sarama.ConsumerMessage
+	for _, offset := range offsets {
+		msg := &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: offset}
+		tracker.consumed(msg)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestOffsetTracker_OutOfOrder(t *testing.T) {
+	tracker := newOffsetTracker()
+	first := trackedMessages(tracker, "t", 0, 10, 11)
+	second := trackedMessages(tracker, "t", 0, 12, 13)
+
+	// the second batch of the partition is inserted first, its offsets can't be marked before the first batch's
+	assert.Empty(t, tracker.inserted(second))
+	assert.Equal(t, []topicPartitionOffset{{"t", 0, 13}}, tracker.inserted(first))
+}
+
+func TestOffsetTracker_FailedBatch(t *testing.T) {
+	tracker := newOffsetTracker()
+	failed := trackedMessages(tracker, "t", 0, 10, 11)
+	inserted := trackedMessages(tracker, "t", 0, 12)
+	other := trackedMessages(tracker, "t", 1, 5)
+
+	// the batch that is never inserted, as on shutdown, holds back the offsets of its partition only
+	assert.Empty(t, tracker.inserted(inserted))
+	assert.Equal(t, []topicPartitionOffset{{"t", 1, 5}}, tracker.inserted(other))
+	// a part of the batch inserted on its own, like the head of a partially failed batch
+	assert.Equal(t, []topicPartitionOffset{{"t", 0, 10}}, tracker.inserted(failed[:1]))
+}
+
+func TestOffsetTracker_Rebalance(t *testing.T) {
+	tracker := newOffsetTracker()
+	inFlight := trackedMessages(tracker, "t", 0, 10, 11)
+	// the partition is consumed again from its marked offset
+	again := trackedMessages(tracker, "t", 0, 10, 11, 12)
+
+	assert.Empty(t, tracker.inserted(again[2:]))
+	// the batch in flight inserted the same messages, which don't have to wait for their second insert
+	assert.Equal(t, []topicPartitionOffset{{"t", 0, 12}}, tracker.inserted(inFlight))
+	assert.Empty(t, tracker.inserted(again[:2]))
+}
+
+func TestOffsetTracker_Committed(t *testing.T) {
+	tracker := newOffsetTracker()
+	first := trackedMessages(tracker, "t", 0, 10, 11)
+	trackedMessages(tracker, "t", 1, 5)
+	// nothing marked yet, the partitions are committed at the first offset consumed
+	assert.Equal(t, map[string]map[int32]int64{"t": {0: 10, 1: 5}}, tracker.committed())
+
+	tracker.inserted(first)
+	assert.Equal(t, map[string]map[int32]int64{"t": {0: 12, 1: 5}}, tracker.committed())
+}
+
+func TestAssignedHighWaterMarks(t *testing.T) {
+	highWaterMarks := map[string]map[int32]int64{"t": {0: 100, 1: 50, 2: 10}}
+	subscriptions := map[string][]int32{"t": {0, 2}, "u": {0}}
+	assert.Equal(t, map[string]map[int32]int64{"t": {0: 100, 2: 10}}, assignedHighWaterMarks(highWaterMarks, subscriptions))
+}
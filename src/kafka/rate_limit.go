@@ -0,0 +1,136 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// RateLimiter spaces the messages out to at most a number of records and of bytes per second, across the
+// workers. Each message waits for the ones before it to be spent at the rate, so that bursts are smoothed rather
+// than batches held back at once. The limits can be changed while running, 0 means unlimited.
+type RateLimiter struct {
+	mu               sync.Mutex
+	recordsPerSecond int
+	bytesPerSecond   int
+	// nextRecord and nextByte are when the next message is allowed by each limit
+	nextRecord time.Time
+	nextByte   time.Time
+}
+
+// RateLimits are the limits of a RateLimiter, as read and written by its HTTP handler.
+type RateLimits struct {
+	RecordsPerSecond int `json:"records_per_second"`
+	BytesPerSecond   int `json:"bytes_per_second"`
+}
+
+func NewRateLimiter(recordsPerSecond, bytesPerSecond int) *RateLimiter {
+	limiter := &RateLimiter{}
+	limiter.SetLimits(RateLimits{RecordsPerSecond: recordsPerSecond, BytesPerSecond: bytesPerSecond})
+	return limiter
+}
+
+func (l *RateLimiter) Limits() RateLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return RateLimits{RecordsPerSecond: l.recordsPerSecond, BytesPerSecond: l.bytesPerSecond}
+}
+
+// SetLimits changes the limits, the messages already waiting keep their delay.
+func (l *RateLimiter) SetLimits(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recordsPerSecond = limits.RecordsPerSecond
+	l.bytesPerSecond = limits.BytesPerSecond
+	// the next messages are spaced out at the new rate from now on, not after the ones reserved at the old one
+	now := time.Now()
+	l.nextRecord, l.nextByte = now, now
+}
+
+// reserve spends the rate of a message of size bytes, returning how long it has to wait for.
+func (l *RateLimiter) reserve(size int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var delay time.Duration
+	if l.recordsPerSecond > 0 {
+		delay = reserveAt(&l.nextRecord, now, time.Second/time.Duration(l.recordsPerSecond))
+	}
+	if l.bytesPerSecond > 0 && size > 0 {
+		cost := time.Duration(int64(size) * int64(time.Second) / int64(l.bytesPerSecond))
+		if bytesDelay := reserveAt(&l.nextByte, now, cost); bytesDelay > delay {
+			delay = bytesDelay
+		}
+	}
+	return delay
+}
+
+func reserveAt(next *time.Time, now time.Time, cost time.Duration) time.Duration {
+	if next.Before(now) {
+		*next = now
+	}
+	delay := next.Sub(now)
+	*next = next.Add(cost)
+	return delay
+}
+
+// wait blocks until a message of size bytes is allowed, it returns false if the context is done first. A nil
+// limiter never waits.
+func (l *RateLimiter) wait(ctx context.Context, size int) bool {
+	if l == nil {
+		return true
+	}
+	delay := l.reserve(size)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ServeHTTP returns the limits as json, or changes the ones given as query parameters on PUT and POST, like
+// "?records_per_second=1000".
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		limits := l.Limits()
+		for param, limit := range map[string]*int{
+			"records_per_second": &limits.RecordsPerSecond,
+			"bytes_per_second":   &limits.BytesPerSecond,
+		} {
+			value := r.URL.Query().Get(param)
+			if value == "" {
+				continue
+			}
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, "invalid "+param+": "+value, http.StatusBadRequest)
+				return
+			}
+			*limit = parsed
+		}
+		l.SetLimits(limits)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Limits())
+}
+
+// messageSize is the size a message counts for against the bytes limit.
+func messageSize(msg *sarama.ConsumerMessage) int {
+	return len(msg.Key) + len(msg.Value)
+}
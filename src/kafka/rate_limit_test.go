@@ -0,0 +1,87 @@
+package kafka
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Records(t *testing.T) {
+	var unlimited *RateLimiter
+	assert.True(t, unlimited.wait(context.Background(), 10))
+	assert.Equal(t, time.Duration(0), NewRateLimiter(0, 0).reserve(10))
+
+	limiter := NewRateLimiter(100, 0)
+	begin := time.Now()
+	var waits sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		waits.Add(1)
+		go func() {
+			defer waits.Done()
+			for j := 0; j < 5; j++ {
+				limiter.wait(context.Background(), 1)
+			}
+		}()
+	}
+	waits.Wait()
+	// the first record goes right away, the others 10ms apart
+	assert.True(t, time.Since(begin) >= 190*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limiter = NewRateLimiter(1, 0)
+	assert.True(t, limiter.wait(ctx, 1))
+	assert.False(t, limiter.wait(ctx, 1))
+}
+
+func TestRateLimiter_Bytes(t *testing.T) {
+	limiter := NewRateLimiter(1000, 1000)
+	assert.Equal(t, time.Duration(0), limiter.reserve(500))
+	// the bytes of the first message hold the second one longer than its record
+	delay := limiter.reserve(10)
+	assert.True(t, delay > 400*time.Millisecond && delay <= 500*time.Millisecond, delay)
+
+	// lifting the limits lets the next messages go right away
+	limiter.SetLimits(RateLimits{})
+	assert.Equal(t, time.Duration(0), limiter.reserve(500))
+	assert.Equal(t, time.Duration(0), limiter.reserve(500))
+}
+
+func TestRateLimiter_ServeHTTP(t *testing.T) {
+	limiter := NewRateLimiter(100, 0)
+	server := httptest.NewServer(limiter)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		response.Body.Close()
+	}
+
+	request, _ := http.NewRequest(http.MethodPut, server.URL+"?bytes_per_second=5000", nil)
+	response, err = http.DefaultClient.Do(request)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		response.Body.Close()
+	}
+	assert.Equal(t, RateLimits{RecordsPerSecond: 100, BytesPerSecond: 5000}, limiter.Limits())
+
+	response, err = http.Post(server.URL+"?records_per_second=0", "", strings.NewReader(""))
+	if assert.NoError(t, err) {
+		response.Body.Close()
+	}
+	assert.Equal(t, RateLimits{BytesPerSecond: 5000}, limiter.Limits())
+
+	response, err = http.Post(server.URL+"?records_per_second=fast", "", strings.NewReader(""))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+		response.Body.Close()
+	}
+	assert.Equal(t, RateLimits{BytesPerSecond: 5000}, limiter.Limits())
+}
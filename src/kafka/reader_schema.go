@@ -0,0 +1,557 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/goavro"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+)
+
+// ReaderSchemaConfig is the reader schema the values of a topic are decoded with: an inline schema, or the latest
+// version of a subject of the schema registry.
+type ReaderSchemaConfig struct {
+	Subject string          `json:"subject"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// ParseReaderSchemas parses the JSON object of reader schemas keyed by topic, given inline or in a file.
+func ParseReaderSchemas(value, path string) (map[string]ReaderSchemaConfig, error) {
+	if value != "" && path != "" {
+		return nil, errors.New("only one of the reader schemas and the reader schemas path should be set")
+	}
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the reader schemas %s: %s", path, err)
+		}
+		value = string(content)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	var configs map[string]ReaderSchemaConfig
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, err
+	}
+	for topic, config := range configs {
+		if (config.Subject == "") == (len(config.Schema) == 0) {
+			return nil, fmt.Errorf("the reader schema of topic %s should have either a subject or a schema", topic)
+		}
+	}
+	return configs, nil
+}
+
+// readerSchema is a parsed reader schema.
+type readerSchema struct {
+	schema   string
+	resolver *avroResolver
+	logical  logicalConverter
+}
+
+// ReaderSchemas are the reader schemas of the topics, the ones of subjects are refreshed with Refresh.
+type ReaderSchemas struct {
+	configs  map[string]ReaderSchemaConfig
+	registry *schema_registry.SchemaRegistry
+	decoder  *Decoder
+	logger   log.Logger
+	lock     sync.RWMutex
+	readers  map[string]*readerSchema
+}
+
+// NewReaderSchemas loads the reader schemas, failing when any of them can't be fetched or parsed.
+func NewReaderSchemas(configs map[string]ReaderSchemaConfig, registry *schema_registry.SchemaRegistry, decoder *Decoder, logger log.Logger) (*ReaderSchemas, error) {
+	r := &ReaderSchemas{configs: configs, registry: registry, decoder: decoder, logger: logger, readers: make(map[string]*readerSchema)}
+	for topic, config := range configs {
+		schema := string(config.Schema)
+		if config.Subject != "" {
+			if registry == nil {
+				return nil, fmt.Errorf("the reader schema of topic %s needs the schema registry", topic)
+			}
+			latest, err := registry.GetLatestSchema(config.Subject)
+			if err != nil {
+				return nil, err
+			}
+			schema = latest
+		}
+		reader, err := r.parse(schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reader schema of topic %s: %s", topic, err)
+		}
+		r.readers[topic] = reader
+	}
+	return r, nil
+}
+
+func (r *ReaderSchemas) parse(schema string) (*readerSchema, error) {
+	if _, err := goavro.NewCodec(schema); err != nil {
+		return nil, err
+	}
+	resolver, err := newAvroResolver(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &readerSchema{schema: schema, resolver: resolver, logical: r.decoder.newLogicalConverter(schema)}, nil
+}
+
+func (r *ReaderSchemas) readerFor(topic string) *readerSchema {
+	if r == nil {
+		return nil
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.readers[topic]
+}
+
+// Refresh fetches the latest version of the subjects of the reader schemas every interval, keeping the current
+// schema of a topic when its fetch fails. It never returns.
+func (r *ReaderSchemas) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.refresh()
+	}
+}
+
+func (r *ReaderSchemas) refresh() {
+	for topic, config := range r.configs {
+		if config.Subject == "" {
+			continue
+		}
+		schema, err := r.registry.GetLatestSchema(config.Subject)
+		if err != nil {
+			level.Warn(r.logger).Log("err", err, "message", "could not refresh the reader schema, keeping the current one", "topic", topic, "subject", config.Subject)
+			continue
+		}
+		if current := r.readerFor(topic); current != nil && current.schema == schema {
+			continue
+		}
+		reader, err := r.parse(schema)
+		if err != nil {
+			level.Warn(r.logger).Log("err", err, "message", "invalid reader schema, keeping the current one", "topic", topic, "subject", config.Subject)
+			continue
+		}
+		r.lock.Lock()
+		r.readers[topic] = reader
+		r.lock.Unlock()
+		level.Info(r.logger).Log("message", "reader schema updated", "topic", topic, "subject", config.Subject)
+	}
+}
+
+// avroResolver projects the values decoded with a writer schema onto the reader schema, following the resolution
+// rules of the avro spec: fields missing from the writer get their default, fields unknown to the reader are left
+// out, and numbers are promoted. goavro decodes unions without their branch, so the branch of the reader is chosen
+// by the type of the value.
+type avroResolver struct {
+	schema interface{}
+	// named are the named types of the reader, by name and full name
+	named map[string]map[string]interface{}
+}
+
+func newAvroResolver(schema string) (*avroResolver, error) {
+	resolver := &avroResolver{named: make(map[string]map[string]interface{})}
+	if err := json.Unmarshal([]byte(schema), &resolver.schema); err != nil {
+		return nil, err
+	}
+	resolver.register(resolver.schema, "")
+	return resolver, nil
+}
+
+// register names the named types of the schema.
+func (a *avroResolver) register(schema interface{}, namespace string) {
+	switch s := schema.(type) {
+	case []interface{}:
+		for _, branch := range s {
+			a.register(branch, namespace)
+		}
+	case map[string]interface{}:
+		if name, ok := s["name"].(string); ok {
+			switch s["type"] {
+			case "record", "error", "enum", "fixed":
+				namespace = typeNamespace(s, namespace)
+				a.named[name] = s
+				a.named[fullName(name, namespace)] = s
+			}
+		}
+		if fields, ok := s["fields"].([]interface{}); ok {
+			for _, field := range fields {
+				if field, ok := field.(map[string]interface{}); ok {
+					a.register(field["type"], namespace)
+				}
+			}
+		}
+		a.register(s["items"], namespace)
+		a.register(s["values"], namespace)
+		if _, named := s["type"].(string); !named {
+			a.register(s["type"], namespace)
+		}
+	}
+}
+
+// typeNamespace is the namespace of a named type and of the types it encloses.
+func typeNamespace(schema map[string]interface{}, namespace string) string {
+	name, _ := schema["name"].(string)
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		return name[:idx]
+	}
+	if ns, ok := schema["namespace"].(string); ok {
+		return ns
+	}
+	return namespace
+}
+
+func (a *avroResolver) resolve(value interface{}) (interface{}, error) {
+	return a.resolveValue(a.schema, "", value, true)
+}
+
+// resolveValue resolves the value to the schema, promoting numbers only when promote is set.
+func (a *avroResolver) resolveValue(schema interface{}, namespace string, value interface{}, promote bool) (interface{}, error) {
+	switch s := schema.(type) {
+	case string:
+		if named, ok := a.named[s]; ok {
+			return a.resolveValue(named, namespace, value, promote)
+		}
+		if named, ok := a.named[fullName(s, namespace)]; ok {
+			return a.resolveValue(named, namespace, value, promote)
+		}
+		return resolvePrimitive(s, value, promote)
+	case []interface{}:
+		// the branch of the same type first, then the ones the value is promoted to
+		for _, promoteBranch := range []bool{false, true} {
+			for _, branch := range s {
+				if resolved, err := a.resolveValue(branch, namespace, value, promoteBranch); err == nil {
+					return resolved, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("no branch of union %s matches %s", schemaName(s), valueType(value))
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record", "error":
+			return a.resolveRecord(s, typeNamespace(s, namespace), value)
+		case "enum":
+			symbol, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected an enum symbol, got %s", valueType(value))
+			}
+			symbols, _ := s["symbols"].([]interface{})
+			for _, known := range symbols {
+				if known == symbol {
+					return symbol, nil
+				}
+			}
+			if fallback, ok := s["default"].(string); ok {
+				return fallback, nil
+			}
+			return nil, fmt.Errorf("symbol %s is not in enum %v", symbol, s["name"])
+		case "fixed":
+			fixed, ok := value.([]byte)
+			size, _ := s["size"].(float64)
+			if !ok || len(fixed) != int(size) {
+				return nil, fmt.Errorf("expected %v bytes of fixed %v, got %s", size, s["name"], valueType(value))
+			}
+			return fixed, nil
+		case "array":
+			items, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an array, got %s", valueType(value))
+			}
+			resolved := make([]interface{}, len(items))
+			for idx, item := range items {
+				var err error
+				if resolved[idx], err = a.resolveValue(s["items"], namespace, item, promote); err != nil {
+					return nil, fmt.Errorf("item %d: %s", idx, err)
+				}
+			}
+			return resolved, nil
+		case "map":
+			entries, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected a map, got %s", valueType(value))
+			}
+			resolved := make(map[string]interface{}, len(entries))
+			for key, entry := range entries {
+				var err error
+				if resolved[key], err = a.resolveValue(s["values"], namespace, entry, promote); err != nil {
+					return nil, fmt.Errorf("value %s: %s", key, err)
+				}
+			}
+			return resolved, nil
+		default:
+			// a primitive type written as an object, possibly with a logical type
+			return a.resolveValue(s["type"], namespace, value, promote)
+		}
+	}
+	return nil, fmt.Errorf("invalid reader schema %v", schema)
+}
+
+func (a *avroResolver) resolveRecord(schema map[string]interface{}, namespace string, value interface{}) (interface{}, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected record %v, got %s", schema["name"], valueType(value))
+	}
+	readerFields, _ := schema["fields"].([]interface{})
+	resolved := make(map[string]interface{}, len(readerFields))
+	for _, readerField := range readerFields {
+		field, ok := readerField.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := field["name"].(string)
+		fieldValue, found := fields[name]
+		if !found {
+			aliases, _ := field["aliases"].([]interface{})
+			for _, alias := range aliases {
+				if alias, ok := alias.(string); ok {
+					if fieldValue, found = fields[alias]; found {
+						break
+					}
+				}
+			}
+		}
+		if !found {
+			fallback, hasDefault := field["default"]
+			if !hasDefault {
+				return nil, fmt.Errorf("field %s of record %v is missing from the writer schema and has no default", name, schema["name"])
+			}
+			value, err := a.defaultValue(field["type"], namespace, fallback)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default of field %s: %s", name, err)
+			}
+			resolved[name] = value
+			continue
+		}
+		value, err := a.resolveValue(field["type"], namespace, fieldValue, true)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", name, err)
+		}
+		resolved[name] = value
+	}
+	return resolved, nil
+}
+
+// defaultValue is the native value of the json default of a field. The defaults of unions are of their first branch.
+func (a *avroResolver) defaultValue(schema interface{}, namespace string, fallback interface{}) (interface{}, error) {
+	switch s := schema.(type) {
+	case []interface{}:
+		if len(s) == 0 {
+			return nil, errors.New("empty union")
+		}
+		return a.defaultValue(s[0], namespace, fallback)
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record", "error":
+			values, ok := fallback.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an object, got %v", fallback)
+			}
+			ns := typeNamespace(s, namespace)
+			fields, _ := s["fields"].([]interface{})
+			record := make(map[string]interface{}, len(fields))
+			for _, field := range fields {
+				field, ok := field.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				name, _ := field["name"].(string)
+				value, ok := values[name]
+				if !ok {
+					if value, ok = field["default"]; !ok {
+						return nil, fmt.Errorf("field %s is missing", name)
+					}
+				}
+				var err error
+				if record[name], err = a.defaultValue(field["type"], ns, value); err != nil {
+					return nil, err
+				}
+			}
+			return record, nil
+		case "array":
+			items, ok := fallback.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an array, got %v", fallback)
+			}
+			resolved := make([]interface{}, len(items))
+			for idx, item := range items {
+				var err error
+				if resolved[idx], err = a.defaultValue(s["items"], namespace, item); err != nil {
+					return nil, err
+				}
+			}
+			return resolved, nil
+		case "map":
+			entries, ok := fallback.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected an object, got %v", fallback)
+			}
+			resolved := make(map[string]interface{}, len(entries))
+			for key, entry := range entries {
+				var err error
+				if resolved[key], err = a.defaultValue(s["values"], namespace, entry); err != nil {
+					return nil, err
+				}
+			}
+			return resolved, nil
+		case "enum":
+			return a.resolveValue(s, namespace, fallback, false)
+		case "fixed":
+			return a.resolveValue(s, namespace, defaultBytes(fallback), false)
+		default:
+			return a.defaultValue(s["type"], namespace, fallback)
+		}
+	case string:
+		if named, ok := a.named[s]; ok {
+			return a.defaultValue(named, namespace, fallback)
+		}
+		if named, ok := a.named[fullName(s, namespace)]; ok {
+			return a.defaultValue(named, namespace, fallback)
+		}
+		switch s {
+		case "bytes":
+			return resolvePrimitive(s, defaultBytes(fallback), false)
+		case "int", "long", "float", "double":
+			number, ok := fallback.(float64)
+			if !ok {
+				return nil, fmt.Errorf("expected a number, got %v", fallback)
+			}
+			switch s {
+			case "int":
+				return int32(number), nil
+			case "long":
+				return int64(number), nil
+			case "float":
+				return float32(number), nil
+			}
+			return number, nil
+		}
+		return resolvePrimitive(s, fallback, false)
+	}
+	return nil, fmt.Errorf("invalid reader schema %v", schema)
+}
+
+// defaultBytes are the bytes of the json default of bytes and fixed, a string of code points from 0 to 255.
+func defaultBytes(fallback interface{}) interface{} {
+	text, ok := fallback.(string)
+	if !ok {
+		return fallback
+	}
+	bytes := make([]byte, 0, len(text))
+	for _, char := range text {
+		bytes = append(bytes, byte(char))
+	}
+	return bytes
+}
+
+func resolvePrimitive(primitive string, value interface{}, promote bool) (interface{}, error) {
+	switch primitive {
+	case "null":
+		if value == nil {
+			return nil, nil
+		}
+	case "boolean":
+		if _, ok := value.(bool); ok {
+			return value, nil
+		}
+	case "int":
+		if _, ok := value.(int32); ok {
+			return value, nil
+		}
+	case "long":
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case int32:
+			if promote {
+				return int64(v), nil
+			}
+		}
+	case "float":
+		switch v := value.(type) {
+		case float32:
+			return v, nil
+		case int32:
+			if promote {
+				return float32(v), nil
+			}
+		case int64:
+			if promote {
+				return float32(v), nil
+			}
+		}
+	case "double":
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case float32:
+			if promote {
+				return float64(v), nil
+			}
+		case int32:
+			if promote {
+				return float64(v), nil
+			}
+		case int64:
+			if promote {
+				return float64(v), nil
+			}
+		}
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case []byte:
+			if promote {
+				return string(v), nil
+			}
+		}
+	case "bytes":
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			if promote {
+				return []byte(v), nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s", primitive)
+	}
+	return nil, fmt.Errorf("expected %s, got %s", primitive, valueType(value))
+}
+
+func schemaName(schema interface{}) string {
+	encoded, _ := json.Marshal(schema)
+	return string(encoded)
+}
+
+// valueType is the avro type of a value decoded by goavro.
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case float32:
+		return "float"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "record or map"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,222 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-kit/kit/log"
+	"github.com/inloco/goavro"
+	"github.com/inloco/kafka-elasticsearch-injector/src/schema_registry"
+	"github.com/stretchr/testify/assert"
+)
+
+const writerSchema = `{"type": "record", "name": "Click", "namespace": "events", "fields": [
+	{"name": "id", "type": "int"},
+	{"name": "old_name", "type": "string"},
+	{"name": "score", "type": ["null", "int"]},
+	{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B", "C"]}},
+	{"name": "internal", "type": "string"}
+]}`
+
+const clickReaderSchema = `{"type": "record", "name": "Click", "namespace": "events", "fields": [
+	{"name": "id", "type": "long"},
+	{"name": "name", "type": "string", "aliases": ["old_name"]},
+	{"name": "score", "type": ["null", "string", "double"]},
+	{"name": "kind", "type": {"type": "enum", "name": "Kind", "symbols": ["A", "B"], "default": "A"}},
+	{"name": "country", "type": "string", "default": "BR"},
+	{"name": "device", "type": ["null", {"type": "record", "name": "Device", "fields": [{"name": "os", "type": "string"}]}], "default": null},
+	{"name": "tags", "type": {"type": "array", "items": "string"}, "default": ["new"]},
+	{"name": "created_at", "type": {"type": "long", "logicalType": "timestamp-millis"}, "default": 0}
+]}`
+
+// newReaderSchemaRegistry serves the writer schema by id and latest as the latest version of subject clicks-value.
+func newReaderSchemaRegistry(t *testing.T, latest *string) (*schema_registry.SchemaRegistry, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schema := writerSchema
+		if r.URL.Path == "/subjects/clicks-value/versions/latest" {
+			schema = *latest
+		}
+		encoded, _ := json.Marshal(map[string]string{"schema": schema})
+		w.Write(encoded)
+	}))
+	registry, err := schema_registry.NewSchemaRegistry(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry, server.Close
+}
+
+func newWriterMessage(t *testing.T, kind string) *sarama.ConsumerMessage {
+	codec, err := goavro.NewCodec(writerSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"id":       int32(7),
+		"old_name": "alice",
+		"score":    map[string]interface{}{"int": int32(3)},
+		"kind":     kind,
+		"internal": "dropped",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sarama.ConsumerMessage{Topic: "clicks", Value: append([]byte{0, 0, 0, 0, 1}, value...)}
+}
+
+func TestDecoder_ReaderSchema(t *testing.T) {
+	latest := clickReaderSchema
+	registry, closeRegistry := newReaderSchemaRegistry(t, &latest)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}
+	readers, err := NewReaderSchemas(map[string]ReaderSchemaConfig{"clicks": {Subject: "clicks-value"}}, registry, d, log.NewNopLogger())
+	if !assert.NoError(t, err) {
+		return
+	}
+	d.ReaderSchemas = readers
+
+	record, err := d.AvroMessageToRecord(context.Background(), newWriterMessage(t, "C"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	delete(record.Json, kafkaTimestampKey)
+	assert.Equal(t, map[string]interface{}{
+		"id":         int64(7),
+		"name":       "alice",
+		"score":      float64(3),
+		"kind":       "A",
+		"country":    "BR",
+		"device":     nil,
+		"tags":       []interface{}{"new"},
+		"created_at": record.Json["created_at"],
+	}, record.Json)
+	// logical types of the reader schema are decoded
+	createdAt, err := record.GetValueForField("created_at")
+	assert.NoError(t, err)
+	assert.Equal(t, "1970-01-01T00:00:00Z", createdAt)
+
+	// other topics keep their writer schema
+	msg := newWriterMessage(t, "B")
+	msg.Topic = "views"
+	record, err = d.AvroMessageToRecord(context.Background(), msg)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int32(7), record.Json["id"])
+		assert.Equal(t, "dropped", record.Json["internal"])
+	}
+}
+
+func TestDecoder_ReaderSchema_Incompatible(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	latest := ""
+	registry, closeRegistry := newReaderSchemaRegistry(t, &latest)
+	defer closeRegistry()
+	d.SchemaRegistry = registry
+	readers, err := NewReaderSchemas(map[string]ReaderSchemaConfig{"clicks": {Schema: json.RawMessage(`{"type": "record", "name": "Click", "fields": [
+		{"name": "id", "type": "int"},
+		{"name": "region", "type": "string"}
+	]}`)}}, nil, d, log.NewNopLogger())
+	if !assert.NoError(t, err) {
+		return
+	}
+	d.ReaderSchemas = readers
+
+	_, err = d.AvroMessageToRecord(context.Background(), newWriterMessage(t, "A"))
+	assert.EqualError(t, err, "could not resolve the value to the reader schema of topic clicks: field region of record Click is missing from the writer schema and has no default")
+	assert.Equal(t, DecodeErrorResolution, decodeErrorKind(err))
+}
+
+func TestReaderSchemas_Refresh(t *testing.T) {
+	latest := `{"type": "record", "name": "Click", "namespace": "events", "fields": [{"name": "id", "type": "long"}]}`
+	registry, closeRegistry := newReaderSchemaRegistry(t, &latest)
+	defer closeRegistry()
+	d := &Decoder{SchemaRegistry: registry, CodecCache: sync.Map{}}
+	readers, err := NewReaderSchemas(map[string]ReaderSchemaConfig{"clicks": {Subject: "clicks-value"}}, registry, d, log.NewNopLogger())
+	if !assert.NoError(t, err) {
+		return
+	}
+	d.ReaderSchemas = readers
+
+	record, err := d.AvroMessageToRecord(context.Background(), newWriterMessage(t, "A"))
+	if assert.NoError(t, err) {
+		assert.NotContains(t, record.Json, "name")
+	}
+
+	// the subject evolves compatibly
+	latest = `{"type": "record", "name": "Click", "namespace": "events", "fields": [
+		{"name": "id", "type": "long"},
+		{"name": "name", "type": "string", "aliases": ["old_name"]}
+	]}`
+	readers.refresh()
+	record, err = d.AvroMessageToRecord(context.Background(), newWriterMessage(t, "A"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", record.Json["name"])
+	}
+
+	// invalid schemas are not picked up
+	latest = `{"type": "record"}`
+	readers.refresh()
+	record, err = d.AvroMessageToRecord(context.Background(), newWriterMessage(t, "A"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", record.Json["name"])
+	}
+}
+
+func TestParseReaderSchemas(t *testing.T) {
+	configs, err := ParseReaderSchemas(`{"clicks": {"subject": "clicks-value"}, "views": {"schema": "string"}}`, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "clicks-value", configs["clicks"].Subject)
+		assert.Equal(t, `"string"`, string(configs["views"].Schema))
+	}
+	configs, err = ParseReaderSchemas("", "")
+	assert.NoError(t, err)
+	assert.Empty(t, configs)
+
+	_, err = ParseReaderSchemas(`{"clicks": {}}`, "")
+	assert.EqualError(t, err, "the reader schema of topic clicks should have either a subject or a schema")
+	_, err = ParseReaderSchemas(`{"clicks": {"subject": "a", "schema": "string"}}`, "")
+	assert.Error(t, err)
+	_, err = ParseReaderSchemas(`{}`, "/reader-schemas.json")
+	assert.Error(t, err)
+	_, err = ParseReaderSchemas(`[]`, "")
+	assert.Error(t, err)
+}
+
+func TestAvroResolver_Defaults(t *testing.T) {
+	resolver, err := newAvroResolver(`{"type": "record", "name": "R", "fields": [
+		{"name": "count", "type": "int", "default": 1},
+		{"name": "ratio", "type": "float", "default": 0.5},
+		{"name": "raw", "type": "bytes", "default": "ÿ"},
+		{"name": "limits", "type": {"type": "map", "values": "long"}, "default": {"max": 10}},
+		{"name": "owner", "type": {"type": "record", "name": "Owner", "fields": [
+			{"name": "name", "type": "string"},
+			{"name": "admin", "type": "boolean", "default": false}
+		]}, "default": {"name": "root"}},
+		{"name": "backup", "type": ["null", "Owner"], "default": null}
+	]}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resolved, err := resolver.resolve(map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"count":  int32(1),
+		"ratio":  float32(0.5),
+		"raw":    []byte{0xff},
+		"limits": map[string]interface{}{"max": int64(10)},
+		"owner":  map[string]interface{}{"name": "root", "admin": false},
+		"backup": nil,
+	}, resolved)
+
+	// named types are resolved where they are referred to
+	resolved, err = resolver.resolve(map[string]interface{}{"backup": map[string]interface{}{"name": "ops", "admin": true}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "ops", "admin": true}, resolved.(map[string]interface{})["backup"])
+
+	_, err = resolver.resolve(map[string]interface{}{"count": "one"})
+	assert.EqualError(t, err, "field count: expected int, got string")
+}
@@ -0,0 +1,396 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/tracing"
+)
+
+const (
+	replayOffsets = "offsets:"
+	// replayLinger inserts the partial batches of a replay when no linger is configured, the last records of
+	// each partition would otherwise never fill one
+	replayLinger = time.Second
+	// replayProgressInterval is how often the progress of each partition is logged
+	replayProgressInterval = 10 * time.Second
+)
+
+var errReplayInterrupted = errors.New("replay interrupted before reaching its end")
+
+// Replay is a range of records consumed once, without joining the consumer group nor committing offsets.
+type Replay struct {
+	Start ReplayBoundary
+	// End is exclusive, partitions missing from its offsets are replayed up to their end
+	End ReplayBoundary
+	// Rate is the most records replayed per second, 0 for no limit
+	Rate int
+}
+
+// ReplayBoundary is where a replay starts or ends on each partition.
+type ReplayBoundary struct {
+	// Time is sarama.OffsetOldest, sarama.OffsetNewest or a timestamp in milliseconds, unless Offsets is set
+	Time int64
+	// Offsets are the offsets of each partition, the partitions missing are not replayed
+	Offsets map[int32]int64
+}
+
+// ReplaySummary counts the records of a replay.
+type ReplaySummary struct {
+	Read    int64
+	Indexed int64
+	// Failed are the records that could not be decoded, along with the ones sent to the dead letter queue
+	Failed int64
+	// Skipped are the records left out by the missing column and coercion policies or by a transform
+	Skipped int64
+}
+
+// ParseReplayBoundary parses earliest, latest, timestamp:<RFC3339> or offsets:<partition>=<offset>,...
+func ParseReplayBoundary(value string) (ReplayBoundary, error) {
+	switch {
+	case strings.HasPrefix(value, replayOffsets):
+	case value == StartEarliest || value == StartLatest || strings.HasPrefix(value, startTimestamp):
+		start, err := ParseStartOffset(value, false)
+		if err != nil {
+			return ReplayBoundary{}, err
+		}
+		return ReplayBoundary{Time: start.Time}, nil
+	default:
+		return ReplayBoundary{}, fmt.Errorf(
+			"replay boundary should be %s, %s, %s<RFC3339> or %s<partition>=<offset>,...",
+			StartEarliest, StartLatest, startTimestamp, replayOffsets,
+		)
+	}
+	offsets := make(map[int32]int64)
+	for _, pair := range strings.Split(strings.TrimPrefix(value, replayOffsets), ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return ReplayBoundary{}, fmt.Errorf("invalid partition offset %q, should be <partition>=<offset>", pair)
+		}
+		partition, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil || partition < 0 {
+			return ReplayBoundary{}, fmt.Errorf("invalid partition %q", parts[0])
+		}
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || offset < 0 {
+			return ReplayBoundary{}, fmt.Errorf("invalid offset %q of partition %d", parts[1], partition)
+		}
+		offsets[int32(partition)] = offset
+	}
+	return ReplayBoundary{Offsets: offsets}, nil
+}
+
+// byTimestamp tells whether the boundary looks offsets up by timestamp, which needs kafka 0.10.1.
+func (b ReplayBoundary) byTimestamp() bool {
+	return b.Offsets == nil && b.Time >= 0
+}
+
+// offset is the offset of the boundary on a partition, false when the partition is missing from its offsets.
+func (b ReplayBoundary) offset(client sarama.Client, topic string, partition int32) (int64, bool, error) {
+	if b.Offsets != nil {
+		offset, ok := b.Offsets[partition]
+		return offset, ok, nil
+	}
+	offset, err := client.GetOffset(topic, partition, b.Time)
+	if err == nil && offset < 0 {
+		// no record at or after the timestamp
+		offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("could not get the replay offset of %s/%d: %s", topic, partition, err)
+	}
+	return offset, true, nil
+}
+
+// replayRange are the offsets of a partition replayed, from start to before end.
+type replayRange struct {
+	topic     string
+	partition int32
+	start     int64
+	end       int64
+}
+
+// replayRanges resolves the boundaries of the replay on the partitions of the topics, within the records
+// they still hold. The partitions with nothing to replay are left out.
+func replayRanges(client sarama.Client, topics []string, replay Replay) ([]replayRange, error) {
+	var ranges []replayRange
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("could not get the partitions of %s: %s", topic, err)
+		}
+		for _, partition := range partitions {
+			start, ok, err := replay.Start.offset(client, topic, partition)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				return nil, fmt.Errorf("could not get the oldest offset of %s/%d: %s", topic, partition, err)
+			}
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return nil, fmt.Errorf("could not get the newest offset of %s/%d: %s", topic, partition, err)
+			}
+			end, ok, err := replay.End.offset(client, topic, partition)
+			if err != nil {
+				return nil, err
+			}
+			if !ok || end > newest {
+				end = newest
+			}
+			if start < oldest {
+				start = oldest
+			}
+			if start < end {
+				ranges = append(ranges, replayRange{topic, partition, start, end})
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// replayProgress follows how far each partition of a replay is inserted. It takes the offsets marked once
+// inserted in place of a consumer group.
+type replayProgress struct {
+	mu sync.Mutex
+	// next is the first offset of each partition not inserted yet
+	next    map[topicPartition]int64
+	ranges  []replayRange
+	read    int64
+	indexed int64
+	failed  int64
+	skipped int64
+}
+
+func newReplayProgress(ranges []replayRange) *replayProgress {
+	next := make(map[topicPartition]int64, len(ranges))
+	for _, r := range ranges {
+		next[topicPartition{r.topic, r.partition}] = r.start
+	}
+	return &replayProgress{next: next, ranges: ranges}
+}
+
+func (p *replayProgress) MarkPartitionOffset(topic string, partition int32, offset int64, metadata string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next[topicPartition{topic, partition}] = offset + 1
+}
+
+func (p *replayProgress) summary() ReplaySummary {
+	return ReplaySummary{
+		Read:    atomic.LoadInt64(&p.read),
+		Indexed: atomic.LoadInt64(&p.indexed),
+		Failed:  atomic.LoadInt64(&p.failed),
+		Skipped: atomic.LoadInt64(&p.skipped),
+	}
+}
+
+func (p *replayProgress) log(logger log.Logger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range p.ranges {
+		next := p.next[topicPartition{r.topic, r.partition}]
+		level.Info(logger).Log(
+			"message", "replay progress",
+			"topic", r.topic,
+			"partition", r.partition,
+			"offset", next,
+			"end", r.end,
+			"remaining", r.end-next,
+		)
+	}
+}
+
+// Replay inserts the records of the replay range of each partition of the topics and returns once all of them
+// are inserted. It fails when a signal interrupts it or a record fails to decode with DecodeErrorFail.
+func (k *kafka) Replay(signals chan os.Signal) (ReplaySummary, error) {
+	if k.config.Net.SASL.Enable {
+		if err := checkAuthentication(k.brokers, &k.config.Config); err != nil {
+			return ReplaySummary{}, err
+		}
+	}
+	client, err := sarama.NewClient(k.brokers, &k.config.Config)
+	if err != nil {
+		return ReplaySummary{}, err
+	}
+	defer client.Close()
+	topics := subscribedTopics(client, k.consumer.Topics, k.consumer.TopicsPattern)
+	ranges, err := replayRanges(client, topics, *k.consumer.Replay)
+	if err != nil {
+		return ReplaySummary{}, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return ReplaySummary{}, err
+	}
+	defer consumer.Close()
+	if err := k.openDeadLetterTopic(); err != nil {
+		return ReplaySummary{}, err
+	}
+	defer k.closeDeadLetterTopic()
+	progress := newReplayProgress(ranges)
+	for _, r := range ranges {
+		level.Info(k.consumer.Logger).Log("message", "replaying partition", "topic", r.topic, "partition", r.partition, "start", r.start, "end", r.end)
+	}
+
+	go func() {
+		for {
+			offset := <-k.offsetCh
+			k.metricsPublisher.UpdateOffset(offset.topic, offset.partition, offset.offset)
+		}
+	}()
+	// inserts are cancelled once the shutdown timeout expires, reads as soon as a signal is received
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+
+	linger := k.consumer.BatchLinger
+	if linger == 0 {
+		linger = replayLinger
+	}
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+	for i := 0; i < k.consumer.Concurrency; i++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			k.fillBatches(ctx, k.messagesOf(worker), k.consumer.BatchSize, linger, newBatchSignals(stop), func(batch []*sarama.ConsumerMessage) bool {
+				return k.insertReplayBatch(ctx, progress, batch)
+			})
+		}(i)
+	}
+
+	limiter := NewRateLimiter(k.consumer.Replay.Rate, 0)
+	var readers sync.WaitGroup
+	for _, r := range ranges {
+		readers.Add(1)
+		go func(r replayRange) {
+			defer readers.Done()
+			if err := k.readReplayRange(readCtx, consumer, r, limiter, progress); err != nil {
+				k.fail(err)
+			}
+		}(r)
+	}
+	read := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(read)
+	}()
+
+	ticker := time.NewTicker(replayProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-read:
+			level.Info(k.consumer.Logger).Log("message", "replay read all the partitions, waiting for the last inserts")
+			read = nil
+		case <-k.drained:
+		case <-ticker.C:
+			progress.log(k.consumer.Logger)
+		case err := <-k.failed:
+			stopReading()
+			cancel()
+			workers.Wait()
+			return progress.summary(), err
+		case <-signals:
+			level.Info(k.consumer.Logger).Log("message", "replay interrupted, waiting for the inserts in flight", "timeout", k.consumer.ShutdownTimeout)
+			stopReading()
+			close(stop)
+			k.awaitWorkers(&workers, signals, cancel)
+			progress.log(k.consumer.Logger)
+			return progress.summary(), errReplayInterrupted
+		}
+		if read == nil && k.offsets.inFlight() == 0 {
+			close(stop)
+			workers.Wait()
+			progress.log(k.consumer.Logger)
+			return progress.summary(), nil
+		}
+	}
+}
+
+// readReplayRange hands the records of the range to the workers, it returns once the last one is handed or the
+// context is done.
+func (k *kafka) readReplayRange(ctx context.Context, consumer sarama.Consumer, r replayRange, limiter *RateLimiter, progress *replayProgress) error {
+	partitionConsumer, err := consumer.ConsumePartition(r.topic, r.partition, r.start)
+	if err != nil {
+		return fmt.Errorf("could not replay %s/%d from offset %d: %s", r.topic, r.partition, r.start, err)
+	}
+	defer partitionConsumer.Close()
+	for {
+		select {
+		case msg := <-partitionConsumer.Messages():
+			if msg.Offset >= r.end {
+				// the records before the end were compacted away
+				return nil
+			}
+			if !limiter.wait(ctx, messageSize(msg)) {
+				return nil
+			}
+			atomic.AddInt64(&progress.read, 1)
+			k.offsets.consumed(msg)
+			select {
+			case k.workerChannel(msg) <- msg:
+			case <-ctx.Done():
+				return nil
+			}
+			if msg.Offset >= r.end-1 {
+				return nil
+			}
+		case err := <-partitionConsumer.Errors():
+			level.Error(k.consumer.Logger).Log("message", "Failed to consume message", "err", err.Error())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// insertReplayBatch inserts a batch of a replay, counting its records.
+func (k *kafka) insertReplayBatch(ctx context.Context, progress *replayProgress, batch []*sarama.ConsumerMessage) bool {
+	span := k.startBatchSpan(batch)
+	defer span.End(nil)
+	decoded, failed, err := k.decodeTraced(span, batch)
+	if err != nil {
+		k.fail(err)
+		return false
+	}
+	results, inserted := k.insertDecoded(tracing.ContextWithSpan(ctx, span), progress, batch, decoded)
+	if !inserted {
+		return false
+	}
+	var indexed, skipped int64
+	failures := int64(failed)
+	for idx, record := range decoded {
+		switch {
+		case record.DecodeErr != nil:
+			// already counted as failed by decode
+		case results == nil:
+			indexed++
+		case results[idx].DeadLettered:
+			failures++
+		case results[idx].Skipped:
+			skipped++
+		default:
+			indexed++
+		}
+	}
+	atomic.AddInt64(&progress.indexed, indexed)
+	atomic.AddInt64(&progress.failed, failures)
+	atomic.AddInt64(&progress.skipped, skipped)
+	return true
+}
@@ -0,0 +1,167 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/inloco/kafka-elasticsearch-injector/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReplayBoundary(t *testing.T) {
+	boundary, err := ParseReplayBoundary(StartEarliest)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ReplayBoundary{Time: sarama.OffsetOldest}, boundary)
+		assert.False(t, boundary.byTimestamp())
+	}
+	boundary, err = ParseReplayBoundary("timestamp:2021-03-01T00:00:00Z")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ReplayBoundary{Time: 1614556800000}, boundary)
+		assert.True(t, boundary.byTimestamp())
+	}
+	boundary, err = ParseReplayBoundary("offsets:0=1500, 1=1320")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ReplayBoundary{Offsets: map[int32]int64{0: 1500, 1: 1320}}, boundary)
+		assert.False(t, boundary.byTimestamp())
+	}
+	for _, invalid := range []string{"", "beginning", "timestamp:yesterday", "offsets:", "offsets:0", "offsets:a=1", "offsets:0=-1"} {
+		_, err = ParseReplayBoundary(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func newReplayCluster(t *testing.T) (*sarama.MockBroker, sarama.Client) {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("events", 0, broker.BrokerID()).
+			SetLeader("events", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("events", 0, sarama.OffsetOldest, 10).
+			SetOffset("events", 0, sarama.OffsetNewest, 100).
+			SetOffset("events", 0, 1614556800000, 42).
+			SetOffset("events", 1, sarama.OffsetOldest, 0).
+			SetOffset("events", 1, sarama.OffsetNewest, 50).
+			SetOffset("events", 1, 1614556800000, -1),
+	})
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_1_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, client
+}
+
+func TestReplayRanges(t *testing.T) {
+	broker, client := newReplayCluster(t)
+	defer broker.Close()
+	defer client.Close()
+
+	// partition 1 has no record after the timestamp, nothing to replay
+	ranges, err := replayRanges(client, []string{"events"}, Replay{
+		Start: ReplayBoundary{Time: 1614556800000},
+		End:   ReplayBoundary{Time: sarama.OffsetNewest},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []replayRange{{"events", 0, 42, 100}}, ranges)
+	}
+
+	// offsets are kept within the records of the partitions, partition 1 is replayed up to its end
+	ranges, err = replayRanges(client, []string{"events"}, Replay{
+		Start: ReplayBoundary{Offsets: map[int32]int64{0: 5, 1: 20}},
+		End:   ReplayBoundary{Offsets: map[int32]int64{0: 60}},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []replayRange{{"events", 0, 10, 60}, {"events", 1, 20, 50}}, ranges)
+	}
+
+	// partitions missing from the start offsets are not replayed
+	ranges, err = replayRanges(client, []string{"events"}, Replay{
+		Start: ReplayBoundary{Offsets: map[int32]int64{1: 0}},
+		End:   ReplayBoundary{Offsets: map[int32]int64{1: 80}},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []replayRange{{"events", 1, 0, 50}}, ranges)
+	}
+}
+
+func TestKafka_InsertReplayBatch(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	var inserted []*models.Record
+	replaying := &kafka{
+		consumer: Consumer{
+			Decoder: d.DeserializerFor("json"),
+			Logger:  logger,
+			Endpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+				inserted = append(inserted, request.([]*models.Record)...)
+				return nil, nil
+			},
+			DecodeErrorPolicy: DecodeErrorSkip,
+		},
+		metricsPublisher: k.metricsPublisher,
+		offsetCh:         make(chan *topicPartitionOffset, 10),
+		offsets:          newOffsetTracker(),
+		drained:          make(chan struct{}, 1),
+		failed:           make(chan error, 1),
+	}
+	progress := newReplayProgress([]replayRange{{"events", 0, 1, 4}})
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "events", Partition: 0, Offset: 1, Value: []byte(`{"id":"a"}`)},
+		{Topic: "events", Partition: 0, Offset: 2, Value: []byte(`not json`)},
+		{Topic: "events", Partition: 0, Offset: 3, Value: []byte(`{"id":"b"}`)},
+	}
+	for _, msg := range batch {
+		replaying.offsets.consumed(msg)
+	}
+
+	assert.True(t, replaying.insertReplayBatch(context.Background(), progress, batch))
+	assert.Len(t, inserted, 2)
+	assert.Equal(t, ReplaySummary{Indexed: 2, Failed: 1}, progress.summary())
+	// the undecodable record is passed over like in the consumer group
+	assert.Equal(t, int64(4), progress.next[topicPartition{"events", 0}])
+	assert.Equal(t, 0, replaying.offsets.inFlight())
+}
+
+func TestKafka_InsertReplayBatch_CountsOutcomes(t *testing.T) {
+	d := &Decoder{CodecCache: sync.Map{}}
+	replaying := &kafka{
+		consumer: Consumer{
+			Decoder: d.DeserializerFor("json"),
+			Logger:  logger,
+			Endpoint: func(ctx context.Context, request interface{}) (interface{}, error) {
+				// rejected by elasticsearch then dead lettered, skipped by a policy, written
+				return []models.RecordResult{
+					{Succeeded: true, DeadLettered: true},
+					{Succeeded: true, Skipped: true},
+					{Succeeded: true},
+					{Succeeded: true, DeadLettered: true},
+				}, nil
+			},
+			DecodeErrorPolicy: DecodeErrorDeadLetter,
+		},
+		metricsPublisher: k.metricsPublisher,
+		offsetCh:         make(chan *topicPartitionOffset, 10),
+		offsets:          newOffsetTracker(),
+		drained:          make(chan struct{}, 1),
+		failed:           make(chan error, 1),
+	}
+	progress := newReplayProgress([]replayRange{{"events", 0, 1, 5}})
+	batch := []*sarama.ConsumerMessage{
+		{Topic: "events", Partition: 0, Offset: 1, Value: []byte(`{"id":"a"}`)},
+		{Topic: "events", Partition: 0, Offset: 2, Value: []byte(`{"id":"b"}`)},
+		{Topic: "events", Partition: 0, Offset: 3, Value: []byte(`{"id":"c"}`)},
+		{Topic: "events", Partition: 0, Offset: 4, Value: []byte(`not json`)},
+	}
+	for _, msg := range batch {
+		replaying.offsets.consumed(msg)
+	}
+
+	assert.True(t, replaying.insertReplayBatch(context.Background(), progress, batch))
+	// the undecodable record dead lettered by the store is only counted once
+	assert.Equal(t, ReplaySummary{Indexed: 1, Failed: 2, Skipped: 1}, progress.summary())
+	assert.Equal(t, int64(5), progress.next[topicPartition{"events", 0}])
+}
@@ -0,0 +1,91 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+)
+
+// DefaultStallTimeout is how long a partition with lag goes without advancing before it is stalled.
+const DefaultStallTimeout = 10 * time.Minute
+
+// stallDetector tracks the committed offset of each assigned partition and when it last advanced, telling which
+// partitions stopped advancing while they have lag, like a partition stuck on a message retried endlessly.
+// Partitions without lag are never stalled, they have nothing to advance to.
+type stallDetector struct {
+	timeout time.Duration
+	lock    sync.Mutex
+	// partitions is the progress of the partitions consumed since the last rebalance
+	partitions map[topicPartition]*partitionProgress
+}
+
+type partitionProgress struct {
+	offset     int64
+	advancedAt time.Time
+	stalled    bool
+}
+
+// stalledPartition is a partition that just stalled.
+type stalledPartition struct {
+	topic     string
+	partition int32
+	offset    int64
+	lag       int64
+	since     time.Duration
+}
+
+func newStallDetector(timeout time.Duration) *stallDetector {
+	return &stallDetector{timeout: timeout, partitions: make(map[topicPartition]*partitionProgress)}
+}
+
+// reset forgets the progress of every partition on rebalance, so that the partitions assigned afterwards start
+// over instead of being stalled by the time they spent assigned elsewhere.
+func (d *stallDetector) reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.partitions = make(map[topicPartition]*partitionProgress)
+}
+
+// update records the committed offsets of the assigned partitions, returning the progress of each of them along
+// with the partitions that stalled since the last update. Partitions no longer assigned are forgotten.
+func (d *stallDetector) update(highWaterMarks map[string]map[int32]int64, committed map[string]map[int32]int64, now time.Time) (map[string]map[int32]metrics.PartitionStall, []stalledPartition) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	progress := make(map[string]map[int32]metrics.PartitionStall)
+	var stalled []stalledPartition
+	seen := make(map[topicPartition]bool)
+	for topic, partitions := range highWaterMarks {
+		for partition, highWaterMark := range partitions {
+			offset, ok := committed[topic][partition]
+			if !ok {
+				// nothing consumed from the partition since it was assigned
+				continue
+			}
+			key := topicPartition{topic, partition}
+			seen[key] = true
+			lag := highWaterMark - offset
+			tracked, ok := d.partitions[key]
+			if !ok || offset != tracked.offset || lag <= 0 {
+				tracked = &partitionProgress{offset: offset, advancedAt: now}
+				d.partitions[key] = tracked
+			}
+			since := now.Sub(tracked.advancedAt)
+			isStalled := d.timeout > 0 && since >= d.timeout
+			if isStalled && !tracked.stalled {
+				stalled = append(stalled, stalledPartition{topic: topic, partition: partition, offset: offset, lag: lag, since: since})
+			}
+			tracked.stalled = isStalled
+			if progress[topic] == nil {
+				progress[topic] = make(map[int32]metrics.PartitionStall)
+			}
+			progress[topic][partition] = metrics.PartitionStall{SinceAdvanced: since.Seconds(), Stalled: isStalled}
+		}
+	}
+	for key := range d.partitions {
+		if !seen[key] {
+			delete(d.partitions, key)
+		}
+	}
+	return progress, stalled
+}
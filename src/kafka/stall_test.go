@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStallDetector(t *testing.T) {
+	d := newStallDetector(time.Minute)
+	now := time.Unix(1000, 0)
+	highWaterMarks := map[string]map[int32]int64{"clicks": {0: 100, 1: 100, 2: 100}}
+	committed := map[string]map[int32]int64{"clicks": {0: 10, 1: 100}}
+
+	progress, stalled := d.update(highWaterMarks, committed, now)
+	assert.Empty(t, stalled)
+	// partitions nothing was consumed from are not tracked
+	assert.Equal(t, map[int32]metrics.PartitionStall{0: {}, 1: {}}, progress["clicks"])
+
+	// partition 0 is stuck with lag, partition 1 has nothing to advance to
+	now = now.Add(time.Minute)
+	progress, stalled = d.update(highWaterMarks, committed, now)
+	assert.Equal(t, []stalledPartition{{topic: "clicks", partition: 0, offset: 10, lag: 90, since: time.Minute}}, stalled)
+	assert.Equal(t, metrics.PartitionStall{SinceAdvanced: 60, Stalled: true}, progress["clicks"][0])
+	assert.Equal(t, metrics.PartitionStall{}, progress["clicks"][1])
+
+	// stalled partitions are only reported once
+	now = now.Add(time.Minute)
+	progress, stalled = d.update(highWaterMarks, committed, now)
+	assert.Empty(t, stalled)
+	assert.True(t, progress["clicks"][0].Stalled)
+
+	// until they advance
+	committed["clicks"][0] = 11
+	progress, _ = d.update(highWaterMarks, committed, now)
+	assert.Equal(t, metrics.PartitionStall{}, progress["clicks"][0])
+}
+
+func TestStallDetector_Reset(t *testing.T) {
+	d := newStallDetector(time.Minute)
+	now := time.Unix(1000, 0)
+	highWaterMarks := map[string]map[int32]int64{"clicks": {0: 100}}
+	committed := map[string]map[int32]int64{"clicks": {0: 10}}
+	d.update(highWaterMarks, committed, now)
+
+	// partitions assigned on rebalance start over
+	d.reset()
+	now = now.Add(2 * time.Minute)
+	progress, stalled := d.update(highWaterMarks, committed, now)
+	assert.Empty(t, stalled)
+	assert.False(t, progress["clicks"][0].Stalled)
+
+	// and the partitions no longer assigned are forgotten
+	d.update(map[string]map[int32]int64{}, committed, now)
+	assert.Empty(t, d.partitions)
+}
+
+func TestStallDetector_Disabled(t *testing.T) {
+	d := newStallDetector(0)
+	now := time.Unix(1000, 0)
+	highWaterMarks := map[string]map[int32]int64{"clicks": {0: 100}}
+	committed := map[string]map[int32]int64{"clicks": {0: 10}}
+	d.update(highWaterMarks, committed, now)
+	progress, stalled := d.update(highWaterMarks, committed, now.Add(time.Hour))
+	assert.Empty(t, stalled)
+	assert.Equal(t, metrics.PartitionStall{SinceAdvanced: 3600}, progress["clicks"][0])
+}
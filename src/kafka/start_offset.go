@@ -0,0 +1,150 @@
+package kafka
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	StartEarliest  = "earliest"
+	StartLatest    = "latest"
+	startTimestamp = "timestamp:"
+)
+
+// StartOffset is where the consumer group starts consuming the partitions it has no committed offset for.
+type StartOffset struct {
+	// Time is sarama.OffsetOldest, sarama.OffsetNewest or a timestamp in milliseconds
+	Time int64
+	// Force seeks the partitions that have a committed offset as well
+	Force bool
+}
+
+func ParseStartOffset(value string, force bool) (StartOffset, error) {
+	switch {
+	case value == "" || value == StartLatest:
+		return StartOffset{Time: sarama.OffsetNewest, Force: force}, nil
+	case value == StartEarliest:
+		return StartOffset{Time: sarama.OffsetOldest, Force: force}, nil
+	case strings.HasPrefix(value, startTimestamp):
+		at, err := time.Parse(time.RFC3339, strings.TrimPrefix(value, startTimestamp))
+		if err != nil {
+			return StartOffset{}, fmt.Errorf("invalid start offset timestamp: %s", err)
+		}
+		return StartOffset{Time: at.UnixNano() / int64(time.Millisecond), Force: force}, nil
+	default:
+		return StartOffset{}, fmt.Errorf("start offset should be %s, %s or %s<RFC3339>", StartEarliest, StartLatest, startTimestamp)
+	}
+}
+
+// needsSeek tells whether offsets have to be committed before joining the group. Otherwise the consumer starts
+// the partitions without offsets at its initial offset.
+func (s StartOffset) needsSeek() bool {
+	return s.Force || s.Time >= 0
+}
+
+// seekStartOffsets commits the start offset of the group on the partitions it has no committed offset for, or on
+// all of them when forced, so that the group consumes them from there once joined.
+func seekStartOffsets(client sarama.Client, group string, topics []string, pattern *regexp.Regexp, start StartOffset, logger log.Logger) error {
+	offsets, err := startOffsets(client, group, subscribedTopics(client, topics, pattern), start)
+	if err != nil {
+		return err
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return fmt.Errorf("could not find the coordinator of consumer group %s: %s", group, err)
+	}
+	request := &sarama.OffsetCommitRequest{
+		Version:                 1,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+	}
+	for key, offset := range offsets {
+		request.AddBlock(key.topic, key.partition, offset, sarama.ReceiveTime, "")
+	}
+	response, err := coordinator.CommitOffset(request)
+	if err != nil {
+		return fmt.Errorf("could not commit the start offsets of consumer group %s: %s", group, err)
+	}
+	for key, offset := range offsets {
+		if kerr, ok := response.Errors[key.topic][key.partition]; ok && kerr != sarama.ErrNoError {
+			// the group has to be empty, members of a running group are the only ones allowed to commit
+			return fmt.Errorf("could not commit the start offset of %s/%d for consumer group %s: %s", key.topic, key.partition, group, kerr)
+		}
+		level.Info(logger).Log("message", "seeked partition to start offset", "topic", key.topic, "partition", key.partition, "offset", offset)
+	}
+	return nil
+}
+
+// subscribedTopics are the existing topics the consumer subscribes to, sorted.
+func subscribedTopics(client sarama.Client, topics []string, pattern *regexp.Regexp) []string {
+	subscribed := make(map[string]bool)
+	for _, topic := range topics {
+		subscribed[topic] = true
+	}
+	if pattern != nil {
+		all, _ := client.Topics()
+		for _, topic := range all {
+			if pattern.MatchString(topic) {
+				subscribed[topic] = true
+			}
+		}
+	}
+	var sorted []string
+	for topic := range subscribed {
+		sorted = append(sorted, topic)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// startOffsets are the offsets to commit on the partitions of the topics so that they are consumed from start.
+func startOffsets(client sarama.Client, group string, topics []string, start StartOffset) (map[topicPartition]int64, error) {
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the coordinator of consumer group %s: %s", group, err)
+	}
+	fetch := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	partitions := make(map[string][]int32)
+	for _, topic := range topics {
+		ids, err := client.Partitions(topic)
+		if err != nil {
+			return nil, fmt.Errorf("could not get the partitions of %s: %s", topic, err)
+		}
+		partitions[topic] = ids
+		for _, partition := range ids {
+			fetch.AddPartition(topic, partition)
+		}
+	}
+	committed, err := coordinator.FetchOffset(fetch)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the offsets of consumer group %s: %s", group, err)
+	}
+	offsets := make(map[topicPartition]int64)
+	for _, topic := range topics {
+		for _, partition := range partitions[topic] {
+			if block := committed.GetBlock(topic, partition); block != nil && block.Offset >= 0 && !start.Force {
+				continue
+			}
+			offset, err := client.GetOffset(topic, partition, start.Time)
+			if err == nil && offset < 0 {
+				// no record at or after the timestamp, only the records produced from now on are consumed
+				offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not get the start offset of %s/%d: %s", topic, partition, err)
+			}
+			offsets[topicPartition{topic, partition}] = offset
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,81 @@
+package kafka
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStartOffset(t *testing.T) {
+	start, err := ParseStartOffset("", false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StartOffset{Time: sarama.OffsetNewest}, start)
+		assert.False(t, start.needsSeek())
+	}
+	start, err = ParseStartOffset(StartEarliest, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StartOffset{Time: sarama.OffsetOldest, Force: true}, start)
+		assert.True(t, start.needsSeek())
+	}
+	start, err = ParseStartOffset("timestamp:2021-03-01T00:00:00Z", false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC).UnixNano()/int64(time.Millisecond), start.Time)
+		assert.True(t, start.needsSeek())
+	}
+	_, err = ParseStartOffset("timestamp:yesterday", false)
+	assert.Error(t, err)
+	_, err = ParseStartOffset("beginning", false)
+	assert.Error(t, err)
+}
+
+func newMockCluster(t *testing.T, committed map[int32]int64) (*sarama.MockBroker, sarama.Client) {
+	broker := sarama.NewMockBroker(t, 1)
+	fetch := sarama.NewMockOffsetFetchResponse(t)
+	for partition, offset := range committed {
+		fetch.SetOffset("group", "events.tenant-a", partition, offset, "", sarama.ErrNoError)
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("events.tenant-a", 0, broker.BrokerID()).
+			SetLeader("events.tenant-a", 1, broker.BrokerID()).
+			SetLeader("other", 0, broker.BrokerID()),
+		"ConsumerMetadataRequest": sarama.NewMockConsumerMetadataResponse(t).SetCoordinator("group", broker),
+		"OffsetFetchRequest":      fetch,
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset("events.tenant-a", 0, 1614556800000, 42).
+			SetOffset("events.tenant-a", 1, 1614556800000, -1).
+			SetOffset("events.tenant-a", 1, sarama.OffsetNewest, 7),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_1_0
+	client, err := sarama.NewClient([]string{broker.Addr()}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, client
+}
+
+func TestStartOffsets_Timestamp(t *testing.T) {
+	broker, client := newMockCluster(t, map[int32]int64{1: 3})
+	defer broker.Close()
+	defer client.Close()
+	topics := subscribedTopics(client, nil, regexp.MustCompile(`^(?:events\.tenant-.*)$`))
+	assert.Equal(t, []string{"events.tenant-a"}, topics)
+
+	// partition 1 has a committed offset and keeps it
+	offsets, err := startOffsets(client, "group", topics, StartOffset{Time: 1614556800000})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[topicPartition]int64{{"events.tenant-a", 0}: 42}, offsets)
+	}
+	// forced, partition 1 has no record after the timestamp and starts at its end
+	offsets, err = startOffsets(client, "group", topics, StartOffset{Time: 1614556800000, Force: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[topicPartition]int64{{"events.tenant-a", 0}: 42, {"events.tenant-a", 1}: 7}, offsets)
+	}
+	assert.NoError(t, seekStartOffsets(client, "group", topics, nil, StartOffset{Time: 1614556800000}, logger))
+}
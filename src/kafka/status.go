@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"sync"
+)
+
+// Status is a snapshot of the consumer for debugging, served by the debug endpoints.
+type Status struct {
+	// Partitions are the partitions assigned to the consumer by topic, empty while rebalancing
+	Partitions map[string][]int32 `json:"assigned_partitions"`
+	// Buffers are the channels buffering the consumed messages for the workers
+	Buffers         []BufferStatus `json:"buffers"`
+	InFlightRecords int            `json:"in_flight_records"`
+}
+
+type BufferStatus struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity"`
+}
+
+// assignment keeps the partitions assigned by the last rebalance, for the status.
+type assignment struct {
+	lock       sync.Mutex
+	partitions map[string][]int32
+}
+
+func (a *assignment) set(partitions map[string][]int32) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.partitions = partitions
+}
+
+func (a *assignment) get() map[string][]int32 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	partitions := make(map[string][]int32, len(a.partitions))
+	for topic, assigned := range a.partitions {
+		partitions[topic] = append([]int32(nil), assigned...)
+	}
+	return partitions
+}
+
+// Status is the state of the consumer started by Start.
+func (k *kafka) Status() Status {
+	status := Status{
+		Partitions:      k.assignment.get(),
+		InFlightRecords: k.offsets.inFlight(),
+	}
+	for _, consumerCh := range k.consumerChs {
+		status.Buffers = append(status.Buffers, BufferStatus{Length: len(consumerCh), Capacity: cap(consumerCh)})
+	}
+	return status
+}
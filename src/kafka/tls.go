@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// NewTLSConfig is the tls config the brokers are reached with, nil when TLS is disabled. Setting any of the
+// certificates enables it.
+func NewTLSConfig(enabled bool, caCertPath, clientCertPath, clientKeyPath string, insecureSkipVerify bool) (*tls.Config, error) {
+	if !enabled && caCertPath == "" && clientCertPath == "" && clientKeyPath == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caCertPath != "" {
+		caCert, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read kafka CA certificate %s: %v", caCertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no PEM certificates found in kafka CA certificate %s", caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if clientCertPath != "" || clientKeyPath != "" {
+		if clientCertPath == "" || clientKeyPath == "" {
+			return nil, errors.New("kafka client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not load kafka client certificate %s with key %s: %v", clientCertPath, clientKeyPath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,138 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCertificate writes a self signed certificate for localhost and its key as PEM files in dir.
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certPath, keyPath
+}
+
+func TestNewTLSConfig_MutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	brokerCert, brokerKey := writeCertificate(t, dir, "broker")
+	clientCert, clientKey := writeCertificate(t, dir, "injector")
+
+	// the broker trusts the client certificate and requires it
+	brokerPair, _ := tls.LoadX509KeyPair(brokerCert, brokerKey)
+	clientCA, _ := ioutil.ReadFile(clientCert)
+	clientPool := x509.NewCertPool()
+	clientPool.AppendCertsFromPEM(clientCA)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{brokerPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	tlsConfig, err := NewTLSConfig(false, brokerCert, clientCert, clientKey, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), tlsConfig)
+	if assert.NoError(t, err) {
+		assert.NoError(t, conn.Handshake())
+		conn.Close()
+	}
+}
+
+func TestNewTLSConfig_Disabled(t *testing.T) {
+	tlsConfig, err := NewTLSConfig(false, "", "", "", false)
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = NewTLSConfig(false, "", "", "", true)
+	if assert.NoError(t, err) && assert.NotNil(t, tlsConfig) {
+		assert.True(t, tlsConfig.InsecureSkipVerify)
+	}
+}
+
+func TestNewTLSConfig_InvalidFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "not.pem")
+	ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+	cert, key := writeCertificate(t, dir, "injector")
+
+	for _, paths := range [][]string{
+		{"/does/not/exist.pem", "", ""},
+		{notPEM, "", ""},
+		{"", cert, notPEM},
+		{"", cert, "/does/not/exist.pem"},
+	} {
+		_, err := NewTLSConfig(true, paths[0], paths[1], paths[2], false)
+		if assert.Error(t, err) {
+			for _, path := range paths {
+				if path != "" && path != cert {
+					assert.Contains(t, err.Error(), path)
+				}
+			}
+		}
+	}
+	_, err = NewTLSConfig(true, "", cert, "", false)
+	assert.Error(t, err)
+	_, err = NewTLSConfig(true, "", "", key, false)
+	assert.Error(t, err)
+}
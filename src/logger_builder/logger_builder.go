@@ -1,29 +1,122 @@
 package logger_builder
 
 import (
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 )
 
+// Components of the injector, logged as the `component` key and filtered by their own LOG_LEVEL_<COMPONENT>.
+const (
+	ComponentKafka          = "kafka"
+	ComponentSchemaRegistry = "schema_registry"
+	ComponentElasticsearch  = "elasticsearch"
+)
+
+// stdout is shared by all loggers, so that the lines of different components are never interleaved.
+var stdout = log.NewSyncWriter(os.Stdout)
+
+// LevelSettings are the env vars of the log levels, which ReloadLevels applies while running.
+var LevelSettings = []string{
+	"LOG_LEVEL",
+	"LOG_LEVEL_" + strings.ToUpper(ComponentKafka),
+	"LOG_LEVEL_" + strings.ToUpper(ComponentSchemaRegistry),
+	"LOG_LEVEL_" + strings.ToUpper(ComponentElasticsearch),
+}
+
 func NewLogger(service string) (logger log.Logger) {
-	logger = log.NewJSONLogger(log.NewSyncWriter(os.Stdout))
-	logger = level.NewFilter(logger, allowedLevels())
+	filter := newLevelFilter(formatLogger(stdout, os.Getenv("LOG_FORMAT")), func() string {
+		return os.Getenv("LOG_LEVEL")
+	})
+	reloadable.add(filter)
+	return withService(filter, service)
+}
+
+// NewComponentLogger is NewLogger with the component key, filtered by LOG_LEVEL_<COMPONENT>, like
+// LOG_LEVEL_SCHEMA_REGISTRY, or by LOG_LEVEL when it isn't set.
+func NewComponentLogger(service string, component string) log.Logger {
+	filter := newLevelFilter(formatLogger(stdout, os.Getenv("LOG_FORMAT")), func() string {
+		if config := os.Getenv("LOG_LEVEL_" + strings.ToUpper(component)); config != "" {
+			return config
+		}
+		return os.Getenv("LOG_LEVEL")
+	})
+	reloadable.add(filter)
+	return log.With(withService(filter, service), "component", component)
+}
+
+// ReloadLevels filters the loggers already created by the current LOG_LEVEL and LOG_LEVEL_<COMPONENT>.
+func ReloadLevels() {
+	reloadable.lock.Lock()
+	defer reloadable.lock.Unlock()
+	for _, filter := range reloadable.filters {
+		filter.reload()
+	}
+}
+
+var reloadable = &levelFilters{}
+
+type levelFilters struct {
+	lock    sync.Mutex
+	filters []*levelFilter
+}
+
+func (f *levelFilters) add(filter *levelFilter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.filters = append(f.filters, filter)
+}
+
+// levelFilter filters the lines of a logger by the level of its config, which can change while running.
+type levelFilter struct {
+	next     log.Logger
+	config   func() string
+	filtered atomic.Value
+}
+
+func newLevelFilter(next log.Logger, config func() string) *levelFilter {
+	filter := &levelFilter{next: next, config: config}
+	filter.reload()
+	return filter
+}
+
+func (f *levelFilter) reload() {
+	f.filtered.Store(level.NewFilter(f.next, allowedLevels(f.config())))
+}
+
+func (f *levelFilter) Log(keyvals ...interface{}) error {
+	return f.filtered.Load().(log.Logger).Log(keyvals...)
+}
+
+func newLogger(w io.Writer, format string, levelConfig string, service string) log.Logger {
+	return withService(level.NewFilter(formatLogger(w, format), allowedLevels(levelConfig)), service)
+}
+
+func formatLogger(w io.Writer, format string) log.Logger {
+	if format == "logfmt" {
+		return log.NewLogfmtLogger(w)
+	}
+	return log.NewJSONLogger(w)
+}
+
+func withService(logger log.Logger, service string) log.Logger {
 	logger = log.With(logger, "caller", log.DefaultCaller)
 	logger = log.With(logger, "time", log.DefaultTimestampUTC)
-	logger = log.With(logger, "service", service)
-
-	return
+	return log.With(logger, "service", service)
 }
 
-func allowedLevels() level.Option {
-	switch config := os.Getenv("LOG_LEVEL"); {
-	case config == "DEBUG":
+func allowedLevels(config string) level.Option {
+	switch config {
+	case "DEBUG":
 		return level.AllowDebug()
-	case config == "WARN":
+	case "WARN":
 		return level.AllowWarn()
-	case config == "NONE":
+	case "NONE":
 		return level.AllowNone()
 	default:
 		return level.AllowInfo()
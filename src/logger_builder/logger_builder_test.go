@@ -0,0 +1,72 @@
+package logger_builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger_Formats(t *testing.T) {
+	var buf bytes.Buffer
+	level.Info(newLogger(&buf, "", "", "injector")).Log("message", "inserted", "doc_count", 2)
+	var line map[string]interface{}
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &line)) {
+		assert.Equal(t, "inserted", line["message"])
+		assert.Equal(t, "injector", line["service"])
+		assert.Equal(t, "info", line["level"])
+	}
+
+	buf.Reset()
+	level.Info(newLogger(&buf, "logfmt", "", "injector")).Log("message", "inserted", "doc_count", 2)
+	assert.True(t, strings.HasPrefix(buf.String(), "level=info caller="), buf.String())
+	assert.True(t, strings.HasSuffix(buf.String(), "service=injector message=inserted doc_count=2\n"), buf.String())
+}
+
+func TestNewLogger_Levels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, "logfmt", "WARN", "injector")
+	level.Info(logger).Log("message", "dropped")
+	level.Warn(logger).Log("message", "kept")
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), "kept")
+}
+
+func TestNewComponentLogger(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = log.NewSyncWriter(&buf)
+	defer func() { stdout = log.NewSyncWriter(os.Stdout) }()
+	os.Setenv("LOG_FORMAT", "logfmt")
+	os.Setenv("LOG_LEVEL", "WARN")
+	os.Setenv("LOG_LEVEL_SCHEMA_REGISTRY", "DEBUG")
+	defer os.Unsetenv("LOG_FORMAT")
+	defer os.Unsetenv("LOG_LEVEL")
+	defer os.Unsetenv("LOG_LEVEL_SCHEMA_REGISTRY")
+
+	level.Debug(NewComponentLogger("injector", ComponentSchemaRegistry)).Log("message", "schema fetched")
+	level.Info(NewComponentLogger("injector", ComponentKafka)).Log("message", "batch consumed")
+	assert.Contains(t, buf.String(), "level=debug")
+	assert.Contains(t, buf.String(), "service=injector component=schema_registry message=\"schema fetched\"")
+	assert.NotContains(t, buf.String(), "batch consumed")
+}
+
+func TestReloadLevels(t *testing.T) {
+	var buf bytes.Buffer
+	stdout = log.NewSyncWriter(&buf)
+	defer func() { stdout = log.NewSyncWriter(os.Stdout) }()
+	os.Setenv("LOG_LEVEL", "WARN")
+	defer os.Unsetenv("LOG_LEVEL")
+
+	logger := NewComponentLogger("injector", ComponentKafka)
+	level.Info(logger).Log("message", "dropped")
+	os.Setenv("LOG_LEVEL", "DEBUG")
+	ReloadLevels()
+	level.Debug(logger).Log("message", "kept")
+	assert.NotContains(t, buf.String(), "dropped")
+	assert.Contains(t, buf.String(), "kept")
+}
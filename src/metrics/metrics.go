@@ -1,7 +1,10 @@
 package metrics
 
 import (
+	"fmt"
+	"os"
 	"strconv"
+	"strings"
 
 	"sync"
 
@@ -18,12 +21,152 @@ type metrics struct {
 	recordsConsumed          *kitprometheus.Counter
 	endpointLatencyHistogram *kitprometheus.Summary
 	bufferFullGauge          *kitprometheus.Gauge
-	lock                     sync.RWMutex
-	topicPartitionToOffset   map[string]map[int32]int64
+	recordsDeadLettered      *kitprometheus.Counter
+	recordsAlreadyExisting   *kitprometheus.Counter
+	circuitBreakerOpenGauge  *kitprometheus.Gauge
+	consumptionPausedGauge   *kitprometheus.Gauge
+	recordsIndexed           *kitprometheus.Counter
+	recordsFailed            *kitprometheus.Counter
+	recordsOversized         *kitprometheus.Counter
+	recordsCollapsed         *kitprometheus.Counter
+	recordsSkipped           *kitprometheus.Counter
+	invalidHeaders           *kitprometheus.Counter
+	decodeErrors             *kitprometheus.Counter
+	messagesDeadLettered     *kitprometheus.Counter
+	recordsFiltered          *kitprometheus.Counter
+	schemaCacheLookups       *kitprometheus.Counter
+	schemaRegistryFetches    *kitprometheus.Counter
+	schemaRegistryFailovers  *kitprometheus.Counter
+	messagesConsumed         *kitprometheus.Counter
+	recordsDecoded           *kitprometheus.Counter
+	recordsDecodeErrors      *kitprometheus.Counter
+	esRecordsIndexed         *kitprometheus.Counter
+	esRecordsFailed          *kitprometheus.Counter
+	bulkRequests             *kitprometheus.Counter
+	batchSize                *kitprometheus.Summary
+	endToEndLatency          *kitprometheus.Histogram
+	endToEndLatencyMax       *kitprometheus.Gauge
+	bulkLatencyHistogram     *kitprometheus.Histogram
+	lastBulkSizeGauge        *kitprometheus.Gauge
+	configReloads            *kitprometheus.Counter
+	configHashGauge          *kitprometheus.Gauge
+	// lock guards the state of the partitions below, which is kept apart for each pipeline
+	lock                   *sync.RWMutex
+	topicPartitionToOffset map[string]map[int32]int64
+	// the lag gauges are deleted when their partition is no longer assigned, which the go-kit gauges can't do
+	lagGauge             *stdprometheus.GaugeVec
+	committedOffsetGauge *stdprometheus.GaugeVec
+	lagReported          map[string]map[int32]bool
+	// the stall gauges are deleted the same way
+	stalledGauge       *stdprometheus.GaugeVec
+	sinceAdvancedGauge *stdprometheus.GaugeVec
+	stallReported      map[string]map[int32]bool
+	// maxLatency is the highest end to end latency of each topic since it was last published
+	maxLatency map[string]float64
 }
 
-func (m *metrics) IncrementRecordsConsumed(count int) {
-	m.recordsConsumed.Add(float64(count))
+func (m *metrics) IncrementRecordsConsumed(topic string, count int) {
+	m.recordsConsumed.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsDeadLettered(topic string, count int) {
+	m.recordsDeadLettered.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsAlreadyExisting(count int) {
+	m.recordsAlreadyExisting.Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsIndexed(topic string, index string, count int) {
+	m.recordsIndexed.With("topic", topic, "index", index).Add(float64(count))
+	m.esRecordsIndexed.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsFailed(topic string, index string, count int) {
+	m.recordsFailed.With("topic", topic, "index", index).Add(float64(count))
+	m.esRecordsFailed.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsOversized(topic string, count int) {
+	m.recordsOversized.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsCollapsed(topic string, count int) {
+	m.recordsCollapsed.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsSkipped(topic string, count int) {
+	m.recordsSkipped.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementInvalidHeaders(topic string, count int) {
+	m.invalidHeaders.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementDecodeErrors(topic string, count int) {
+	m.decodeErrors.With("topic", topic).Add(float64(count))
+	m.recordsDecodeErrors.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementMessagesConsumed(topic string, count int) {
+	m.messagesConsumed.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsDecoded(topic string, count int) {
+	m.recordsDecoded.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) ObserveBatchSize(topic string, size int) {
+	m.batchSize.With("topic", topic).Observe(float64(size))
+}
+
+func (m *metrics) IncrementBulkRequests(topic string, status string) {
+	m.bulkRequests.With("topic", topic, "status", status).Add(1)
+}
+
+func (m *metrics) IncrementMessagesDeadLettered(topic string, kind string, count int) {
+	m.messagesDeadLettered.With("topic", topic, "error", kind).Add(float64(count))
+}
+
+func (m *metrics) IncrementRecordsFiltered(topic string, count int) {
+	m.recordsFiltered.With("topic", topic).Add(float64(count))
+}
+
+func (m *metrics) IncrementSchemaCacheLookups(result string) {
+	m.schemaCacheLookups.With("result", result).Add(1)
+}
+
+func (m *metrics) IncrementSchemaRegistryFetches(instance string) {
+	m.schemaRegistryFetches.With("instance", instance).Add(1)
+}
+
+func (m *metrics) IncrementSchemaRegistryFailovers(instance string) {
+	m.schemaRegistryFailovers.With("instance", instance).Add(1)
+}
+
+func (m *metrics) ObserveEndToEndLatency(topic string, seconds float64) {
+	m.endToEndLatency.With("topic", topic).Observe(seconds)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if seconds > m.maxLatency[topic] {
+		m.maxLatency[topic] = seconds
+	}
+}
+
+// PublishEndToEndLatencyMax sets the max latency gauges to the highest latency observed since the last call, 0 for
+// the topics without records since.
+func (m *metrics) PublishEndToEndLatencyMax() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for topic, seconds := range m.maxLatency {
+		m.endToEndLatencyMax.With("topic", topic).Set(seconds)
+		m.maxLatency[topic] = 0
+	}
+}
+
+func (m *metrics) RecordBulk(size int, latency float64) {
+	m.bulkLatencyHistogram.Observe(latency)
+	m.lastBulkSizeGauge.Set(float64(size))
 }
 
 func (m *metrics) RecordEndpointLatency(latency float64) {
@@ -69,20 +212,191 @@ func (m *metrics) BufferFull(full bool) {
 	m.bufferFullGauge.Set(val)
 }
 
+func (m *metrics) CircuitBreakerOpen(open bool) {
+	val := 0.0
+	if open {
+		val = 1.0
+	}
+	m.circuitBreakerOpenGauge.Set(val)
+}
+
+func (m *metrics) IncrementConfigReloads(result string) {
+	m.configReloads.With("result", result).Add(1)
+}
+
+func (m *metrics) PublishConfigHash(hash uint32) {
+	m.configHashGauge.Set(float64(hash))
+}
+
+func (m *metrics) ConsumptionPaused(paused bool) {
+	val := 0.0
+	if paused {
+		val = 1.0
+	}
+	m.consumptionPausedGauge.Set(val)
+}
+
+// PublishLag reports the lag and committed offset of the partitions assigned to this instance, given by their
+// high water marks, and stops reporting the partitions assigned to other instances since.
+func (m *metrics) PublishLag(highWaterMarks map[string]map[int32]int64, committed map[string]map[int32]int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for topic, partitions := range m.lagReported {
+		for partition := range partitions {
+			if _, ok := highWaterMarks[topic][partition]; !ok {
+				labels := stdprometheus.Labels{"topic": topic, "partition": strconv.Itoa(int(partition))}
+				m.lagGauge.Delete(labels)
+				m.committedOffsetGauge.Delete(labels)
+				delete(partitions, partition)
+			}
+		}
+	}
+	for topic, partitions := range highWaterMarks {
+		for partition, highWaterMark := range partitions {
+			offset, ok := committed[topic][partition]
+			if !ok {
+				// nothing consumed from the partition yet
+				continue
+			}
+			labels := stdprometheus.Labels{"topic": topic, "partition": strconv.Itoa(int(partition))}
+			m.lagGauge.With(labels).Set(float64(highWaterMark - offset))
+			m.committedOffsetGauge.With(labels).Set(float64(offset))
+			if m.lagReported[topic] == nil {
+				m.lagReported[topic] = make(map[int32]bool)
+			}
+			m.lagReported[topic][partition] = true
+		}
+	}
+}
+
+// PartitionStall is the progress of an assigned partition, the seconds since its committed offset last advanced
+// and whether it is stalled.
+type PartitionStall struct {
+	SinceAdvanced float64
+	Stalled       bool
+}
+
+// PublishPartitionStalls sets the stall gauges of the assigned partitions, deleting the ones of the partitions no
+// longer assigned.
+func (m *metrics) PublishPartitionStalls(stalls map[string]map[int32]PartitionStall) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for topic, partitions := range m.stallReported {
+		for partition := range partitions {
+			if _, ok := stalls[topic][partition]; !ok {
+				labels := stdprometheus.Labels{"topic": topic, "partition": strconv.Itoa(int(partition))}
+				m.stalledGauge.Delete(labels)
+				m.sinceAdvancedGauge.Delete(labels)
+				delete(partitions, partition)
+			}
+		}
+	}
+	for topic, partitions := range stalls {
+		for partition, stall := range partitions {
+			labels := stdprometheus.Labels{"topic": topic, "partition": strconv.Itoa(int(partition))}
+			stalled := 0.0
+			if stall.Stalled {
+				stalled = 1
+			}
+			m.stalledGauge.With(labels).Set(stalled)
+			m.sinceAdvancedGauge.With(labels).Set(stall.SinceAdvanced)
+			if m.stallReported[topic] == nil {
+				m.stallReported[topic] = make(map[int32]bool)
+			}
+			m.stallReported[topic][partition] = true
+		}
+	}
+}
+
+// ResetPartitions forgets the offsets consumed from the partitions no longer assigned to this instance after a
+// rebalance, their delay is reported by the instance they were assigned to.
+func (m *metrics) ResetPartitions(assigned map[string][]int32) {
+	isAssigned := make(map[string]map[int32]bool)
+	for topic, partitions := range assigned {
+		isAssigned[topic] = make(map[int32]bool)
+		for _, partition := range partitions {
+			isAssigned[topic][partition] = true
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for topic, partitions := range m.topicPartitionToOffset {
+		for partition := range partitions {
+			if !isAssigned[topic][partition] {
+				delete(partitions, partition)
+				m.partitionDelay.With("partition", strconv.Itoa(int(partition)), "topic", topic).Set(0)
+			}
+		}
+	}
+}
+
 type MetricsPublisher interface {
 	PublishOffsetMetrics(highWaterMarks map[string]map[int32]int64)
+	PublishLag(highWaterMarks map[string]map[int32]int64, committed map[string]map[int32]int64)
+	PublishPartitionStalls(stalls map[string]map[int32]PartitionStall)
 	UpdateOffset(topic string, partition int32, delay int64)
-	IncrementRecordsConsumed(count int)
+	ResetPartitions(assigned map[string][]int32)
+	IncrementRecordsConsumed(topic string, count int)
+	IncrementRecordsDeadLettered(topic string, count int)
+	IncrementRecordsAlreadyExisting(count int)
+	IncrementRecordsIndexed(topic string, index string, count int)
+	IncrementRecordsFailed(topic string, index string, count int)
+	IncrementRecordsOversized(topic string, count int)
+	IncrementRecordsCollapsed(topic string, count int)
+	IncrementRecordsSkipped(topic string, count int)
+	IncrementInvalidHeaders(topic string, count int)
+	IncrementDecodeErrors(topic string, count int)
+	IncrementMessagesConsumed(topic string, count int)
+	IncrementRecordsDecoded(topic string, count int)
+	ObserveBatchSize(topic string, size int)
+	IncrementBulkRequests(topic string, status string)
+	ObserveEndToEndLatency(topic string, seconds float64)
+	PublishEndToEndLatencyMax()
+	IncrementMessagesDeadLettered(topic string, kind string, count int)
+	IncrementRecordsFiltered(topic string, count int)
+	IncrementSchemaCacheLookups(result string)
+	IncrementSchemaRegistryFetches(instance string)
+	IncrementSchemaRegistryFailovers(instance string)
+	RecordBulk(size int, latency float64)
 	RecordEndpointLatency(latency float64)
 	BufferFull(full bool)
+	CircuitBreakerOpen(open bool)
+	ConsumptionPaused(paused bool)
+	IncrementConfigReloads(result string)
+	PublishConfigHash(hash uint32)
 }
 
+var (
+	publisher     MetricsPublisher
+	publisherOnce sync.Once
+)
+
+// NewMetricsPublisher returns the publisher of the process, the metrics are only registered on the first call.
 func NewMetricsPublisher() MetricsPublisher {
+	publisherOnce.Do(func() {
+		publisher = newMetricsPublisher()
+	})
+	return publisher
+}
+
+// NewPipelineMetricsPublisher returns a publisher of the metrics of the process for a pipeline, keeping the state
+// of its partitions apart, so that the rebalances of a pipeline don't forget the partitions of the others.
+func NewPipelineMetricsPublisher() MetricsPublisher {
+	m := *NewMetricsPublisher().(*metrics)
+	m.lock = &sync.RWMutex{}
+	m.topicPartitionToOffset = make(map[string]map[int32]int64)
+	m.lagReported = make(map[string]map[int32]bool)
+	m.stallReported = make(map[string]map[int32]bool)
+	m.maxLatency = make(map[string]float64)
+	return &m
+}
+
+func newMetricsPublisher() MetricsPublisher {
 	logger := logger_builder.NewLogger("metrics_updater")
 	recordsConsumed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
 		Name: "kafka_consumer_records_consumed_successfully",
 		Help: "Number of records consumed successfully",
-	}, []string{})
+	}, []string{"topic"})
 	partitionDelay := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
 		Name: "kafka_consumer_partition_delay",
 		Help: "Kafka consumer partition delay",
@@ -95,13 +409,213 @@ func NewMetricsPublisher() MetricsPublisher {
 		Name: "kafka_consumer_buffer_full",
 		Help: "Kafka consumer boolean indicating if app buffer is full",
 	}, []string{})
+	recordsDeadLettered := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_dead_lettered",
+		Help: "Number of records rejected by elasticsearch and sent to the dead letter queue",
+	}, []string{"topic"})
+	recordsAlreadyExisting := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_already_existing",
+		Help: "Number of records skipped because their document already exists, as happens when a batch is retried",
+	}, []string{})
+	circuitBreakerOpenGauge := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_circuit_breaker_open",
+		Help: "Kafka consumer boolean indicating if consumption is paused because elasticsearch is failing",
+	}, []string{})
+	consumptionPausedGauge := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_paused",
+		Help: "Kafka consumer boolean indicating if consumption is paused because too many records are not inserted yet",
+	}, []string{})
+	recordsIndexed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_indexed_total",
+		Help: "Number of records written to elasticsearch",
+	}, []string{"topic", "index"})
+	recordsFailed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_failed_total",
+		Help: "Number of records that could not be written to elasticsearch, rejected or after running out of retries",
+	}, []string{"topic", "index"})
+	recordsOversized := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_oversized",
+		Help: "Number of records rejected for exceeding the maximum document or bulk size",
+	}, []string{"topic"})
+	recordsCollapsed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_collapsed",
+		Help: "Number of records skipped because a later record of the same batch has the same document id",
+	}, []string{"topic"})
+	recordsSkipped := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_skipped",
+		Help: "Number of records skipped because they miss their doc id or index column",
+	}, []string{"topic"})
+	invalidHeaders := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_invalid_headers",
+		Help: "Number of kafka headers skipped because their value is not valid UTF-8",
+	}, []string{"topic"})
+	decodeErrors := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_decode_errors",
+		Help: "Number of kafka messages that could not be decoded",
+	}, []string{"topic"})
+	messagesDeadLettered := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_messages_dead_lettered",
+		Help: "Number of kafka messages that could not be decoded, produced to the dead letter topic",
+	}, []string{"topic", "error"})
+	recordsFiltered := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_records_filtered",
+		Help: "Number of records left out by the consumer filter",
+	}, []string{"topic"})
+	schemaCacheLookups := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_schema_cache_lookups",
+		Help: "Number of avro schema lookups, by whether they hit the cache, were fetched, were read from the local schema directory, failed or were backing off after a failure",
+	}, []string{"result"})
+	schemaRegistryFetches := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_schema_registry_fetches",
+		Help: "Number of schema registry requests served, by the schema registry instance that served them",
+	}, []string{"instance"})
+	schemaRegistryFailovers := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_schema_registry_failovers",
+		Help: "Number of schema registry requests moved to another instance, by the schema registry instance that failed",
+	}, []string{"instance"})
+	messagesConsumed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_messages_consumed_total",
+		Help: "Number of kafka messages consumed, before they are decoded",
+	}, []string{"topic"})
+	recordsDecoded := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "records_decoded_total",
+		Help: "Number of kafka messages decoded to records",
+	}, []string{"topic"})
+	recordsDecodeErrors := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "records_decode_errors_total",
+		Help: "Number of kafka messages that could not be decoded",
+	}, []string{"topic"})
+	esRecordsIndexed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "es_records_indexed_total",
+		Help: "Number of records written to elasticsearch",
+	}, []string{"topic"})
+	esRecordsFailed := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "es_records_failed_total",
+		Help: "Number of records that could not be written to elasticsearch",
+	}, []string{"topic"})
+	bulkRequests := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "es_bulk_requests_total",
+		Help: "Number of elasticsearch bulk requests holding records of the topic, by whether they succeeded, partially failed or failed",
+	}, []string{"topic", "status"})
+	batchSize := kitprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+		Name: "kafka_batch_size",
+		Help: "Number of kafka messages of the topic in each batch consumed",
+	}, []string{"topic"})
+	latencyBuckets, err := parseBuckets(os.Getenv("METRICS_END_TO_END_LATENCY_BUCKETS"))
+	if err != nil {
+		level.Error(logger).Log("err", err, "message", "invalid METRICS_END_TO_END_LATENCY_BUCKETS, using the default buckets")
+		latencyBuckets = defaultLatencyBuckets
+	}
+	endToEndLatency := kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Name:    "kafka_consumer_end_to_end_latency_seconds",
+		Help:    "Seconds between the kafka timestamp of the records and the elasticsearch response acknowledging their insert",
+		Buckets: latencyBuckets,
+	}, []string{"topic"})
+	endToEndLatencyMax := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_end_to_end_latency_max_seconds",
+		Help: "Highest end to end latency of the records inserted during the last metrics update interval",
+	}, []string{"topic"})
+	bulkLatencyHistogram := kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Name:    "kafka_consumer_bulk_latency_seconds",
+		Help:    "Latency of elasticsearch bulk inserts in seconds",
+		Buckets: stdprometheus.DefBuckets,
+	}, []string{})
+	lagGauge := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_lag",
+		Help: "Number of records between the committed offset and the end of the partitions assigned to this instance",
+	}, []string{"topic", "partition"})
+	committedOffsetGauge := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Name: "kafka_last_committed_offset",
+		Help: "Offset committed for the partitions assigned to this instance",
+	}, []string{"topic", "partition"})
+	stdprometheus.MustRegister(lagGauge, committedOffsetGauge)
+	stalledGauge := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_partition_stalled",
+		Help: "1 when the partition has lag and its committed offset hasn't advanced for the stall timeout, 0 otherwise",
+	}, []string{"topic", "partition"})
+	sinceAdvancedGauge := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_partition_seconds_since_advanced",
+		Help: "Seconds since the committed offset of the partition last advanced, or it last had no lag",
+	}, []string{"topic", "partition"})
+	stdprometheus.MustRegister(stalledGauge, sinceAdvancedGauge)
+	lastBulkSizeGauge := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_last_bulk_size",
+		Help: "Number of documents of the last elasticsearch bulk insert",
+	}, []string{})
+	configReloads := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "kafka_consumer_config_reloads",
+		Help: "Reloads of the config, by result: success or failure",
+	}, []string{"result"})
+	configHashGauge := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "kafka_consumer_config_hash",
+		Help: "Hash of the settings in effect, the same across the instances running the same config",
+	}, []string{})
 	return &metrics{
 		logger:                   logger,
 		partitionDelay:           partitionDelay,
 		recordsConsumed:          recordsConsumed,
 		endpointLatencyHistogram: endpointLatencySummary,
 		bufferFullGauge:          bufferFullGauge,
-		lock:                     sync.RWMutex{},
-		topicPartitionToOffset: make(map[string]map[int32]int64),
+		recordsDeadLettered:      recordsDeadLettered,
+		recordsAlreadyExisting:   recordsAlreadyExisting,
+		circuitBreakerOpenGauge:  circuitBreakerOpenGauge,
+		consumptionPausedGauge:   consumptionPausedGauge,
+		recordsIndexed:           recordsIndexed,
+		recordsFailed:            recordsFailed,
+		recordsOversized:         recordsOversized,
+		recordsCollapsed:         recordsCollapsed,
+		recordsSkipped:           recordsSkipped,
+		invalidHeaders:           invalidHeaders,
+		decodeErrors:             decodeErrors,
+		messagesDeadLettered:     messagesDeadLettered,
+		recordsFiltered:          recordsFiltered,
+		schemaCacheLookups:       schemaCacheLookups,
+		schemaRegistryFetches:    schemaRegistryFetches,
+		schemaRegistryFailovers:  schemaRegistryFailovers,
+		messagesConsumed:         messagesConsumed,
+		recordsDecoded:           recordsDecoded,
+		recordsDecodeErrors:      recordsDecodeErrors,
+		esRecordsIndexed:         esRecordsIndexed,
+		esRecordsFailed:          esRecordsFailed,
+		bulkRequests:             bulkRequests,
+		batchSize:                batchSize,
+		endToEndLatency:          endToEndLatency,
+		endToEndLatencyMax:       endToEndLatencyMax,
+		bulkLatencyHistogram:     bulkLatencyHistogram,
+		lastBulkSizeGauge:        lastBulkSizeGauge,
+		configReloads:            configReloads,
+		configHashGauge:          configHashGauge,
+		lock:                     &sync.RWMutex{},
+		topicPartitionToOffset:   make(map[string]map[int32]int64),
+		lagGauge:                 lagGauge,
+		committedOffsetGauge:     committedOffsetGauge,
+		lagReported:              make(map[string]map[int32]bool),
+		stalledGauge:             stalledGauge,
+		sinceAdvancedGauge:       sinceAdvancedGauge,
+		stallReported:            make(map[string]map[int32]bool),
+		maxLatency:               make(map[string]float64),
+	}
+}
+
+// defaultLatencyBuckets are the buckets of the end to end latency, in seconds, around the minute it usually takes
+// records to be searchable.
+var defaultLatencyBuckets = []float64{0.5, 1, 2.5, 5, 10, 15, 30, 45, 60, 90, 120, 300, 600}
+
+// parseBuckets parses a comma separated list of increasing bucket bounds, in seconds.
+func parseBuckets(value string) ([]float64, error) {
+	if strings.TrimSpace(value) == "" {
+		return defaultLatencyBuckets, nil
+	}
+	var buckets []float64
+	for _, bound := range strings.Split(value, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(bound), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %s", bound, err)
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets should be increasing, %v comes after %v", bucket, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bucket)
 	}
+	return buckets, nil
 }
@@ -3,12 +3,32 @@ package metrics
 import (
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var (
+	registerOnce sync.Once
+	// mux serves the metrics port, apart from the default mux where net/http/pprof registers its routes
+	mux = http.NewServeMux()
+)
+
+// Register serves the metrics at /metrics on METRICS_PORT, once per process.
 func Register() {
-	http.Handle("/metrics", promhttp.Handler())
-	port := os.Getenv("METRICS_PORT")
-	go http.ListenAndServe(":"+port, nil)
+	registerOnce.Do(func() {
+		mux.Handle("/metrics", Handler())
+		port := os.Getenv("METRICS_PORT")
+		go http.ListenAndServe(":"+port, mux)
+	})
+}
+
+// Handle serves another route on METRICS_PORT, like the rate limits.
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Handler exports the metrics of the process, to be served along with other routes, like the probes.
+func Handler() http.Handler {
+	return promhttp.Handler()
 }
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Coercion is the type a field of the documents is coerced to, like the type of its elasticsearch mapping.
+type Coercion int
+
+const (
+	CoerceLong    Coercion = 0
+	CoerceDouble  Coercion = 1
+	CoerceBoolean Coercion = 2
+	CoerceString  Coercion = 3
+)
+
+func (c Coercion) String() string {
+	switch c {
+	case CoerceDouble:
+		return "double"
+	case CoerceBoolean:
+		return "boolean"
+	case CoerceString:
+		return "string"
+	default:
+		return "long"
+	}
+}
+
+// CoercionError is a field whose value can't be coerced to its type.
+type CoercionError struct {
+	Field string
+	Value interface{}
+	Type  Coercion
+}
+
+func (e *CoercionError) Error() string {
+	if value, ok := e.Value.(string); ok {
+		return fmt.Sprintf("field %s can't be coerced to %s: %q", e.Field, e.Type, value)
+	}
+	return fmt.Sprintf("field %s can't be coerced to %s: %v", e.Field, e.Type, e.Value)
+}
+
+// CoerceFields converts the values of the given fields of a record document in place, like the numeric ids sent
+// as strings, so that they match the mappings of the indices. Nested fields are selected by their path, like
+// "user.id", their parents are copied rather than changed since they are shared with the record. The items of
+// arrays are coerced one by one. Missing and null fields are left as they are. It fails with a *CoercionError on
+// the first value that can't be coerced, leaving the document as it was.
+func CoerceFields(document map[string]interface{}, coercions map[string]Coercion) error {
+	coerced := make(map[string]interface{}, len(document))
+	for field, value := range document {
+		coerced[field] = value
+	}
+	for field, coercion := range coercions {
+		if err := coerceField(coerced, strings.Split(field, "."), coercion); err != nil {
+			err.Field = field
+			return err
+		}
+	}
+	for field, value := range coerced {
+		document[field] = value
+	}
+	return nil
+}
+
+func coerceField(document map[string]interface{}, path []string, coercion Coercion) *CoercionError {
+	value, ok := document[path[0]]
+	if !ok || value == nil {
+		return nil
+	}
+	if len(path) == 1 {
+		coerced, err := coerceValue(value, coercion)
+		if err != nil {
+			return err
+		}
+		document[path[0]] = coerced
+		return nil
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	nestedCopy := make(map[string]interface{}, len(nested))
+	for key, nestedValue := range nested {
+		nestedCopy[key] = nestedValue
+	}
+	if err := coerceField(nestedCopy, path[1:], coercion); err != nil {
+		return err
+	}
+	document[path[0]] = nestedCopy
+	return nil
+}
+
+func coerceValue(value interface{}, coercion Coercion) (interface{}, *CoercionError) {
+	if items, ok := value.([]interface{}); ok {
+		coerced := make([]interface{}, len(items))
+		for idx, item := range items {
+			if item == nil {
+				continue
+			}
+			var err *CoercionError
+			if coerced[idx], err = coerceValue(item, coercion); err != nil {
+				return nil, err
+			}
+		}
+		return coerced, nil
+	}
+	var coerced interface{}
+	var ok bool
+	switch coercion {
+	case CoerceLong:
+		coerced, ok = coerceLong(value)
+	case CoerceDouble:
+		coerced, ok = coerceDouble(value)
+	case CoerceBoolean:
+		coerced, ok = coerceBoolean(value)
+	case CoerceString:
+		coerced, ok = coerceString(value)
+	}
+	if !ok {
+		return nil, &CoercionError{Value: value, Type: coercion}
+	}
+	return coerced, nil
+}
+
+// coerceLong accepts integers, and decimals without a fractional part, like 42.0.
+func coerceLong(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case json.Number:
+		return parseLong(v.String())
+	case float64:
+		return floatToLong(v)
+	case float32:
+		return floatToLong(float64(v))
+	case string:
+		return parseLong(strings.TrimSpace(v))
+	default:
+		return 0, false
+	}
+}
+
+func parseLong(value string) (int64, bool) {
+	if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return parsed, true
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return floatToLong(parsed)
+}
+
+func floatToLong(value float64) (int64, bool) {
+	if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(value), true
+}
+
+// coerceDouble accepts numbers, elasticsearch rejects NaN and the infinities.
+func coerceDouble(value interface{}) (float64, bool) {
+	var parsed float64
+	switch v := value.(type) {
+	case float64:
+		parsed = v
+	case float32:
+		parsed = float64(v)
+	case int64:
+		parsed = float64(v)
+	case int32:
+		parsed = float64(v)
+	case int:
+		parsed = float64(v)
+	case json.Number:
+		var err error
+		if parsed, err = v.Float64(); err != nil {
+			return 0, false
+		}
+	case string:
+		var err error
+		if parsed, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return parsed, !math.IsNaN(parsed) && !math.IsInf(parsed, 0)
+}
+
+// coerceBoolean accepts booleans and the strings true and false, in any case.
+func coerceBoolean(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true":
+			return true, true
+		case "false":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// coerceString accepts the values that aren't objects, avro timestamps are written as rfc3339 strings in UTC.
+func coerceString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int:
+		return strconv.Itoa(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), true
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoerceFields(t *testing.T) {
+	user := map[string]interface{}{"id": "42", "admin": "TRUE"}
+	record := Record{Json: map[string]interface{}{
+		"user":     user,
+		"amount":   json.Number("10.5"),
+		"quantity": "3.0",
+		"code":     json.Number("7"),
+		"tags":     []interface{}{"1", nil, 2},
+		"note":     nil,
+		"at":       time.Date(2021, 3, 15, 2, 59, 0, 0, time.UTC),
+	}}
+	document := record.FilteredFieldsJSON(nil)
+
+	err := CoerceFields(document, map[string]Coercion{
+		"user.id":    CoerceLong,
+		"user.admin": CoerceBoolean,
+		"amount":     CoerceDouble,
+		"quantity":   CoerceLong,
+		"code":       CoerceString,
+		"tags":       CoerceLong,
+		"note":       CoerceLong,
+		"at":         CoerceString,
+		"missing":    CoerceLong,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{"id": int64(42), "admin": true}, document["user"])
+	assert.Equal(t, 10.5, document["amount"])
+	assert.Equal(t, int64(3), document["quantity"])
+	assert.Equal(t, "7", document["code"])
+	assert.Equal(t, []interface{}{int64(1), nil, int64(2)}, document["tags"])
+	assert.Nil(t, document["note"])
+	assert.Equal(t, "2021-03-15T02:59:00Z", document["at"])
+	assert.NotContains(t, document, "missing")
+	assert.Equal(t, "42", user["id"], "the record should be left untouched")
+}
+
+func TestCoerceFields_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		coercion Coercion
+		expected string
+	}{
+		{"42a", CoerceLong, `field f can't be coerced to long: "42a"`},
+		{json.Number("4.2"), CoerceLong, "field f can't be coerced to long: 4.2"},
+		{"yes", CoerceBoolean, `field f can't be coerced to boolean: "yes"`},
+		{int64(1), CoerceBoolean, "field f can't be coerced to boolean: 1"},
+		{"NaN", CoerceDouble, `field f can't be coerced to double: "NaN"`},
+		{map[string]interface{}{}, CoerceString, "field f can't be coerced to string: map[]"},
+	} {
+		document := map[string]interface{}{"f": tc.value, "g": "1"}
+		err := CoerceFields(document, map[string]Coercion{"f": tc.coercion, "g": CoerceLong})
+		if assert.EqualError(t, err, tc.expected) {
+			assert.Equal(t, &CoercionError{Field: "f", Value: tc.value, Type: tc.coercion}, err)
+			assert.Equal(t, "1", document["g"], "the document should be left as it was")
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package models
 
 type ElasticRecord struct {
-	Index string
-	Type  string
-	ID    string
-	Json  map[string]interface{}
+	Index    string
+	Type     string
+	ID       string
+	Routing  string
+	Pipeline string
+	Version  int64
+	Deleted  bool
+	Json     map[string]interface{}
+	// Script updates the document with the record fields as params, starting from Upsert when it doesn't exist
+	Script string
+	Upsert map[string]interface{}
 }
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Filter selects the records to index with conditions on their fields, like
+// `event_type in (click,view) && country == BR`. Conditions are joined with && and ||, && binding tighter.
+type Filter struct {
+	// a record matches when all the conditions of any of the alternatives match
+	alternatives [][]filterCondition
+}
+
+// filterCondition compares the value of a field, as returned by GetValueForField, to a set of values.
+type filterCondition struct {
+	field   string
+	values  map[string]bool
+	negated bool
+}
+
+func (c filterCondition) match(record *Record) bool {
+	value, err := record.GetValueForField(c.field)
+	if err != nil {
+		// records missing the field only match negated conditions
+		return c.negated
+	}
+	return c.values[value] != c.negated
+}
+
+// Match tells whether the record is selected by the filter.
+func (f *Filter) Match(record *Record) bool {
+	for _, conditions := range f.alternatives {
+		matched := true
+		for _, condition := range conditions {
+			if !condition.match(record) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFilter parses a filter expression, made of conditions like `field == value`, `field != value`,
+// `field in (a,b)` and `field not in (a,b)`. Values with spaces or symbols are quoted with double quotes.
+func ParseFilter(expression string) (*Filter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty filter")
+	}
+	parser := &filterParser{tokens: tokens}
+	filter := &Filter{}
+	for {
+		conditions, err := parser.conditions()
+		if err != nil {
+			return nil, err
+		}
+		filter.alternatives = append(filter.alternatives, conditions)
+		if parser.done() {
+			return filter, nil
+		}
+		if !parser.accept("||") {
+			return nil, fmt.Errorf("expected && or || instead of %s", parser.peek())
+		}
+	}
+}
+
+// filterToken is a symbol, a bare word or a quoted value.
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	for idx := 0; idx < len(expression); {
+		switch char := expression[idx]; {
+		case char == ' ' || char == '\t' || char == '\n':
+			idx++
+		case char == '(' || char == ')' || char == ',':
+			tokens = append(tokens, filterToken{text: string(char)})
+			idx++
+		case strings.HasPrefix(expression[idx:], "=="), strings.HasPrefix(expression[idx:], "!="),
+			strings.HasPrefix(expression[idx:], "&&"), strings.HasPrefix(expression[idx:], "||"):
+			tokens = append(tokens, filterToken{text: expression[idx : idx+2]})
+			idx += 2
+		case char == '"':
+			end := strings.IndexByte(expression[idx+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated quoted value")
+			}
+			tokens = append(tokens, filterToken{text: expression[idx+1 : idx+1+end], quoted: true})
+			idx += end + 2
+		default:
+			end := idx
+			for end < len(expression) && !strings.ContainsRune(" \t\n(),\"=!&|", rune(expression[end])) {
+				end++
+			}
+			if end == idx {
+				return nil, fmt.Errorf("unexpected %q", expression[idx:])
+			}
+			tokens = append(tokens, filterToken{text: expression[idx:end]})
+			idx = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() string {
+	if p.done() {
+		return "the end of the filter"
+	}
+	return fmt.Sprintf("%q", p.tokens[p.pos].text)
+}
+
+// accept consumes the next token if it is the given symbol or keyword.
+func (p *filterParser) accept(symbol string) bool {
+	if p.done() || p.tokens[p.pos].quoted || p.tokens[p.pos].text != symbol {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+// word consumes a field name or a value.
+func (p *filterParser) word() (string, error) {
+	if p.done() {
+		return "", errors.New("unexpected end of the filter")
+	}
+	token := p.tokens[p.pos]
+	if !token.quoted && strings.ContainsAny(token.text, "(),=!&|") {
+		return "", fmt.Errorf("expected a field or value instead of %q", token.text)
+	}
+	p.pos++
+	return token.text, nil
+}
+
+// conditions parses conditions joined with &&.
+func (p *filterParser) conditions() ([]filterCondition, error) {
+	var conditions []filterCondition
+	for {
+		condition, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+		if !p.accept("&&") {
+			return conditions, nil
+		}
+	}
+}
+
+func (p *filterParser) condition() (filterCondition, error) {
+	field, err := p.word()
+	if err != nil {
+		return filterCondition{}, err
+	}
+	condition := filterCondition{field: field, values: make(map[string]bool)}
+	switch {
+	case p.accept("=="), p.accept("!="):
+		condition.negated = p.tokens[p.pos-1].text == "!="
+		value, err := p.word()
+		if err != nil {
+			return filterCondition{}, err
+		}
+		condition.values[value] = true
+		return condition, nil
+	case p.accept("not"):
+		condition.negated = true
+		if !p.accept("in") {
+			return filterCondition{}, fmt.Errorf("expected in after not instead of %s", p.peek())
+		}
+	case p.accept("in"):
+	default:
+		return filterCondition{}, fmt.Errorf("expected ==, !=, in or not in after %s instead of %s", field, p.peek())
+	}
+	if !p.accept("(") {
+		return filterCondition{}, fmt.Errorf("expected ( instead of %s", p.peek())
+	}
+	for {
+		value, err := p.word()
+		if err != nil {
+			return filterCondition{}, err
+		}
+		condition.values[value] = true
+		if p.accept(")") {
+			return condition, nil
+		}
+		if !p.accept(",") {
+			return filterCondition{}, fmt.Errorf("expected , or ) instead of %s", p.peek())
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Match(t *testing.T) {
+	filter, err := ParseFilter(`event_type in (click, view) && country == BR || header.source == "back office"`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	click := &Record{Json: map[string]interface{}{"event_type": "click", "country": "BR"}}
+	assert.True(t, filter.Match(click))
+	purchase := &Record{Json: map[string]interface{}{"event_type": "purchase", "country": "BR"}}
+	assert.False(t, filter.Match(purchase))
+	foreign := &Record{Json: map[string]interface{}{"event_type": "view", "country": "AR"}}
+	assert.False(t, filter.Match(foreign))
+	backOffice := &Record{Json: map[string]interface{}{}, Headers: map[string]string{"source": "back office"}}
+	assert.True(t, filter.Match(backOffice))
+}
+
+func TestFilter_MatchNegated(t *testing.T) {
+	filter, err := ParseFilter(`tenant_id != 7 && status not in (deleted,"on hold")`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, filter.Match(&Record{Json: map[string]interface{}{"tenant_id": json.Number("8"), "status": "active"}}))
+	assert.False(t, filter.Match(&Record{Json: map[string]interface{}{"tenant_id": json.Number("7"), "status": "active"}}))
+	assert.False(t, filter.Match(&Record{Json: map[string]interface{}{"tenant_id": int64(8), "status": "on hold"}}))
+	// missing fields only match negated conditions
+	assert.True(t, filter.Match(&Record{Json: map[string]interface{}{}}))
+
+	filter, err = ParseFilter(`country == BR`)
+	if assert.NoError(t, err) {
+		assert.False(t, filter.Match(&Record{Json: map[string]interface{}{}}))
+		assert.False(t, filter.Match(&Record{Json: map[string]interface{}{"country": true}}))
+	}
+}
+
+func TestParseFilter_Invalid(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"country",
+		"country = BR",
+		"country == ",
+		"country == BR &&",
+		"country == BR || || id == 1",
+		"country BR",
+		"country in BR",
+		"country in (BR",
+		"country in (BR,)",
+		"country not (BR)",
+		`country == "BR`,
+		"country == BR)",
+	} {
+		_, err := ParseFilter(expression)
+		assert.Error(t, err, expression)
+	}
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"sort"
+	"strconv"
+)
+
+// FlattenFields replaces the nested objects of the document with top level fields named by their dotted path, like
+// `payment.method.type`. maxDepth is the number of levels flattened, the objects nested deeper are kept as the
+// value of their path, 0 flattens every level. Arrays are kept as they are, unless flattenArrays is set, then
+// their items are flattened too, named by their index, like `items.0.sku`. The nested objects themselves are not
+// modified, since they are shared with the record. It returns the sorted paths of the fields that collide, the
+// field already at the top level, or the first of the flattened ones, is kept.
+func FlattenFields(document map[string]interface{}, maxDepth int, flattenArrays bool) []string {
+	f := flattener{fields: make(map[string]interface{}), collisions: make(map[string]bool), maxDepth: maxDepth, flattenArrays: flattenArrays}
+	// sorted, so that the same field is kept every time
+	keys := make([]string, 0, len(document))
+	for key := range document {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if f.flatten(key, document[key], 1) {
+			delete(document, key)
+		}
+	}
+	for path, value := range f.fields {
+		if _, exists := document[path]; exists {
+			f.collisions[path] = true
+			continue
+		}
+		document[path] = value
+	}
+	var collisions []string
+	for path := range f.collisions {
+		collisions = append(collisions, path)
+	}
+	sort.Strings(collisions)
+	return collisions
+}
+
+type flattener struct {
+	fields        map[string]interface{}
+	collisions    map[string]bool
+	maxDepth      int
+	flattenArrays bool
+}
+
+// flatten adds the leaves of the value under path, telling whether it was flattened.
+func (f flattener) flatten(path string, value interface{}, depth int) bool {
+	if f.maxDepth > 0 && depth > f.maxDepth {
+		return false
+	}
+	switch nested := value.(type) {
+	case map[string]interface{}:
+		if len(nested) == 0 {
+			return false
+		}
+		keys := make([]string, 0, len(nested))
+		for key := range nested {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			f.add(path+"."+key, nested[key], depth)
+		}
+		return true
+	case []interface{}:
+		if !f.flattenArrays || len(nested) == 0 {
+			return false
+		}
+		for idx, item := range nested {
+			f.add(path+"."+strconv.Itoa(idx), item, depth)
+		}
+		return true
+	}
+	return false
+}
+
+func (f flattener) add(path string, value interface{}, depth int) {
+	if f.flatten(path, value, depth+1) {
+		return
+	}
+	if _, exists := f.fields[path]; exists {
+		f.collisions[path] = true
+		return
+	}
+	f.fields[path] = value
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newNestedDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"id": 1,
+		"payment": map[string]interface{}{
+			"method": map[string]interface{}{"type": "card", "brand": "visa"},
+			"amount": 10,
+		},
+		"items": []interface{}{map[string]interface{}{"sku": "a-1"}, "loose"},
+		"empty": map[string]interface{}{},
+	}
+}
+
+func TestFlattenFields(t *testing.T) {
+	document := newNestedDocument()
+	assert.Empty(t, FlattenFields(document, 0, false))
+	assert.Equal(t, map[string]interface{}{
+		"id":                   1,
+		"payment.method.type":  "card",
+		"payment.method.brand": "visa",
+		"payment.amount":       10,
+		"items":                []interface{}{map[string]interface{}{"sku": "a-1"}, "loose"},
+		"empty":                map[string]interface{}{},
+	}, document)
+}
+
+func TestFlattenFields_MaxDepth(t *testing.T) {
+	document := newNestedDocument()
+	FlattenFields(document, 1, false)
+	assert.Equal(t, map[string]interface{}{"type": "card", "brand": "visa"}, document["payment.method"])
+	assert.Equal(t, 10, document["payment.amount"])
+	assert.NotContains(t, document, "payment")
+}
+
+func TestFlattenFields_Arrays(t *testing.T) {
+	document := newNestedDocument()
+	FlattenFields(document, 0, true)
+	assert.Equal(t, "a-1", document["items.0.sku"])
+	assert.Equal(t, "loose", document["items.1"])
+	assert.NotContains(t, document, "items")
+
+	document = newNestedDocument()
+	FlattenFields(document, 1, true)
+	assert.Equal(t, map[string]interface{}{"sku": "a-1"}, document["items.0"])
+}
+
+func TestFlattenFields_Collisions(t *testing.T) {
+	nested := map[string]interface{}{"b": map[string]interface{}{"c": 6}, "b.c": 3, "c": map[string]interface{}{"d": 4}}
+	document := map[string]interface{}{"a": nested, "a.b.c": 5}
+	assert.Equal(t, []string{"a.b.c"}, FlattenFields(document, 0, false))
+	// the top level field is kept
+	assert.Equal(t, map[string]interface{}{"a.b.c": 5, "a.c.d": 4}, document)
+	// nested objects are not modified
+	assert.Len(t, nested, 3)
+
+	// between flattened fields, the first path in alphabetical order is kept
+	document = map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"c": 6}, "b.c": 3}}
+	assert.Equal(t, []string{"a.b.c"}, FlattenFields(document, 0, false))
+	assert.Equal(t, map[string]interface{}{"a.b.c": 6}, document)
+}
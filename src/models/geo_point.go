@@ -0,0 +1,32 @@
+package models
+
+// GeoPoint is a geo_point field assembled from the latitude and longitude fields of the documents.
+type GeoPoint struct {
+	Lat string
+	Lon string
+}
+
+// AddGeoPoints sets the given fields of a record document to {"lat": <lat>, "lon": <lon>} objects, in place,
+// replacing the fields the document already has by those names. The latitude and longitude are top level fields of
+// the document, their values are kept as they are. Documents missing either of them, or with a null one, don't get
+// the field, since elasticsearch rejects half formed points. With removeSources the latitude and longitude are
+// removed from the document, whether the point was set or not.
+func AddGeoPoints(document map[string]interface{}, points map[string]GeoPoint, removeSources bool) {
+	geoPoints := make(map[string]interface{}, len(points))
+	for field, point := range points {
+		lat, lon := document[point.Lat], document[point.Lon]
+		if lat == nil || lon == nil {
+			continue
+		}
+		geoPoints[field] = map[string]interface{}{"lat": lat, "lon": lon}
+	}
+	if removeSources {
+		for _, point := range points {
+			delete(document, point.Lat)
+			delete(document, point.Lon)
+		}
+	}
+	for field, geoPoint := range geoPoints {
+		document[field] = geoPoint
+	}
+}
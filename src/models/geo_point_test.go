@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var geoPoints = map[string]GeoPoint{
+	"location": {Lat: "lat", Lon: "lon"},
+	"pickup":   {Lat: "pickup_lat", Lon: "pickup_lon"},
+}
+
+func TestAddGeoPoints(t *testing.T) {
+	document := map[string]interface{}{
+		"id":         "1",
+		"lat":        -8.05,
+		"lon":        json.Number("-34.9"),
+		"pickup_lat": -23.55,
+		"pickup_lon": -46.63,
+	}
+	AddGeoPoints(document, geoPoints, false)
+	assert.Equal(t, map[string]interface{}{
+		"id":         "1",
+		"lat":        -8.05,
+		"lon":        json.Number("-34.9"),
+		"pickup_lat": -23.55,
+		"pickup_lon": -46.63,
+		"location":   map[string]interface{}{"lat": -8.05, "lon": json.Number("-34.9")},
+		"pickup":     map[string]interface{}{"lat": -23.55, "lon": -46.63},
+	}, document)
+}
+
+func TestAddGeoPoints_RemoveSources(t *testing.T) {
+	document := map[string]interface{}{
+		"id":         "1",
+		"lat":        -8.05,
+		"lon":        -34.9,
+		"pickup_lat": -23.55,
+		"pickup_lon": nil,
+	}
+	AddGeoPoints(document, geoPoints, true)
+	assert.Equal(t, map[string]interface{}{
+		"id":       "1",
+		"location": map[string]interface{}{"lat": -8.05, "lon": -34.9},
+	}, document)
+}
+
+func TestAddGeoPoints_MissingComponent(t *testing.T) {
+	document := map[string]interface{}{"lat": -8.05, "lon": nil, "pickup_lat": -23.55}
+	AddGeoPoints(document, geoPoints, false)
+	assert.Equal(t, map[string]interface{}{"lat": -8.05, "lon": nil, "pickup_lat": -23.55}, document)
+}
+
+func TestAddGeoPoints_ReplacesSourceField(t *testing.T) {
+	document := map[string]interface{}{"location": "-8.05", "lon": -34.9}
+	AddGeoPoints(document, map[string]GeoPoint{"location": {Lat: "location", Lon: "lon"}}, true)
+	assert.Equal(t, map[string]interface{}{
+		"location": map[string]interface{}{"lat": "-8.05", "lon": -34.9},
+	}, document)
+}
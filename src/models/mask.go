@@ -0,0 +1,73 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+type MaskStrategy int
+
+const (
+	MaskSHA256 MaskStrategy = 0
+	MaskRedact MaskStrategy = 1
+	MaskLast4  MaskStrategy = 2
+)
+
+// RedactedValue replaces the values of the fields masked with MaskRedact.
+const RedactedValue = "[redacted]"
+
+// MaskFields replaces the values of the given fields of a record document, usually filtered by
+// FilteredFieldsJSON, in place. Nested fields are selected by their path, like "user.email", their parents are
+// copied rather than changed since they are shared with the record. Missing and null fields are ignored.
+func MaskFields(document map[string]interface{}, masks map[string]MaskStrategy, salt string) {
+	for field, strategy := range masks {
+		maskField(document, strings.Split(field, "."), strategy, salt)
+	}
+}
+
+func maskField(document map[string]interface{}, path []string, strategy MaskStrategy, salt string) {
+	value, ok := document[path[0]]
+	if !ok || value == nil {
+		return
+	}
+	if len(path) == 1 {
+		document[path[0]] = maskValue(fmt.Sprint(value), strategy, salt)
+		return
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	nestedCopy := make(map[string]interface{}, len(nested))
+	for key, nestedValue := range nested {
+		nestedCopy[key] = nestedValue
+	}
+	maskField(nestedCopy, path[1:], strategy, salt)
+	document[path[0]] = nestedCopy
+}
+
+// maskValue hashes values with sha256, keyed by the salt with hmac when there is one, so that the same value
+// always gets the same pseudonym. last4 keeps the last four characters, values that short are masked whole.
+func maskValue(value string, strategy MaskStrategy, salt string) string {
+	switch strategy {
+	case MaskRedact:
+		return RedactedValue
+	case MaskLast4:
+		runes := []rune(value)
+		if len(runes) <= 4 {
+			return strings.Repeat("*", len(runes))
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	default:
+		if salt == "" {
+			sum := sha256.Sum256([]byte(value))
+			return hex.EncodeToString(sum[:])
+		}
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write([]byte(value))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskFields(t *testing.T) {
+	user := map[string]interface{}{"email": "jane@example.com", "card": "4111111111111111"}
+	record := Record{Json: map[string]interface{}{"user": user, "ssn": "123", "phone": nil, "id": 42}}
+	document := record.FilteredFieldsJSON(nil)
+
+	MaskFields(document, map[string]MaskStrategy{
+		"user.email":   MaskSHA256,
+		"user.card":    MaskLast4,
+		"ssn":          MaskLast4,
+		"phone":        MaskRedact,
+		"id":           MaskRedact,
+		"missing":      MaskRedact,
+		"id.not_a_map": MaskRedact,
+	}, "")
+
+	masked := document["user"].(map[string]interface{})
+	assert.Equal(t, "8c87b489ce35cf2e2f39f80e282cb2e804932a56a213983eeeb428407d43b52d", masked["email"])
+	assert.Equal(t, "************1111", masked["card"])
+	assert.Equal(t, "***", document["ssn"])
+	assert.Nil(t, document["phone"])
+	assert.Equal(t, RedactedValue, document["id"])
+	assert.NotContains(t, document, "missing")
+	assert.Equal(t, "jane@example.com", user["email"], "the record should be left untouched")
+}
+
+func TestMaskFields_Salt(t *testing.T) {
+	unsalted := map[string]interface{}{"email": "jane@example.com"}
+	salted := map[string]interface{}{"email": "jane@example.com"}
+	otherSalt := map[string]interface{}{"email": "jane@example.com"}
+	MaskFields(unsalted, map[string]MaskStrategy{"email": MaskSHA256}, "")
+	MaskFields(salted, map[string]MaskStrategy{"email": MaskSHA256}, "pepper")
+	MaskFields(otherSalt, map[string]MaskStrategy{"email": MaskSHA256}, "salt")
+
+	assert.NotEqual(t, unsalted["email"], salted["email"])
+	assert.NotEqual(t, salted["email"], otherSalt["email"])
+	assert.Len(t, salted["email"], 64)
+}
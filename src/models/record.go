@@ -1,8 +1,13 @@
 package models
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"fmt"
 )
@@ -12,28 +17,131 @@ type Record struct {
 	Partition int32
 	Offset    int64
 	Timestamp time.Time
+	Key       []byte
+	Deleted   bool // the record is a tombstone, Json holds the decoded key fields when available
 	Json      map[string]interface{}
+	// Headers are the kafka headers of the record with valid UTF-8 values
+	Headers map[string]string
+	// DecodeErr is why the message could not be decoded, the record then only holds its raw Value to be dead lettered
+	DecodeErr error
+	Value     []byte
+	// KeyString is the key as used by the KeyColumn when it had to be decoded, like avro keys, empty otherwise
+	KeyString string
+}
+
+// HeaderPrefix refers columns to the headers of the record instead of its fields, like "header.x-tenant-id".
+const HeaderPrefix = "header."
+
+// KeyColumn refers columns to the kafka message key instead of a field, like ES_DOC_ID_COLUMN=@key.
+const KeyColumn = "@key"
+
+const (
+	LayoutHour  = "2006-01-02-15"
+	LayoutDay   = "2006-01-02"
+	LayoutMonth = "2006-01"
+)
+
+// FormatTimestamp formats the timestamp in the given location, or in UTC when loc is nil, so that a record lands in
+// the same time suffix whatever the time zone of the host is.
+func (r *Record) FormatTimestamp(layout string, loc *time.Location) string {
+	return r.timestampIn(loc).Format(layout)
 }
 
 func (r *Record) FormatTimestampDay() string {
-	return r.Timestamp.Format("2006-01-02")
+	return r.FormatTimestamp(LayoutDay, nil)
 }
 
 func (r *Record) FormatTimestampHour() string {
-	return r.Timestamp.Format("2006-01-02-15")
+	return r.FormatTimestamp(LayoutHour, nil)
+}
+
+// FormatTimestampWeek formats the ISO week of the timestamp, weeks start on monday and belong to the
+// year of their thursday, so the first days of january may be in the last week of the previous year.
+func (r *Record) FormatTimestampWeek(loc *time.Location) string {
+	year, week := r.timestampIn(loc).ISOWeek()
+	return fmt.Sprintf("%d-w%02d", year, week)
+}
+
+func (r *Record) timestampIn(loc *time.Location) time.Time {
+	if loc == nil {
+		return r.Timestamp.UTC()
+	}
+	return r.Timestamp.In(loc)
 }
 
 func (r *Record) GetId() string {
 	return fmt.Sprintf("%d:%d", r.Partition, r.Offset)
 }
 
-func (r *Record) GetValueForField(field string) (string, error) {
+// GetKeyValue is the value of the KeyColumn: the decoded key, text keys as they are and the other keys encoded as
+// base64. Records without key fall back to their partition and offset, like records without id column.
+func (r *Record) GetKeyValue() string {
+	switch {
+	case len(r.Key) == 0:
+		return r.GetId()
+	case r.KeyString != "":
+		return r.KeyString
+	case utf8.Valid(r.Key) && bytes.IndexByte(r.Key, 0) < 0:
+		return string(r.Key)
+	default:
+		return base64.StdEncoding.EncodeToString(r.Key)
+	}
+}
+
+// GetField returns the value of a field, which can be a dotted path through nested records and array indices, like
+// `payment.method.type` or `items.0.sku`. A field named with dots is found before the path.
+func (r *Record) GetField(field string) (interface{}, bool) {
 	if value, ok := r.Json[field]; ok {
+		return value, true
+	}
+	if !strings.Contains(field, ".") {
+		return nil, false
+	}
+	var value interface{} = r.Json
+	for _, step := range strings.Split(field, ".") {
+		switch nested := value.(type) {
+		case map[string]interface{}:
+			field, ok := nested[step]
+			if !ok {
+				return nil, false
+			}
+			value = field
+		case []interface{}:
+			idx, err := strconv.Atoi(step)
+			if err != nil || idx < 0 || idx >= len(nested) {
+				return nil, false
+			}
+			value = nested[idx]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (r *Record) GetValueForField(field string) (string, error) {
+	if field == KeyColumn {
+		return r.GetKeyValue(), nil
+	}
+	if strings.HasPrefix(field, HeaderPrefix) {
+		if value, ok := r.Headers[strings.TrimPrefix(field, HeaderPrefix)]; ok {
+			return value, nil
+		}
+		return "", fmt.Errorf("could not get value from header %s", strings.TrimPrefix(field, HeaderPrefix))
+	}
+	if value, ok := r.GetField(field); ok {
 		switch castedValue := value.(type) {
 		case string:
 			return castedValue, nil
 		case int32:
 			return strconv.FormatInt(int64(castedValue), 10), nil
+		case int64:
+			return strconv.FormatInt(castedValue, 10), nil
+		case json.Number:
+			return castedValue.String(), nil
+		case time.Time:
+			// avro timestamps
+			return castedValue.UTC().Format(time.RFC3339Nano), nil
 		default:
 			return "", fmt.Errorf("Value from colum %s is not parseable to string", field)
 		}
@@ -54,3 +162,62 @@ func (r *Record) FilteredFieldsJSON(blacklistedFields []string) map[string]inter
 	}
 	return filteredRecord
 }
+
+// WhitelistedFieldsJSON keeps only the given fields of the record. Nested fields are selected by their path,
+// like "address.city", and keep their parents; fields missing from the record are ignored.
+func (r *Record) WhitelistedFieldsJSON(whitelistedFields []string) map[string]interface{} {
+	filteredRecord := make(map[string]interface{})
+	for _, field := range whitelistedFields {
+		copyField(r.Json, filteredRecord, strings.Split(field, "."))
+	}
+	return filteredRecord
+}
+
+func copyField(from, to map[string]interface{}, path []string) {
+	value, ok := from[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		to[path[0]] = value
+		return
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	nestedTo, ok := to[path[0]].(map[string]interface{})
+	if !ok {
+		nestedTo = make(map[string]interface{})
+	}
+	copyField(nested, nestedTo, path[1:])
+	if len(nestedTo) > 0 {
+		to[path[0]] = nestedTo
+	}
+}
+
+// RenameFields renames the top level fields of a record document, usually filtered by FilteredFieldsJSON,
+// in place. Renaming a field to one the document already has is an error.
+func RenameFields(document map[string]interface{}, renames map[string]string) error {
+	for from, to := range renames {
+		if _, ok := document[from]; !ok {
+			continue
+		}
+		if _, exists := document[to]; exists {
+			if _, renamed := renames[to]; !renamed {
+				return fmt.Errorf("could not rename field %s to %s, the record already has it", from, to)
+			}
+		}
+	}
+	renamed := make(map[string]interface{}, len(renames))
+	for from, to := range renames {
+		if value, ok := document[from]; ok {
+			renamed[to] = value
+			delete(document, from)
+		}
+	}
+	for key, value := range renamed {
+		document[key] = value
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package models
+
+// RecordResult is the outcome of writing one record of a batch. Records sent to the dead letter queue or skipped
+// on purpose also succeed, consumption moves past them.
+type RecordResult struct {
+	Succeeded bool
+	Err       error
+	// DeadLettered tells the record was sent to the dead letter queue instead of being written
+	DeadLettered bool
+	// Skipped tells the record was left out of the insert by a policy or a transform
+	Skipped bool
+}
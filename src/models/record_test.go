@@ -28,6 +28,66 @@ func TestRecord_GetValueForField_FieldValueForExistentField(t *testing.T) {
 	}
 }
 
+func TestRecord_GetValueForField_Path(t *testing.T) {
+	record := createDummyRecord(existentFieldName, existentFieldValue)
+	record.Json["payment"] = map[string]interface{}{"method": map[string]interface{}{"type": "card"}}
+	record.Json["items"] = []interface{}{map[string]interface{}{"sku": "a-1"}, map[string]interface{}{"sku": int64(2)}}
+	record.Json["payment.method.type"] = "dotted"
+
+	for field, expected := range map[string]string{
+		"payment.method.type": "dotted",
+		"items.0.sku":         "a-1",
+		"items.1.sku":         "2",
+	} {
+		value, err := record.GetValueForField(field)
+		if assert.NoError(t, err, field) {
+			assert.Equal(t, expected, value, field)
+		}
+	}
+	delete(record.Json, "payment.method.type")
+	value, err := record.GetValueForField("payment.method.type")
+	assert.NoError(t, err)
+	assert.Equal(t, "card", value)
+
+	for _, field := range []string{"payment.method.kind", "payment.method.type.x", "items.2.sku", "items.-1.sku", "items.first.sku", "payment.method"} {
+		_, err := record.GetValueForField(field)
+		assert.Error(t, err, field)
+	}
+}
+
+func TestRecord_GetValueForField_Header(t *testing.T) {
+	record := createDummyRecord(existentFieldName, existentFieldValue)
+	record.Headers = map[string]string{"x-tenant-id": "acme"}
+
+	value, err := record.GetValueForField("header.x-tenant-id")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "acme", value)
+	}
+	_, err = record.GetValueForField("header." + existentFieldName)
+	assert.Error(t, err)
+}
+
+func TestRecord_GetValueForField_Key(t *testing.T) {
+	record := createDummyRecord(existentFieldName, existentFieldValue)
+	for key, expected := range map[string]string{
+		"":               record.GetId(),
+		"user-42":        "user-42",
+		"\x00\x01binary": "AAFiaW5hcnk=",
+		"\xff\xfe":       "//4=",
+	} {
+		record.Key = []byte(key)
+		value, err := record.GetValueForField(KeyColumn)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, value, "key %q", key)
+		}
+	}
+
+	record.Key = []byte{0, 0, 0, 0, 1, 14}
+	record.KeyString = "decoded"
+	value, _ := record.GetValueForField(KeyColumn)
+	assert.Equal(t, "decoded", value)
+}
+
 func TestRecord_FilteredFieldsJSON_NoOpForInexistentField(t *testing.T) {
 	record := createDummyRecord(existentFieldName, existentFieldValue)
 
@@ -44,6 +104,48 @@ func TestRecord_FilteredFieldsJSON_DeletesExistentField(t *testing.T) {
 	assert.Empty(t, filteredJson)
 }
 
+func TestRecord_WhitelistedFieldsJSON(t *testing.T) {
+	record := createDummyRecord(existentFieldName, existentFieldValue)
+	record.Json["other"] = "other-value"
+	record.Json["address"] = map[string]interface{}{"city": "Recife", "street": "Rua da Aurora"}
+
+	filteredJson := record.WhitelistedFieldsJSON([]string{existentFieldName, inexistentFieldName, "address.city", "other.nested"})
+	assert.Equal(t, map[string]interface{}{
+		existentFieldName: existentFieldValue,
+		"address":         map[string]interface{}{"city": "Recife"},
+	}, filteredJson)
+	assert.Len(t, record.Json["address"], 2) // Record JSON is not changed.
+}
+
+func TestRecord_FormatTimestampWeek(t *testing.T) {
+	for ts, expected := range map[time.Time]string{
+		time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC):   "2018-w01", // monday
+		time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC): "2019-w01",
+		time.Date(2021, 1, 3, 0, 0, 0, 0, time.UTC):   "2020-w53", // sunday
+		time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC):   "2021-w01",
+	} {
+		record := &Record{Timestamp: ts}
+		assert.Equal(t, expected, record.FormatTimestampWeek(nil))
+	}
+}
+
+func TestRecord_FormatTimestamp_TimeZone(t *testing.T) {
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the host runs at 23:59 local time, 02:59 UTC of the next day
+	local := time.Local
+	time.Local = saoPaulo
+	defer func() { time.Local = local }()
+	record := &Record{Timestamp: time.Unix(time.Date(2021, 3, 15, 2, 59, 0, 0, time.UTC).Unix(), 0)}
+
+	assert.Equal(t, "2021-03-15", record.FormatTimestampDay())
+	assert.Equal(t, "2021-03-15-02", record.FormatTimestampHour())
+	assert.Equal(t, "2021-03-14", record.FormatTimestamp(LayoutDay, saoPaulo))
+	assert.Equal(t, "2021-03-15", record.FormatTimestamp(LayoutDay, time.UTC))
+}
+
 func createDummyRecord(fieldName string, fieldValue string) *Record {
 	return &Record{
 		Topic:     "dummy-topic",
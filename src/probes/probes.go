@@ -1,8 +1,12 @@
 package probes
 
 import (
+	"encoding/json"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 )
 
 var (
@@ -10,12 +14,41 @@ var (
 	ReadinessRoute = os.Getenv("K8S_READINESS_ROUTE")
 )
 
+// Routes of the combined probes, which report each of their checks as json. The readiness of a single pipeline
+// is served at ReadyRoute followed by its name, like /readyz/orders.
+const (
+	HealthRoute = "/healthz"
+	ReadyRoute  = "/readyz"
+)
+
+// PipelineCheck is the name of the check of a component of a pipeline, under which it is reported by the
+// readiness of the pipeline.
+func PipelineCheck(pipeline, component string) string {
+	return pipeline + "/" + component
+}
+
+// probeName is the name of the check set by SetLivenessCheck and SetReadinessCheck in the reports of the probes.
+const probeName = "injector"
+
 type ProbeCheck func() bool
 
 type Probes struct {
 	livenessCheck  ProbeCheck
 	readinessCheck ProbeCheck
 	port           string
+	// livenessChecks and readinessChecks are the named checks of the components, all of which have to pass too.
+	// They are added while serving, as the components are created.
+	lock            sync.Mutex
+	livenessChecks  map[string]ProbeCheck
+	readinessChecks map[string]ProbeCheck
+	// routes are served along with the probes
+	routes map[string]http.Handler
+}
+
+// report is the json body of the probes, the state of each check by name.
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
 }
 
 func New(port string) *Probes {
@@ -27,9 +60,31 @@ func New(port string) *Probes {
 		readinessCheck: func() bool {
 			return false
 		},
+		livenessChecks:  make(map[string]ProbeCheck),
+		readinessChecks: make(map[string]ProbeCheck),
+		routes:          make(map[string]http.Handler),
 	}
 }
 
+// AddLivenessCheck adds a named check to the liveness probe, like the progress of the kafka consumer.
+func (p *Probes) AddLivenessCheck(name string, fn ProbeCheck) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.livenessChecks[name] = fn
+}
+
+// AddReadinessCheck adds a named check to the readiness probe, like the health of elasticsearch.
+func (p *Probes) AddReadinessCheck(name string, fn ProbeCheck) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.readinessChecks[name] = fn
+}
+
+// Handle serves another route on the port of the probes, like the metrics. Routes are added before Serve.
+func (p *Probes) Handle(pattern string, handler http.Handler) {
+	p.routes[pattern] = handler
+}
+
 func (p *Probes) SetLivenessCheck(fn ProbeCheck) {
 	p.livenessCheck = fn
 }
@@ -62,20 +117,127 @@ func (p *Probes) Ready() {
 	}
 }
 
-func (p *Probes) Serve() error {
-	mux := http.NewServeMux()
+// run runs the check set for the probe along with the named checks, it is true when all of them pass.
+func run(check ProbeCheck, named map[string]ProbeCheck) (bool, report) {
+	passed := true
+	checks := map[string]string{probeName: "ok"}
+	if !check() {
+		passed = false
+		checks[probeName] = "failing"
+	}
+	for _, name := range sortedNames(named) {
+		checks[name] = "ok"
+		if !named[name]() {
+			passed = false
+			checks[name] = "failing"
+		}
+	}
+	status := "ok"
+	if !passed {
+		status = "failing"
+	}
+	return passed, report{Status: status, Checks: checks}
+}
 
-	mux.Handle(LivenessRoute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !p.livenessCheck() {
-			w.WriteHeader(http.StatusInternalServerError)
+func sortedNames(checks map[string]ProbeCheck) []string {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// copyChecks is a copy of the named checks, run without holding the lock.
+func (p *Probes) copyChecks(checks map[string]ProbeCheck) map[string]ProbeCheck {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	copied := make(map[string]ProbeCheck, len(checks))
+	for name, check := range checks {
+		copied[name] = check
+	}
+	return copied
+}
+
+func (p *Probes) liveness() (bool, report) {
+	return run(p.livenessCheck, p.copyChecks(p.livenessChecks))
+}
+
+func (p *Probes) readiness() (bool, report) {
+	return run(p.readinessCheck, p.copyChecks(p.readinessChecks))
+}
+
+// pipelineReadiness runs the readiness checks of a pipeline along with the check set for the probe, found is false
+// when the pipeline has no checks.
+func (p *Probes) pipelineReadiness(pipeline string) (found bool, passed bool, body report) {
+	checks := make(map[string]ProbeCheck)
+	for name, check := range p.copyChecks(p.readinessChecks) {
+		if strings.HasPrefix(name, PipelineCheck(pipeline, "")) {
+			checks[name] = check
 		}
-	}))
+	}
+	if len(checks) == 0 {
+		return false, false, report{}
+	}
+	passed, body = run(p.readinessCheck, checks)
+	return true, passed, body
+}
+
+// pipelineHandler reports the readiness of the pipeline named by the path, like reportHandler does for all of them.
+func (p *Probes) pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	found, passed, body := p.pipelineReadiness(strings.TrimPrefix(r.URL.Path, ReadyRoute+"/"))
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !passed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
 
-	mux.Handle(ReadinessRoute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !p.readinessCheck() {
+// statusHandler fails the kubernetes probe routes with 500 when a check fails.
+func statusHandler(probe func() (bool, report)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if passed, _ := probe(); !passed {
 			w.WriteHeader(http.StatusInternalServerError)
 		}
-	}))
+	})
+}
 
-	return http.ListenAndServe(":"+p.port, mux)
+// reportHandler fails the combined probe routes with 503 when a check fails, reporting every check.
+func reportHandler(probe func() (bool, report)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed, body := probe()
+		w.Header().Set("Content-Type", "application/json")
+		if !passed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+func (p *Probes) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle(LivenessRoute, statusHandler(p.liveness))
+	mux.Handle(ReadinessRoute, statusHandler(p.readiness))
+	// the kubernetes routes may be the combined ones already
+	if HealthRoute != LivenessRoute && HealthRoute != ReadinessRoute {
+		mux.Handle(HealthRoute, reportHandler(p.liveness))
+	}
+	if ReadyRoute != LivenessRoute && ReadyRoute != ReadinessRoute {
+		mux.Handle(ReadyRoute, reportHandler(p.readiness))
+	}
+	mux.HandleFunc(ReadyRoute+"/", p.pipelineHandler)
+
+	for pattern, handler := range p.routes {
+		mux.Handle(pattern, handler)
+	}
+	return mux
+}
+
+func (p *Probes) Serve() error {
+	return http.ListenAndServe(":"+p.port, p.mux())
 }
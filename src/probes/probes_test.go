@@ -0,0 +1,94 @@
+package probes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbes_Reports(t *testing.T) {
+	LivenessRoute, ReadinessRoute = "/live", "/ready"
+	p := New("0")
+	p.Alive()
+	p.Ready()
+	kafkaReady := false
+	p.AddLivenessCheck("kafka", func() bool { return true })
+	p.AddReadinessCheck("kafka", func() bool { return kafkaReady })
+	p.AddReadinessCheck("elasticsearch", func() bool { return true })
+	server := httptest.NewServer(p.mux())
+	defer server.Close()
+
+	get := func(route string) (int, report) {
+		res, err := http.Get(server.URL + route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var body report
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body
+	}
+
+	status, body := get(HealthRoute)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, report{Status: "ok", Checks: map[string]string{"injector": "ok", "kafka": "ok"}}, body)
+
+	status, body = get(ReadyRoute)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, report{Status: "failing", Checks: map[string]string{"injector": "ok", "kafka": "failing", "elasticsearch": "ok"}}, body)
+	status, _ = get(ReadinessRoute)
+	assert.Equal(t, http.StatusInternalServerError, status)
+
+	kafkaReady = true
+	status, _ = get(ReadinessRoute)
+	assert.Equal(t, http.StatusOK, status)
+
+	// shutting down
+	p.Unready()
+	status, body = get(ReadyRoute)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "failing", body.Checks["injector"])
+}
+
+func TestProbes_PipelineReadiness(t *testing.T) {
+	p := New("0")
+	p.Ready()
+	ordersReady := false
+	p.AddReadinessCheck(PipelineCheck("orders", "elasticsearch"), func() bool { return ordersReady })
+	p.AddReadinessCheck(PipelineCheck("orders", "kafka"), func() bool { return true })
+	p.AddReadinessCheck(PipelineCheck("payments", "elasticsearch"), func() bool { return true })
+	server := httptest.NewServer(p.mux())
+	defer server.Close()
+
+	get := func(route string) (int, report) {
+		res, err := http.Get(server.URL + route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var body report
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body
+	}
+
+	status, body := get(ReadyRoute + "/payments")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, report{Status: "ok", Checks: map[string]string{"injector": "ok", "payments/elasticsearch": "ok"}}, body)
+
+	status, body = get(ReadyRoute + "/orders")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "failing", body.Checks["orders/elasticsearch"])
+
+	// the aggregated readiness fails along with any pipeline
+	status, _ = get(ReadyRoute)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	ordersReady = true
+	status, _ = get(ReadyRoute)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _ = get(ReadyRoute + "/clicks")
+	assert.Equal(t, http.StatusNotFound, status)
+}
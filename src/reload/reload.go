@@ -0,0 +1,246 @@
+// Package reload applies the changes of the config while running, on SIGHUP or when the config file changes,
+// without the restart that would rebalance the consumer group. Only the settings with a handler are applied, the
+// ones that change what is consumed or where it is written to, like the brokers, topics or elasticsearch hosts,
+// are logged as ignored until the next restart.
+package reload
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+	"github.com/inloco/kafka-elasticsearch-injector/src/validation"
+)
+
+// PrepareFunc validates the reloaded settings of a handler from the env vars, returning how to apply them.
+type PrepareFunc func() (apply func(), err error)
+
+type handler struct {
+	settings []string
+	prepare  PrepareFunc
+}
+
+// Reloader reloads the config file, or only checks the env vars without one.
+type Reloader struct {
+	path     string
+	logger   log.Logger
+	metrics  metrics.MetricsPublisher
+	lock     sync.Mutex
+	current  map[string]string
+	handlers []handler
+	// pipelines are the pipelines of the config file the process started with, which are never reloaded
+	pipelines []config_file.Pipeline
+}
+
+func New(path string, logger log.Logger, metricsPublisher metrics.MetricsPublisher) *Reloader {
+	r := &Reloader{
+		path:      path,
+		logger:    logger,
+		metrics:   metricsPublisher,
+		current:   config_file.Effective(),
+		pipelines: config_file.Pipelines(),
+	}
+	metricsPublisher.PublishConfigHash(r.hash())
+	return r
+}
+
+// Handle registers how the settings are applied while running. The handler is only prepared when one of its
+// settings changed.
+func (r *Reloader) Handle(settings []string, prepare PrepareFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers = append(r.handlers, handler{settings: settings, prepare: prepare})
+}
+
+// Reload loads the config file again and applies the settings that changed. Either every handler with a changed
+// setting applies it or, when any of them fails, none does and the previous config stays in effect.
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.reload()
+	if err != nil {
+		r.metrics.IncrementConfigReloads("failure")
+		level.Error(r.logger).Log("message", "could not reload the config, keeping the previous one", "err", err)
+		return err
+	}
+	r.metrics.IncrementConfigReloads("success")
+	r.metrics.PublishConfigHash(r.hash())
+	return nil
+}
+
+func (r *Reloader) reload() error {
+	if r.path != "" {
+		if err := config_file.Load(r.path); err != nil {
+			return err
+		}
+	}
+	if !reflect.DeepEqual(config_file.Pipelines(), r.pipelines) {
+		level.Warn(r.logger).Log("message", "ignoring the changes of the pipelines, restart to apply them")
+	}
+	next := config_file.Effective()
+	reloadable := make(map[string]bool)
+	for _, h := range r.handlers {
+		for _, setting := range h.settings {
+			reloadable[setting] = true
+		}
+	}
+	var changed, ignored []string
+	for _, name := range changedSettings(r.current, next) {
+		if reloadable[name] {
+			changed = append(changed, name)
+		} else {
+			ignored = append(ignored, name)
+		}
+	}
+	// the ignored settings keep their value, so that nothing reading the env vars half applies them
+	r.restore(ignored)
+	if len(ignored) > 0 {
+		level.Warn(r.logger).Log(
+			"message", "ignoring the settings that can't be reloaded, restart to apply them",
+			"settings", strings.Join(ignored, ","),
+		)
+	}
+
+	var errs validation.Errors
+	var applies []func()
+	for _, h := range r.handlers {
+		if !touches(h.settings, changed) {
+			continue
+		}
+		apply, err := h.prepare()
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		applies = append(applies, apply)
+	}
+	if err := errs.Err(); err != nil {
+		r.restore(changed)
+		return err
+	}
+	for _, apply := range applies {
+		apply()
+	}
+	r.current = config_file.Effective()
+	level.Info(r.logger).Log(
+		"message", "config reloaded",
+		"changed", strings.Join(changed, ","),
+		"hash", fmt.Sprintf("%08x", r.hash()),
+	)
+	return nil
+}
+
+// restore sets the env vars of the settings back to the config in effect.
+func (r *Reloader) restore(names []string) {
+	for _, name := range names {
+		if value, set := r.current[name]; set {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// Watch reloads on each signal and, with a config file and a positive interval, whenever the modification time
+// or size of the file changes. It returns when the signals are closed.
+func (r *Reloader) Watch(signals <-chan os.Signal, interval time.Duration) {
+	var tick <-chan time.Time
+	if r.path != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	last := r.stat()
+	for {
+		select {
+		case _, more := <-signals:
+			if !more {
+				return
+			}
+			level.Info(r.logger).Log("message", "reloading the config on signal")
+			last = r.stat()
+			r.Reload()
+		case <-tick:
+			if current := r.stat(); current != last {
+				last = current
+				level.Info(r.logger).Log("message", "reloading the config, the config file changed", "path", r.path)
+				r.Reload()
+			}
+		}
+	}
+}
+
+// fileVersion tells the versions of the config file apart, the zero value when it can't be read.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func (r *Reloader) stat() fileVersion {
+	if r.path == "" {
+		return fileVersion{}
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+func changedSettings(current, next map[string]string) []string {
+	var changed []string
+	for name, value := range next {
+		if previous, set := current[name]; !set || previous != value {
+			changed = append(changed, name)
+		}
+	}
+	for name := range current {
+		if _, set := next[name]; !set {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func touches(settings, changed []string) bool {
+	for _, setting := range settings {
+		for _, name := range changed {
+			if setting == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hash is the FNV-1a hash of the settings in effect, sorted by name, followed by the settings of each pipeline.
+func (r *Reloader) hash() uint32 {
+	h := fnv.New32a()
+	writeSettings(h, "", r.current)
+	for _, pipeline := range r.pipelines {
+		writeSettings(h, pipeline.Name+".", pipeline.Settings)
+	}
+	return h.Sum32()
+}
+
+func writeSettings(w io.Writer, prefix string, values map[string]string) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%s=%s\n", prefix, name, values[name])
+	}
+}
@@ -0,0 +1,129 @@
+package reload
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/inloco/kafka-elasticsearch-injector/src/config_file"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetrics struct {
+	metrics.MetricsPublisher
+	reloads map[string]int
+	hash    uint32
+}
+
+func (m *fakeMetrics) IncrementConfigReloads(result string) {
+	m.reloads[result]++
+}
+
+func (m *fakeMetrics) PublishConfigHash(hash uint32) {
+	m.hash = hash
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, "KAFKA_ADDRESS: kafka:9092\nKAFKA_CONSUMER_FILTER: country == BR\n")
+	defer os.Unsetenv("KAFKA_ADDRESS")
+	defer os.Unsetenv("KAFKA_CONSUMER_FILTER")
+
+	// loaded on startup, before the reloader snapshots the config
+	if !assert.NoError(t, config_file.Load(path)) {
+		return
+	}
+	m := &fakeMetrics{reloads: make(map[string]int)}
+	r := New(path, log.NewNopLogger(), m)
+	initialHash := m.hash
+	var applied []string
+	var prepareErr error
+	r.Handle([]string{"KAFKA_CONSUMER_FILTER"}, func() (func(), error) {
+		if prepareErr != nil {
+			return nil, prepareErr
+		}
+		filter := os.Getenv("KAFKA_CONSUMER_FILTER")
+		return func() { applied = append(applied, filter) }, nil
+	})
+
+	writeConfig(t, path, "KAFKA_ADDRESS: other:9092\nKAFKA_CONSUMER_FILTER: country == AR\n")
+	assert.NoError(t, r.Reload())
+	assert.Equal(t, []string{"country == AR"}, applied)
+	// the brokers can't be reloaded, they keep their value
+	assert.Equal(t, "kafka:9092", os.Getenv("KAFKA_ADDRESS"))
+	assert.NotEqual(t, initialHash, m.hash)
+
+	prepareErr = errors.New("invalid filter")
+	writeConfig(t, path, "KAFKA_ADDRESS: kafka:9092\nKAFKA_CONSUMER_FILTER: country ==\n")
+	assert.EqualError(t, r.Reload(), "invalid filter")
+	assert.Equal(t, []string{"country == AR"}, applied)
+	assert.Equal(t, "country == AR", os.Getenv("KAFKA_CONSUMER_FILTER"))
+
+	prepareErr = nil
+	writeConfig(t, path, "KAFKA_ADDRESS: kafka:9092\n")
+	assert.NoError(t, r.Reload())
+	assert.Equal(t, []string{"country == AR", ""}, applied)
+	_, set := os.LookupEnv("KAFKA_CONSUMER_FILTER")
+	assert.False(t, set)
+
+	assert.Equal(t, map[string]int{"success": 2, "failure": 1}, m.reloads)
+}
+
+func TestReloader_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	writeConfig(t, path, "LOG_LEVEL: INFO\n")
+	defer os.Unsetenv("LOG_LEVEL")
+
+	r := New(path, log.NewNopLogger(), &fakeMetrics{reloads: make(map[string]int)})
+	applied := make(chan string, 10)
+	r.Handle([]string{"LOG_LEVEL"}, func() (func(), error) {
+		value := os.Getenv("LOG_LEVEL")
+		return func() { applied <- value }, nil
+	})
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		r.Watch(signals, 10*time.Millisecond)
+		close(done)
+	}()
+
+	signals <- os.Interrupt
+	assert.Equal(t, "INFO", awaitApplied(t, applied))
+
+	writeConfig(t, path, "LOG_LEVEL: DEBUG\n")
+	assert.Equal(t, "DEBUG", awaitApplied(t, applied))
+
+	close(signals)
+	<-done
+}
+
+func awaitApplied(t *testing.T, applied chan string) string {
+	select {
+	case value := <-applied:
+		return value
+	case <-time.After(2 * time.Second):
+		t.Fatal("the config was not reloaded")
+		return ""
+	}
+}
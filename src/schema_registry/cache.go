@@ -0,0 +1,155 @@
+package schema_registry
+
+import (
+	"sync"
+	"time"
+)
+
+// Results of the schema cache lookups, as counted by the metrics.
+const (
+	// SchemaCacheHit is a schema found in the cache
+	SchemaCacheHit = "hit"
+	// SchemaCacheMiss is a schema fetched from the registry
+	SchemaCacheMiss = "miss"
+	// SchemaCacheError is a fetch that failed
+	SchemaCacheError = "error"
+	// SchemaCacheLocal is a schema read from the local schema directory, since the registry failed
+	SchemaCacheLocal = "local"
+	// SchemaCacheBackoff is the error of a failed fetch returned again without reaching the registry
+	SchemaCacheBackoff = "backoff"
+)
+
+const (
+	defaultErrorBackoff    = time.Second
+	defaultMaxErrorBackoff = time.Minute
+	// maxFailedSchemas bounds the failed ids remembered, which may be garbage read from undecodable messages
+	maxFailedSchemas = 1000
+)
+
+// schemaEntry is a schema of the cache. Schemas never change once registered, so fetched schemas are kept for
+// good, while failed fetches are only kept until retryAt.
+type schemaEntry struct {
+	schema  RegisteredSchema
+	fetched bool
+	err     error
+	// failures is the number of failed fetches in a row, doubling the backoff each time
+	failures int
+	retryAt  time.Time
+	// fetching is closed once the fetch in progress is done, nil when there is none
+	fetching chan struct{}
+}
+
+// schemaCache holds the schemas by id, shared by every topic of the process. Only one fetch of an id is in
+// progress at a time, the other lookups of the same id wait for its result.
+type schemaCache struct {
+	lock       sync.Mutex
+	entries    map[int32]*schemaEntry
+	failed     int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	now        func() time.Time
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{
+		entries:    make(map[int32]*schemaEntry),
+		backoff:    defaultErrorBackoff,
+		maxBackoff: defaultMaxErrorBackoff,
+		now:        time.Now,
+	}
+}
+
+// get returns the schema with the id, calling fetch when it isn't cached and isn't backing off, along with the
+// result of the lookup.
+func (c *schemaCache) get(id int32, fetch func() (RegisteredSchema, error)) (RegisteredSchema, string, error) {
+	c.lock.Lock()
+	for {
+		entry, ok := c.entries[id]
+		if !ok {
+			entry = &schemaEntry{}
+			c.entries[id] = entry
+		}
+		if entry.fetched {
+			c.lock.Unlock()
+			return entry.schema, SchemaCacheHit, nil
+		}
+		if entry.fetching != nil {
+			fetching := entry.fetching
+			c.lock.Unlock()
+			<-fetching
+			c.lock.Lock()
+			continue
+		}
+		if entry.err != nil && c.now().Before(entry.retryAt) {
+			err := entry.err
+			c.lock.Unlock()
+			return RegisteredSchema{}, SchemaCacheBackoff, err
+		}
+		entry.fetching = make(chan struct{})
+		c.lock.Unlock()
+
+		schema, err := fetch()
+
+		c.lock.Lock()
+		c.fetched(id, entry, schema, err)
+		close(entry.fetching)
+		entry.fetching = nil
+		c.lock.Unlock()
+		if err != nil {
+			return RegisteredSchema{}, SchemaCacheError, err
+		}
+		return schema, SchemaCacheMiss, nil
+	}
+}
+
+// fetched records the result of a fetch, with the lock held.
+func (c *schemaCache) fetched(id int32, entry *schemaEntry, schema RegisteredSchema, err error) {
+	if err == nil {
+		if entry.err != nil {
+			c.failed--
+		}
+		entry.schema, entry.fetched, entry.err = schema, true, nil
+		return
+	}
+	if entry.err == nil {
+		c.failed++
+	}
+	backoff := c.backoff
+	for idx := 0; idx < entry.failures && backoff < c.maxBackoff; idx++ {
+		backoff *= 2
+	}
+	if backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	entry.err = err
+	entry.failures++
+	entry.retryAt = c.now().Add(backoff)
+	if c.failed > maxFailedSchemas {
+		c.evictFailed(id)
+	}
+}
+
+// evictFailed forgets the failed ids whose backoff is over, or any other one when none is, so that the failed
+// ids stay bounded.
+func (c *schemaCache) evictFailed(keep int32) {
+	now := c.now()
+	var evictable []int32
+	for id, entry := range c.entries {
+		if id == keep || entry.err == nil || entry.fetching != nil {
+			continue
+		}
+		if !now.Before(entry.retryAt) {
+			delete(c.entries, id)
+			c.failed--
+		} else {
+			evictable = append(evictable, id)
+		}
+	}
+	for _, id := range evictable {
+		if c.failed <= maxFailedSchemas {
+			return
+		}
+		delete(c.entries, id)
+		c.failed--
+	}
+}
@@ -0,0 +1,132 @@
+package schema_registry
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestSchemaCache_Get(t *testing.T) {
+	cache := newSchemaCache()
+	var fetches int
+	fetch := func() (RegisteredSchema, error) {
+		fetches++
+		return RegisteredSchema{Schema: `"string"`}, nil
+	}
+
+	schema, result, err := cache.get(1, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, `"string"`, schema.Schema)
+	assert.Equal(t, SchemaCacheMiss, result)
+
+	schema, result, err = cache.get(1, fetch)
+	assert.NoError(t, err)
+	assert.Equal(t, `"string"`, schema.Schema)
+	assert.Equal(t, SchemaCacheHit, result)
+	assert.Equal(t, 1, fetches)
+}
+
+func TestSchemaCache_Get_Backoff(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	cache := newSchemaCache()
+	cache.now = clock.Now
+	outage := errors.New("connection refused")
+	var fetches int
+	failing := func() (RegisteredSchema, error) {
+		fetches++
+		return RegisteredSchema{}, outage
+	}
+
+	_, result, err := cache.get(1, failing)
+	assert.Equal(t, outage, err)
+	assert.Equal(t, SchemaCacheError, result)
+
+	// the error is returned again until the backoff is over
+	_, result, err = cache.get(1, failing)
+	assert.Equal(t, outage, err)
+	assert.Equal(t, SchemaCacheBackoff, result)
+	assert.Equal(t, 1, fetches)
+
+	// then doubles at every failure in a row
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		clock.now = clock.now.Add(backoff - time.Millisecond)
+		_, result, _ = cache.get(1, failing)
+		assert.Equal(t, SchemaCacheBackoff, result)
+		clock.now = clock.now.Add(time.Millisecond)
+		_, result, _ = cache.get(1, failing)
+		assert.Equal(t, SchemaCacheError, result)
+	}
+	assert.Equal(t, 4, fetches)
+
+	// up to the maximum
+	clock.now = clock.now.Add(time.Hour)
+	for idx := 0; idx < 10; idx++ {
+		cache.get(1, failing)
+		clock.now = clock.now.Add(time.Minute)
+	}
+	assert.Equal(t, time.Minute, cache.entries[1].retryAt.Sub(clock.now.Add(-time.Minute)))
+
+	clock.now = clock.now.Add(time.Minute)
+	schema, result, err := cache.get(1, func() (RegisteredSchema, error) { return RegisteredSchema{Schema: `"int"`}, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, `"int"`, schema.Schema)
+	assert.Equal(t, SchemaCacheMiss, result)
+	assert.Equal(t, 0, cache.failed)
+}
+
+func TestSchemaCache_Get_Singleflight(t *testing.T) {
+	cache := newSchemaCache()
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var fetches int
+	fetch := func() (RegisteredSchema, error) {
+		lock.Lock()
+		fetches++
+		lock.Unlock()
+		<-release
+		return RegisteredSchema{Schema: `"string"`}, nil
+	}
+
+	var wg sync.WaitGroup
+	for idx := 0; idx < 10; idx++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			schema, _, err := cache.get(1, fetch)
+			assert.NoError(t, err)
+			assert.Equal(t, `"string"`, schema.Schema)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, fetches)
+}
+
+func TestSchemaCache_Get_BoundedFailures(t *testing.T) {
+	cache := newSchemaCache()
+	failing := func() (RegisteredSchema, error) {
+		return RegisteredSchema{}, ErrSchemaNotFound
+	}
+	cache.get(-1, func() (RegisteredSchema, error) { return RegisteredSchema{Schema: `"string"`}, nil })
+	for id := int32(0); id < maxFailedSchemas+100; id++ {
+		cache.get(id, failing)
+	}
+	assert.Equal(t, maxFailedSchemas, cache.failed)
+	assert.Len(t, cache.entries, maxFailedSchemas+1)
+
+	// fetched schemas are never evicted
+	_, result, _ := cache.get(-1, failing)
+	assert.Equal(t, SchemaCacheHit, result)
+}
@@ -0,0 +1,92 @@
+package schema_registry
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultProbeInterval = 30 * time.Second
+
+// instance is one of the urls of the schema registry.
+type instance struct {
+	url url.URL
+	// failedAt is when the instance last failed, zero while it is healthy
+	failedAt time.Time
+}
+
+// instances are the urls of the schema registry, tried in turn when one of them can't be reached or responds with
+// a server error. Requests go to the last instance that served one, failed instances are only tried again once
+// the probe interval passed since they failed, or when every instance failed.
+type instances struct {
+	lock          sync.Mutex
+	all           []*instance
+	current       int
+	probeInterval time.Duration
+	now           func() time.Time
+}
+
+// newInstances parses the comma separated urls of the schema registry.
+func newInstances(urls string, probeInterval time.Duration) (*instances, error) {
+	if probeInterval <= 0 {
+		probeInterval = defaultProbeInterval
+	}
+	i := &instances{probeInterval: probeInterval, now: time.Now}
+	for _, value := range strings.Split(urls, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		i.all = append(i.all, &instance{url: *u})
+	}
+	if len(i.all) == 0 {
+		return nil, fmt.Errorf("no schema registry url in %q", urls)
+	}
+	return i, nil
+}
+
+// candidates are the instances a request is tried on, in order, starting with the current one.
+func (i *instances) candidates() []*instance {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	now := i.now()
+	var candidates, failed []*instance
+	for idx := range i.all {
+		candidate := i.all[(i.current+idx)%len(i.all)]
+		if candidate.failedAt.IsZero() || !now.Before(candidate.failedAt.Add(i.probeInterval)) {
+			candidates = append(candidates, candidate)
+		} else {
+			failed = append(failed, candidate)
+		}
+	}
+	// better to try the failed instances early than to fail without trying
+	return append(candidates, failed...)
+}
+
+func (i *instances) succeeded(served *instance) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	served.failedAt = time.Time{}
+	for idx, candidate := range i.all {
+		if candidate == served {
+			i.current = idx
+		}
+	}
+}
+
+func (i *instances) failed(failed *instance) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	failed.failedAt = i.now()
+}
+
+// name is the instance as labeled by the metrics, without its credentials.
+func (i *instance) name() string {
+	return i.url.Host
+}
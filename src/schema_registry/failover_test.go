@@ -0,0 +1,101 @@
+package schema_registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type registryInstance struct {
+	server   *httptest.Server
+	status   int
+	requests int
+}
+
+func newRegistryInstance(schema string) *registryInstance {
+	i := &registryInstance{status: http.StatusOK}
+	i.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.requests++
+		if r.URL.Path != "/subjects/clicks-value/versions/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(i.status)
+		w.Write([]byte(`{"schema":"` + schema + `"}`))
+	}))
+	return i
+}
+
+func TestSchemaRegistry_Failover(t *testing.T) {
+	a, b := newRegistryInstance("a"), newRegistryInstance("b")
+	defer a.server.Close()
+	defer b.server.Close()
+	registry, err := NewSchemaRegistryWithConfig(Config{URL: a.server.URL + ", " + b.server.URL, ProbeInterval: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Unix(0, 0)
+	registry.instances.now = func() time.Time { return now }
+
+	schema, err := registry.GetLatestSchema("clicks-value")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", schema)
+
+	// server errors fail over to the next instance, which keeps serving
+	a.status = http.StatusBadGateway
+	schema, err = registry.GetLatestSchema("clicks-value")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", schema)
+	a.status = http.StatusOK
+	schema, err = registry.GetLatestSchema("clicks-value")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", schema)
+	assert.Equal(t, 2, a.requests)
+
+	// client errors don't fail over
+	_, err = registry.GetLatestSchema("views-value")
+	assert.EqualError(t, err, "could not fetch the latest schema of subject views-value: schema not found")
+	assert.Equal(t, 2, a.requests)
+
+	// the failed instance is only tried first once the probe interval passed
+	b.server.Close()
+	schema, err = registry.GetLatestSchema("clicks-value")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", schema)
+	now = now.Add(30 * time.Second)
+	a.status = http.StatusServiceUnavailable
+	_, err = registry.GetLatestSchema("clicks-value")
+	assert.Error(t, err)
+	assert.Equal(t, 4, a.requests)
+}
+
+func TestInstances_Candidates(t *testing.T) {
+	i, err := newInstances("http://a:8081,http://b:8081,http://c:8081", time.Minute)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Unix(0, 0)
+	i.now = func() time.Time { return now }
+	names := func() []string {
+		var names []string
+		for _, candidate := range i.candidates() {
+			names = append(names, candidate.name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a:8081", "b:8081", "c:8081"}, names())
+
+	i.failed(i.all[0])
+	i.succeeded(i.all[1])
+	assert.Equal(t, []string{"b:8081", "c:8081", "a:8081"}, names())
+	i.failed(i.all[1])
+	assert.Equal(t, []string{"c:8081", "b:8081", "a:8081"}, names())
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"b:8081", "c:8081", "a:8081"}, names())
+
+	_, err = newInstances(" , ", time.Minute)
+	assert.EqualError(t, err, `no schema registry url in " , "`)
+}
@@ -0,0 +1,122 @@
+package schema_registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// localSchemaExtensions are the extensions of the schema files, by schema type.
+var localSchemaExtensions = map[string]string{
+	SchemaTypeAvro: ".avsc",
+	SchemaTypeJSON: ".json",
+}
+
+// localStore is a directory of schemas, named by their id like `42.avsc`, or `42.json` for JSON Schemas, read when
+// the registry can't be reached. They may be kept in subdirectories, like `<subject>/42.avsc`. Schemas added to
+// the directory while running are found too, as long as they are at its top level.
+type localStore struct {
+	dir string
+	// files are the schemas found under the subdirectories at startup, by id
+	files map[int32]localSchemaFile
+	// lock serializes the writes of persisted schemas
+	lock sync.Mutex
+}
+
+type localSchemaFile struct {
+	path       string
+	schemaType string
+}
+
+// newLocalStore indexes the schemas of the directory, creating it when the persisted schemas are written to it.
+func newLocalStore(dir string, persist bool) (*localStore, error) {
+	if persist {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create local schema directory %s: %s", dir, err)
+		}
+	}
+	store := &localStore{dir: dir, files: make(map[int32]localSchemaFile)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if id, schemaType, ok := localSchemaId(info.Name()); ok && !info.IsDir() {
+			store.files[id] = localSchemaFile{path: path, schemaType: schemaType}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read local schema directory %s: %s", dir, err)
+	}
+	return store, nil
+}
+
+// localSchemaId is the id and type of the schema file name, false when it isn't named by an id.
+func localSchemaId(name string) (int32, string, bool) {
+	for schemaType, extension := range localSchemaExtensions {
+		if !strings.HasSuffix(name, extension) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, extension), 10, 32)
+		if err != nil {
+			return 0, "", false
+		}
+		return int32(id), schemaType, true
+	}
+	return 0, "", false
+}
+
+func (s *localStore) path(id int32, schemaType string) string {
+	return filepath.Join(s.dir, strconv.Itoa(int(id))+localSchemaExtensions[schemaType])
+}
+
+// get reads the schema with the id, failing with ErrSchemaNotFound when the directory doesn't have it.
+func (s *localStore) get(id int32) (RegisteredSchema, error) {
+	candidates := []localSchemaFile{{s.path(id, SchemaTypeAvro), SchemaTypeAvro}, {s.path(id, SchemaTypeJSON), SchemaTypeJSON}}
+	if indexed, ok := s.files[id]; ok {
+		candidates = []localSchemaFile{indexed}
+	}
+	for _, candidate := range candidates {
+		schema, err := ioutil.ReadFile(candidate.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return RegisteredSchema{}, err
+		}
+		return RegisteredSchema{Schema: string(schema), Type: candidate.schemaType}, nil
+	}
+	return RegisteredSchema{}, ErrSchemaNotFound
+}
+
+// put writes the schema to the top level of the directory, unless it is there already. The schema is written to a
+// temporary file first, so that a crash never leaves a partial schema behind. Only the types the store reads are
+// written.
+func (s *localStore) put(id int32, schema RegisteredSchema) error {
+	if _, ok := localSchemaExtensions[schema.Type]; !ok {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := s.path(id, schema.Type)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".schema-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(schema.Schema); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,106 @@
+package schema_registry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLocalSchemaDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "local-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "clicks-value"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "1.avsc"), []byte(`"string"`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "clicks-value", "2.avsc"), []byte(`"long"`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "clicks-value", "5.json"), []byte(`{"type": "object"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not a schema"), 0644)
+	return dir
+}
+
+func TestSchemaRegistry_GetSchema_LocalFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dir := newLocalSchemaDir(t)
+	defer os.RemoveAll(dir)
+
+	registry, err := NewSchemaRegistryWithConfig(Config{URL: server.URL, LocalSchemaDir: dir})
+	if !assert.NoError(t, err) {
+		return
+	}
+	schema, err := registry.GetSchema(1)
+	assert.NoError(t, err)
+	assert.Equal(t, `"string"`, schema)
+	schema, err = registry.GetSchema(2)
+	assert.NoError(t, err)
+	assert.Equal(t, `"long"`, schema)
+
+	registered, err := registry.GetRegisteredSchema(5)
+	assert.NoError(t, err)
+	assert.Equal(t, RegisteredSchema{Schema: `{"type": "object"}`, Type: SchemaTypeJSON}, registered)
+
+	_, err = registry.GetSchema(3)
+	assert.EqualError(t, err, "could not fetch schema 3: schema registry responded 503 Service Unavailable")
+
+	// schemas added at the top level while running are found
+	ioutil.WriteFile(filepath.Join(dir, "4.avsc"), []byte(`"int"`), 0644)
+	schema, err = registry.GetSchema(4)
+	assert.NoError(t, err)
+	assert.Equal(t, `"int"`, schema)
+}
+
+func TestSchemaRegistry_GetSchema_Persist(t *testing.T) {
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"schema":"\"double\""}`))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "persisted-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{URL: server.URL, LocalSchemaDir: filepath.Join(dir, "schemas"), PersistSchemas: true}
+
+	registry, err := NewSchemaRegistryWithConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = registry.GetSchema(9)
+	assert.NoError(t, err)
+	persisted, err := ioutil.ReadFile(filepath.Join(dir, "schemas", "9.avsc"))
+	assert.NoError(t, err)
+	assert.Equal(t, `"double"`, string(persisted))
+
+	// a restart during an outage still decodes the persisted schemas
+	available = false
+	registry, err = NewSchemaRegistryWithConfig(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	schema, err := registry.GetSchema(9)
+	assert.NoError(t, err)
+	assert.Equal(t, `"double"`, schema)
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "schemas"))
+	assert.Len(t, files, 1)
+}
+
+func TestNewSchemaRegistryWithConfig_MissingLocalSchemaDir(t *testing.T) {
+	_, err := NewSchemaRegistryWithConfig(Config{URL: "http://localhost:8081", LocalSchemaDir: "/does/not/exist"})
+	assert.EqualError(t, err, "could not read local schema directory /does/not/exist: lstat /does/not/exist: no such file or directory")
+}
@@ -1,39 +1,294 @@
 package schema_registry
 
 import (
-	"sync"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
 
 	"github.com/datamountaineer/schema-registry"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/inloco/kafka-elasticsearch-injector/src/metrics"
 )
 
 const INVALID_SCHEMA = "Invalid Schema"
 
+// ErrUnauthorized is returned, wrapped with the schema id, when the schema registry rejects the credentials, so that
+// it is told apart from a schema that doesn't exist.
+var ErrUnauthorized = errors.New("schema registry rejected the credentials")
+
+// ErrSchemaNotFound is returned, wrapped with the schema id, when the schema registry has no schema with the id.
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// Types of the schemas of the registry, as given by their schemaType.
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeJSON     = "JSON"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+// RegisteredSchema is a schema of the registry along with its type.
+type RegisteredSchema struct {
+	Schema string
+	// Type is SchemaTypeAvro, SchemaTypeJSON or SchemaTypeProtobuf
+	Type string
+}
+
+// SchemaError is an error fetching a schema from the schema registry.
+type SchemaError struct {
+	Id  int32
+	Err error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("could not fetch schema %d: %s", e.Id, e.Err)
+}
+
+// Config is how the schema registry is reached.
+type Config struct {
+	// URL is the url of the registry, or the comma separated urls of its instances, which are failed over in turn
+	URL string
+	// Username and Password are sent with basic auth, unless Authorization is set
+	Username string
+	Password string
+	// Authorization is the value of the Authorization header sent with every request, like "Bearer <token>"
+	Authorization string
+	// CACertPath is a PEM bundle with the CAs trusted when reaching the registry over https
+	CACertPath string
+	// LocalSchemaDir is a directory of schemas named by their id, like `42.avsc`, read when a schema can't be
+	// fetched from the registry
+	LocalSchemaDir string
+	// PersistSchemas writes every schema fetched from the registry to LocalSchemaDir, so that they are found
+	// there after a restart
+	PersistSchemas bool
+	// ProbeInterval is how long an instance that failed is skipped, defaults to 30s
+	ProbeInterval time.Duration
+	// Logger logs the failovers and the schemas that couldn't be persisted, nothing is logged when nil
+	Logger log.Logger
+}
+
 type SchemaRegistry struct {
-	Client  schemaregistry.Client
-	schemas *sync.Map
+	// Client registers schemas, schemas are fetched with the http client built from the config
+	Client           schemaregistry.Client
+	cache            *schemaCache
+	instances        *instances
+	http             *http.Client
+	config           Config
+	local            *localStore
+	logger           log.Logger
+	metricsPublisher metrics.MetricsPublisher
 }
 
+// GetSchema returns the schema with the id, whatever its type.
 func (sr *SchemaRegistry) GetSchema(id int32) (string, error) {
+	schema, err := sr.GetRegisteredSchema(id)
+	return schema.Schema, err
+}
 
-	if schema, exists := sr.schemas.Load(id); exists {
-		if schemaString, ok := schema.(string); ok {
-			return schemaString, nil
+// GetRegisteredSchema returns the schema with the id along with its type. Fetched schemas are cached for good,
+// failed fetches are retried after a backoff, doubling up to a minute, and returned again in the meantime. When the
+// registry fails, the schema is read from the local schema directory, if there is one.
+func (sr *SchemaRegistry) GetRegisteredSchema(id int32) (RegisteredSchema, error) {
+	local := false
+	schema, result, err := sr.cache.get(id, func() (RegisteredSchema, error) {
+		schema, err := sr.fetchSchema(id)
+		if err == nil {
+			sr.persist(id, schema)
+			return schema, nil
+		}
+		if sr.local == nil {
+			return RegisteredSchema{}, err
+		}
+		schema, localErr := sr.local.get(id)
+		if localErr == ErrSchemaNotFound {
+			return RegisteredSchema{}, err
+		}
+		if localErr != nil {
+			return RegisteredSchema{}, fmt.Errorf("%s, and could not read the local schema: %s", err, localErr)
 		}
+		local = true
+		return schema, nil
+	})
+	if local {
+		result = SchemaCacheLocal
 	}
+	sr.metricsPublisher.IncrementSchemaCacheLookups(result)
+	if err != nil {
+		return RegisteredSchema{}, &SchemaError{id, err}
+	}
+	return schema, nil
+}
+
+// persist writes the schema fetched from the registry to the local schema directory, when enabled. Failures are
+// only logged, the schema is cached in memory anyway.
+func (sr *SchemaRegistry) persist(id int32, schema RegisteredSchema) {
+	if sr.local == nil || !sr.config.PersistSchemas {
+		return
+	}
+	if err := sr.local.put(id, schema); err != nil {
+		level.Warn(sr.logger).Log("err", err, "message", fmt.Sprintf("could not persist schema %d to %s", id, sr.local.dir))
+	}
+}
+
+// GetLatestSchema fetches the latest version of the schema of a subject, which isn't cached since it changes as
+// the subject evolves.
+func (sr *SchemaRegistry) GetLatestSchema(subject string) (string, error) {
+	var schema struct {
+		Schema string `json:"schema"`
+	}
+	if err := sr.get(fmt.Sprintf("/subjects/%s/versions/latest", subject), &schema); err != nil {
+		return "", fmt.Errorf("could not fetch the latest schema of subject %s: %s", subject, err)
+	}
+	return schema.Schema, nil
+}
 
-	schema, err := sr.Client.GetSchemaById(int(id))
-	sr.schemas.Store(id, schema)
-	return schema, err
+// fetchSchema gets the schema with the id from the registry, with the credentials of the config. Schemas without
+// schemaType are avro, as the registry leaves it out for them.
+func (sr *SchemaRegistry) fetchSchema(id int32) (RegisteredSchema, error) {
+	var schema struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := sr.get(fmt.Sprintf("/schemas/ids/%d", id), &schema); err != nil {
+		return RegisteredSchema{}, err
+	}
+	if schema.SchemaType == "" {
+		schema.SchemaType = SchemaTypeAvro
+	}
+	return RegisteredSchema{Schema: schema.Schema, Type: schema.SchemaType}, nil
+}
+
+// get decodes the json response of the registry to a GET on the path. Instances that can't be reached or respond
+// with a server error are failed over to the next one.
+func (sr *SchemaRegistry) get(urlPath string, out interface{}) error {
+	var err error
+	var previous *instance
+	for _, candidate := range sr.instances.candidates() {
+		if previous != nil {
+			level.Warn(sr.logger).Log("err", err, "message", fmt.Sprintf("schema registry %s failed, trying %s", previous.name(), candidate.name()))
+		}
+		previous = candidate
+		var failover bool
+		failover, err = sr.getFrom(candidate, urlPath, out)
+		if !failover {
+			sr.instances.succeeded(candidate)
+			sr.metricsPublisher.IncrementSchemaRegistryFetches(candidate.name())
+			return err
+		}
+		sr.instances.failed(candidate)
+		sr.metricsPublisher.IncrementSchemaRegistryFailovers(candidate.name())
+	}
+	return err
+}
+
+// getFrom does the GET on an instance, telling whether it failed in a way that another instance may not.
+func (sr *SchemaRegistry) getFrom(instance *instance, urlPath string, out interface{}) (bool, error) {
+	u := instance.url
+	u.Path = path.Join(u.Path, urlPath)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Accept", "application/vnd.schemaregistry.v1+json, application/vnd.schemaregistry+json, application/json")
+	if sr.config.Authorization != "" {
+		req.Header.Set("Authorization", sr.config.Authorization)
+	} else if sr.config.Username != "" || sr.config.Password != "" {
+		req.SetBasicAuth(sr.config.Username, sr.config.Password)
+	}
+	resp, err := sr.http.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, ErrUnauthorized
+	case resp.StatusCode == http.StatusNotFound:
+		return false, ErrSchemaNotFound
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		var registryErr struct {
+			ErrorCode int    `json:"error_code"`
+			Message   string `json:"message"`
+		}
+		failover := resp.StatusCode >= 500
+		if err := json.NewDecoder(resp.Body).Decode(&registryErr); err != nil || registryErr.Message == "" {
+			return failover, fmt.Errorf("schema registry responded %s", resp.Status)
+		}
+		return failover, fmt.Errorf("schema registry responded %s: %s (%d)", resp.Status, registryErr.Message, registryErr.ErrorCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("invalid schema registry response: %s", err)
+	}
+	return false, nil
+}
+
+// newHTTPClient is the client every schema is fetched with, so that its connections are reused.
+func newHTTPClient(config Config) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if config.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(config.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read schema registry CA certificate %s: %v", config.CACertPath, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no PEM certificates found in schema registry CA certificate %s", config.CACertPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
 }
 
 func NewSchemaRegistry(url string) (*SchemaRegistry, error) {
-	client, err := schemaregistry.NewClient(url)
+	return NewSchemaRegistryWithConfig(Config{URL: url})
+}
+
+// NewSchemaRegistryWithConfig creates the schema registry client, failing when the CA certificate or the local
+// schema directory can't be loaded.
+func NewSchemaRegistryWithConfig(config Config) (*SchemaRegistry, error) {
+	instances, err := newInstances(config.URL, config.ProbeInterval)
 	if err != nil {
 		return nil, err
 	}
+	// schemas are only registered on the first instance
+	client, err := schemaregistry.NewClient(instances.all[0].url.String())
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	var local *localStore
+	if config.LocalSchemaDir != "" {
+		local, err = newLocalStore(config.LocalSchemaDir, config.PersistSchemas)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
 	return &SchemaRegistry{
-		Client:  client,
-		schemas: &sync.Map{},
+		Client:           client,
+		cache:            newSchemaCache(),
+		instances:        instances,
+		http:             httpClient,
+		config:           config,
+		local:            local,
+		logger:           logger,
+		metricsPublisher: metrics.NewMetricsPublisher(),
 	}, nil
 }
 
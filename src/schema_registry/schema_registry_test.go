@@ -0,0 +1,139 @@
+package schema_registry
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newRegistryServer(t *testing.T, requests *int) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			w.Write([]byte(`{"schema":"\"string\""}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+}
+
+func writeCACert(t *testing.T, server *httptest.Server) string {
+	file, err := ioutil.TempFile("", "schema-registry-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return file.Name()
+}
+
+func TestSchemaRegistry_GetSchema_Auth(t *testing.T) {
+	var requests int
+	server := newRegistryServer(t, &requests)
+	defer server.Close()
+	caCertPath := writeCACert(t, server)
+	defer os.Remove(caCertPath)
+
+	registry, err := NewSchemaRegistryWithConfig(Config{URL: server.URL, Username: "user", Password: "secret", CACertPath: caCertPath})
+	if assert.NoError(t, err) {
+		schema, err := registry.GetSchema(1)
+		assert.NoError(t, err)
+		assert.Equal(t, `"string"`, schema)
+		// cached
+		registry.GetSchema(1)
+		assert.Equal(t, 1, requests)
+
+		_, err = registry.GetSchema(2)
+		assert.Equal(t, &SchemaError{2, ErrSchemaNotFound}, err)
+	}
+
+	registry, err = NewSchemaRegistryWithConfig(Config{URL: server.URL, Username: "user", Password: "wrong", CACertPath: caCertPath})
+	if assert.NoError(t, err) {
+		_, err = registry.GetSchema(1)
+		assert.Equal(t, &SchemaError{1, ErrUnauthorized}, err)
+	}
+
+	// the server certificate isn't trusted without the CA
+	registry, err = NewSchemaRegistryWithConfig(Config{URL: server.URL, Username: "user", Password: "secret"})
+	if assert.NoError(t, err) {
+		_, err = registry.GetSchema(1)
+		assert.Error(t, err)
+	}
+}
+
+func TestSchemaRegistry_GetSchema_Authorization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"schema":"\"int\""}`))
+	}))
+	defer server.Close()
+
+	registry, err := NewSchemaRegistryWithConfig(Config{URL: server.URL, Authorization: "Bearer token", Username: "ignored"})
+	if assert.NoError(t, err) {
+		schema, err := registry.GetSchema(1)
+		assert.NoError(t, err)
+		assert.Equal(t, `"int"`, schema)
+	}
+}
+
+func TestNewSchemaRegistryWithConfig_InvalidCACert(t *testing.T) {
+	_, err := NewSchemaRegistryWithConfig(Config{URL: "https://localhost:8081", CACertPath: "/does/not/exist.pem"})
+	assert.EqualError(t, err, "could not read schema registry CA certificate /does/not/exist.pem: open /does/not/exist.pem: no such file or directory")
+}
+
+func TestSchemaRegistry_GetLatestSchema(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subjects/clicks-value/versions/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"subject":"clicks-value","version":3,"id":7,"schema":"\"long\""}`))
+	}))
+	defer server.Close()
+
+	registry, err := NewSchemaRegistry(server.URL)
+	if assert.NoError(t, err) {
+		schema, err := registry.GetLatestSchema("clicks-value")
+		assert.NoError(t, err)
+		assert.Equal(t, `"long"`, schema)
+
+		_, err = registry.GetLatestSchema("views-value")
+		assert.EqualError(t, err, "could not fetch the latest schema of subject views-value: schema not found")
+	}
+}
+
+func TestSchemaRegistry_GetRegisteredSchema(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/schemas/ids/2" {
+			w.Write([]byte(`{"schema":"{\"type\":\"object\"}","schemaType":"JSON"}`))
+			return
+		}
+		w.Write([]byte(`{"schema":"\"string\""}`))
+	}))
+	defer server.Close()
+
+	registry, err := NewSchemaRegistry(server.URL)
+	if assert.NoError(t, err) {
+		schema, err := registry.GetRegisteredSchema(1)
+		assert.NoError(t, err)
+		assert.Equal(t, RegisteredSchema{Schema: `"string"`, Type: SchemaTypeAvro}, schema)
+		schema, err = registry.GetRegisteredSchema(2)
+		assert.NoError(t, err)
+		assert.Equal(t, RegisteredSchema{Schema: `{"type":"object"}`, Type: SchemaTypeJSON}, schema)
+	}
+}
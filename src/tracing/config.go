@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	defaultServiceName   = "kafka-elasticsearch-injector"
+	defaultTimeout       = 10 * time.Second
+	defaultFlushInterval = 5 * time.Second
+	maxQueuedSpans       = 2048
+	maxExportedSpans     = 512
+)
+
+// Config is the OTLP exporter of the spans, read from the standard OpenTelemetry environment variables.
+type Config struct {
+	// Endpoint receives the spans as OTLP over HTTP with JSON, tracing is disabled when it is empty
+	Endpoint string
+	Headers  map[string]string
+	Timeout  time.Duration
+	// FlushInterval is how long the spans that ended wait to be exported along with the following ones
+	FlushInterval      time.Duration
+	ServiceName        string
+	ResourceAttributes map[string]string
+	Logger             log.Logger
+}
+
+// NewConfig reads the config of the environment variables. Tracing is enabled by OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, unless OTEL_SDK_DISABLED is true or OTEL_TRACES_EXPORTER is none.
+func NewConfig(logger log.Logger) (Config, error) {
+	config := Config{
+		Timeout:       defaultTimeout,
+		FlushInterval: defaultFlushInterval,
+		ServiceName:   defaultServiceName,
+		Logger:        logger,
+	}
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return config, nil
+	}
+	switch exporter := os.Getenv("OTEL_TRACES_EXPORTER"); exporter {
+	case "", "otlp":
+	case "none":
+		return config, nil
+	default:
+		return config, fmt.Errorf("invalid OTEL_TRACES_EXPORTER: %s, only otlp is supported", exporter)
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		config.Endpoint = endpoint
+	} else if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		config.Endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	} else {
+		return config, nil
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/json" {
+		return config, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_PROTOCOL: %s, only http/json is supported", protocol)
+	}
+	var err error
+	if config.Headers, err = parseKeyValues(firstEnv("OTEL_EXPORTER_OTLP_TRACES_HEADERS", "OTEL_EXPORTER_OTLP_HEADERS")); err != nil {
+		return config, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %s", err)
+	}
+	if value := firstEnv("OTEL_EXPORTER_OTLP_TRACES_TIMEOUT", "OTEL_EXPORTER_OTLP_TIMEOUT"); value != "" {
+		millis, err := strconv.Atoi(value)
+		if err != nil || millis <= 0 {
+			return config, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT: %s, should be a positive number of milliseconds", value)
+		}
+		config.Timeout = time.Duration(millis) * time.Millisecond
+	}
+	if value := os.Getenv("OTEL_BSP_SCHEDULE_DELAY"); value != "" {
+		millis, err := strconv.Atoi(value)
+		if err != nil || millis <= 0 {
+			return config, fmt.Errorf("invalid OTEL_BSP_SCHEDULE_DELAY: %s, should be a positive number of milliseconds", value)
+		}
+		config.FlushInterval = time.Duration(millis) * time.Millisecond
+	}
+	if config.ResourceAttributes, err = parseKeyValues(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")); err != nil {
+		return config, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %s", err)
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		config.ServiceName = name
+	} else if name, ok := config.ResourceAttributes["service.name"]; ok {
+		config.ServiceName = name
+	}
+	return config, nil
+}
+
+func firstEnv(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// parseKeyValues parses comma separated `key=value` pairs with URL encoded values, the format of the headers and
+// the resource attributes.
+func parseKeyValues(value string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("%q should be key=value", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %s", pair, err)
+		}
+		pairs[strings.TrimSpace(parts[0])] = decoded
+	}
+	return pairs, nil
+}
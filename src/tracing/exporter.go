@@ -0,0 +1,262 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// exporter sends the spans that ended to the OTLP endpoint in batches, from a goroutine of its own so that the
+// batches are never held back by tracing. Spans are dropped when the endpoint lags behind.
+type exporter struct {
+	config   Config
+	client   *http.Client
+	resource otlpResource
+	logger   log.Logger
+	spans    chan *Span
+	dropped  int64
+	stop     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+func newExporter(config Config) *exporter {
+	logger := config.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	attributes := map[string]string{}
+	for key, value := range config.ResourceAttributes {
+		attributes[key] = value
+	}
+	attributes["service.name"] = config.ServiceName
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var resource otlpResource
+	for _, key := range keys {
+		resource.Attributes = append(resource.Attributes, otlpAttribute{Key: key, Value: newOTLPValue(attributes[key])})
+	}
+	e := &exporter{
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		resource: resource,
+		logger:   logger,
+		spans:    make(chan *Span, maxQueuedSpans),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// close exports the queued spans and stops the exporter.
+func (e *exporter) close() {
+	e.once.Do(func() {
+		close(e.stop)
+		<-e.stopped
+	})
+}
+
+func (e *exporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.config.FlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= maxExportedSpans {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					for len(batch) > maxExportedSpans {
+						e.send(batch[:maxExportedSpans])
+						batch = batch[maxExportedSpans:]
+					}
+					e.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) send(spans []*Span) {
+	if dropped := atomic.SwapInt64(&e.dropped, 0); dropped > 0 {
+		level.Warn(e.logger).Log("message", "spans dropped, the otlp endpoint lags behind", "span_count", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+	if err := e.post(spans); err != nil {
+		level.Warn(e.logger).Log("message", "could not export spans", "span_count", len(spans), "err", err)
+	}
+}
+
+func (e *exporter) post(spans []*Span) error {
+	request := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: defaultServiceName}}},
+	}}}
+	scope := &request.ResourceSpans[0].ScopeSpans[0]
+	for _, span := range spans {
+		scope.Spans = append(scope.Spans, newOTLPSpan(span))
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.config.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("otlp endpoint responded %s", res.Status)
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of the spans, ids are hex encoded and 64 bit integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+// otlpStatus is unset for the spans that succeeded, 2 with the message for the ones that failed.
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newOTLPValue(value interface{}) otlpValue {
+	switch v := value.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		return otlpValue{IntValue: strconv.Itoa(v)}
+	case int64:
+		return otlpValue{IntValue: strconv.FormatInt(v, 10)}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		formatted := fmt.Sprint(v)
+		return otlpValue{StringValue: &formatted}
+	}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	encoded := otlpSpan{
+		TraceID:           hex.EncodeToString(span.context.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.context.SpanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Attributes:        span.attributes,
+	}
+	if span.parentID != [8]byte{} {
+		encoded.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	for _, link := range span.links {
+		encoded.Links = append(encoded.Links, otlpLink{
+			TraceID: hex.EncodeToString(link.TraceID[:]),
+			SpanID:  hex.EncodeToString(link.SpanID[:]),
+		})
+	}
+	if span.err != nil {
+		encoded.Status = otlpStatus{Code: 2, Message: span.err.Error()}
+	}
+	return encoded
+}
@@ -0,0 +1,156 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// SpanContext identifies a span, as propagated by the W3C traceparent header.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// Span kinds of OTLP.
+const (
+	spanKindInternal = 1
+	spanKindConsumer = 5
+)
+
+// Tracer starts the spans of the consumed batches and exports them once they end. A nil tracer is disabled: the
+// spans it starts are nil, and every method of a nil span returns right away.
+type Tracer struct {
+	exporter *exporter
+}
+
+// Span is a timed operation of a batch. Spans are not safe for concurrent use.
+type Span struct {
+	tracer     *Tracer
+	context    SpanContext
+	parentID   [8]byte
+	kind       int
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes []otlpAttribute
+	links      []SpanContext
+	err        error
+}
+
+// NewTracer exports the spans to the OTLP endpoint of the config, it is nil when tracing is disabled.
+func NewTracer(config Config) *Tracer {
+	if config.Endpoint == "" {
+		return nil
+	}
+	return &Tracer{exporter: newExporter(config)}
+}
+
+// Start starts a root span, linked to the spans that produced the messages it handles.
+func (t *Tracer) Start(name string, links ...SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{tracer: t, kind: spanKindConsumer, name: name, start: time.Now(), links: links}
+	rand.Read(span.context.TraceID[:])
+	rand.Read(span.context.SpanID[:])
+	return span
+}
+
+// Close exports the spans that ended and were not exported yet.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.exporter.close()
+}
+
+// Child starts a span within this one.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{tracer: s.tracer, kind: spanKindInternal, name: name, start: time.Now(), parentID: s.context.SpanID}
+	child.context.TraceID = s.context.TraceID
+	rand.Read(child.context.SpanID[:])
+	return child
+}
+
+// SetAttribute sets an attribute of the span, a string, bool, int, int64 or float64. Attributes of other types
+// are formatted as strings.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	for idx := range s.attributes {
+		if s.attributes[idx].Key == key {
+			s.attributes[idx].Value = newOTLPValue(value)
+			return
+		}
+	}
+	s.attributes = append(s.attributes, otlpAttribute{Key: key, Value: newOTLPValue(value)})
+}
+
+// End ends the span and queues it for export, failed with the error unless it is nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.tracer.exporter.export(s)
+}
+
+type spanKey struct{}
+
+// ContextWithSpan is the context of the span, which the operations done with the context are children of.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext is the span of the context, nil without one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the span of the context along with its context, nil without a span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.Child(name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// ParseTraceparent parses a W3C traceparent header, like `00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`.
+// It is false when the header is invalid, or its ids are all zeros.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var span SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return span, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return span, false
+	}
+	if len(parts[1]) != 2*len(span.TraceID) || len(parts[2]) != 2*len(span.SpanID) {
+		return span, false
+	}
+	if _, err := hex.Decode(span.TraceID[:], []byte(parts[1])); err != nil {
+		return span, false
+	}
+	if _, err := hex.Decode(span.SpanID[:], []byte(parts[2])); err != nil {
+		return span, false
+	}
+	if span.TraceID == [16]byte{} || span.SpanID == [8]byte{} {
+		return span, false
+	}
+	return span, true
+}
@@ -0,0 +1,173 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCollector is an OTLP endpoint keeping the spans it receives.
+func newCollector(t *testing.T) (*httptest.Server, func() []otlpSpan, func() http.Header) {
+	var lock sync.Mutex
+	var spans []otlpSpan
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var request otlpRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Error(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		header = r.Header
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+	}))
+	received := func() []otlpSpan {
+		lock.Lock()
+		defer lock.Unlock()
+		return spans
+	}
+	headers := func() http.Header {
+		lock.Lock()
+		defer lock.Unlock()
+		return header
+	}
+	return server, received, headers
+}
+
+func TestParseTraceparent(t *testing.T) {
+	span, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, byte(0x4b), span.TraceID[0])
+	assert.Equal(t, byte(0xb7), span.SpanID[7])
+
+	// later versions may append fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future")
+	assert.True(t, ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-zbf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestTracer_Disabled(t *testing.T) {
+	tracer := NewTracer(Config{})
+	assert.Nil(t, tracer)
+
+	span := tracer.Start("batch")
+	assert.Nil(t, span)
+	child := span.Child("decode")
+	child.SetAttribute("records", 1)
+	child.End(nil)
+	span.End(errors.New("failed"))
+	tracer.Close()
+
+	ctx := context.Background()
+	assert.Equal(t, ctx, ContextWithSpan(ctx, span))
+	spanCtx, started := StartSpan(ctx, "insert")
+	assert.Nil(t, started)
+	assert.Equal(t, ctx, spanCtx)
+}
+
+func TestTracer_Export(t *testing.T) {
+	server, received, headers := newCollector(t)
+	defer server.Close()
+	tracer := NewTracer(Config{
+		Endpoint:      server.URL + "/v1/traces",
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		Timeout:       time.Second,
+		FlushInterval: time.Hour,
+		ServiceName:   "injector",
+	})
+	producer, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	batch := tracer.Start("kafka.batch", producer)
+	batch.SetAttribute("messaging.batch.message_count", 2)
+	ctx, insert := StartSpan(ContextWithSpan(context.Background(), batch), "elasticsearch.insert")
+	assert.Equal(t, insert, SpanFromContext(ctx))
+	insert.SetAttribute("retry_count", 0)
+	insert.SetAttribute("retry_count", 1)
+	insert.End(errors.New("bulk failed"))
+	batch.End(nil)
+	tracer.Close()
+
+	spans := received()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, "Bearer token", headers().Get("Authorization"))
+	assert.Equal(t, "elasticsearch.insert", spans[0].Name)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spanKindInternal, spans[0].Kind)
+	assert.Equal(t, otlpStatus{Code: 2, Message: "bulk failed"}, spans[0].Status)
+	assert.Equal(t, []otlpAttribute{{Key: "retry_count", Value: otlpValue{IntValue: "1"}}}, spans[0].Attributes)
+
+	assert.Equal(t, "kafka.batch", spans[1].Name)
+	assert.Empty(t, spans[1].ParentSpanID)
+	assert.Equal(t, spanKindConsumer, spans[1].Kind)
+	assert.Equal(t, otlpStatus{}, spans[1].Status)
+	assert.Equal(t, []otlpLink{{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}}, spans[1].Links)
+	assert.Len(t, spans[1].TraceID, 32)
+	assert.Len(t, spans[1].SpanID, 16)
+}
+
+func TestNewConfig(t *testing.T) {
+	env := map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "http://collector:4318/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "api-key=secret%3D,tenant=acme",
+		"OTEL_EXPORTER_OTLP_TIMEOUT":  "2000",
+		"OTEL_RESOURCE_ATTRIBUTES":    "service.name=indexer,deployment.environment=prod",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	config, err := NewConfig(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "http://collector:4318/v1/traces", config.Endpoint)
+	assert.Equal(t, map[string]string{"api-key": "secret=", "tenant": "acme"}, config.Headers)
+	assert.Equal(t, 2*time.Second, config.Timeout)
+	assert.Equal(t, "indexer", config.ServiceName)
+
+	os.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	_, err = NewConfig(nil)
+	assert.EqualError(t, err, "invalid OTEL_EXPORTER_OTLP_PROTOCOL: grpc, only http/json is supported")
+	os.Unsetenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+
+	os.Setenv("OTEL_TRACES_EXPORTER", "none")
+	config, err = NewConfig(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, config.Endpoint)
+	os.Unsetenv("OTEL_TRACES_EXPORTER")
+
+	os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	config, err = NewConfig(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, config.Endpoint)
+}
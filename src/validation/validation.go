@@ -0,0 +1,115 @@
+// Package validation collects the errors of the config, so that all of them are reported at startup at once
+// instead of one per restart.
+package validation
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors are the errors found in the config, in the order they were found.
+type Errors []error
+
+// Add adds an error, nil errors are ignored and the errors of another validation are added one by one.
+func (e *Errors) Add(err error) {
+	if err == nil {
+		return
+	}
+	if errs, ok := err.(Errors); ok {
+		*e = append(*e, errs...)
+		return
+	}
+	*e = append(*e, err)
+}
+
+func (e *Errors) Addf(format string, args ...interface{}) {
+	e.Add(fmt.Errorf(format, args...))
+}
+
+// Required adds an error when the env var is empty.
+func (e *Errors) Required(name, value string) {
+	if value == "" {
+		e.Addf("%s is required", name)
+	}
+}
+
+// Err is nil when there are no errors.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for idx, err := range e {
+		messages[idx] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Duration parses the duration of an env var, def when it is empty. It must not be negative, or must be
+// positive when zero is not allowed.
+func (e *Errors) Duration(name, value string, def time.Duration, allowZero bool) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 || (d == 0 && !allowZero) {
+		e.Addf("invalid %s %q, should be a %s duration, like 5s", name, value, positive(allowZero))
+		return def
+	}
+	return d
+}
+
+// Int parses the number of an env var, def when it is empty. It must not be negative, or must be positive when
+// zero is not allowed.
+func (e *Errors) Int(name, value string, def int, allowZero bool) int {
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || (n == 0 && !allowZero) {
+		e.Addf("invalid %s %q, should be a %s number", name, value, positive(allowZero))
+		return def
+	}
+	return n
+}
+
+// Bool parses the flag of an env var, def when it is empty.
+func (e *Errors) Bool(name, value string, def bool) bool {
+	if value == "" {
+		return def
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		e.Addf("invalid %s %q, should be true or false", name, value)
+		return def
+	}
+	return flag
+}
+
+// URLs checks that each url of a comma separated list is an absolute http or https url.
+func (e *Errors) URLs(name, value string) {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		u, err := url.Parse(item)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			e.Addf("invalid %s %q, should be an http or https url with a host", name, item)
+		}
+	}
+}
+
+func positive(allowZero bool) string {
+	if allowZero {
+		return "non negative"
+	}
+	return "positive"
+}
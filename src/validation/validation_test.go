@@ -0,0 +1,48 @@
+package validation
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	var errs Errors
+	assert.NoError(t, errs.Err())
+
+	errs.Add(nil)
+	errs.Required("KAFKA_ADDRESS", "")
+	errs.Required("KAFKA_CONSUMER_GROUP", "injector")
+	errs.Add(Errors{errors.New("first"), errors.New("second")})
+	assert.Len(t, errs, 3)
+	assert.EqualError(t, errs.Err(), "KAFKA_ADDRESS is required; first; second")
+}
+
+func TestErrors_Parse(t *testing.T) {
+	var errs Errors
+	assert.Equal(t, time.Second, errs.Duration("TIMEOUT", "", time.Second, false))
+	assert.Equal(t, 2*time.Second, errs.Duration("TIMEOUT", "2s", time.Second, false))
+	assert.Equal(t, time.Duration(0), errs.Duration("LINGER", "0s", time.Second, true))
+	assert.Equal(t, 3, errs.Int("RETRIES", "3", 5, true))
+	assert.True(t, errs.Bool("ENABLED", "true", false))
+	errs.URLs("HOSTS", " http://es-1:9200, https://es-2 ,")
+	assert.Empty(t, errs)
+
+	assert.Equal(t, time.Second, errs.Duration("TIMEOUT", "0s", time.Second, false))
+	assert.Equal(t, time.Second, errs.Duration("TIMEOUT", "-1s", time.Second, true))
+	assert.Equal(t, 5, errs.Int("RETRIES", "five", 5, true))
+	assert.Equal(t, 1, errs.Int("CONCURRENCY", "0", 1, false))
+	assert.False(t, errs.Bool("ENABLED", "yes", false))
+	errs.URLs("HOSTS", "http://es-1:9200,es-2:9200,ftp://es-3")
+	assert.Equal(t, Errors{
+		errors.New(`invalid TIMEOUT "0s", should be a positive duration, like 5s`),
+		errors.New(`invalid TIMEOUT "-1s", should be a non negative duration, like 5s`),
+		errors.New(`invalid RETRIES "five", should be a non negative number`),
+		errors.New(`invalid CONCURRENCY "0", should be a positive number`),
+		errors.New(`invalid ENABLED "yes", should be true or false`),
+		errors.New(`invalid HOSTS "es-2:9200", should be an http or https url with a host`),
+		errors.New(`invalid HOSTS "ftp://es-3", should be an http or https url with a host`),
+	}, errs)
+}